@@ -0,0 +1,138 @@
+package flashback
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Checkpoint tells where a replay got to in its ops file(s), so that it can
+// be resumed from there after a crash, see ByLineOpsReader.SeekToOffset
+type Checkpoint struct {
+	OpsFilename string `json:"ops_filename"`
+	// the offset of the oldest op not done yet, see OpsProgress. The ops in
+	// flight when the checkpoint was written get replayed again on resume.
+	Offset int64 `json:"offset"`
+	// the recorded time of that op
+	Timestamp time.Time `json:"timestamp"`
+	// when the checkpoint was written
+	WrittenAt time.Time `json:"written_at"`
+}
+
+// WriteCheckpoint saves the checkpoint as JSON. The file gets replaced all at
+// once, so that a crash while writing it leaves the previous checkpoint.
+func WriteCheckpoint(filename string, checkpoint *Checkpoint) error {
+	encoded, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(append(encoded, '\n')); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// ReadCheckpoint loads the checkpoint saved by WriteCheckpoint, or returns nil
+// if there is none yet
+func ReadCheckpoint(filename string) (*Checkpoint, error) {
+	encoded, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var checkpoint Checkpoint
+	if err = json.Unmarshal(encoded, &checkpoint); err != nil {
+		return nil, fmt.Errorf("could not parse the checkpoint %s: %s", filename, err)
+	}
+	if checkpoint.Offset < 0 {
+		return nil, fmt.Errorf("invalid offset %d in the checkpoint %s", checkpoint.Offset, filename)
+	}
+	return &checkpoint, nil
+}
+
+// OpsProgress tracks the ops from when they are read to when they are done,
+// to tell the offset a replay can be resumed from without missing any op.
+// The workers fetch the ops concurrently, and from several channels when
+// they get routed, so the latest op fetched may be ahead of ops still queued
+// or in flight: the replay can only be resumed from the oldest op not done
+// yet. It is safe for concurrent use.
+type OpsProgress struct {
+	mutex sync.Mutex
+	// the offsets of the ops read but not done yet, and their recorded time
+	pending      offsetHeap
+	pendingTimes map[int64]time.Time
+	// where the op after the latest one read starts
+	nextOffset int64
+	latestTime time.Time
+}
+
+// NewOpsProgress tracks the ops read from the given offset on
+func NewOpsProgress(offset int64) *OpsProgress {
+	return &OpsProgress{pendingTimes: make(map[int64]time.Time), nextOffset: offset}
+}
+
+// Read records that the op got read, and that it is pending until Done
+func (p *OpsProgress) Read(op *Op) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	heap.Push(&p.pending, op.Offset)
+	p.pendingTimes[op.Offset] = op.Timestamp
+	p.nextOffset = op.Offset + int64(op.Size)
+	p.latestTime = op.Timestamp
+}
+
+// Done records that the op at the given offset got executed, or skipped
+func (p *OpsProgress) Done(offset int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// the heap is cleaned up lazily, see Resume
+	delete(p.pendingTimes, offset)
+}
+
+// Resume returns the offset and recorded time of the oldest op not done yet,
+// or else where the op after the latest one read starts, along with the time
+// of the latter.
+func (p *OpsProgress) Resume() (int64, time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for len(p.pending) > 0 {
+		if timestamp, ok := p.pendingTimes[p.pending[0]]; ok {
+			return p.pending[0], timestamp
+		}
+		heap.Pop(&p.pending)
+	}
+	return p.nextOffset, p.latestTime
+}
+
+// offsetHeap is a min-heap of offsets, see container/heap
+type offsetHeap []int64
+
+func (h offsetHeap) Len() int            { return len(h) }
+func (h offsetHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h offsetHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *offsetHeap) Push(x interface{}) { *h = append(*h, x.(int64)) }
+func (h *offsetHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,77 @@
+package flashback
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestCheckpoint(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "flashback_checkpoint")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "replay.checkpoint")
+
+	// no checkpoint yet
+	checkpoint, err := ReadCheckpoint(filename)
+	ensure.Nil(t, err)
+	ensure.True(t, checkpoint == nil)
+
+	at := time.Date(2014, 4, 2, 16, 38, 29, 0, time.UTC)
+	ensure.Nil(t, WriteCheckpoint(filename, &Checkpoint{OpsFilename: "ops.bson", Offset: 1234, Timestamp: at}))
+	ensure.Nil(t, WriteCheckpoint(filename, &Checkpoint{OpsFilename: "ops.bson", Offset: 5678, Timestamp: at}))
+	checkpoint, err = ReadCheckpoint(filename)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, checkpoint.OpsFilename, "ops.bson")
+	ensure.DeepEqual(t, checkpoint.Offset, int64(5678))
+	ensure.True(t, checkpoint.Timestamp.Equal(at))
+	// the temporary files are gone
+	files, err := ioutil.ReadDir(dir)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(files), 1)
+
+	ensure.Nil(t, ioutil.WriteFile(filename, []byte("{not json"), 0666))
+	_, err = ReadCheckpoint(filename)
+	ensure.NotNil(t, err)
+	ensure.Nil(t, ioutil.WriteFile(filename, []byte(`{"offset": -1}`), 0666))
+	_, err = ReadCheckpoint(filename)
+	ensure.NotNil(t, err)
+}
+
+func TestOpsProgress(t *testing.T) {
+	t.Parallel()
+
+	at := time.Date(2014, 4, 2, 16, 38, 29, 0, time.UTC)
+	progress := NewOpsProgress(100)
+	offset, _ := progress.Resume()
+	ensure.DeepEqual(t, offset, int64(100))
+
+	ops := make([]*Op, 4)
+	for i := range ops {
+		ops[i] = &Op{Offset: 100 + int64(i)*10, Size: 10, Timestamp: at.Add(time.Duration(i) * time.Second)}
+		progress.Read(ops[i])
+	}
+	// the ops after the oldest one pending don't move the offset
+	progress.Done(ops[1].Offset)
+	progress.Done(ops[3].Offset)
+	offset, timestamp := progress.Resume()
+	ensure.DeepEqual(t, offset, int64(100))
+	ensure.True(t, timestamp.Equal(at))
+
+	progress.Done(ops[0].Offset)
+	offset, timestamp = progress.Resume()
+	ensure.DeepEqual(t, offset, int64(120))
+	ensure.True(t, timestamp.Equal(at.Add(2*time.Second)))
+
+	// once all the ops are done, the replay resumes after the latest one
+	progress.Done(ops[2].Offset)
+	offset, timestamp = progress.Resume()
+	ensure.DeepEqual(t, offset, int64(140))
+	ensure.True(t, timestamp.Equal(at.Add(3*time.Second)))
+}
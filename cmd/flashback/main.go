@@ -1,18 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
 	"time"
+	"unicode/utf8"
 
+	"github.com/HdrHistogram/hdrhistogram-go"
 	"github.com/ParsePlatform/flashback"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/yaml.v2"
 )
 
 func panicOnError(err error) {
@@ -21,16 +38,47 @@ func panicOnError(err error) {
 	}
 }
 
+// set at build time, e.g. with go build -ldflags "-X main.version=1.0
+// -X main.gitCommit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%F)"
 var (
+	version   = "dev"
+	gitCommit = "unknown"
+	buildDate = "unknown"
+)
+
+func versionString() string {
+	return fmt.Sprintf("flashback %s (commit %s, built %s, %s)", version, gitCommit, buildDate, runtime.Version())
+}
+
+var (
+	showVersion              bool
+	configFilename           string
 	maxOps                   int
 	numSkipOps               int
+	resumeFromOffset         int64
+	checkpointFilename       string
+	checkpointInterval       time.Duration
+	resume                   bool
+	strictOrdering           bool
+	timingJitter             time.Duration
+	timingJitterSeed         int64
+	quiet                    bool
 	opsFilename              string
 	slowOpThresholdMs        int
-	socketTimeout            int64
+	slowOpThreshold          time.Duration
+	slowOpLogRate            int
+	deprecatedSocketTimeout  int64
+	socketTimeout            time.Duration
+	opTimeoutsList           string
+	opTimeouts               map[flashback.OpType]time.Duration
+	opTimeout                time.Duration
+	connectTimeout           time.Duration
 	startTime                int64
+	endTime                  int64
 	style                    string
 	cyclic                   bool
 	url                      string
+	urls                     []string
 	challengerUrl            string
 	challengerUrl2           string
 	challengerUrl3           string
@@ -45,22 +93,146 @@ var (
 	challengerStatsFilename3 string
 	opFilter                 string
 	speedup                  float64
+	nsMap                    string
+	nsMapper                 *flashback.NsMapper
+	collectionSuffix         string
+	forceDb                  string
+	opTransformsFilename     string
+	opTransformer            *flashback.OpTransformer
+	metricsAddr              string
+	useTLS                   bool
+	tlsCAFile                string
+	tlsInsecure              bool
+	writeConcern             string
+	writeSafe                *mgo.Safe
+	perNsStats               bool
+	percentilesList          string
+	percentiles              []float64
+	opsPerSecSmoothing       float64
+	statsJSONFilename        string
+	latencyCSVFilename       string
+	timeSeriesFilename       string
+	latencyWindow            time.Duration
+	thinkTime                time.Duration
+	validateReads            bool
+	validationDumpFilename   string
+	errorDumpFilename        string
+	errorDumpMax             int
+	gomaxprocs               int
+	dryRun                   bool
+	profileOnly              bool
+	opTypesList              string
+	opTypes                  []flashback.OpType
+	phase                    string
+	includeNs                string
+	excludeNs                string
+	nsFilter                 *flashback.NsFilter
+	maxOpsPerSec             float64
+	targetRps                float64
+	maxInflight              int
+	opRateLimitsList         string
+	opRateLimits             map[flashback.OpType]float64
+	maxRetries               int
+	redialAfter              int
+	failOnErrorRate          float64
+	failFast                 bool
+	failFastAllowList        string
+	failFastAllowed          []flashback.ErrorCategory
+	reportInterval           time.Duration
+	reportTable              bool
+	highlightLatency         time.Duration
+	color                    bool
+	noColor                  bool
+	readPreference           string
+	readMode                 mgo.Mode
+	logFormat                string
+	logLevel                 string
+	warmupOps                int
+	warmupDuration           time.Duration
+	loops                    int
+	replayDuration           time.Duration
+	oplogUrl                 string
+	poolSize                 int
+	prewarmConnections       bool
+	pinSessions              bool
+	preserveOrderPerNs       bool
+	deterministicDispatch    bool
+	opTypeWorkers            map[flashback.OpType]*int
+	hdrOutput                string
+	strict                   bool
+	preserveTimestamps       bool
+	drainCursors             bool
+	ignoreDupKey             bool
+	genericCommands          bool
+	checkIndexes             bool
+	verboseWorkers           bool
+	controlAddr              string
+	replayFraction           float64
+	maxOpSize                int
+	maxOpAge                 time.Duration
+	keepOversizedOps         bool
+	// the reader the ops get replayed from, see makeOpsChan
+	opsReader flashback.OpsReader
+	// set for the "real" style, once the ops channel is closed
+	dispatchStatus *flashback.DispatchStatus
+	// the backpressure of the workers on the dispatch
+	dispatchMeter *flashback.DispatchMeter
+	// set if only a fraction of the ops are replayed
+	fractionReader *flashback.FractionOpsReader
+	// set if the ops are limited in size
+	sizeLimitedReader *flashback.SizeLimitedOpsReader
+	// set if the ops are limited in age
+	staleReader *flashback.StaleOpsReader
+	// times the reads of opsReader
+	timedReader *flashback.TimedOpsReader
+	// tracks the ops until the workers are done with them, to tell where the
+	// replay can be resumed from. Only set if it could be resumed.
+	opsProgress *flashback.OpsProgress
+	// the recorded time of the op the replay resumes from, see resume
+	resumeOpTime time.Time
+	// opens the ops file(s) again, for the passes over the ops ahead of the
+	// replay. Unset when the ops can't be read twice (stdin, the oplog).
+	reopenOps func() (error, *flashback.ByLineOpsReader)
+	// used to report the progress of the replay, see makeOpsChan
+	expectedOps    int64
+	readerProgress func() float64
+	// toggled by SIGUSR1
+	pauser = flashback.NewPauser()
+	// whether the report tables get colored, see color and no_color
+	colorReport bool
 )
 
 const (
 	// Set one minute timeout on mongo socket connections (nanoseconds) by default
 	defaultMgoSocketTimeout = 60000000000
+	// the timeout mgo.Dial uses
+	defaultMgoConnectTimeout = 10 * time.Second
 )
 
 func init() {
+	flag.BoolVar(&showVersion,
+		"version",
+		false,
+		"Print the version of flashback, and exit.")
+	flag.StringVar(&configFilename,
+		"config",
+		"",
+		"[Optional] YAML or JSON file of flag values, keyed by the flag names (e.g. \"workers: 16\"). "+
+			"Lists are passed comma-separated. The flags given on the command line override it.")
 	flag.StringVar(&opsFilename,
 		"ops_filename",
 		"",
-		"The file for the serialized ops, generated by the Record scripts.")
+		"The file for the serialized ops, generated by the Record scripts. Use \"-\" to read ops from stdin. "+
+			"May also be a directory or a glob, to read several files in lexical order, a tar archive, or an "+
+			"http(s):// or s3://<bucket>/<key> url to stream the file from.")
 	flag.StringVar(&url,
 		"url",
 		"",
-		"[Optional] The database server's url, in the format of mongodb://[<user>:<password>@]<host>[:<port>]. Defaults to mongodb://localhost:27017")
+		"[Optional] The database server's url, in the format of <host>[:<port>] or "+
+			"mongodb://[<user>:<password>@]<host>[:<port>][/<database>][?<options>], where options may include "+
+			"authSource and replicaSet. Defaults to mongodb://localhost:27017\n"+
+			"Several comma-separated mongodb:// urls may be given to replay the ops against all of them "+
+			"and compare their latencies, like with challenger_url.")
 	flag.StringVar(&challengerUrl,
 		"challenger_url",
 		"",
@@ -90,14 +262,34 @@ func init() {
 		1.0,
 		"This option is for \"real\" style. Instead of replaying ops realtime, you can use this option "+
 			"to speedup or slowdown execution. For example, setting speedup to 2 will send ops 2x faster")
+	flag.Float64Var(&targetRps,
+		"target_rps",
+		0,
+		"[Optional] With the \"real\" style, set the speedup so that the replay averages this many ops/sec, "+
+			"keeping the bursts and lulls of the recording. The recorded rate is measured by reading the ops "+
+			"once beforehand.")
 	flag.BoolVar(&cyclic,
 		"cyclic",
 		false,
-		"In \"real\" style, if true, we are going to cycle through the ops infinitely. If false, we will execute all the ops only once")
+		"In \"real\" style, if true, we are going to cycle through the ops infinitely. If false, we will execute all the ops only once. "+
+			"In \"stress\" style, the preloaded ops are cycled through until `duration` or `loops` stops the replay.")
 	flag.IntVar(&workers,
 		"workers",
 		10,
 		"[Optional] Number of workers that sends ops to database.")
+	opTypeWorkers = make(map[flashback.OpType]*int)
+	for _, opType := range flashback.AllOpTypes {
+		name := strings.TrimPrefix(string(opType), "command.")
+		opTypeWorkers[opType] = flag.Int("workers_"+name,
+			0,
+			fmt.Sprintf("[Optional] Number of workers dedicated to the %s ops, on top of `workers`. "+
+				"Those ops then don't go to the other workers, so they can't hold them up.", name))
+	}
+	flag.IntVar(&gomaxprocs,
+		"gomaxprocs",
+		0,
+		"[Optional] Maximum number of cpus executing the replay at once (see GOMAXPROCS), e.g. to "+
+			"leave some to a server running on the same host. If 0, all the cpus are used.")
 	flag.IntVar(&maxOps,
 		"maxOps",
 		math.MaxUint32, // default value for maxOps is maxUint32
@@ -109,14 +301,78 @@ func init() {
 		0,
 		"[Optional] Skip first N ops. Useful for when the total ops in ops_filename"+
 			" exceeds available memory and you're running in stress mode.")
-	flag.Int64Var(&socketTimeout,
+	flag.BoolVar(&strictOrdering,
+		"strict_ordering",
+		false,
+		"[Optional] With the \"real\" style, stop the replay with an error at the first op that is "+
+			"older than the op before it. By default, such ops are replayed right away and counted.")
+	flag.DurationVar(&timingJitter,
+		"timing_jitter",
+		0,
+		"[Optional] With the \"real\" style, move the time of each op by a random offset within "+
+			"[-timing_jitter, +timing_jitter] (e.g. 5ms), to add some variance to the load. Off by default.")
+	flag.Int64Var(&timingJitterSeed,
+		"timing_jitter_seed",
+		0,
+		"[Optional] The seed of the random offsets of timing_jitter, to replay the ops with the same "+
+			"offsets again. By default, the seed is picked at random and logged.")
+	flag.Int64Var(&resumeFromOffset,
+		"resume_from_offset",
+		0,
+		"[Optional] Start from the op at this offset in the ops file(s), as printed by the reports, "+
+			"e.g. to resume a replay that crashed. The reports print the offset of the oldest op not done "+
+			"yet, so the ops in flight at the time (and some done after it) get replayed again. "+
+			"Requires uncompressed ops files.")
+	flag.StringVar(&checkpointFilename,
+		"checkpoint",
+		"",
+		"[Optional] Periodically save the offset of the oldest op not done yet to this file, for resume. "+
+			"Requires uncompressed ops files.")
+	flag.DurationVar(&checkpointInterval,
+		"checkpoint_interval",
+		time.Minute,
+		"[Optional] How often to save the checkpoint. It is saved at the end of the replay too.")
+	flag.BoolVar(&resume,
+		"resume",
+		false,
+		"[Optional] Resume the replay from the checkpoint saved by a previous one, e.g. that crashed, "+
+			"or start from the beginning if there is none yet.")
+	flag.Int64Var(&deprecatedSocketTimeout,
 		"socketTimeout",
 		defaultMgoSocketTimeout,
-		"[Optional] Mongo socket timeout in nanoseconds.")
+		"[Deprecated] Mongo socket timeout in nanoseconds. Use socket_timeout instead.")
+	flag.DurationVar(&socketTimeout,
+		"socket_timeout",
+		defaultMgoSocketTimeout,
+		"[Optional] How long to wait for the database to respond to an op, e.g. 5m for big aggregations.")
+	flag.StringVar(&opTimeoutsList,
+		"op_timeouts",
+		flashback.DefaultOpTimeouts,
+		"[Optional] Comma-separated list of op_type=duration pairs overriding socket_timeout for the ops "+
+			"of those types, 0 meaning no timeout. By default, the index builds have none.")
+	flag.DurationVar(&opTimeout,
+		"op_timeout",
+		0,
+		"[Optional] The time budget of each op, retries included, e.g. 30s. The ops exceeding it are given up "+
+			"on (though not killed on the server) and count as timeout errors. No budget by default.")
+	flag.DurationVar(&connectTimeout,
+		"connect_timeout",
+		defaultMgoConnectTimeout,
+		"[Optional] How long to wait for the connection to the database to be established, "+
+			"e.g. 2s to fail fast on a dead host.")
 	flag.IntVar(&slowOpThresholdMs,
 		"slow_op_threshold_ms",
 		0,
-		"[Optional] All ops that take longer than slow_op_threshold_ms will be logged. Turned off by default.")
+		"[Deprecated] Slow op threshold in milliseconds. Use slow_op_threshold instead.")
+	flag.DurationVar(&slowOpThreshold,
+		"slow_op_threshold",
+		0,
+		"[Optional] Log the ops that take longer than that, e.g. 500ms, with their type, namespace and "+
+			"latency against each host. Turned off by default.")
+	flag.IntVar(&slowOpLogRate,
+		"slow_op_log_rate",
+		10,
+		"[Optional] Most slow ops to log per second, the others only get counted.")
 	flag.BoolVar(&verbose,
 		"verbose",
 		false,
@@ -126,6 +382,11 @@ func init() {
 		0,
 		"[Optional] Provide a unix timestamp (i.e. 1396456709419)"+
 			"indicating the first op that you want to run. Otherwise, play from the top.")
+	flag.Int64Var(&endTime,
+		"end_time",
+		0,
+		"[Optional] Provide a unix timestamp (i.e. 1396457609419) "+
+			"indicating the last op that you want to run. Otherwise, play until the end.")
 	flag.StringVar(&stderr,
 		"stderr",
 		"",
@@ -154,25 +415,636 @@ func init() {
 		"op_filter",
 		"",
 		"[Optional] If specified, we'll only execute ops of that particular type")
+	flag.StringVar(&nsMap,
+		"ns_map",
+		"",
+		"[Optional] Comma-separated list of from=to namespace pairs, such as \"prod.users=staging.users,prod.*=staging.*\". "+
+			"Ops recorded against a \"from\" namespace will be replayed against the \"to\" namespace. "+
+			"Unmatched namespaces are replayed unchanged.")
+	flag.StringVar(&collectionSuffix,
+		"collection_suffix",
+		"",
+		"[Optional] Suffix appended to the name of every collection replayed against, after ns_map, e.g. "+
+			"\"_alice\" to replay \"users\" into \"users_alice\" and keep apart from other replays.")
+	flag.StringVar(&forceDb,
+		"force_db",
+		"",
+		"[Optional] Replay the ops on every database against this one, keeping their collection names. "+
+			"Cannot be combined with ns_map.")
+	flag.StringVar(&opTransformsFilename,
+		"op_transforms",
+		"",
+		"[Optional] YAML or JSON file holding a list of rules rewriting the documents written by the ops, "+
+			"e.g. [{ns: mydb.users, action: copy, from: a, to: b}] to replay into a collection sharded on b "+
+			"rather than a. The actions are copy and prefix (which also takes a length).")
+	flag.StringVar(&metricsAddr,
+		"metrics_addr",
+		"",
+		"[Optional] If specified (e.g. \":9090\"), serve the stats analyzer output as Prometheus metrics on "+
+			"http://<metrics_addr>/metrics. The metrics are updated at each reporting interval.")
+	flag.BoolVar(&useTLS,
+		"tls",
+		false,
+		"[Optional] Connect to the database servers over TLS.")
+	flag.StringVar(&tlsCAFile,
+		"tls_ca_file",
+		"",
+		"[Optional] PEM file with the CA certificates used to verify the servers' certificates, "+
+			"instead of the system's CA pool. Requires -tls.")
+	flag.BoolVar(&tlsInsecure,
+		"tls_insecure",
+		false,
+		"[Optional] Skip verifying the servers' certificates. Requires -tls.")
+	flag.StringVar(&writeConcern,
+		"write_concern",
+		"",
+		"[Optional] Write concern to replay the writes with, such as \"0\" (fire and forget), \"1\" or \"majority\". "+
+			"Defaults to the driver's default of acknowledged writes.")
+	flag.BoolVar(&perNsStats,
+		"per_ns_stats",
+		false,
+		"[Optional] Also break down the latencies by namespace in the periodic reports. "+
+			"Turned off by default, since it uses more memory for traces that touch many collections.")
+	flag.StringVar(&percentilesList,
+		"percentiles",
+		"50,70,90,95,99",
+		"[Optional] Comma-separated list of the latency percentiles to report, e.g. \"50,99,99.9\". "+
+			"P50, P70, P90, P95 and P99 are always computed, for the other reports and the metrics.")
+	flag.Float64Var(&opsPerSecSmoothing,
+		"ops_per_sec_smoothing",
+		flashback.DefaultOpsPerSecSmoothing,
+		"[Optional] Weight of the latest interval in the smoothed ops/sec of the reports, between 0 (exclusive) "+
+			"and 1. The lower, the steadier the rate but the slower it follows the changes. 1 means no smoothing.")
+	flag.StringVar(&statsJSONFilename,
+		"stats_json",
+		"",
+		"[Optional] Provide a path to a file that will store the final stats of each host as json once the replay is done.")
+	flag.StringVar(&latencyCSVFilename,
+		"latency_csv",
+		"",
+		"[Optional] Provide a path to a file that will store the latency of every op as a csv row: "+
+			"timestamp,node,op_type,ns,latency_ms,success,error.")
+	flag.DurationVar(&latencyWindow,
+		"window",
+		0,
+		"[Optional] Also report the latency percentiles over this sliding window, e.g. 60s for the last "+
+			"minute, which shows transient spikes better than the totals. Rounded up to the second.")
+	flag.StringVar(&timeSeriesFilename,
+		"timeseries",
+		"",
+		"[Optional] Provide a path to a file that will store, every second, a csv row per host with the ops "+
+			"executed and the latencies over that second: elapsed_sec,node,ops_executed,ops_per_sec,p50_ms,p99_ms.")
+	flag.BoolVar(&dryRun,
+		"dry_run",
+		false,
+		"[Optional] Read and dispatch all the ops as usual, but don't connect to the database or execute them. "+
+			"Useful to validate an ops file and see its op type distribution.")
+	flag.BoolVar(&profileOnly,
+		"profile_only",
+		false,
+		"[Optional] Only read the whole ops file and print the share of each op type and of each namespace "+
+			"in it, then exit. Lighter than dry_run, and doesn't require style.")
+	flag.StringVar(&opTypesList,
+		"op_types",
+		"",
+		fmt.Sprintf("[Optional] Comma-separated list of op types to replay, such as \"query,getmore\". "+
+			"All the other ops are skipped when reading them. Valid op types are: %v", flashback.AllOpTypes))
+	flag.StringVar(&phase,
+		"phase",
+		flashback.AllPhase,
+		"[Optional] Only replay the ops of one phase of a two-phase replay: \"writes\" (inserts, updates, "+
+			"removes and findAndModify) to populate the target, then \"reads\" (queries, counts, getmores, "+
+			"aggregates and distincts) against the populated data. Defaults to \"all\". Cannot be used with `op_types`.")
+	flag.StringVar(&includeNs,
+		"include_ns",
+		"",
+		"[Optional] Comma-separated list of namespaces to replay, such as \"mydb.orders,logs.*\". "+
+			"Ops against all the other namespaces are skipped when reading them.")
+	flag.StringVar(&excludeNs,
+		"exclude_ns",
+		"",
+		"[Optional] Comma-separated list of namespaces not to replay, such as \"mydb.users,*.system.*\". "+
+			"Takes precedence over include_ns.")
+	flag.Float64Var(&maxOpsPerSec,
+		"max_ops_per_sec",
+		0,
+		"[Optional] Cap the total number of ops sent to the database per second, across all workers. "+
+			"Ops are delayed rather than dropped. Turned off by default.")
+	flag.IntVar(&maxInflight,
+		"max_inflight",
+		0,
+		"[Optional] Most ops in flight at once, across the workers, to replay at a given concurrency rather "+
+			"than a given rate. Only useful below the number of workers. Turned off by default.")
+	flag.StringVar(&opRateLimitsList,
+		"op_rate_limits",
+		"",
+		"[Optional] Comma-separated list of op_type=ops_per_sec pairs capping the rate of the ops of those "+
+			"types, e.g. \"command.aggregate=50,update=1000\". The other op types are not limited.")
+	flag.Float64Var(&replayFraction,
+		"replay_fraction",
+		1,
+		"[Optional] Only replay this fraction (between 0 and 1) of the ops, e.g. 0.1 for 10% of "+
+			"the load. The ops are picked by hashing them, so every run replays the same ones.")
+	flag.DurationVar(&maxOpAge,
+		"max_op_age",
+		0,
+		"[Optional] Skip the ops recorded longer than this before the newest op read so far, or than "+
+			"the current time with oplog_url, e.g. 10m to skip the stale backlog when tailing an oplog from "+
+			"far behind. 0 means no limit.")
+	flag.IntVar(&maxOpSize,
+		"max_op_size",
+		0,
+		"[Optional] Skip the ops larger than this many bytes in the ops file(s), logging their namespace and "+
+			"size, e.g. so that a few huge documents don't exhaust the memory of the replay host. "+
+			"0 means no limit.")
+	flag.BoolVar(&keepOversizedOps,
+		"keep_oversized_ops",
+		false,
+		"[Optional] Replay the ops larger than max_op_size after all, only counting them apart.")
+	flag.IntVar(&maxRetries,
+		"max_retries",
+		flashback.DefaultMaxRetries,
+		"[Optional] Number of times an op is retried, with exponential backoff, after a socket failure "+
+			"(e.g. during a replica set election).")
+	flag.IntVar(&redialAfter,
+		"redial_after",
+		10,
+		"[Optional] Once this many ops in a row failed against a target because of the connection, even "+
+			"after max_retries, the worker dials it again (e.g. after it restarted), backing off until it "+
+			"succeeds. 0 turns re-dialing off.")
+	flag.Float64Var(&failOnErrorRate,
+		"fail_on_error_rate",
+		-1,
+		"[Optional] Exit with a non-zero status if the percentage of ops that failed exceeds this value "+
+			"on any host by the end of the replay. Disabled when negative, which is the default.")
+	flag.BoolVar(&failFast,
+		"fail_fast",
+		false,
+		"[Optional] Stop the replay on the first op that fails, other than with the errors of "+
+			"fail_fast_allow, and exit with a non-zero status once the in-flight ops are done, e.g. to catch a "+
+			"misconfigured target early in CI.")
+	flag.StringVar(&failFastAllowList,
+		"fail_fast_allow",
+		"",
+		fmt.Sprintf("[Optional] Comma-separated list of the error categories fail_fast lets through, "+
+			"e.g. \"duplicate_key,not_found\", among %v.", flashback.AllErrorCategories))
+	flag.DurationVar(&reportInterval,
+		"report_interval",
+		5*time.Second,
+		"[Optional] How often to report the execution status, e.g. \"30s\". "+
+			"If 0, only the final report is printed.")
+	flag.BoolVar(&reportTable,
+		"report_table",
+		false,
+		"[Optional] Report the op types as the rows of an aligned table, with the ops/sec and latency "+
+			"percentiles of the interval as columns, rather than as a few lines each.")
+	flag.DurationVar(&highlightLatency,
+		"highlight_latency",
+		100*time.Millisecond,
+		"[Optional] With report_table, color the latencies over this threshold, 0 meaning none.")
+	flag.BoolVar(&color,
+		"color",
+		false,
+		"[Optional] Color the report tables even when stdout isn't a terminal, e.g. when piped to less -R.")
+	flag.BoolVar(&noColor,
+		"no_color",
+		false,
+		"[Optional] Never color the report tables. By default, they are colored when stdout is a terminal.")
+	flag.BoolVar(&quiet,
+		"quiet",
+		false,
+		"[Optional] Only print the final report, e.g. when the replayer runs as part of a larger tool. "+
+			"Same as report_interval=0; errors are still logged.")
+	flag.StringVar(&readPreference,
+		"read_preference",
+		"",
+		"[Optional] Read preference for queries, counts, aggregations and distincts: primary, "+
+			"primaryPreferred, secondary, secondaryPreferred or nearest. Ops recorded with their own "+
+			"read preference keep it. Defaults to the mode of the url.")
+	flag.StringVar(&logFormat,
+		"log_format",
+		flashback.TextLogFormat,
+		"[Optional] Format of the log lines: \"text\", or \"json\" to write each of them as a JSON "+
+			"object with its level, timestamp, message and fields such as the worker id.")
+	flag.StringVar(&logLevel,
+		"log_level",
+		flashback.InfoLevel,
+		"[Optional] Least severe level of the messages to log: \"debug\", \"info\", \"warn\" or \"error\".")
+	flag.IntVar(&warmupOps,
+		"warmup_ops",
+		0,
+		"[Optional] Number of ops to execute before collecting stats, as their latencies are skewed "+
+			"by cold caches and connection setup. Cannot be used with warmup_duration.")
+	flag.DurationVar(&warmupDuration,
+		"warmup_duration",
+		0,
+		"[Optional] How long to execute ops before collecting stats, e.g. \"1m\". "+
+			"Cannot be used with warmup_ops.")
+	flag.DurationVar(&replayDuration,
+		"duration",
+		0,
+		"[Optional] Stop the replay after this long (e.g. \"2h\"), whatever the number of ops replayed, "+
+			"for soak tests. The time spent paused doesn't count. Implies `cyclic` when reading ops files, "+
+			"so that the ops don't run out before.")
+	flag.IntVar(&loops,
+		"loops",
+		0,
+		"[Optional] With `cyclic`, how many times to go through the ops before stopping. "+
+			"If 0, they are cycled through infinitely, which the \"stress\" style requires `duration` for.")
+	flag.StringVar(&oplogUrl,
+		"oplog_url",
+		"",
+		"[Optional] Instead of reading ops_filename, tail the oplog of the replica set member at this url "+
+			"and replay its inserts, updates and removes in near real time, in the \"real\" style. "+
+			"Starts from start_time if set, from the latest entry otherwise.")
+	flag.IntVar(&poolSize,
+		"pool_size",
+		0,
+		"[Optional] Maximum number of connections to each server, shared by all the workers: each op "+
+			"then takes a connection from a common pool, waiting for one if all are in use. By default, "+
+			"every worker dials its own session, which holds a connection to each server it sends ops to.")
+	flag.BoolVar(&prewarmConnections,
+		"prewarm_connections",
+		false,
+		"[Optional] Have each worker connect its session to each url with a ping before its first op, so "+
+			"that the early latencies don't include connecting to the servers.")
+	flag.DurationVar(&thinkTime,
+		"think_time",
+		0,
+		"[Optional] Make each worker wait this long after each op before fetching the next one, like a "+
+			"client would. With the stress style, the workers then behave as a fixed number of clients "+
+			"(closed loop) rather than draining the ops as fast as possible.")
+	flag.BoolVar(&pinSessions,
+		"pin_sessions",
+		false,
+		"[Optional] Send all the ops recorded in the same client session to the same worker, so that "+
+			"they are executed in order (e.g. to reproduce read-your-writes issues). Sessions still run "+
+			"in parallel across workers.")
+	flag.BoolVar(&preserveOrderPerNs,
+		"preserve_order_per_ns",
+		false,
+		"[Optional] Send all the ops on the same collection to the same worker, so that the writes to "+
+			"each document are executed in order, e.g. for the dataset to end up as in production with "+
+			"the stress style. Collections still run in parallel across workers.")
+	flag.BoolVar(&deterministicDispatch,
+		"deterministic_dispatch",
+		false,
+		"[Optional] Send op i to worker i mod workers, so that every replay of the ops file assigns them to "+
+			"the workers the same way, e.g. to reproduce lock contention. Costs some throughput, since a "+
+			"slow worker holds the others up.")
+	flag.StringVar(&errorDumpFilename,
+		"error_dump",
+		"",
+		"[Optional] Append the ops that failed to this file, as one JSON object per line along with "+
+			"the node and the error, to reproduce the failures later.")
+	flag.IntVar(&errorDumpMax,
+		"error_dump_max",
+		1000,
+		"[Optional] With `error_dump`, how many failed ops to dump at most, so as not to fill the disk.")
+	flag.BoolVar(&validateReads,
+		"validate_reads",
+		false,
+		"[Optional] Compare the results of the queries recorded with their result (in the result field "+
+			"of the ops) to the recorded ones, and report how many differ. The order of the documents only "+
+			"matters for sorted queries.")
+	flag.StringVar(&validationDumpFilename,
+		"validation_dump",
+		"",
+		"[Optional] With `validate_reads`, append the queries whose results differ to this file, with "+
+			"both results, one JSON object per line (up to error_dump_max of them per host).")
+	flag.BoolVar(&verboseWorkers,
+		"verbose_workers",
+		false,
+		"[Optional] Also report the ops executed by each worker, and flag the workers lagging far "+
+			"behind the others (e.g. because their ops hit a slow shard).")
+	flag.StringVar(&controlAddr,
+		"control_addr",
+		"",
+		"[Optional] Serve a control API at this address (e.g. :9217): GET /status returns the "+
+			"stats of each node, GET /workers the number of workers and POST /workers?count=N "+
+			"scales the replay to N workers (unless pin_sessions is set).")
+	flag.StringVar(&hdrOutput,
+		"hdr_output",
+		"",
+		"[Optional] At the end of the replay, write the full latency histogram of each op type of each "+
+			"host to this file, in the HdrHistogram log format (tagged <host>:<op type>, in nanoseconds). "+
+			"The histograms of several replays can then be merged to compute accurate percentiles.")
+	flag.BoolVar(&strict,
+		"strict",
+		false,
+		"[Optional] Stop the replay, and exit with a non-zero status, at the first malformed op found in "+
+			"ops_filename. By default, malformed ops are logged and skipped.")
+	flag.BoolVar(&preserveTimestamps,
+		"preserve_timestamps",
+		false,
+		"[Optional] Use the time the writes were recorded at for the timestamps the server would "+
+			"otherwise fill in: the fields set by $currentDate in updates and findAndModify, and the "+
+			"top-level empty timestamps of inserted documents.")
+	flag.BoolVar(&drainCursors,
+		"drain_cursors",
+		true,
+		"[Optional] Fetch all the results of the queries, and time that. Use -drain_cursors=false to "+
+			"only fetch their first batch, e.g. for tests focused on throughput. Queries that left a cursor "+
+			"open when recorded always fetch their first batch only, the next ones coming with their getmores.")
+	flag.BoolVar(&ignoreDupKey,
+		"ignore_dup_key",
+		false,
+		"[Optional] Count the inserts that fail with duplicate key errors as successes, without logging "+
+			"them, e.g. when re-running the replay of inserts against a target that has some of the docs already. "+
+			"The bulk inserts then run unordered, so that the docs after a duplicate still get inserted.")
+	flag.BoolVar(&genericCommands,
+		"generic_commands",
+		false,
+		"[Optional] Replay the commands that have no op type of their own (e.g. mapReduce or collStats) "+
+			"as recorded, under the \"command\" op type. Otherwise they are skipped.")
+	flag.BoolVar(&checkIndexes,
+		"check_indexes",
+		false,
+		"[Optional] Before the replay starts, read the ops to replay ahead to warn about the text and geo "+
+			"indexes they need that the targets lack. That reads the ops twice, downloading them again from "+
+			"an http or s3 url. Otherwise, the warnings get logged as the ops get replayed.")
 }
 
 func parseFlags() error {
 	flag.Parse()
+	if showVersion {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
+	if configFilename != "" {
+		if err := loadConfig(configFilename); err != nil {
+			return err
+		}
+	}
 	validArgs := true
 	errorMsg := ""
 
-	if style == "" {
+	// socketTimeout is an alias of socket_timeout, which takes precedence
+	explicitFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicitFlags[f.Name] = true
+	})
+	if explicitFlags["socketTimeout"] && !explicitFlags["socket_timeout"] {
+		socketTimeout = time.Duration(deprecatedSocketTimeout)
+	}
+	// likewise for slow_op_threshold_ms
+	if explicitFlags["slow_op_threshold_ms"] && !explicitFlags["slow_op_threshold"] {
+		slowOpThreshold = time.Duration(slowOpThresholdMs) * time.Millisecond
+	}
+	urls = splitUrls(url)
+	// the ops get cycled through until the duration elapses
+	if replayDuration > 0 && oplogUrl == "" && opsFilename != flashback.StdinFilename {
+		cyclic = true
+	}
+
+	var err error
+	if style == "" && !profileOnly {
 		validArgs = false
 		errorMsg = "Missing `style` argument."
-	} else if style != "stress" && style != "real" {
+	} else if style != "" && style != "stress" && style != "real" {
 		validArgs = false
 		errorMsg = "Invalid `style` argument passed to program: " + style + ". The only acceptable values are \"stress\" and \"real\"."
-	} else if opsFilename == "" {
+	} else if opsFilename == "" && oplogUrl == "" {
 		validArgs = false
 		errorMsg = "Missing required `ops_filename` argument."
+	} else if opsFilename != "" && oplogUrl != "" {
+		validArgs = false
+		errorMsg = "Only one of the `ops_filename` and `oplog_url` arguments can be used."
+	} else if profileOnly && opsFilename == "" {
+		validArgs = false
+		errorMsg = "The `profile_only` argument requires `ops_filename`."
+	} else if oplogUrl != "" && (style != "real" || cyclic) {
+		validArgs = false
+		errorMsg = "The `oplog_url` argument requires the \"real\" style, and cannot be used with `cyclic`."
 	} else if workers <= 0 {
 		validArgs = false
 		errorMsg = "The `workers` argument must be a positive number."
+	} else if err = validateOpTypeWorkers(); err != nil {
+		validArgs = false
+		errorMsg = err.Error()
+	} else if maxRetries < 0 {
+		validArgs = false
+		errorMsg = "The `max_retries` argument must not be negative."
+	} else if redialAfter < 0 {
+		validArgs = false
+		errorMsg = "The `redial_after` argument must not be negative."
+	} else if maxInflight < 0 {
+		validArgs = false
+		errorMsg = "The `max_inflight` argument must not be negative."
+	} else if maxOpsPerSec < 0 {
+		validArgs = false
+		errorMsg = "The `max_ops_per_sec` argument must not be negative."
+	} else if validationDumpFilename != "" && !validateReads {
+		validArgs = false
+		errorMsg = "The `validation_dump` argument requires `validate_reads`."
+	} else if thinkTime < 0 {
+		validArgs = false
+		errorMsg = "The `think_time` argument must not be negative."
+	} else if latencyWindow < 0 {
+		validArgs = false
+		errorMsg = "The `window` argument must not be negative."
+	} else if failFastAllowed, err = flashback.ParseErrorCategories(failFastAllowList); err != nil {
+		validArgs = false
+		errorMsg = "Invalid `fail_fast_allow` argument: " + err.Error()
+	} else if maxOpAge < 0 {
+		validArgs = false
+		errorMsg = "The `max_op_age` argument must not be negative."
+	} else if maxOpSize < 0 {
+		validArgs = false
+		errorMsg = "The `max_op_size` argument must not be negative."
+	} else if keepOversizedOps && maxOpSize == 0 {
+		validArgs = false
+		errorMsg = "The `keep_oversized_ops` argument requires `max_op_size`."
+	} else if replayFraction <= 0 || replayFraction > 1 {
+		validArgs = false
+		errorMsg = "The `replay_fraction` argument must be greater than 0 and at most 1."
+	} else if socketTimeout < 0 || connectTimeout < 0 {
+		validArgs = false
+		errorMsg = "The `socket_timeout` and `connect_timeout` arguments must not be negative."
+	} else if opTimeout < 0 {
+		validArgs = false
+		errorMsg = "The `op_timeout` argument must not be negative."
+	} else if opTimeouts, err = flashback.ParseOpTimeouts(opTimeoutsList); err != nil {
+		validArgs = false
+		errorMsg = "Invalid `op_timeouts` argument: " + err.Error()
+	} else if opRateLimits, err = flashback.ParseOpRateLimits(opRateLimitsList); err != nil {
+		validArgs = false
+		errorMsg = "Invalid `op_rate_limits` argument: " + err.Error()
+	} else if len(opRateLimits) > 0 && (pinSessions || preserveOrderPerNs || deterministicDispatch) {
+		// the limited op types are queued apart, which reorders them
+		validArgs = false
+		errorMsg = "The `op_rate_limits` argument cannot be used with `pin_sessions`, " +
+			"`preserve_order_per_ns` or `deterministic_dispatch`."
+	} else if reportInterval < 0 {
+		validArgs = false
+		errorMsg = "The `report_interval` argument must not be negative."
+	} else if poolSize < 0 {
+		validArgs = false
+		errorMsg = "The `pool_size` argument must not be negative."
+	} else if color && noColor {
+		validArgs = false
+		errorMsg = "Only one of the `color` and `no_color` arguments can be used."
+	} else if color && logFormat == flashback.JSONLogFormat {
+		validArgs = false
+		errorMsg = "The `color` argument cannot be used with the json `log_format`."
+	} else if highlightLatency < 0 {
+		validArgs = false
+		errorMsg = "The `highlight_latency` argument must not be negative."
+	} else if logFormat != flashback.TextLogFormat && logFormat != flashback.JSONLogFormat {
+		validArgs = false
+		errorMsg = "Invalid `log_format` argument: " + logFormat + ". The only acceptable values are \"text\" and \"json\"."
+	} else if logLevel != flashback.DebugLevel && logLevel != flashback.InfoLevel &&
+		logLevel != flashback.WarnLevel && logLevel != flashback.ErrorLevel {
+		validArgs = false
+		errorMsg = "Invalid `log_level` argument: " + logLevel + ". The only acceptable values are \"debug\", \"info\", \"warn\" and \"error\"."
+	} else if slowOpThreshold < 0 || slowOpLogRate < 1 {
+		validArgs = false
+		errorMsg = "The `slow_op_threshold` argument must not be negative, and `slow_op_log_rate` must be positive."
+	} else if warmupOps < 0 || warmupDuration < 0 {
+		validArgs = false
+		errorMsg = "The `warmup_ops` and `warmup_duration` arguments must not be negative."
+	} else if warmupOps > 0 && warmupDuration > 0 {
+		validArgs = false
+		errorMsg = "Only one of the `warmup_ops` and `warmup_duration` arguments can be used."
+	} else if targetRps < 0 {
+		validArgs = false
+		errorMsg = "The `target_rps` argument must not be negative."
+	} else if targetRps > 0 && (style != "real" || cyclic || oplogUrl != "" || opsFilename == flashback.StdinFilename) {
+		validArgs = false
+		errorMsg = "The `target_rps` argument requires the \"real\" style, and cannot be used with `cyclic`, " +
+			"`duration`, `oplog_url` or stdin."
+	} else if targetRps > 0 && explicitFlags["speedup"] {
+		validArgs = false
+		errorMsg = "Only one of the `speedup` and `target_rps` arguments can be used."
+	} else if speedup <= 0 {
+		validArgs = false
+		errorMsg = "The `speedup` argument must be a positive number."
+	} else if timingJitter < 0 {
+		validArgs = false
+		errorMsg = "The `timing_jitter` argument must not be negative."
+	} else if endTime > 0 && endTime < startTime {
+		validArgs = false
+		errorMsg = "The `end_time` argument must not be before `start_time`."
+	} else if cyclic && opsFilename == flashback.StdinFilename {
+		validArgs = false
+		errorMsg = "The `cyclic` argument cannot be used when reading ops from stdin, since stdin cannot be re-read."
+	} else if resumeFromOffset < 0 {
+		validArgs = false
+		errorMsg = "The `resume_from_offset` argument must not be negative."
+	} else if resumeFromOffset > 0 &&
+		(cyclic || replayDuration > 0 || oplogUrl != "" || opsFilename == flashback.StdinFilename) {
+		validArgs = false
+		errorMsg = "The `resume_from_offset` argument cannot be used with `cyclic`, `duration`, `oplog_url` or stdin."
+	} else if checkpointFilename != "" &&
+		(cyclic || replayDuration > 0 || oplogUrl != "" || opsFilename == flashback.StdinFilename) {
+		validArgs = false
+		errorMsg = "The `checkpoint` argument cannot be used with `cyclic`, `duration`, `oplog_url` or stdin."
+	} else if checkpointInterval <= 0 {
+		validArgs = false
+		errorMsg = "The `checkpoint_interval` argument must be positive."
+	} else if resume && checkpointFilename == "" {
+		validArgs = false
+		errorMsg = "The `resume` argument requires `checkpoint`."
+	} else if resume && resumeFromOffset > 0 {
+		validArgs = false
+		errorMsg = "Only one of the `resume` and `resume_from_offset` arguments can be used."
+	} else if pinSessions && preserveOrderPerNs || deterministicDispatch && (pinSessions || preserveOrderPerNs) {
+		validArgs = false
+		errorMsg = "The `pin_sessions`, `preserve_order_per_ns` and `deterministic_dispatch` arguments cannot be used together."
+	} else if gomaxprocs < 0 {
+		validArgs = false
+		errorMsg = "The `gomaxprocs` argument must not be negative."
+	} else if errorDumpMax <= 0 {
+		validArgs = false
+		errorMsg = "The `error_dump_max` argument must be a positive number."
+	} else if replayDuration < 0 {
+		validArgs = false
+		errorMsg = "The `duration` argument must not be negative."
+	} else if loops < 0 {
+		validArgs = false
+		errorMsg = "The `loops` argument must not be negative."
+	} else if loops > 0 && !cyclic {
+		validArgs = false
+		errorMsg = "The `loops` argument requires `cyclic`."
+	} else if style == "stress" && cyclic && replayDuration == 0 && loops == 0 {
+		validArgs = false
+		errorMsg = "With the \"stress\" style, the `cyclic` argument requires `duration` or `loops`."
+	} else if !useTLS && (tlsCAFile != "" || tlsInsecure) {
+		validArgs = false
+		errorMsg = "The `tls_ca_file` and `tls_insecure` arguments require `tls`."
+	} else if err = validateUrls(); err != nil {
+		validArgs = false
+		errorMsg = err.Error()
+	} else if nsMapper, err = flashback.NewNsMapper(nsMap); err != nil {
+		validArgs = false
+		errorMsg = "Invalid `ns_map` argument: " + err.Error()
+	} else if nsMap != "" && forceDb != "" {
+		validArgs = false
+		errorMsg = "The `force_db` and `ns_map` arguments are mutually exclusive."
+	} else if err = nsMapper.SetForcedDatabase(forceDb); err != nil {
+		validArgs = false
+		errorMsg = "Invalid `force_db` argument: " + err.Error()
+	} else if opTransformer, err = flashback.LoadOpTransformer(opTransformsFilename); err != nil {
+		validArgs = false
+		errorMsg = "Invalid `op_transforms` argument: " + err.Error()
+	} else if err = nsMapper.SetCollectionSuffix(collectionSuffix); err != nil {
+		validArgs = false
+		errorMsg = "Invalid `collection_suffix` argument: " + err.Error()
+	} else if percentiles, err = flashback.ParsePercentiles(percentilesList); err != nil {
+		validArgs = false
+		errorMsg = "Invalid `percentiles` argument: " + err.Error()
+	} else if opsPerSecSmoothing <= 0 || opsPerSecSmoothing > 1 {
+		validArgs = false
+		errorMsg = "The `ops_per_sec_smoothing` argument must be between 0 (exclusive) and 1."
+	} else if opTypes, err = flashback.ParseOpTypes(opTypesList); err != nil {
+		validArgs = false
+		errorMsg = "Invalid `op_types` argument: " + err.Error()
+	} else if phase != flashback.AllPhase && opTypesList != "" {
+		validArgs = false
+		errorMsg = "Only one of the `phase` and `op_types` arguments can be used."
+	} else if nsFilter, err = flashback.NewNsFilter(includeNs, excludeNs); err != nil {
+		validArgs = false
+		errorMsg = "Invalid `include_ns` or `exclude_ns` argument: " + err.Error()
+	} else if writeConcern != "" {
+		if writeSafe, err = flashback.ParseWriteConcern(writeConcern); err != nil {
+			validArgs = false
+			errorMsg = "Invalid `write_concern` argument: " + err.Error()
+		}
+	}
+	if validArgs && opTypesList == "" {
+		if opTypes, err = flashback.PhaseOpTypes(phase); err != nil {
+			validArgs = false
+			errorMsg = "Invalid `phase` argument: " + err.Error()
+		}
+	}
+	if validArgs && checkpointFilename != "" {
+		// rather than fail on resume
+		if err = flashback.CheckOpsSeekable(opsFilename); err != nil {
+			validArgs = false
+			errorMsg = "The `checkpoint` argument requires ops files that can be resumed from: " + err.Error()
+		}
+	}
+	if validArgs && resume {
+		if checkpoint, err := flashback.ReadCheckpoint(checkpointFilename); err != nil {
+			validArgs = false
+			errorMsg = "Invalid `checkpoint` argument: " + err.Error()
+		} else if checkpoint != nil && checkpoint.OpsFilename != opsFilename {
+			validArgs = false
+			errorMsg = fmt.Sprintf("The checkpoint %s was saved while replaying %s, not %s.", checkpointFilename,
+				checkpoint.OpsFilename, opsFilename)
+		} else if checkpoint != nil {
+			resumeFromOffset = checkpoint.Offset
+			resumeOpTime = checkpoint.Timestamp
+		}
+	}
+	if timingJitter > 0 && !explicitFlags["timing_jitter_seed"] {
+		timingJitterSeed = time.Now().UnixNano()
+	}
+	if validArgs && readPreference != "" {
+		if readMode, err = flashback.ParseReadPreference(readPreference); err != nil {
+			validArgs = false
+			errorMsg = "Invalid `read_preference` argument: " + err.Error()
+		}
 	}
 
 	if !validArgs {
@@ -182,208 +1054,1405 @@ func parseFlags() error {
 		os.Exit(1)
 	}
 
-	var err error
 	if logger, err = flashback.NewLogger(stdout, stderr); err != nil {
 		return err
 	}
-	return nil
+	colorReport = color ||
+		!noColor && stdout == "" && logFormat == flashback.TextLogFormat && isTerminal(os.Stdout)
+	if err = logger.SetFormat(logFormat); err != nil {
+		return err
+	}
+	return logger.SetLevel(logLevel)
 }
 
-func makeOpsChan(style string, opsFilename string, logger *flashback.Logger) (chan *flashback.Op, error) {
-	// Prepare to dispatch ops
-	var (
-		reader flashback.OpsReader
-		err    error
-	)
-
-	if style == "real" && cyclic == true {
-		reader = flashback.NewCyclicOpsReader(func() flashback.OpsReader {
-			err, reader := flashback.NewFileByLineOpsReader(opsFilename, logger, opFilter)
-			panicOnError(err)
-			return reader
-		}, logger)
-	} else {
-		err, reader = flashback.NewFileByLineOpsReader(opsFilename, logger, opFilter)
-		if err != nil {
-			return nil, err
+// dedicatedOpTypes returns the op types that have workers of their own
+func dedicatedOpTypes() []flashback.OpType {
+	var opTypes []flashback.OpType
+	for _, opType := range flashback.AllOpTypes {
+		if *opTypeWorkers[opType] > 0 {
+			opTypes = append(opTypes, opType)
 		}
 	}
+	return opTypes
+}
 
-	if startTime > 0 {
-		if _, err := reader.SetStartTime(startTime); err != nil {
-			return nil, err
+func validateOpTypeWorkers() error {
+	for _, opType := range flashback.AllOpTypes {
+		if *opTypeWorkers[opType] < 0 {
+			return fmt.Errorf("The `workers_%s` argument must not be negative.",
+				strings.TrimPrefix(string(opType), "command."))
 		}
 	}
-	if numSkipOps > 0 {
-		if err := reader.SkipOps(numSkipOps); err != nil {
-			return nil, err
-		}
+	if (pinSessions || preserveOrderPerNs || deterministicDispatch) && len(dedicatedOpTypes()) > 0 {
+		return errors.New("The `workers_<op type>` arguments cannot be used with `pin_sessions`, " +
+			"`preserve_order_per_ns` or `deterministic_dispatch`.")
 	}
+	return nil
+}
 
-	if style == "stress" {
-		return flashback.NewBestEffortOpsDispatcher(reader, maxOps, logger), nil
-	} else {
-		return flashback.NewByTimeOpsDispatcher(reader, maxOps, logger, speedup), nil
+// loadConfig sets the flags found in the given YAML (or JSON, which YAML
+// parses as well) file, except the ones given on the command line
+func loadConfig(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	if err = yaml.Unmarshal(content, &config); err != nil {
+		return fmt.Errorf("could not parse the config file %s: %s", filename, err)
+	}
+
+	commandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		commandLine[f.Name] = true
+	})
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if flag.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("unknown flag %s in the config file %s", name, filename)
+		}
+		if commandLine[name] || config[name] == nil {
+			continue
+		}
+		var value string
+		switch v := config[name].(type) {
+		case []interface{}:
+			values := make([]string, len(v))
+			for i, elem := range v {
+				values[i] = fmt.Sprint(elem)
+			}
+			value = strings.Join(values, ",")
+		case map[interface{}]interface{}:
+			return fmt.Errorf("invalid value for %s in the config file %s: expected a scalar or a list", name, filename)
+		default:
+			value = fmt.Sprint(v)
+		}
+		if err = flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for %s in the config file %s: %s", value, name, filename, err)
+		}
 	}
+	return nil
 }
 
-type node struct {
-	name          string
-	url           string
-	statsFile     *os.File
-	statsChan     chan flashback.OpStat
-	statsAnalyzer *flashback.StatsAnalyzer
+// splitUrls splits a comma-separated list of urls. Since the hosts of a
+// replica set are comma-separated as well, the list is only split in front of
+// the urls starting with mongodb://.
+func splitUrls(list string) []string {
+	const scheme = "mongodb://"
+	parts := strings.Split(list, ","+scheme)
+	for i := 1; i < len(parts); i++ {
+		parts[i] = scheme + parts[i]
+	}
+	return parts
 }
 
-type nodeWorkerState struct {
-	name    string
-	session *mgo.Session
-	exec    *flashback.OpsExecutor
+// failFastAllows tells whether fail_fast lets the op error through
+func failFastAllows(err error) bool {
+	category := flashback.CategorizeError(err)
+	for _, allowed := range failFastAllowed {
+		if category == allowed {
+			return true
+		}
+	}
+	return false
 }
 
-func main() {
-	// Will enable system threads to make sure all cpus can be well utilized.
-	runtime.GOMAXPROCS(runtime.NumCPU())
-	err := parseFlags()
-	panicOnError(err)
-	defer logger.Close()
+// validateUrls makes sure all the given urls can be parsed, so that we fail
+// with a helpful message rather than having every worker panic.
+func validateUrls() error {
+	values := []struct{ flag, value string }{
+		{"challenger_url", challengerUrl},
+		{"challenger_url2", challengerUrl2},
+		{"challenger_url3", challengerUrl3},
+		{"oplog_url", oplogUrl},
+	}
+	for _, u := range urls {
+		values = append(values, struct{ flag, value string }{"url", u})
+	}
+	for _, u := range values {
+		if u.value == "" {
+			continue
+		}
+		// don't echo the url itself back, since it may contain a password
+		if _, err := mgo.ParseURL(u.value); err != nil {
+			return fmt.Errorf("Invalid `%s` argument: %s. Expected either <host>[:<port>] or "+
+				"mongodb://[<user>:<password>@]<host>[:<port>][/<database>][?<options>]", u.flag, err)
+		}
+	}
+	return nil
+}
 
-	opsChan, err := makeOpsChan(style, opsFilename, logger)
-	panicOnError(err)
+// newTLSConfig builds the config used to connect to the servers over TLS, or
+// returns nil if TLS isn't enabled.
+func newTLSConfig() (*tls.Config, error) {
+	if !useTLS {
+		return nil, nil
+	}
 
-	createNode := func(name string, nodeUrl string, filename string) node {
-		var n node
-		// stats file
-		if filename != "" {
-			var err error
-			n.statsFile, err = os.Create(filename)
-			panicOnError(err)
-		} else {
-			n.statsFile = nil
+	config := &tls.Config{InsecureSkipVerify: tlsInsecure}
+	if tlsCAFile != "" {
+		pem, err := ioutil.ReadFile(tlsCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", tlsCAFile)
 		}
-		n.name = name
-		n.url = nodeUrl
-		n.statsChan = make(chan flashback.OpStat, workers*100)
-		n.statsAnalyzer = flashback.NewStatsAnalyzer(n.statsChan)
-		return n
 	}
+	return config, nil
+}
 
-	var nodes []node
-	// create "default" node
-	nodes = append(nodes, createNode("default", url, statsFilename))
-	// create "challenger" node if necessary
-	if challengerUrl != "" {
-		nodes = append(nodes, createNode("challenger", challengerUrl, challengerStatsFilename))
+// tlsDialer returns a mgo.DialInfo.DialServer callback that wraps the
+// connections in TLS.
+func tlsDialer(config *tls.Config, timeout time.Duration) func(*mgo.ServerAddr) (net.Conn, error) {
+	return func(addr *mgo.ServerAddr) (net.Conn, error) {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr.String(), config)
+		if err != nil {
+			// mgo keeps retrying quietly, so make sure a certificate problem is visible
+			logger.Errorf("TLS connection to %s failed: %s", addr, err)
+		}
+		return conn, err
 	}
-	// create "challenger2" node if necessary
-	if challengerUrl2 != "" {
-		nodes = append(nodes, createNode("challenger2", challengerUrl2, challengerStatsFilename2))
+}
+
+// dialSession connects to the given url, over TLS if tlsConfig isn't nil
+func dialSession(url string, tlsConfig *tls.Config) (*mgo.Session, error) {
+	dialInfo, err := mgo.ParseURL(url)
+	if err != nil {
+		return nil, err
 	}
-	// create "challenger3" node if necessary
-	if challengerUrl3 != "" {
-		nodes = append(nodes, createNode("challenger3", challengerUrl3, challengerStatsFilename3))
+	dialInfo.Timeout = connectTimeout
+	if tlsConfig != nil {
+		dialInfo.DialServer = tlsDialer(tlsConfig, dialInfo.Timeout)
 	}
+	return mgo.DialWithInfo(dialInfo)
+}
 
-	// close stats files
+// checkNodes connects to every node once and pings it, so that an unreachable
+// server or bad credentials make the replay fail with a single clear error,
+// rather than every worker failing on its own.
+func checkNodes(nodes []node, tlsConfig *tls.Config) error {
 	for _, n := range nodes {
-		if n.statsFile != nil {
-			defer n.statsFile.Close()
+		session, err := dialSession(n.url, tlsConfig)
+		if err == nil {
+			err = session.Ping()
+			session.Close()
+		}
+		if err != nil {
+			// don't log the url itself, since it may contain a password
+			return fmt.Errorf("cannot connect to the %s node: %s", n.name, err)
+		}
+	}
+	return nil
+}
+
+// prewarmSession connects the session to the primary up front with a ping,
+// so that its first op doesn't pay for it. With a read mode other than the
+// primary, a copy of the session connects to the server the reads go to as
+// well, its socket then waiting for the session in the pool they share.
+func prewarmSession(session *mgo.Session, readMode mgo.Mode) error {
+	err := session.Ping()
+	if err == nil && readMode != mgo.Primary {
+		reads := session.Copy()
+		reads.SetMode(readMode, true)
+		err = reads.Ping()
+		reads.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("could not pre-open the connections: %s", err)
+	}
+	return nil
+}
+
+// profileOps logs the share of each op type and namespace in the ops file,
+// see profile_only
+func profileOps() error {
+	err, reader := flashback.NewFileByLineOpsReader(opsFilename, logger, opFilter)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	profile := flashback.NewOpsProfile()
+	for op := reader.Next(); op != nil; op = reader.Next() {
+		profile.Add(op)
+	}
+	if err = reader.Err(); err != nil {
+		return err
+	}
+
+	logger.Infof("Profiled %d ops (%d malformed ones skipped, %d that wouldn't be replayed)",
+		profile.Ops, reader.MalformedOps(), profile.Skipped)
+	logger.Infof("Op types: %s", profile.Distribution())
+	const maxNamespaces = 20
+	replayed := float64(profile.Ops - profile.Skipped)
+	for _, count := range profile.TopNamespaces(maxNamespaces) {
+		logger.Infof("  %s: %d ops (%.1f%%)", count.Ns, count.Ops, 100*float64(count.Ops)/replayed)
+	}
+	if len(profile.Namespaces) > maxNamespaces {
+		logger.Infof("  and %d other namespaces", len(profile.Namespaces)-maxNamespaces)
+	}
+	return nil
+}
+
+func makeOpsChan(style string, opsFilename string, tlsConfig *tls.Config,
+	logger *flashback.Logger) (chan *flashback.Op, error) {
+	// Prepare to dispatch ops
+	var (
+		reader       flashback.OpsReader
+		byLineReader *flashback.ByLineOpsReader
+		err          error
+	)
+
+	setupReader := func(reader *flashback.ByLineOpsReader) {
+		reader.SetOpTypes(opTypes)
+		reader.SetNsFilter(nsFilter)
+		reader.SetStrict(strict)
+	}
+	newReader := func() (error, *flashback.ByLineOpsReader) {
+		err, reader := flashback.NewFileByLineOpsReader(opsFilename, logger, opFilter)
+		if err != nil {
+			return err, nil
+		}
+		setupReader(reader)
+		return nil, reader
+	}
+
+	if oplogUrl == "" && opsFilename != flashback.StdinFilename {
+		reopenOps = newReader
+	}
+
+	if oplogUrl != "" {
+		session, err := dialSession(oplogUrl, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		err, oplogReader := flashback.NewOplogOpsReader(session, 0, logger)
+		if err != nil {
+			return nil, err
+		}
+		oplogReader.SetOpTypes(opTypes)
+		oplogReader.SetNsFilter(nsFilter)
+		reader = oplogReader
+	} else if style == "real" && cyclic == true {
+		// the files get re-opened for each loop, rather than held in memory
+		err, cyclicReader := flashback.NewFileCyclicOpsReader(opsFilename, logger, opFilter, setupReader)
+		if err != nil {
+			return nil, err
+		}
+		cyclicReader.SetLoops(loops)
+		reader = cyclicReader
+	} else {
+		err, byLineReader = newReader()
+		if err != nil {
+			return nil, err
+		}
+		if resumeFromOffset > 0 {
+			if err := byLineReader.SeekToOffset(resumeFromOffset); err != nil {
+				return nil, err
+			}
+		}
+		reader = byLineReader
+		if opsFilename != flashback.StdinFilename {
+			opsProgress = flashback.NewOpsProgress(resumeFromOffset)
+		}
+	}
+
+	if startTime > 0 {
+		if _, err := reader.SetStartTime(startTime); err != nil {
+			return nil, err
+		}
+	}
+	if endTime > 0 {
+		reader.SetEndTime(endTime)
+	}
+	if numSkipOps > 0 {
+		if err := reader.SkipOps(numSkipOps); err != nil {
+			return nil, err
+		}
+	}
+
+	if byLineReader != nil {
+		// track the progress from where the replay starts, i.e. after skipping
+		startBytes := byLineReader.BytesRead()
+		if totalBytes := byLineReader.TotalBytes(); totalBytes > startBytes {
+			readerProgress = func() float64 {
+				return float64(byLineReader.BytesRead()-startBytes) / float64(totalBytes-startBytes)
+			}
+		}
+	}
+
+	opsReader = reader
+	timedReader = flashback.NewTimedOpsReader(reader)
+	reader = timedReader
+	if replayFraction < 1 {
+		fractionReader = flashback.NewFractionOpsReader(reader, replayFraction)
+		reader = fractionReader
+	}
+	if maxOpAge > 0 {
+		staleReader = flashback.NewStaleOpsReader(reader, maxOpAge)
+		// the newest entries of an oplog tailed from far behind are stale too
+		staleReader.SetWallClock(oplogUrl != "")
+		reader = staleReader
+	}
+	if maxOpSize > 0 {
+		sizeLimitedReader = flashback.NewSizeLimitedOpsReader(reader, maxOpSize, logger)
+		sizeLimitedReader.SetKeepOversized(keepOversizedOps)
+		reader = sizeLimitedReader
+	}
+	if opsProgress != nil {
+		// the ops skipped above are behind the ones read next, so they
+		// needn't be tracked
+		reader = &progressOpsReader{OpsReader: reader}
+	}
+	dispatchMeter = flashback.NewDispatchMeter()
+	var opsChan chan *flashback.Op
+	if style == "stress" {
+		// the ops get preloaded, so we know exactly how many will be replayed
+		counter := &countingOpsReader{OpsReader: reader}
+		opsChan = flashback.NewBestEffortOpsDispatcher(counter, maxOps, logger, cyclic, loops,
+			dispatchMeter)
+		if !cyclic {
+			expectedOps = counter.opsReturned
+		} else if replayDuration == 0 {
+			expectedOps = counter.opsReturned * int64(loops)
+		}
+	} else {
+		if maxOps > 0 && maxOps != math.MaxUint32 {
+			expectedOps = int64(maxOps)
+		}
+		if targetRps > 0 {
+			recordedRps, err := measureRecordedRate(newReader)
+			if err != nil {
+				return nil, fmt.Errorf("could not measure the rate of the ops for target_rps: %s", err)
+			}
+			speedup = targetRps / recordedRps
+			logger.Infof("The ops were recorded at %.2f ops/sec on average, replaying them with a speedup of %f "+
+				"to average %.2f ops/sec", recordedRps, speedup, targetRps)
+		}
+		if timingJitter > 0 {
+			logger.Infof("Jittering the ops with the seed %d, see timing_jitter_seed", timingJitterSeed)
+		}
+		opsChan, dispatchStatus = flashback.NewByTimeOpsDispatcher(reader, maxOps, logger, speedup, pauser,
+			strictOrdering, timingJitter, timingJitterSeed, dispatchMeter)
+	}
+	if maxOpsPerSec > 0 {
+		opsChan = flashback.NewRateLimitedOpsChan(opsChan, maxOpsPerSec, logger)
+	}
+	return opsChan, nil
+}
+
+// measureRecordedRate reads the ops that will be replayed, with a reader of
+// their own, to tell the average rate they were recorded at, see target_rps
+func measureRecordedRate(newReader func() (error, *flashback.ByLineOpsReader)) (float64, error) {
+	reader, err := openReplayedOps(newReader)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	rate, err := flashback.RecordedRate(reader, maxOps)
+	// only that fraction of the ops gets replayed
+	return rate * replayFraction, err
+}
+
+// openReplayedOps opens a reader of its own over the ops that will be
+// replayed, positioned like the one of the replay
+func openReplayedOps(newReader func() (error, *flashback.ByLineOpsReader)) (*flashback.ByLineOpsReader, error) {
+	err, reader := newReader()
+	if err != nil {
+		return nil, err
+	}
+	if resumeFromOffset > 0 {
+		err = reader.SeekToOffset(resumeFromOffset)
+	}
+	if err == nil && startTime > 0 {
+		_, err = reader.SetStartTime(startTime)
+	}
+	if endTime > 0 {
+		reader.SetEndTime(endTime)
+	}
+	if err == nil && numSkipOps > 0 {
+		err = reader.SkipOps(numSkipOps)
+	}
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// checkRequiredIndexes reads the ops that will be replayed ahead, with a
+// reader of their own, and warns about the indexes they need that the nodes
+// lack before the replay starts, see flashback.IndexChecker
+func checkRequiredIndexes(nodes []node, tlsConfig *tls.Config) error {
+	reader, err := openReplayedOps(reopenOps)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	for i := 0; i < maxOps; i++ {
+		op := reader.Next()
+		if op == nil {
+			break
+		}
+		if op = flashback.CanonicalizeOp(op); op == nil {
+			continue
+		}
+		op = opTransformer.Transform(op)
+		database, collection := nsMapper.Map(op.Database, op.Collection)
+		for _, n := range nodes {
+			n.indexChecker.Require(op, database, collection)
+		}
+	}
+	if err := reader.Err(); err != nil {
+		return err
+	}
+
+	for _, n := range nodes {
+		session, err := dialSession(n.url, tlsConfig)
+		if err != nil {
+			return fmt.Errorf("cannot connect to the %s node: %s", n.name, err)
+		}
+		if failing := n.indexChecker.CheckRequired(session); failing > 0 {
+			logger.Warnf("[%s] %d ops will fail for lack of an index, see above", n.name, failing)
+		}
+		session.Close()
+	}
+	return nil
+}
+
+// reportReader logs how fast the ops were read and parsed, compared to how
+// long the replay took, to tell whether it was held up by the ops file(s)
+func reportReader(replayTime time.Duration) {
+	readTime := timedReader.ReadTime()
+	if readTime <= 0 {
+		return
+	}
+	opsRead := opsReader.OpsRead()
+	megabytes := float64(timedReader.BytesRead()) / (1 << 20)
+	logger.Infof("Read %d ops (%.2f MB) in %v: %.2f ops/sec, %.2f MB/sec. The replay took %v.",
+		opsRead, megabytes, readTime, float64(opsRead)/readTime.Seconds(), megabytes/readTime.Seconds(),
+		replayTime)
+}
+
+// formatLatencies formats the latencies of one line of the reports, with
+// the percentiles asked for by -percentiles
+func formatLatencies(label string, status *flashback.ExecutionStatus, latencies []float64,
+	maxLatency float64) string {
+	formatted := make([]string, 0, len(percentiles)+1)
+	for _, percentile := range percentiles {
+		formatted = append(formatted, fmt.Sprintf("P%s: %.2fms",
+			strconv.FormatFloat(percentile*100, 'g', 6, 64), latencies[status.PercentileIndex(percentile)]))
+	}
+	formatted = append(formatted, fmt.Sprintf("Max %.2fms", maxLatency))
+	return fmt.Sprintf("   %s: %s", label, strings.Join(formatted, ", "))
+}
+
+// the ANSI escape codes of the report colors
+const (
+	ansiBold  = "\x1b[1m"
+	ansiRed   = "\x1b[31m"
+	ansiReset = "\x1b[0m"
+)
+
+// isTerminal tells whether the file is a terminal rather than, e.g., a pipe
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// formatTable aligns the cells of the rows in columns, the first row being
+// the header. If colorReport is set, the header is in bold and the cells for
+// which highlight is true in red. Unlike with tabwriter, the escape codes of
+// the colors don't count towards the widths of the columns.
+func formatTable(rows [][]string, highlight func(row, col int) bool) []string {
+	var widths []int
+	for _, row := range rows {
+		for col, cell := range row {
+			if col == len(widths) {
+				widths = append(widths, 0)
+			}
+			if width := utf8.RuneCountInString(cell); width > widths[col] {
+				widths[col] = width
+			}
+		}
+	}
+
+	lines := make([]string, len(rows))
+	for i, row := range rows {
+		var line bytes.Buffer
+		for col, cell := range row {
+			switch {
+			case colorReport && i == 0:
+				line.WriteString(ansiBold + cell + ansiReset)
+			case colorReport && highlight(i, col):
+				line.WriteString(ansiRed + cell + ansiReset)
+			default:
+				line.WriteString(cell)
+			}
+			if col < len(row)-1 {
+				line.WriteString(strings.Repeat(" ", widths[col]-utf8.RuneCountInString(cell)+2))
+			}
+		}
+		lines[i] = line.String()
+	}
+	return lines
+}
+
+// reportOpTypesTable logs the counts, ops/sec and latencies of the op types
+// seen so far as a table, see report_table
+func reportOpTypesTable(status *flashback.ExecutionStatus) {
+	header := []string{"Op type", "Count", "Interval", "Ops/sec"}
+	for _, percentile := range percentiles {
+		header = append(header, "P"+strconv.FormatFloat(percentile*100, 'g', 6, 64))
+	}
+	header = append(header, "Max")
+	rows := [][]string{header}
+	// the latencies, by row and column
+	latencies := map[int]map[int]float64{}
+	for _, opType := range flashback.AllOpTypes {
+		if status.Counts[opType] == 0 {
+			continue
+		}
+		row := []string{string(opType), strconv.FormatInt(status.Counts[opType], 10),
+			strconv.FormatInt(status.IntervalCounts[opType], 10),
+			fmt.Sprintf("%.2f", status.IntervalTypeOpsSec[opType])}
+		rowLatencies := map[int]float64{}
+		for _, percentile := range percentiles {
+			latency := status.IntervalLatencies[opType][status.PercentileIndex(percentile)]
+			rowLatencies[len(row)] = latency
+			row = append(row, fmt.Sprintf("%.2fms", latency))
+		}
+		rowLatencies[len(row)] = status.IntervalMaxLatency[opType]
+		row = append(row, fmt.Sprintf("%.2fms", status.IntervalMaxLatency[opType]))
+		latencies[len(rows)] = rowLatencies
+		rows = append(rows, row)
+	}
+
+	thresholdMs := float64(highlightLatency) / float64(time.Millisecond)
+	highlight := func(row, col int) bool {
+		latency, ok := latencies[row][col]
+		return ok && highlightLatency > 0 && latency > thresholdMs
+	}
+	logger.Info("  Op types, with the ops/sec and latencies of the interval:")
+	for _, line := range formatTable(rows, highlight) {
+		logger.Info("    " + line)
+	}
+}
+
+// reportComparison logs a table comparing the latencies of every node to the
+// ones of the default node, op type by op type.
+func reportComparison(nodes []node) {
+	statuses := make([]*flashback.ExecutionStatus, len(nodes))
+	for i, n := range nodes {
+		statuses[i] = n.statsAnalyzer.GetStatus()
+	}
+
+	var table bytes.Buffer
+	out := tabwriter.NewWriter(&table, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(out, "Op type\tNode\tCount\tP50\tP95\tP99\tMax\tP99 vs default")
+	for _, opType := range flashback.AllOpTypes {
+		if statuses[0].Counts[opType] == 0 {
+			continue
+		}
+		defaultP99 := statuses[0].Latencies[opType][flashback.P99]
+		for i, n := range nodes {
+			latencies := statuses[i].Latencies[opType]
+			delta := ""
+			if i > 0 && defaultP99 > 0 {
+				delta = fmt.Sprintf("%+.1f%%", (latencies[flashback.P99]-defaultP99)*100/defaultP99)
+			}
+			fmt.Fprintf(out, "%s\t%s\t%d\t%.2fms\t%.2fms\t%.2fms\t%.2fms\t%s\n", opType, n.name,
+				statuses[i].Counts[opType], latencies[flashback.P50], latencies[flashback.P95],
+				latencies[flashback.P99], statuses[i].MaxLatency[opType], delta)
+		}
+	}
+	out.Flush()
+
+	logger.Info("Latency comparison:")
+	for _, line := range strings.Split(strings.TrimRight(table.String(), "\n"), "\n") {
+		logger.Info("  " + line)
+	}
+}
+
+// writeCheckpoint saves where the replay got to, see checkpoint
+func writeCheckpoint() {
+	offset, timestamp := opsProgress.Resume()
+	checkpoint := &flashback.Checkpoint{
+		OpsFilename: opsFilename,
+		Offset:      offset,
+		Timestamp:   timestamp,
+		WrittenAt:   time.Now(),
+	}
+	if err := flashback.WriteCheckpoint(checkpointFilename, checkpoint); err != nil {
+		logger.Error("saving the checkpoint failed: ", err)
+	}
+}
+
+// progressOpsReader records the ops returned by the underlying reader in
+// opsProgress, so that they count as pending until the workers are done with
+// them
+type progressOpsReader struct {
+	flashback.OpsReader
+}
+
+func (p *progressOpsReader) Next() *flashback.Op {
+	op := p.OpsReader.Next()
+	if op != nil {
+		opsProgress.Read(op)
+	}
+	return op
+}
+
+// countingOpsReader counts the ops returned by the underlying reader, after
+// they got filtered
+type countingOpsReader struct {
+	flashback.OpsReader
+	opsReturned int64
+}
+
+func (c *countingOpsReader) Next() *flashback.Op {
+	op := c.OpsReader.Next()
+	if op != nil {
+		c.opsReturned++
+	}
+	return op
+}
+
+type node struct {
+	name          string
+	url           string
+	statsFile     *os.File
+	statsChan     chan flashback.OpStat
+	statsAnalyzer *flashback.StatsAnalyzer
+	// shared by the executors of all the workers, see flashback.Cursors
+	cursors *flashback.Cursors
+	// likewise, see flashback.IndexChecker
+	indexChecker *flashback.IndexChecker
+	// set with -validate_reads, see flashback.ReadValidator
+	readValidator *flashback.ReadValidator
+	// the stats the executors had to drop, added up atomically by the
+	// workers once they are done
+	droppedStats *int64
+	// with -pool_size, the session whose pool the sessions of all the
+	// workers share
+	pool *mgo.Session
+}
+
+// workerStats are the per worker stats of -verbose_workers
+type workerStats struct {
+	id int
+	// updated atomically by the worker
+	opsExecuted int64
+	// the latency of the latest op against the default node, in nanoseconds
+	lastLatency int64
+	// the ops executed as of the previous report
+	reportedOps int64
+}
+
+// reportWorkers logs the ops executed by each worker since the previous
+// report, flagging the workers more than 2 standard deviations below the mean.
+func reportWorkers(stats []*workerStats, interval time.Duration) {
+	if len(stats) == 0 {
+		return
+	}
+	opsPerSec := make([]float64, len(stats))
+	mean := 0.0
+	for i := range stats {
+		opsExecuted := atomic.LoadInt64(&stats[i].opsExecuted)
+		opsPerSec[i] = float64(opsExecuted-stats[i].reportedOps) / interval.Seconds()
+		mean += opsPerSec[i]
+	}
+	mean /= float64(len(stats))
+	variance := 0.0
+	for _, value := range opsPerSec {
+		variance += (value - mean) * (value - mean)
+	}
+	stddev := math.Sqrt(variance / float64(len(stats)))
+
+	for i := range stats {
+		opsExecuted := atomic.LoadInt64(&stats[i].opsExecuted)
+		lagging := ""
+		if opsPerSec[i] < mean-2*stddev {
+			lagging = " <-- lagging"
+		}
+		logger.Infof("  Worker #%d: executed %d ops (%d in interval), %.2f ops/sec (interval), "+
+			"last latency %v%s", stats[i].id, opsExecuted, opsExecuted-stats[i].reportedOps, opsPerSec[i],
+			time.Duration(atomic.LoadInt64(&stats[i].lastLatency)), lagging)
+		stats[i].reportedOps = opsExecuted
+	}
+}
+
+// how much of the failed ops -verbose logs
+const maxLoggedOpLen = 300
+
+// redialBackoff returns how long to wait before the given attempt to re-dial
+// a target, which doubles with each attempt up to 30s
+func redialBackoff(attempt int) time.Duration {
+	backoff := time.Second << uint(attempt-1)
+	if backoff <= 0 || backoff > 30*time.Second {
+		backoff = 30 * time.Second
+	}
+	return backoff
+}
+
+// workerPool keeps track of the running workers, so that they can be scaled
+// up or down via -control_addr
+type workerPool struct {
+	mutex sync.Mutex
+	fetch func(stats *workerStats, quit chan struct{})
+	// the running workers, in the order they were started
+	running []*runningWorker
+	started int
+	// how many workers haven't exited yet, including the stopped ones
+	active int
+	// closed once all the workers exited
+	done chan struct{}
+}
+
+func newWorkerPool(fetch func(stats *workerStats, quit chan struct{})) *workerPool {
+	return &workerPool{fetch: fetch, done: make(chan struct{})}
+}
+
+type runningWorker struct {
+	stats *workerStats
+	quit  chan struct{}
+}
+
+func (p *workerPool) Workers() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.running)
+}
+
+// SetWorkers starts new workers, or stops the most recent ones, until the
+// given number of them run
+func (p *workerPool) SetWorkers(workers int) error {
+	if pinSessions || preserveOrderPerNs || deterministicDispatch {
+		return errors.New("the workers can't be scaled when the ops are pinned to them")
+	}
+	if len(dedicatedOpTypes()) > 0 {
+		return errors.New("the workers can't be scaled when some are dedicated to op types")
+	}
+	p.scale(workers)
+	return nil
+}
+
+func (p *workerPool) scale(workers int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for len(p.running) < workers {
+		if p.started > 0 && p.active == 0 {
+			// the replay is over
+			break
+		}
+		worker := &runningWorker{&workerStats{id: p.started}, make(chan struct{})}
+		p.running = append(p.running, worker)
+		p.started++
+		p.active++
+		go p.run(worker)
+	}
+	for len(p.running) > workers {
+		last := len(p.running) - 1
+		close(p.running[last].quit)
+		p.running = p.running[:last]
+	}
+}
+
+func (p *workerPool) run(worker *runningWorker) {
+	p.fetch(worker.stats, worker.quit)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.active--
+	if p.active == 0 {
+		close(p.done)
+	}
+}
+
+// Done returns a channel closed once all the workers exited, be it because
+// the ops ran out, the replay got interrupted or they were all stopped.
+func (p *workerPool) Done() chan struct{} {
+	return p.done
+}
+
+func (p *workerPool) stats() []*workerStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	stats := make([]*workerStats, len(p.running))
+	for i, worker := range p.running {
+		stats[i] = worker.stats
+	}
+	return stats
+}
+
+type nodeWorkerState struct {
+	node    node
+	session *mgo.Session
+	exec    *flashback.OpsExecutor
+	// the error of the latest op, and how many ops in a row failed because
+	// of the connection
+	err      error
+	failures int
+}
+
+func main() {
+	err := parseFlags()
+	panicOnError(err)
+	defer logger.Close()
+	logger.Info(versionString())
+	if profileOnly {
+		panicOnError(profileOps())
+		return
+	}
+	if resume && resumeFromOffset > 0 {
+		logger.Infof("Resuming from the checkpoint %s, at the op recorded at %s (offset %d)", checkpointFilename,
+			resumeOpTime, resumeFromOffset)
+	} else if resume {
+		logger.Infof("No checkpoint in %s yet, starting from the beginning", checkpointFilename)
+	}
+	// the runtime uses all the cpus by default
+	if gomaxprocs > 0 {
+		runtime.GOMAXPROCS(gomaxprocs)
+	}
+
+	// before anything gets dialed, for the socket counts of the reports to
+	// be right
+	mgo.SetStats(true)
+
+	tlsConfig, err := newTLSConfig()
+	panicOnError(err)
+
+	opsChan, err := makeOpsChan(style, opsFilename, tlsConfig, logger)
+	panicOnError(err)
+
+	var latencyCSV *flashback.LatencyCSVWriter
+	if latencyCSVFilename != "" {
+		latencyCSVFile, err := os.Create(latencyCSVFilename)
+		panicOnError(err)
+		defer latencyCSVFile.Close()
+		latencyCSV, err = flashback.NewLatencyCSVWriter(latencyCSVFile)
+		panicOnError(err)
+	}
+
+	var timeSeries *flashback.TimeSeriesWriter
+	if timeSeriesFilename != "" {
+		timeSeriesFile, err := os.Create(timeSeriesFilename)
+		panicOnError(err)
+		defer timeSeriesFile.Close()
+		timeSeries, err = flashback.NewTimeSeriesWriter(timeSeriesFile)
+		panicOnError(err)
+	}
+
+	var validationDump *os.File
+	if validationDumpFilename != "" {
+		validationDump, err = os.OpenFile(validationDumpFilename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		panicOnError(err)
+		defer validationDump.Close()
+	}
+
+	var errorDump *flashback.ErrorDump
+	if errorDumpFilename != "" {
+		errorDumpFile, err := os.OpenFile(errorDumpFilename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		panicOnError(err)
+		defer errorDumpFile.Close()
+		errorDump = flashback.NewErrorDump(errorDumpFile, errorDumpMax)
+	}
+
+	var inflightLimiter *flashback.InflightLimiter
+	if maxInflight > 0 {
+		inflightLimiter = flashback.NewInflightLimiter(maxInflight)
+		logger.Infof("Limiting the replay to %d ops in flight", maxInflight)
+	}
+	var opRateLimiter *flashback.OpRateLimiter
+	if len(opRateLimits) > 0 {
+		opRateLimiter = flashback.NewOpRateLimiter(opRateLimits)
+	}
+
+	var slowOpLog *flashback.SlowOpLog
+	if slowOpThreshold > 0 {
+		slowOpLog = flashback.NewSlowOpLog(slowOpThreshold, slowOpLogRate)
+	}
+
+	createNode := func(name string, nodeUrl string, filename string) node {
+		var n node
+		// stats file
+		if filename != "" {
+			var err error
+			n.statsFile, err = os.Create(filename)
+			panicOnError(err)
+		} else {
+			n.statsFile = nil
+		}
+		n.name = name
+		n.url = nodeUrl
+		n.statsChan = make(chan flashback.OpStat, workers*100)
+		n.statsAnalyzer = flashback.NewStatsAnalyzer(n.statsChan)
+		n.statsAnalyzer.TrackConnections()
+		n.cursors = flashback.NewCursors()
+		n.droppedStats = new(int64)
+		n.indexChecker = flashback.NewIndexChecker(logger)
+		if validateReads {
+			n.readValidator = flashback.NewReadValidator(name)
+			if validationDump != nil {
+				n.readValidator.SetDump(validationDump, errorDumpMax)
+			}
+		}
+		n.statsAnalyzer.SetPercentiles(percentiles)
+		n.statsAnalyzer.SetOpsPerSecSmoothing(opsPerSecSmoothing)
+		if perNsStats {
+			n.statsAnalyzer.TrackNamespaces()
+		}
+		if hdrOutput != "" {
+			n.statsAnalyzer.RecordHistograms()
+		}
+		if latencyCSV != nil {
+			n.statsAnalyzer.SetLatencyCSV(latencyCSV, name)
+		}
+		if timeSeries != nil {
+			n.statsAnalyzer.TrackTimeSeries()
+		}
+		if latencyWindow > 0 {
+			n.statsAnalyzer.SetWindow(latencyWindow)
+		}
+		if warmupOps > 0 {
+			n.statsAnalyzer.SetWarmupOps(int64(warmupOps))
+		} else if warmupDuration > 0 {
+			n.statsAnalyzer.SetWarmupDuration(warmupDuration)
+		}
+		if expectedOps > 0 {
+			n.statsAnalyzer.SetExpectedOps(expectedOps)
+		} else if readerProgress != nil {
+			n.statsAnalyzer.SetProgressFunc(readerProgress)
+		}
+		return n
+	}
+
+	var nodes []node
+	// create "default" node
+	nodes = append(nodes, createNode("default", urls[0], statsFilename))
+	// create "url2", "url3"... nodes for the other urls, if any
+	for i, otherUrl := range urls[1:] {
+		nodes = append(nodes, createNode(fmt.Sprintf("url%d", i+2), otherUrl, ""))
+	}
+	// create "challenger" node if necessary
+	if challengerUrl != "" {
+		nodes = append(nodes, createNode("challenger", challengerUrl, challengerStatsFilename))
+	}
+	// create "challenger2" node if necessary
+	if challengerUrl2 != "" {
+		nodes = append(nodes, createNode("challenger2", challengerUrl2, challengerStatsFilename2))
+	}
+	// create "challenger3" node if necessary
+	if challengerUrl3 != "" {
+		nodes = append(nodes, createNode("challenger3", challengerUrl3, challengerStatsFilename3))
+	}
+
+	// close stats files
+	for _, n := range nodes {
+		if n.statsFile != nil {
+			defer n.statsFile.Close()
 		}
 	}
 
+	if !dryRun {
+		if err := checkNodes(nodes, tlsConfig); err != nil {
+			logger.Error(err)
+			logger.Close()
+			os.Exit(1)
+		}
+	}
+	// the ops that need an index the targets lack get reported before the
+	// replay if asked and the ops can be read twice, and as they get replayed
+	// otherwise
+	if checkIndexes && !dryRun && reopenOps == nil {
+		logger.Warn("The ops can't be read twice, checking the indexes they need during the replay")
+	} else if checkIndexes && !dryRun {
+		logger.Info("Checking the indexes the ops need")
+		if err := checkRequiredIndexes(nodes, tlsConfig); err != nil {
+			logger.Error("Could not check the indexes the ops need, checking them during the replay: ", err)
+		} else {
+			for i := range nodes {
+				nodes[i].indexChecker = nil
+			}
+		}
+	}
+	if poolSize > 0 && !dryRun {
+		for i := range nodes {
+			pool, err := dialSession(nodes[i].url, tlsConfig)
+			panicOnError(err)
+			defer pool.Close()
+			pool.SetPoolLimit(poolSize)
+			nodes[i].pool = pool
+		}
+	}
+
+	var metricsExporter *flashback.MetricsExporter
+	if metricsAddr != "" {
+		metricsExporter = flashback.NewMetricsExporter()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metricsExporter)
+		go func() {
+			logger.Error("metrics server stopped: ", http.ListenAndServe(metricsAddr, mux))
+		}()
+	}
+
+	// On SIGINT/SIGTERM, stop handing out ops but let the in-flight ones finish,
+	// so that we still get the final report. A second signal exits immediately
+	// in case a worker is stuck.
+	stop := make(chan struct{})
+	// set once an op failed with fail_fast, which stops the replay
+	var failedFast int32
+	var stopOnce sync.Once
+	stopReplay := func() {
+		stopOnce.Do(func() {
+			close(stop)
+			// let the paused workers see the stop
+			pauser.Resume()
+		})
+	}
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Infof("Received %s, waiting for in-flight ops to finish", sig)
+		stopReplay()
+		sig = <-signals
+		logger.Errorf("Received %s again, exiting immediately", sig)
+		os.Exit(1)
+	}()
+
+	// SIGUSR1 pauses the replay, e.g. while taking a backup, and resumes it.
+	pauseSignals := make(chan os.Signal, 1)
+	signal.Notify(pauseSignals, syscall.SIGUSR1)
+	go func() {
+		for range pauseSignals {
+			if pauser.Toggle() {
+				logger.Info("Paused the replay, send SIGUSR1 again to resume")
+			} else {
+				logger.Infof("Resumed the replay, after being paused for %v overall", pauser.PausedFor())
+			}
+		}
+	}()
+
 	// Set up workers to do the job
-	exit := make(chan int)
-	opsExecuted := int64(0)
-	fetch := func(id int) {
+	var opTypeChans map[flashback.OpType]chan *flashback.Op
+	if opTypes := dedicatedOpTypes(); len(opTypes) > 0 || opRateLimiter != nil {
+		opTypeChans, opsChan = flashback.NewOpTypeOpsChans(opsChan, opTypes, opRateLimiter, stop)
+	}
+	workerOpsChans := make([]chan *flashback.Op, workers)
+	// the workers the ops are pinned to tell when they stop, so that their ops
+	// don't hold up the others
+	workerExits := make(chan int, workers)
+	if pinSessions {
+		workerOpsChans = flashback.NewSessionPinnedOpsChans(opsChan, workers, workerExits)
+	} else if preserveOrderPerNs {
+		workerOpsChans = flashback.NewNsPinnedOpsChans(opsChan, workers, workerExits)
+	} else if deterministicDispatch {
+		workerOpsChans = flashback.NewRoundRobinOpsChans(opsChan, workers, workerExits)
+	} else {
+		for i := range workerOpsChans {
+			workerOpsChans[i] = opsChan
+		}
+	}
+	// the dedicated workers come after the shared ones
+	for _, opType := range flashback.AllOpTypes {
+		for i := 0; i < *opTypeWorkers[opType] && opTypeChans != nil; i++ {
+			workerOpsChans = append(workerOpsChans, opTypeChans[opType])
+		}
+	}
+
+	dialWorkerSession := func(n node) (*mgo.Session, error) {
+		var session *mgo.Session
+		if n.pool != nil {
+			// the copies share the pool, and its limit
+			session = n.pool.Copy()
+		} else {
+			var err error
+			if session, err = dialSession(n.url, tlsConfig); err != nil {
+				return nil, err
+			}
+		}
+		session.SetSocketTimeout(socketTimeout)
+		if writeConcern != "" {
+			session.SetSafe(writeSafe)
+		}
+		if prewarmConnections {
+			mode := mgo.Primary
+			if readPreference != "" {
+				mode = readMode
+			}
+			if err := prewarmSession(session, mode); err != nil {
+				session.Close()
+				return nil, err
+			}
+			if n.pool != nil {
+				// the socket goes back to the shared pool, already connected
+				session.Refresh()
+			}
+		}
+		return session, nil
+	}
+
+	fetch := func(stats *workerStats, quit chan struct{}) {
+		id := stats.id
+		logger := logger.WithFields(flashback.Fields{"worker": id})
 		logger.Infof("Worker #%d report for duty\n", id)
 
 		workerStates := make([]nodeWorkerState, len(nodes))
+		// the sessions get replaced when re-dialing
+		defer func() {
+			for _, ws := range workerStates {
+				if ws.session != nil {
+					ws.session.Close()
+				}
+				if ws.exec != nil {
+					atomic.AddInt64(ws.node.droppedStats, ws.exec.DroppedStats())
+				}
+			}
+		}()
 
 		for i, n := range nodes {
-			dialInfo, err := mgo.ParseURL(n.url)
-			panicOnError(err)
-			session, err := mgo.DialWithInfo(dialInfo)
+			if dryRun {
+				exec := flashback.NewDryRunOpsExecutor(n.statsChan, logger)
+				exec.SetStatsAnalyzer(n.statsAnalyzer)
+				exec.SetGenericCommands(genericCommands)
+				workerStates[i] = nodeWorkerState{node: n, exec: exec}
+				continue
+			}
+
+			session, err := dialWorkerSession(n)
 			panicOnError(err)
-			session.SetSocketTimeout(time.Duration(socketTimeout))
-			defer session.Close()
+			exec := flashback.NewOpsExecutor(session, n.statsChan, logger.WithFields(flashback.Fields{"node": n.name}))
+			exec.SetStatsAnalyzer(n.statsAnalyzer)
+			exec.SetNsMapper(nsMapper)
+			exec.SetOpTransformer(opTransformer)
+			exec.SetMaxRetries(maxRetries)
+			if readPreference != "" {
+				exec.SetReadPreference(readMode)
+			}
+			exec.SetPreserveTimestamps(preserveTimestamps)
+			exec.SetDrainCursors(drainCursors)
+			exec.SetIgnoreDupKey(ignoreDupKey)
+			exec.SetOpTimeouts(socketTimeout, opTimeouts)
+			exec.SetOpBudget(opTimeout)
+			exec.SetGenericCommands(genericCommands)
+			exec.SetCursors(n.cursors)
+			exec.SetIndexChecker(n.indexChecker)
+			if n.readValidator != nil {
+				exec.SetReadValidator(n.readValidator)
+			}
+			if slowOpLog != nil {
+				exec.SetSlowOpLog(slowOpLog)
+			}
 			workerStates[i] = nodeWorkerState{
-				n.name,
-				session,
-				flashback.NewOpsExecutor(session, n.statsChan, logger),
+				node:    n,
+				session: session,
+				exec:    exec,
 			}
 		}
 
+		// redial replaces the session of a node whose ops keep failing, e.g.
+		// because the server restarted, backing off until it is back. It
+		// returns false if the worker got stopped in the meantime.
+		redial := func(ws *nodeWorkerState) bool {
+			logger := logger.WithFields(flashback.Fields{"node": ws.node.name})
+			logger.Errorf("[%s] %d ops in a row failed, re-dialing: %s", ws.node.name, ws.failures, ws.err)
+			ws.session.Close()
+			ws.session = nil
+			for attempt := 1; ; attempt++ {
+				session, err := dialWorkerSession(ws.node)
+				if err == nil {
+					logger.Infof("[%s] Re-dialed after %d attempt(s)", ws.node.name, attempt)
+					ws.session = session
+					ws.exec.SetSession(session)
+					ws.failures = 0
+					return true
+				}
+				backoff := redialBackoff(attempt)
+				logger.Errorf("[%s] Re-dialing failed, retrying in %v: %s", ws.node.name, backoff, err)
+				select {
+				case <-time.After(backoff):
+				case <-stop:
+					return false
+				case <-quit:
+					return false
+				}
+			}
+		}
+
+		// workers started via -control_addr have no pinned channel, but the
+		// sessions can't be pinned then anyway
+		opsChan := opsChan
+		if id < len(workerOpsChans) {
+			opsChan = workerOpsChans[id]
+		}
 		for {
-			op := <-opsChan
+			pauser.Wait()
+			var op *flashback.Op
+			select {
+			case op = <-opsChan:
+			case <-stop:
+			case <-quit:
+			}
 			if op == nil {
 				break
 			}
+			offset := op.Offset
 			op = flashback.CanonicalizeOp(op)
-			if op == nil {
+			if op == nil || op.Type == flashback.Command && !genericCommands {
+				if opsProgress != nil {
+					opsProgress.Done(offset)
+				}
 				continue
 			}
+			if inflightLimiter != nil {
+				inflightLimiter.Acquire()
+			}
 
 			var wg sync.WaitGroup
 			wg.Add(len(nodes))
+			// the worker stops once it isn't authorized to execute an op
+			unauthorized := int32(0)
 
-			execute := func(executor *flashback.OpsExecutor, name string) {
+			execute := func(ws *nodeWorkerState) {
 				defer wg.Done()
-				err := executor.Execute(op)
+				name := ws.node.name
+				err := ws.exec.Execute(op)
+				if ws.node.pool != nil {
+					// a session holds on to its socket, so hand it back to
+					// the shared pool for the other workers
+					ws.session.Refresh()
+				}
+				ws.err = err
 				if err != nil {
+					logger := logger.WithFields(flashback.Fields{"node": name, "op_type": op.Type})
+					if failFast && !failFastAllows(err) && atomic.CompareAndSwapInt32(&failedFast, 0, 1) {
+						logger.Errorf("[%s] Stopping the replay on the first failed op, see fail_fast - "+
+							"type:%s,database:%s,collection:%s,error:%s,op:%s", name, op.Type, op.Database,
+							op.Collection, err, flashback.FormatOp(op, maxLoggedOpLen))
+						stopReplay()
+					}
+					if errorDump != nil {
+						if err := errorDump.Dump(name, op, err); err != nil {
+							logger.Error("dumping the failed op failed: ", err)
+						}
+					}
 					if verbose == true {
 						logger.Error(fmt.Sprintf(
-							"[%s] error executing op - type:%s,database:%s,collection:%s,error:%s", name,
-							op.Type, op.Database, op.Collection, err))
+							"[%s] error executing op - type:%s,database:%s,collection:%s,error:%s,op:%s", name,
+							op.Type, op.Database, op.Collection, err, flashback.FormatOp(op, maxLoggedOpLen)))
 					} else if strings.HasPrefix(err.Error(), "not authorized") {
 						logger.Error(fmt.Sprintf(
 							"[%s] not authorized to execute op - type:%s,database:%s", name, op.Type,
 							op.Database))
-						exit <- 1
+						atomic.StoreInt32(&unauthorized, 1)
 					}
 				}
 			}
 
-			for _, ws := range workerStates {
-				go execute(ws.exec, ws.name)
+			for i := range workerStates {
+				go execute(&workerStates[i])
 			}
 			wg.Wait()
+			if inflightLimiter != nil {
+				inflightLimiter.Release()
+			}
+			if opsProgress != nil {
+				opsProgress.Done(offset)
+			}
 
-			if slowOpThresholdMs > 0 {
-				isSlow := func(latency time.Duration) bool {
-					return latency > time.Duration(slowOpThresholdMs)*time.Millisecond
+			redialed := true
+			for i := range workerStates {
+				ws := &workerStates[i]
+				if !flashback.IsConnectionError(ws.err) {
+					ws.failures = 0
+					continue
 				}
-				wasAnyOpSlow := false
-				for _, ws := range workerStates {
-					if isSlow(ws.exec.LastLatency()) {
-						wasAnyOpSlow = true
+				ws.failures++
+				if ws.session != nil && redialAfter > 0 && ws.failures >= redialAfter {
+					if redialed = redial(ws); !redialed {
 						break
 					}
 				}
-				if wasAnyOpSlow {
-					var timeOutput string
-					for _, ws := range workerStates {
-						timeOutput = fmt.Sprintf("%s %v (%s)", timeOutput, ws.exec.LastLatency(), ws.name)
-					}
-					logger.Infof(fmt.Sprintf("Slow op - %s\ntype:%s,database:%s,collection:%s",
-						timeOutput, op.Type, op.Database, op.Collection))
-				}
 			}
 
-			atomic.AddInt64(&opsExecuted, 1)
+			atomic.AddInt64(&stats.opsExecuted, 1)
+			atomic.StoreInt64(&stats.lastLatency, int64(workerStates[0].exec.LastLatency()))
+			if atomic.LoadInt32(&unauthorized) != 0 || !redialed {
+				break
+			}
+			if thinkTime > 0 {
+				select {
+				case <-time.After(thinkTime):
+				case <-stop:
+				case <-quit:
+				}
+			}
 		}
-		exit <- 1
 		logger.Infof("Worker #%d done!\n", id)
+		if id < workers {
+			workerExits <- id
+		}
+	}
+
+	pool := newWorkerPool(fetch)
+	replayStart := time.Now()
+	pool.scale(len(workerOpsChans))
+	if replayDuration > 0 {
+		// the time spent paused doesn't count towards the duration, so the
+		// timer is rearmed for what's left of it until none is
+		pausedBefore := pauser.PausedFor()
+		go func() {
+			for {
+				replayed := time.Now().Sub(replayStart) - (pauser.PausedFor() - pausedBefore)
+				if replayed >= replayDuration {
+					break
+				}
+				select {
+				case <-time.After(replayDuration - replayed):
+				case <-stop:
+					return
+				}
+			}
+			logger.Infof("Replayed for %v, waiting for in-flight ops to finish", replayDuration)
+			stopReplay()
+		}()
 	}
 
-	for i := 0; i < workers; i++ {
-		go fetch(i)
+	var controlServer *flashback.ControlServer
+	if controlAddr != "" {
+		controlServer = flashback.NewControlServer(pool, logger)
+		go func() {
+			logger.Error("control server stopped: ", http.ListenAndServe(controlAddr, controlServer))
+		}()
 	}
 
+	lastReport := time.Now()
 	report := func() {
+		if pauser.Paused() {
+			logger.Info("The replay is paused, send SIGUSR1 to resume")
+		}
+		if opsProgress != nil {
+			offset, _ := opsProgress.Resume()
+			logger.Infof("The ops before offset %d are done, see resume_from_offset", offset)
+		}
+		queued, capacity, blocked := dispatchMeter.Sample()
+		logger.Infof("Dispatch - %d of %d ops queued for the workers, blocked on them %.2f%% of the interval",
+			queued, capacity, blocked*100)
 		printStatus := func(status *flashback.ExecutionStatus, statsOut *os.File, name string) {
+			if status.WarmingUp {
+				logger.Infof("[%s] Warming up, the stats aren't collected yet", name)
+				return
+			}
 			logger.Infof("[%s] Executed %d ops (%d in interval), got %d errors (%d in interval), "+
-				"%.2f ops/sec (total), %.2f ops/sec (interval)", name, status.OpsExecuted, status.IntervalOpsExecuted,
-				status.OpsErrors, status.IntervalOpsErrors, status.OpsPerSec, status.IntervalOpsPerSec)
+				"%.2f ops/sec (total), %.2f ops/sec (interval), %.2f ops/sec (smoothed)", name, status.OpsExecuted,
+				status.IntervalOpsExecuted, status.OpsErrors, status.IntervalOpsErrors, status.OpsPerSec,
+				status.IntervalOpsPerSec, status.SmoothedOpsPerSec)
 
 			var statsLineOutput string
 			if statsOut != nil {
@@ -391,18 +2460,45 @@ func main() {
 				statsLineOutput = fmt.Sprintf("%s,%d,%.2f", timestamp, status.IntervalOpsExecuted, status.IntervalOpsPerSec)
 			}
 
+			if status.OpsErrors > 0 {
+				var errorsOutput []string
+				for _, category := range flashback.AllErrorCategories {
+					errorsOutput = append(errorsOutput, fmt.Sprintf("%s: %d (%d in interval)", category,
+						status.ErrorCounts[category], status.IntervalErrorCounts[category]))
+				}
+				logger.Infof("  Errors - %s", strings.Join(errorsOutput, ", "))
+			}
+
+			if status.Progress >= 0 {
+				eta := "unknown"
+				if status.Progress > 0 {
+					eta = (status.ETA / time.Second * time.Second).String()
+				}
+				logger.Infof("  Progress: %.1f%%, ETA: %s", status.Progress*100, eta)
+			}
+			if c := status.Connections; c != nil {
+				logger.Infof("  Connections (all urls) - sockets alive: %d, in use: %d, session refs: %d, "+
+					"connections made: %d to primaries, %d to secondaries", c.SocketsAlive, c.SocketsInUse,
+					c.SocketRefs, c.MasterConns, c.SlaveConns)
+			}
+
+			if reportTable {
+				reportOpTypesTable(status)
+			}
 			for _, opType := range flashback.AllOpTypes {
-				latencies := status.Latencies[opType]
-				intervalLatencies := status.IntervalLatencies[opType]
-				logger.Infof("  Op type: %s, count: %d, interval count %d, avg ops/sec: %.2f, interval ops/sec: %.2f",
-					opType, status.Counts[opType], status.IntervalCounts[opType],
-					status.TypeOpsSec[opType], status.IntervalTypeOpsSec[opType])
-				template := "   %s: P50: %.2fms, P70: %.2fms, P90: %.2fms, P95 %.2fms, P99 %.2fms, Max %.2fms\n"
-				logger.Infof(template, "Total", latencies[flashback.P50], latencies[flashback.P70], latencies[flashback.P90],
-					latencies[flashback.P95], latencies[flashback.P99], status.MaxLatency[opType])
-				logger.Infof(template, "Interval", intervalLatencies[flashback.P50], intervalLatencies[flashback.P70],
-					intervalLatencies[flashback.P90], intervalLatencies[flashback.P95], intervalLatencies[flashback.P99],
-					status.IntervalMaxLatency[opType])
+				if !reportTable {
+					latencies := status.Latencies[opType]
+					intervalLatencies := status.IntervalLatencies[opType]
+					logger.Infof("  Op type: %s, count: %d, interval count %d, avg ops/sec: %.2f, interval ops/sec: %.2f",
+						opType, status.Counts[opType], status.IntervalCounts[opType],
+						status.TypeOpsSec[opType], status.IntervalTypeOpsSec[opType])
+					logger.Info(formatLatencies("Total", status, latencies, status.MaxLatency[opType]))
+					logger.Info(formatLatencies("Interval", status, intervalLatencies, status.IntervalMaxLatency[opType]))
+					if status.WindowLatencies != nil {
+						logger.Info(formatLatencies("Last "+status.Window.String(), status,
+							status.WindowLatencies[opType], status.WindowMaxLatency[opType]))
+					}
+				}
 
 				if statsOut != nil {
 					statsLineOutput = fmt.Sprintf("%s,%d,%.2f", statsLineOutput,
@@ -410,35 +2506,214 @@ func main() {
 				}
 			}
 
+			if len(status.CommandCounts) > 0 {
+				names := make([]string, 0, len(status.CommandCounts))
+				for name := range status.CommandCounts {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				var commandsOutput []string
+				for _, name := range names {
+					commandsOutput = append(commandsOutput, fmt.Sprintf("%s: %d (max %.2fms)", name,
+						status.CommandCounts[name], status.CommandMaxLatency[name]))
+				}
+				logger.Infof("  Commands - %s", strings.Join(commandsOutput, ", "))
+			}
+
+			if perNsStats {
+				namespaces := make([]string, 0, len(status.NsCounts))
+				for ns := range status.NsCounts {
+					namespaces = append(namespaces, ns)
+				}
+				sort.Strings(namespaces)
+				for _, ns := range namespaces {
+					latencies := status.NsLatencies[ns]
+					intervalLatencies := status.NsIntervalLatencies[ns]
+					logger.Infof("  Namespace: %s, count: %d, interval count %d",
+						ns, status.NsCounts[ns], status.NsIntervalCounts[ns])
+					logger.Info(formatLatencies("Total", status, latencies, status.NsMaxLatency[ns]))
+					logger.Info(formatLatencies("Interval", status, intervalLatencies, status.NsIntervalMaxLatency[ns]))
+				}
+			}
+
 			// Write stats to disk at each interval for analysis later
 			// Format is:
 			// time,  ops, ops/sec, insert ops, inserts/sec, update ops, update/sec, remove ops, remove/sec,
-			// query ops, query/sec, count ops, count/sec, fam ops, fam/sec
+			// query ops, query/sec, count ops, count/sec, fam ops, fam/sec, getmore ops, getmore/sec,
+			// aggregate ops, aggregate/sec, distinct ops, distinct/sec
 			if statsOut != nil {
 				statsOut.WriteString(statsLineOutput + "\n")
 			}
 		}
 
 		for _, n := range nodes {
-			printStatus(n.statsAnalyzer.GetStatus(), n.statsFile, n.name)
+			status := n.statsAnalyzer.GetStatus()
+			printStatus(status, n.statsFile, n.name)
+			if metricsExporter != nil {
+				metricsExporter.Update(n.name, status)
+			}
+			if controlServer != nil {
+				controlServer.Update(n.name, status)
+			}
+		}
+
+		if latencyCSV != nil {
+			if err := latencyCSV.Flush(); err != nil {
+				logger.Error("writing the latency csv failed: ", err)
+			}
+		}
+
+		if verboseWorkers {
+			now := time.Now()
+			reportWorkers(pool.stats(), now.Sub(lastReport))
+			lastReport = now
 		}
 	}
 
-	reportTicker := time.NewTicker(5 * time.Second)
-	// Periodically report execution status
-	go func() {
-		for range reportTicker.C {
-			report()
+	sampleTimeSeries := func() {
+		elapsedSec := float64(time.Now().Sub(replayStart)) / float64(time.Second)
+		for _, n := range nodes {
+			timeSeries.Write(elapsedSec, n.name, n.statsAnalyzer.SampleTimeSeries())
 		}
-	}()
+		if err := timeSeries.Flush(); err != nil {
+			logger.Error("writing the time series failed: ", err)
+		}
+	}
 
-	// Wait for workers
-	received := 0
-	for received < workers {
-		<-exit
-		received += 1
+	// Periodically report execution status until all the workers are done,
+	// whether or not maxOps was reached
+	var reportTicks, timeSeriesTicks, checkpointTicks <-chan time.Time
+	if reportInterval > 0 && !quiet {
+		reportTicker := time.NewTicker(reportInterval)
+		defer reportTicker.Stop()
+		reportTicks = reportTicker.C
+	}
+	if timeSeries != nil {
+		timeSeriesTicker := time.NewTicker(time.Second)
+		defer timeSeriesTicker.Stop()
+		timeSeriesTicks = timeSeriesTicker.C
+	}
+	if checkpointFilename != "" {
+		checkpointTicker := time.NewTicker(checkpointInterval)
+		defer checkpointTicker.Stop()
+		checkpointTicks = checkpointTicker.C
+	}
+	for workersDone := false; !workersDone; {
+		select {
+		case <-reportTicks:
+			report()
+		case <-timeSeriesTicks:
+			sampleTimeSeries()
+		case <-checkpointTicks:
+			writeCheckpoint()
+		case <-pool.Done():
+			workersDone = true
+		}
 	}
-	reportTicker.Stop()
 	// report one last time
+	if timeSeries != nil {
+		sampleTimeSeries()
+	}
+	if checkpointFilename != "" {
+		writeCheckpoint()
+	}
 	report()
+	if len(nodes) > 1 {
+		reportComparison(nodes)
+	}
+	for _, n := range nodes {
+		if dropped := atomic.LoadInt64(n.droppedStats); dropped > 0 {
+			logger.Warnf("[%s] The latencies of %d ops were dropped because their analysis fell behind, "+
+				"so the percentiles above leave them out (the ops and their errors are counted)", n.name, dropped)
+		}
+		if n.readValidator != nil {
+			logger.Infof("[%s] %d of the %d queries validated didn't return the recorded result", n.name,
+				n.readValidator.Mismatches(), n.readValidator.Validated())
+		}
+	}
+
+	if fractionReader != nil && fractionReader.OpsSeen() > 0 {
+		logger.Infof("Replayed %d of the %d ops read (%.2f%%)", fractionReader.OpsKept(),
+			fractionReader.OpsSeen(), float64(fractionReader.OpsKept())*100/float64(fractionReader.OpsSeen()))
+	}
+	if opRateLimiter != nil {
+		limits, rates := opRateLimiter.Limits(), opRateLimiter.Rates()
+		for _, opType := range flashback.AllOpTypes {
+			if limit, ok := limits[opType]; ok {
+				logger.Infof("Replayed the %s ops at %.2f ops/sec, limited to %.2f", opType, rates[opType], limit)
+			}
+		}
+	}
+	if targetRps > 0 && dispatchStatus != nil {
+		logger.Infof("Dispatched the ops at %.2f ops/sec on average, targeting %.2f", dispatchStatus.Rate(), targetRps)
+	}
+	if staleReader != nil && staleReader.StaleOps() > 0 {
+		logger.Infof("Skipped %d ops recorded more than %v ago", staleReader.StaleOps(), maxOpAge)
+	}
+	if sizeLimitedReader != nil && sizeLimitedReader.OversizedOps() > 0 {
+		action := "Skipped"
+		if keepOversizedOps {
+			action = "Replayed"
+		}
+		logger.Errorf("%s %d ops larger than %d bytes", action, sizeLimitedReader.OversizedOps(), maxOpSize)
+	}
+	reportReader(time.Now().Sub(replayStart))
+	if malformed, ok := opsReader.(interface {
+		MalformedOps() int
+	}); ok && malformed.MalformedOps() > 0 {
+		logger.Errorf("Skipped %d malformed ops", malformed.MalformedOps())
+	}
+	if err := opsReader.Err(); strict && err != nil && err != io.EOF {
+		logger.Errorf("The replay stopped early: %s", err)
+		logger.Close()
+		os.Exit(1)
+	}
+	if dispatchStatus != nil && dispatchStatus.Err != nil {
+		logger.Errorf("The replay stopped early: %s", dispatchStatus.Err)
+		logger.Close()
+		os.Exit(1)
+	}
+
+	if statsJSONFilename != "" {
+		summaries := make(map[string]*flashback.StatsSummary)
+		for _, n := range nodes {
+			summaries[n.name] = n.statsAnalyzer.GetStatus().Summary()
+		}
+		encoded, err := json.MarshalIndent(summaries, "", "  ")
+		panicOnError(err)
+		panicOnError(ioutil.WriteFile(statsJSONFilename, append(encoded, '\n'), 0666))
+	}
+
+	if hdrOutput != "" {
+		hdrFile, err := os.Create(hdrOutput)
+		panicOnError(err)
+		hdrLog := hdrhistogram.NewHistogramLogWriter(hdrFile)
+		panicOnError(hdrLog.OutputLogFormatVersion())
+		panicOnError(hdrLog.OutputLegend())
+		for _, n := range nodes {
+			panicOnError(n.statsAnalyzer.WriteHistograms(hdrLog, n.name+":"))
+		}
+		panicOnError(hdrFile.Close())
+	}
+
+	if atomic.LoadInt32(&failedFast) == 1 {
+		logger.Error("The replay stopped early on a failed op, see fail_fast")
+		logger.Close()
+		os.Exit(1)
+	}
+
+	if failOnErrorRate >= 0 {
+		failed := false
+		for _, n := range nodes {
+			if errorRate := n.statsAnalyzer.GetStatus().ErrorRate(); errorRate > failOnErrorRate {
+				logger.Errorf("[%s] %.2f%% of the ops failed, which exceeds the allowed %.2f%%",
+					n.name, errorRate, failOnErrorRate)
+				failed = true
+			}
+		}
+		if failed {
+			logger.Close()
+			os.Exit(1)
+		}
+	}
 }
@@ -0,0 +1,112 @@
+package flashback
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// WorkerScaler is what the ControlServer scales the replay with
+type WorkerScaler interface {
+	// Workers returns the number of running workers
+	Workers() int
+	// SetWorkers starts or stops workers until the given number of them run.
+	// Stopped workers finish their in-flight op first.
+	SetWorkers(workers int) error
+}
+
+// ControlServer lets the replay be inspected and adjusted over HTTP while it
+// runs, e.g. to ramp the concurrency up until the latencies degrade:
+//   - GET /status returns the workers count and the stats of each node
+//   - GET /workers returns the workers count
+//   - POST /workers?count=N scales the replay to N workers
+//
+// Like the MetricsExporter, it serves the snapshots handed over via Update
+// rather than calling GetStatus, which would reset the interval stats.
+type ControlServer struct {
+	mutex    sync.Mutex
+	scaler   WorkerScaler
+	statuses map[string]*ExecutionStatus
+	mux      *http.ServeMux
+	logger   *Logger
+}
+
+type controlStatus struct {
+	Workers int                      `json:"workers"`
+	Nodes   map[string]*StatsSummary `json:"nodes,omitempty"`
+}
+
+func NewControlServer(scaler WorkerScaler, logger *Logger) *ControlServer {
+	c := &ControlServer{
+		scaler:   scaler,
+		statuses: make(map[string]*ExecutionStatus),
+		mux:      http.NewServeMux(),
+		logger:   logger,
+	}
+	c.mux.HandleFunc("/status", c.serveStatus)
+	c.mux.HandleFunc("/workers", c.serveWorkers)
+	return c
+}
+
+// Update replaces the snapshot served for the given node
+func (c *ControlServer) Update(node string, status *ExecutionStatus) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.statuses[node] = status
+}
+
+func (c *ControlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mux.ServeHTTP(w, r)
+}
+
+func (c *ControlServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.mutex.Lock()
+	status := controlStatus{
+		Workers: c.scaler.Workers(),
+		Nodes:   make(map[string]*StatsSummary, len(c.statuses)),
+	}
+	for node, nodeStatus := range c.statuses {
+		status.Nodes[node] = nodeStatus.Summary()
+	}
+	c.mutex.Unlock()
+	writeJSON(w, status)
+}
+
+func (c *ControlServer) serveWorkers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		count, err := strconv.Atoi(r.FormValue("count"))
+		if err != nil || count < 1 {
+			http.Error(w, fmt.Sprintf("count should be a positive number, got %q", r.FormValue("count")),
+				http.StatusBadRequest)
+			return
+		}
+		if err := c.scaler.SetWorkers(count); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		c.logger.Infof("Scaled the replay to %d workers", count)
+	default:
+		http.Error(w, "only GET and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, controlStatus{Workers: c.scaler.Workers()})
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(encoded, '\n'))
+}
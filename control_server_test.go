@@ -0,0 +1,84 @@
+package flashback
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+type mockScaler struct {
+	workers int
+	err     error
+}
+
+func (s *mockScaler) Workers() int {
+	return s.workers
+}
+
+func (s *mockScaler) SetWorkers(workers int) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.workers = workers
+	return nil
+}
+
+func TestControlServer(t *testing.T) {
+	t.Parallel()
+
+	logger, _ := NewLogger("", "")
+	scaler := &mockScaler{workers: 10}
+	server := NewControlServer(scaler, logger)
+	status := &ExecutionStatus{
+		OpsExecuted: 42,
+		OpsErrors:   3,
+		Latencies:   make(map[OpType][]float64),
+	}
+	for _, opType := range AllOpTypes {
+		status.Latencies[opType] = make([]float64, len(latencyPercentiles))
+	}
+	server.Update("default", status)
+
+	serve := func(method string, url string) (int, controlStatus) {
+		request, err := http.NewRequest(method, url, nil)
+		ensure.Nil(t, err)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		var status controlStatus
+		if recorder.Code == http.StatusOK {
+			ensure.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+		}
+		return recorder.Code, status
+	}
+
+	code, served := serve("GET", "/status")
+	ensure.DeepEqual(t, code, http.StatusOK)
+	ensure.DeepEqual(t, served.Workers, 10)
+	ensure.DeepEqual(t, served.Nodes["default"].OpsExecuted, int64(42))
+	ensure.DeepEqual(t, served.Nodes["default"].OpsErrors, int64(3))
+
+	code, served = serve("POST", "/workers?count=25")
+	ensure.DeepEqual(t, code, http.StatusOK)
+	ensure.DeepEqual(t, served.Workers, 25)
+	ensure.DeepEqual(t, scaler.workers, 25)
+
+	code, served = serve("GET", "/workers")
+	ensure.DeepEqual(t, code, http.StatusOK)
+	ensure.DeepEqual(t, served.Workers, 25)
+
+	code, _ = serve("POST", "/workers?count=0")
+	ensure.DeepEqual(t, code, http.StatusBadRequest)
+	code, _ = serve("POST", "/workers?count=many")
+	ensure.DeepEqual(t, code, http.StatusBadRequest)
+	code, _ = serve("DELETE", "/workers")
+	ensure.DeepEqual(t, code, http.StatusMethodNotAllowed)
+
+	scaler.err = errors.New("can't scale")
+	code, _ = serve("POST", "/workers?count=5")
+	ensure.DeepEqual(t, code, http.StatusConflict)
+	ensure.DeepEqual(t, scaler.workers, 25)
+}
@@ -0,0 +1,101 @@
+package flashback
+
+import (
+	"sync"
+
+	"gopkg.in/mgo.v2"
+)
+
+const (
+	// the number of docs the server returns in the first batch of a query,
+	// unless told otherwise
+	defaultFirstBatchSize = 101
+	// past that many open cursors, the ones that aren't drained anymore (e.g.
+	// because their getmores got filtered out) start getting closed
+	maxOpenCursors = 1000
+)
+
+// Cursors keeps track of the cursors opened by the replayed queries, by the
+// id of the cursor they opened when recorded, so that the recorded getmores
+// can fetch the next batches from them.
+//
+// The getmores of a query are usually executed by other workers than the
+// query itself, so the executors of a node should all share the same Cursors.
+// A getmore executed before its query is done finds no cursor and is skipped.
+type Cursors struct {
+	mutex   sync.Mutex
+	cursors map[int64]*cursor
+}
+
+type cursor struct {
+	// only one batch at a time is fetched from the iter
+	mutex     sync.Mutex
+	iter      *mgo.Iter
+	batchSize int
+}
+
+func NewCursors() *Cursors {
+	return &Cursors{cursors: make(map[int64]*cursor)}
+}
+
+func (c *Cursors) add(cursorId int64, iter *mgo.Iter, batchSize int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.cursors) >= maxOpenCursors {
+		// the map is iterated in random order, so that's a random one
+		for id, evicted := range c.cursors {
+			evicted.iter.Close()
+			delete(c.cursors, id)
+			break
+		}
+	}
+	c.cursors[cursorId] = &cursor{iter: iter, batchSize: batchSize}
+}
+
+func (c *Cursors) get(cursorId int64) *cursor {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.cursors[cursorId]
+}
+
+func (c *Cursors) remove(cursorId int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.cursors, cursorId)
+}
+
+// Len returns the number of open cursors
+func (c *Cursors) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.cursors)
+}
+
+// Close closes all the open cursors
+func (c *Cursors) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for id, cursor := range c.cursors {
+		cursor.iter.Close()
+		delete(c.cursors, id)
+	}
+}
+
+// fetchBatch reads the next batchSize docs from the iter, or the next
+// defaultFirstBatchSize ones if batchSize isn't positive. It returns whether
+// the iter is exhausted.
+func fetchBatch(iter *mgo.Iter, batchSize int) ([]Document, bool) {
+	if batchSize <= 0 {
+		batchSize = defaultFirstBatchSize
+	}
+	result := []Document{}
+	for len(result) < batchSize {
+		var doc Document
+		if !iter.Next(&doc) {
+			return result, true
+		}
+		result = append(result, doc)
+	}
+	return result, false
+}
@@ -0,0 +1,142 @@
+package flashback
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// OpJSON renders the op as a JSON object, with the same field names as in the
+// ops files, e.g. for the logs.
+func OpJSON(op *Op) ([]byte, error) {
+	doc := bson.D{{"ns", op.Ns}, {"ts", op.Timestamp}, {"op", op.Type}}
+	optional := []struct {
+		name  string
+		value interface{}
+		set   bool
+	}{
+		{"ntoskip", op.NToSkip, op.NToSkip != 0},
+		{"ntoreturn", op.NToReturn, op.NToReturn != 0},
+		{"query", op.QueryDoc, op.QueryDoc != nil},
+		{"command", op.CommandDoc, op.CommandDoc != nil},
+		{"o", op.InsertDoc, op.InsertDoc != nil},
+		{"updateobj", op.UpdateDoc, op.UpdateDoc != nil},
+		{"session_id", op.SessionId, op.SessionId != ""},
+		{"cursorid", op.CursorId, op.CursorId != 0},
+		{"upsert", op.Upsert, op.Upsert},
+		{"multi", op.Multi, op.Multi},
+	}
+	for _, field := range optional {
+		if field.set {
+			doc = append(doc, bson.DocElem{Name: field.name, Value: field.value})
+		}
+	}
+	return json.Marshal(jsonDoc(doc))
+}
+
+// FormatOp renders the op as JSON, truncated to about maxLen characters
+func FormatOp(op *Op, maxLen int) string {
+	encoded, err := OpJSON(op)
+	if err != nil {
+		return "<" + err.Error() + ">"
+	}
+	if len(encoded) > maxLen {
+		return string(encoded[:maxLen]) + "..."
+	}
+	return string(encoded)
+}
+
+// jsonDoc renders a bson.D as a JSON object, keeping the order of its fields
+type jsonDoc bson.D
+
+func (d jsonDoc) MarshalJSON() ([]byte, error) {
+	var out bytes.Buffer
+	out.WriteByte('{')
+	for i, elem := range d {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		name, err := json.Marshal(elem.Name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(jsonValue(elem.Value))
+		if err != nil {
+			return nil, err
+		}
+		out.Write(name)
+		out.WriteByte(':')
+		out.Write(value)
+	}
+	out.WriteByte('}')
+	return out.Bytes(), nil
+}
+
+func jsonValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case bson.D:
+		return jsonDoc(value)
+	case bson.M:
+		converted := make(map[string]interface{}, len(value))
+		for name, elem := range value {
+			converted[name] = jsonValue(elem)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(value))
+		for i, elem := range value {
+			converted[i] = jsonValue(elem)
+		}
+		return converted
+	}
+	return value
+}
+
+// ErrorDump appends the ops that failed to a file, one JSON object per line,
+// for later inspection. It stops once maxEntries ops were dumped, so that a
+// replay failing across the board doesn't fill the disk.
+type ErrorDump struct {
+	mutex      sync.Mutex
+	out        io.Writer
+	maxEntries int
+	entries    int
+}
+
+type errorDumpEntry struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Node      string          `json:"node"`
+	Error     string          `json:"error"`
+	Op        json.RawMessage `json:"op"`
+}
+
+func NewErrorDump(out io.Writer, maxEntries int) *ErrorDump {
+	return &ErrorDump{out: out, maxEntries: maxEntries}
+}
+
+// Dump appends the op that failed against the given node, unless the dump is
+// full already. It is safe to call from several workers.
+func (d *ErrorDump) Dump(node string, op *Op, opErr error) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.entries >= d.maxEntries {
+		return nil
+	}
+
+	encodedOp, err := OpJSON(op)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(errorDumpEntry{time.Now(), node, opErr.Error(), encodedOp})
+	if err != nil {
+		return err
+	}
+	if _, err = d.out.Write(append(encoded, '\n')); err != nil {
+		return err
+	}
+	d.entries++
+	return nil
+}
@@ -0,0 +1,53 @@
+package flashback
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestOpJSON(t *testing.T) {
+	op := &Op{
+		Ns:        "db.c1",
+		Timestamp: time.Unix(1396456709, 0).UTC(),
+		Type:      Query,
+		QueryDoc:  bson.D{{"b", 1}, {"a", bson.D{{"$in", []interface{}{"x", bson.D{{"c", true}}}}}}},
+		NToSkip:   2,
+	}
+	encoded, err := OpJSON(op)
+	ensure.Nil(t, err)
+	// the fields keep their order
+	ensure.DeepEqual(t, string(encoded), `{"ns":"db.c1","ts":"2014-04-02T16:38:29Z","op":"query",`+
+		`"ntoskip":2,"query":{"b":1,"a":{"$in":["x",{"c":true}]}}}`)
+
+	formatted := FormatOp(op, 20)
+	ensure.DeepEqual(t, formatted, `{"ns":"db.c1","ts":"...`)
+}
+
+func TestErrorDump(t *testing.T) {
+	var out bytes.Buffer
+	dump := NewErrorDump(&out, 2)
+	op := &Op{Ns: "db.c1", Type: Insert, InsertDoc: bson.D{{"_id", 1}}}
+	for i := 0; i < 3; i++ {
+		ensure.Nil(t, dump.Dump("default", op, errors.New("E11000 duplicate key error")))
+	}
+
+	// capped at 2 entries
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	ensure.DeepEqual(t, len(lines), 2)
+	var entry struct {
+		Node  string
+		Error string
+		Op    map[string]interface{}
+	}
+	ensure.Nil(t, json.Unmarshal([]byte(lines[0]), &entry))
+	ensure.DeepEqual(t, entry.Node, "default")
+	ensure.DeepEqual(t, entry.Error, "E11000 duplicate key error")
+	ensure.DeepEqual(t, entry.Op["o"], map[string]interface{}{"_id": float64(1)})
+}
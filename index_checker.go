@@ -0,0 +1,226 @@
+package flashback
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The kinds of indexes some query operators can't run without
+const (
+	textIndex = "text"
+	geoIndex  = "geospatial"
+)
+
+// IndexChecker warns, once per namespace, about the replayed ops that use
+// query operators requiring an index the target collection doesn't have:
+// $text requires a text index, and $near, $nearSphere and $geoNear a 2d or
+// 2dsphere index. Such ops would otherwise all fail, with nothing but the
+// error counts to tell why.
+//
+// The ops are best checked before the replay starts, by passing them all to
+// Require in a first pass, then calling CheckRequired. When they can't be
+// read twice, the executors check them with Check as they go instead, in
+// which case the executors of a node should all share the same IndexChecker,
+// so that each collection only gets checked once.
+type IndexChecker struct {
+	mutex  sync.Mutex
+	logger *Logger
+	// the namespaces and index kinds already checked
+	checked map[string]bool
+	// the namespaces the ops passed to Require need indexes on
+	required map[string]*nsIndexes
+}
+
+// nsIndexes are the number of ops needing each kind of index on a collection
+type nsIndexes struct {
+	database   string
+	collection string
+	ops        map[string]int64
+}
+
+func NewIndexChecker(logger *Logger) *IndexChecker {
+	return &IndexChecker{
+		logger:   logger,
+		checked:  make(map[string]bool),
+		required: make(map[string]*nsIndexes),
+	}
+}
+
+// Require counts the kinds of indexes the op needs on the collection it is
+// run against, for CheckRequired
+func (c *IndexChecker) Require(op *Op, database string, collection string) {
+	kinds := requiredIndexes(op)
+	if len(kinds) == 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ns := database + "." + collection
+	required, ok := c.required[ns]
+	if !ok {
+		required = &nsIndexes{database: database, collection: collection, ops: make(map[string]int64)}
+		c.required[ns] = required
+	}
+	for _, kind := range kinds {
+		required.ops[kind]++
+	}
+}
+
+// CheckRequired looks up the indexes of the collections the ops passed to
+// Require are run against, using the given session, and warns about the
+// missing ones, in the order of the namespaces. It returns how many of the
+// ops will fail for lack of an index.
+func (c *IndexChecker) CheckRequired(session *mgo.Session) int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	namespaces := make([]string, 0, len(c.required))
+	for ns := range c.required {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
+	failing := int64(0)
+	for _, ns := range namespaces {
+		required := c.required[ns]
+		indexes, err := session.DB(required.database).C(required.collection).Indexes()
+		if err != nil && !isNsNotFound(err) {
+			c.logger.Errorf("Could not check the indexes of %s: %s", ns, err)
+			continue
+		}
+		for _, kind := range []string{textIndex, geoIndex} {
+			ops, ok := required.ops[kind]
+			if !ok {
+				continue
+			}
+			c.checked[ns+":"+kind] = true
+			if !hasIndex(indexes, kind) {
+				c.logger.Warnf("%s has no %s index, which %d of the ops to replay need: they will fail",
+					ns, kind, ops)
+				failing += ops
+			}
+		}
+	}
+	return failing
+}
+
+// Check looks up the indexes of the collection the op is run against, using
+// the given session, the first time an op needing a given kind of index is
+// run against it.
+func (c *IndexChecker) Check(session *mgo.Session, op *Op, database string, collection string) {
+	kinds := requiredIndexes(op)
+	if len(kinds) == 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ns := database + "." + collection
+	var toCheck []string
+	for _, kind := range kinds {
+		if !c.checked[ns+":"+kind] {
+			c.checked[ns+":"+kind] = true
+			toCheck = append(toCheck, kind)
+		}
+	}
+	if len(toCheck) == 0 {
+		return
+	}
+
+	indexes, err := session.DB(database).C(collection).Indexes()
+	if err != nil && !isNsNotFound(err) {
+		c.logger.Errorf("Could not check the indexes of %s: %s", ns, err)
+		return
+	}
+	for _, kind := range toCheck {
+		if !hasIndex(indexes, kind) {
+			c.logger.Warnf("%s has no %s index, which the replayed %s ops need: they will fail",
+				ns, kind, op.Type)
+		}
+	}
+}
+
+func isNsNotFound(err error) bool {
+	if queryErr, ok := err.(*mgo.QueryError); ok {
+		return queryErr.Code == 26 || strings.Contains(queryErr.Message, "ns not found")
+	}
+	return strings.Contains(err.Error(), "ns not found")
+}
+
+// hasIndex tells whether one of the indexes is of the given kind. mgo prefixes
+// the keys of the special indexes with their type, e.g. "$text:title".
+func hasIndex(indexes []mgo.Index, kind string) bool {
+	for _, index := range indexes {
+		for _, key := range index.Key {
+			switch {
+			case kind == textIndex && strings.HasPrefix(key, "$text:"):
+				return true
+			case kind == geoIndex && (strings.HasPrefix(key, "$2d:") || strings.HasPrefix(key, "$2dsphere:")):
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requiredIndexes returns the kinds of indexes the op can't run without
+func requiredIndexes(op *Op) []string {
+	var docs []interface{}
+	switch op.Type {
+	case Query, Update, Remove:
+		docs = append(docs, op.QueryDoc)
+	case Count, FindAndModify, Distinct:
+		if query, ok := GetElem(op.CommandDoc, "query"); ok {
+			docs = append(docs, query)
+		}
+	case Aggregate:
+		if pipeline, ok := GetElem(op.CommandDoc, "pipeline"); ok {
+			docs = append(docs, pipeline)
+		}
+	}
+
+	found := make(map[string]bool)
+	for _, doc := range docs {
+		findIndexOperators(doc, found)
+	}
+	var kinds []string
+	for _, kind := range []string{textIndex, geoIndex} {
+		if found[kind] {
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds
+}
+
+// findIndexOperators walks the value, flagging the kinds of indexes its
+// operators require
+func findIndexOperators(value interface{}, found map[string]bool) {
+	check := func(name string, value interface{}) {
+		switch name {
+		case "$text":
+			found[textIndex] = true
+		case "$near", "$nearSphere", "$geoNear":
+			found[geoIndex] = true
+		}
+		findIndexOperators(value, found)
+	}
+
+	switch value := value.(type) {
+	case bson.D:
+		for _, elem := range value {
+			check(elem.Name, elem.Value)
+		}
+	case bson.M:
+		for name, elem := range value {
+			check(name, elem)
+		}
+	case []interface{}:
+		for _, elem := range value {
+			findIndexOperators(elem, found)
+		}
+	}
+}
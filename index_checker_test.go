@@ -0,0 +1,64 @@
+package flashback
+
+import (
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRequiredIndexes(t *testing.T) {
+	text := bson.D{{"$text", bson.D{{"$search", "coffee"}}}}
+	near := bson.D{{"loc", bson.D{{"$nearSphere", bson.D{{"$geometry", bson.M{"type": "Point"}}}}}}}
+	within := bson.D{{"loc", bson.D{{"$geoWithin", bson.D{{"$centerSphere", []interface{}{}}}}}}}
+
+	ensure.DeepEqual(t, len(requiredIndexes(&Op{Type: Query, QueryDoc: bson.D{{"a", 1}}})), 0)
+	ensure.DeepEqual(t, requiredIndexes(&Op{Type: Query, QueryDoc: text}), []string{textIndex})
+	ensure.DeepEqual(t, requiredIndexes(&Op{Type: Remove, QueryDoc: near}), []string{geoIndex})
+	ensure.DeepEqual(t, len(requiredIndexes(&Op{Type: Query, QueryDoc: within})), 0)
+	ensure.DeepEqual(t, requiredIndexes(&Op{Type: Query, QueryDoc: bson.D{{"$or", []interface{}{text, near}}}}),
+		[]string{textIndex, geoIndex})
+	ensure.DeepEqual(t, requiredIndexes(&Op{Type: Count, CommandDoc: bson.D{{"count", "c1"}, {"query", text}}}),
+		[]string{textIndex})
+	pipeline := []interface{}{bson.D{{"$geoNear", bson.D{{"near", []interface{}{0, 0}}}}}}
+	ensure.DeepEqual(t, requiredIndexes(&Op{Type: Aggregate, CommandDoc: bson.D{{"aggregate", "c1"},
+		{"pipeline", pipeline}}}), []string{geoIndex})
+	// inserted documents aren't queries
+	ensure.DeepEqual(t, len(requiredIndexes(&Op{Type: Insert, InsertDoc: text})), 0)
+}
+
+func TestHasIndex(t *testing.T) {
+	indexes := []mgo.Index{{Key: []string{"_id"}}, {Key: []string{"$2dsphere:loc", "a"}}}
+	ensure.True(t, hasIndex(indexes, geoIndex))
+	ensure.False(t, hasIndex(indexes, textIndex))
+	indexes = append(indexes, mgo.Index{Key: []string{"$text:title", "$text:body"}})
+	ensure.True(t, hasIndex(indexes, textIndex))
+}
+
+func TestCheckRequired(t *testing.T) {
+	test_db := "test_db_for_index_checker"
+
+	session, err := mgo.Dial("localhost")
+	ensure.Nil(t, err)
+	defer session.Close()
+	err = session.DB(test_db).DropDatabase()
+	ensure.Nil(t, err)
+	ensure.Nil(t, session.DB(test_db).C("c1").EnsureIndexKey("$text:title"))
+
+	logger, err := NewLogger("", "")
+	ensure.Nil(t, err)
+	checker := NewIndexChecker(logger)
+	text := &Op{Type: Query, QueryDoc: bson.D{{"$text", bson.D{{"$search", "coffee"}}}}}
+	near := &Op{Type: Query, QueryDoc: bson.D{{"loc", bson.D{{"$near", []interface{}{0, 0}}}}}}
+	checker.Require(text, test_db, "c1")
+	checker.Require(text, test_db, "c1")
+	checker.Require(near, test_db, "c1")
+	// the collection doesn't even exist
+	checker.Require(text, test_db, "c2")
+	checker.Require(&Op{Type: Query, QueryDoc: bson.D{{"a", 1}}}, test_db, "c3")
+
+	// c1 has the text index, but neither c1 nor c2 the one the others need
+	ensure.DeepEqual(t, checker.CheckRequired(session), int64(2))
+	ensure.DeepEqual(t, len(checker.checked), 3)
+}
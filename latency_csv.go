@@ -0,0 +1,54 @@
+package flashback
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LatencyCSVWriter writes the latency of every op as a CSV row, for the
+// analyses the percentiles don't allow. It may be shared by the analyzers of
+// several nodes.
+type LatencyCSVWriter struct {
+	mutex sync.Mutex
+	out   *csv.Writer
+}
+
+var latencyCSVHeader = []string{"timestamp", "node", "op_type", "ns", "latency_ms", "success", "error"}
+
+// NewLatencyCSVWriter writes the CSV header to out, followed by the rows
+// written by the analyzers it is set on, see StatsAnalyzer.SetLatencyCSV.
+func NewLatencyCSVWriter(out io.Writer) (*LatencyCSVWriter, error) {
+	w := &LatencyCSVWriter{out: csv.NewWriter(out)}
+	if err := w.out.Write(latencyCSVHeader); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *LatencyCSVWriter) write(node string, opStat OpStat) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	latencyMs := float64(opStat.Latency) / float64(time.Millisecond)
+	w.out.Write([]string{
+		opStat.StartTime.Format(time.RFC3339Nano),
+		node,
+		string(opStat.OpType),
+		opStat.Ns,
+		strconv.FormatFloat(latencyMs, 'f', 3, 64),
+		strconv.FormatBool(!opStat.OpError),
+		string(opStat.ErrorCategory),
+	})
+}
+
+// Flush writes the buffered rows, returning the first error the writes hit
+func (w *LatencyCSVWriter) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.out.Flush()
+	return w.out.Error()
+}
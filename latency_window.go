@@ -0,0 +1,113 @@
+package flashback
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// how many latencies each second of a latencyWindow keeps at most
+const windowBucketSamples = 1000
+
+// latencyWindow computes latency percentiles over a sliding window, e.g. the
+// last minute, which shows transient spikes that the percentiles since the
+// start of the replay smooth over. The window is split into one bucket per
+// second, each keeping a uniform sample of its latencies, so that the memory
+// used doesn't grow with the throughput.
+type latencyWindow struct {
+	buckets []windowBucket
+	rng     *rand.Rand
+}
+
+type windowBucket struct {
+	// the unix time of the second the bucket holds
+	second  int64
+	count   int64
+	max     float64
+	samples []float64
+}
+
+func newLatencyWindow(window time.Duration) *latencyWindow {
+	seconds := int((window + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return &latencyWindow{
+		buckets: make([]windowBucket, seconds),
+		rng:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (w *latencyWindow) insert(now time.Time, latencyMs float64) {
+	second := now.Unix()
+	bucket := &w.buckets[second%int64(len(w.buckets))]
+	if bucket.second != second {
+		bucket.second = second
+		bucket.count = 0
+		bucket.max = 0
+		bucket.samples = bucket.samples[:0]
+	}
+
+	bucket.count++
+	if bucket.max < latencyMs {
+		bucket.max = latencyMs
+	}
+	// reservoir sampling
+	if len(bucket.samples) < windowBucketSamples {
+		bucket.samples = append(bucket.samples, latencyMs)
+	} else if i := w.rng.Int63n(bucket.count); i < windowBucketSamples {
+		bucket.samples[i] = latencyMs
+	}
+}
+
+type weightedLatency struct {
+	latencyMs float64
+	weight    float64
+}
+
+// percentiles returns the given percentiles of the latencies inserted within
+// the window, and their max. They are all 0 if there were none.
+func (w *latencyWindow) percentiles(now time.Time, percentiles []float64) ([]float64, float64) {
+	// each sample stands for count / len(samples) latencies of its second
+	var samples []weightedLatency
+	totalWeight := 0.0
+	max := 0.0
+	oldest := now.Unix() - int64(len(w.buckets))
+	for _, bucket := range w.buckets {
+		if bucket.second <= oldest || bucket.second > now.Unix() || bucket.count == 0 {
+			continue
+		}
+		weight := float64(bucket.count) / float64(len(bucket.samples))
+		for _, latencyMs := range bucket.samples {
+			samples = append(samples, weightedLatency{latencyMs, weight})
+		}
+		totalWeight += float64(bucket.count)
+		if max < bucket.max {
+			max = bucket.max
+		}
+	}
+
+	latencies := make([]float64, len(percentiles))
+	if len(samples) == 0 {
+		return latencies, 0
+	}
+	sort.Sort(byLatency(samples))
+	for i, percentile := range percentiles {
+		target := percentile * totalWeight
+		cumulated := 0.0
+		for _, sample := range samples {
+			cumulated += sample.weight
+			latencies[i] = sample.latencyMs
+			if cumulated >= target {
+				break
+			}
+		}
+	}
+	return latencies, max
+}
+
+type byLatency []weightedLatency
+
+func (l byLatency) Len() int           { return len(l) }
+func (l byLatency) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byLatency) Less(i, j int) bool { return l[i].latencyMs < l[j].latencyMs }
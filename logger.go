@@ -1,21 +1,59 @@
 package flashback
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strings"
+	"time"
 )
 
+// The supported log formats, see Logger.SetFormat
+const (
+	TextLogFormat = "text"
+	JSONLogFormat = "json"
+)
+
+// The log levels, from the most verbose to the least, see Logger.SetLevel.
+// The debug and info messages go to stdout, the warn and error ones to stderr.
+const (
+	DebugLevel = "debug"
+	InfoLevel  = "info"
+	WarnLevel  = "warn"
+	ErrorLevel = "error"
+)
+
+var logLevels = []string{DebugLevel, InfoLevel, WarnLevel, ErrorLevel}
+
+// Fields are the structured data attached to the log messages, such as the
+// worker id or the op type
+type Fields map[string]interface{}
+
 // Logger provides a way to send different types of log messages to stderr/stdout
 type Logger struct {
-	stderr  *log.Logger
-	stdout  *log.Logger
-	toClose []closeable
+	// the logger of each level
+	outputs   map[string]*log.Logger
+	toClose   []closeable
+	formatter logFormatter
+	fields    Fields
+	// the messages below that level (an index in logLevels) are dropped
+	minLevel int
 }
 
 type closeable interface {
 	Close() error
 }
 
+// logFormatter turns a message and its fields into the line to be logged
+type logFormatter interface {
+	format(level string, fields Fields, message string) string
+	// the flags of the underlying log.Logger, e.g. to add a timestamp
+	flags() int
+	prefix(level string) string
+}
+
 // NewLogger creates a new logger
 func NewLogger(stdout string, stderr string) (logger *Logger, err error) {
 	var (
@@ -34,35 +72,128 @@ func NewLogger(stdout string, stderr string) (logger *Logger, err error) {
 		if stdoutWriter, err = os.OpenFile(stdout, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666); err != nil {
 			return
 		}
-		toClose = append(toClose, stderrWriter)
+		toClose = append(toClose, stdoutWriter)
 	}
 
 	logger = &Logger{
-		stderr:  log.New(stderrWriter, "ERROR ", log.LstdFlags|log.Lshortfile),
-		stdout:  log.New(stdoutWriter, "INFO ", log.LstdFlags|log.Lshortfile),
-		toClose: toClose,
+		outputs: map[string]*log.Logger{
+			DebugLevel: log.New(stdoutWriter, "", 0),
+			InfoLevel:  log.New(stdoutWriter, "", 0),
+			WarnLevel:  log.New(stderrWriter, "", 0),
+			ErrorLevel: log.New(stderrWriter, "", 0),
+		},
+		toClose:  toClose,
+		minLevel: levelIndex(InfoLevel),
 	}
+	logger.SetFormat(TextLogFormat)
 	return
 }
 
+func levelIndex(level string) int {
+	for i, l := range logLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// SetLevel makes the logger drop the messages below the given level, one of
+// DebugLevel, InfoLevel (the default), WarnLevel or ErrorLevel. Like
+// SetFormat, it should be called before WithFields.
+func (l *Logger) SetLevel(level string) error {
+	index := levelIndex(level)
+	if index < 0 {
+		return fmt.Errorf("unknown log level %q, should be one of %s", level, strings.Join(logLevels, ", "))
+	}
+	l.minLevel = index
+	return nil
+}
+
+// SetFormat switches the logger to the given format, either TextLogFormat
+// (the default) or JSONLogFormat. It should be called before WithFields, since
+// the derived loggers keep the format they were created with.
+func (l *Logger) SetFormat(format string) error {
+	switch format {
+	case TextLogFormat:
+		l.formatter = textFormatter{}
+	case JSONLogFormat:
+		l.formatter = jsonFormatter{}
+	default:
+		return fmt.Errorf("unknown log format %q, should be %s or %s", format, TextLogFormat, JSONLogFormat)
+	}
+
+	for level, out := range l.outputs {
+		out.SetFlags(l.formatter.flags())
+		out.SetPrefix(l.formatter.prefix(level))
+	}
+	return nil
+}
+
+// WithFields returns a logger that attaches the given fields, on top of the
+// ones of this logger, to every message. It writes to the same outputs, so
+// only the original logger should be closed.
+func (l *Logger) WithFields(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for key, value := range l.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+
+	derived := *l
+	derived.fields = merged
+	return &derived
+}
+
+// output logs the message unless its level is filtered out, crediting the
+// caller of the exported methods for it (hence the call depth of 3)
+func (l *Logger) output(level string, message func() string) {
+	if levelIndex(level) < l.minLevel {
+		return
+	}
+	l.outputs[level].Output(3, l.formatter.format(level, l.fields, message()))
+}
+
+// Debug prints message to stdout, if the level is debug
+func (l *Logger) Debug(v ...interface{}) {
+	l.output(DebugLevel, func() string { return fmt.Sprint(v...) })
+}
+
+// Debugf prints message to stdout, if the level is debug
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.output(DebugLevel, func() string { return fmt.Sprintf(format, v...) })
+}
+
 // Info prints message to stdout
 func (l *Logger) Info(v ...interface{}) {
-	l.stdout.Print(v...)
+	l.output(InfoLevel, func() string { return fmt.Sprint(v...) })
 }
 
 // Infof prints message to stdout
 func (l *Logger) Infof(format string, v ...interface{}) {
-	l.stdout.Printf(format, v...)
+	l.output(InfoLevel, func() string { return fmt.Sprintf(format, v...) })
+}
+
+// Warn prints message to stderr
+func (l *Logger) Warn(v ...interface{}) {
+	l.output(WarnLevel, func() string { return fmt.Sprint(v...) })
+}
+
+// Warnf prints message to stderr
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.output(WarnLevel, func() string { return fmt.Sprintf(format, v...) })
 }
 
 // Error prints message to stderr
 func (l *Logger) Error(v ...interface{}) {
-	l.stderr.Print(v...)
+	l.output(ErrorLevel, func() string { return fmt.Sprint(v...) })
 }
 
 // Errorf prints message to stderr
 func (l *Logger) Errorf(format string, v ...interface{}) {
-	l.stderr.Printf(format, v...)
+	l.output(ErrorLevel, func() string { return fmt.Sprintf(format, v...) })
 }
 
 // Close the underlying files
@@ -71,3 +202,65 @@ func (l *Logger) Close() {
 		c.Close()
 	}
 }
+
+// textFormatter writes the free-form messages, followed by the fields as
+// key=value pairs
+type textFormatter struct{}
+
+func (textFormatter) format(level string, fields Fields, message string) string {
+	if len(fields) == 0 {
+		return message
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = fmt.Sprintf("%s=%v", key, fields[key])
+	}
+	return strings.TrimRight(message, "\n") + " " + strings.Join(pairs, " ")
+}
+
+func (textFormatter) flags() int {
+	return log.LstdFlags | log.Lshortfile
+}
+
+func (textFormatter) prefix(level string) string {
+	return strings.ToUpper(level) + " "
+}
+
+// jsonFormatter writes each message as a JSON object on its own line, for
+// log shippers to parse
+type jsonFormatter struct{}
+
+func (jsonFormatter) format(level string, fields Fields, message string) string {
+	entry := make(map[string]interface{}, len(fields)+3)
+	for key, value := range fields {
+		entry[key] = value
+	}
+	// the fields can't override these
+	entry["level"] = level
+	entry["timestamp"] = time.Now().Format(time.RFC3339Nano)
+	entry["message"] = strings.TrimRight(message, "\n")
+
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		encoded, _ = json.Marshal(map[string]string{
+			"level":     level,
+			"timestamp": entry["timestamp"].(string),
+			"message":   fmt.Sprintf("%s (could not encode the fields: %s)", entry["message"], err),
+		})
+	}
+	return string(encoded)
+}
+
+func (jsonFormatter) flags() int {
+	return 0
+}
+
+func (jsonFormatter) prefix(level string) string {
+	return ""
+}
@@ -0,0 +1,83 @@
+package flashback
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func readLogLines(t *testing.T, filename string) []string {
+	content, err := ioutil.ReadFile(filename)
+	ensure.Nil(t, err)
+	return strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+}
+
+func TestLoggerFormats(t *testing.T) {
+	file, err := ioutil.TempFile("", "flashback_log")
+	ensure.Nil(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	logger, err := NewLogger(file.Name(), "")
+	ensure.Nil(t, err)
+	defer logger.Close()
+
+	logger.Infof("plain %d\n", 1)
+	logger.WithFields(Fields{"worker": 3, "op_type": Query}).Info("with fields")
+	ensure.NotNil(t, logger.SetFormat("xml"))
+	ensure.Nil(t, logger.SetFormat(JSONLogFormat))
+	logger.WithFields(Fields{"worker": 3, "level": "ignored"}).Infof("as json\n")
+
+	lines := readLogLines(t, file.Name())
+	ensure.DeepEqual(t, len(lines), 3)
+	ensure.True(t, strings.HasPrefix(lines[0], "INFO "))
+	// the caller gets credited, rather than the logger itself
+	ensure.StringContains(t, lines[0], "logger_test.go")
+	ensure.True(t, strings.HasSuffix(lines[0], ": plain 1"))
+	ensure.True(t, strings.HasSuffix(lines[1], ": with fields op_type=query worker=3"))
+
+	var entry map[string]interface{}
+	ensure.Nil(t, json.Unmarshal([]byte(lines[2]), &entry))
+	ensure.DeepEqual(t, entry["level"], "info")
+	ensure.DeepEqual(t, entry["message"], "as json")
+	ensure.DeepEqual(t, entry["worker"], float64(3))
+	ensure.NotNil(t, entry["timestamp"])
+}
+
+func TestLoggerLevels(t *testing.T) {
+	file, err := ioutil.TempFile("", "flashback_log")
+	ensure.Nil(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	// both outputs go to the same file
+	logger, err := NewLogger(file.Name(), file.Name())
+	ensure.Nil(t, err)
+	defer logger.Close()
+
+	logger.Debugf("hidden %d", 1)
+	logger.Info("shown")
+	logger.Warnf("warned %d", 2)
+	ensure.NotNil(t, logger.SetLevel("verbose"))
+	ensure.Nil(t, logger.SetLevel(DebugLevel))
+	logger.WithFields(Fields{"worker": 1}).Debug("debugged")
+	ensure.Nil(t, logger.SetLevel(ErrorLevel))
+	logger.Info("hidden")
+	logger.Warn("hidden")
+	logger.Errorf("failed %d", 3)
+
+	lines := readLogLines(t, file.Name())
+	ensure.DeepEqual(t, len(lines), 4)
+	ensure.True(t, strings.HasPrefix(lines[0], "INFO "))
+	ensure.True(t, strings.HasSuffix(lines[0], ": shown"))
+	ensure.True(t, strings.HasPrefix(lines[1], "WARN "))
+	ensure.True(t, strings.HasSuffix(lines[1], ": warned 2"))
+	ensure.True(t, strings.HasPrefix(lines[2], "DEBUG "))
+	ensure.True(t, strings.HasSuffix(lines[2], ": debugged worker=1"))
+	ensure.True(t, strings.HasPrefix(lines[3], "ERROR "))
+	ensure.True(t, strings.HasSuffix(lines[3], ": failed 3"))
+}
@@ -0,0 +1,117 @@
+package flashback
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MetricsExporter serves the latest ExecutionStatus of each node in the
+// Prometheus text exposition format, so long replays can be scraped and graphed.
+//
+// GetStatus resets the interval stats, so the exporter never calls it itself.
+// Instead, whoever already polls the StatsAnalyzer hands over each snapshot
+// via Update.
+type MetricsExporter struct {
+	mutex    sync.Mutex
+	nodes    []string
+	statuses map[string]*ExecutionStatus
+}
+
+func NewMetricsExporter() *MetricsExporter {
+	return &MetricsExporter{statuses: make(map[string]*ExecutionStatus)}
+}
+
+// Update replaces the snapshot exported for the given node
+func (m *MetricsExporter) Update(node string, status *ExecutionStatus) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.statuses[node]; !ok {
+		m.nodes = append(m.nodes, node)
+	}
+	m.statuses[node] = status
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *MetricsExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	fmt.Fprintln(out, "# HELP flashback_ops_total Number of ops executed.")
+	fmt.Fprintln(out, "# TYPE flashback_ops_total counter")
+	m.forEachOpType(func(node string, opType OpType, status *ExecutionStatus) {
+		fmt.Fprintf(out, "flashback_ops_total{node=\"%s\",op_type=\"%s\"} %d\n",
+			escapeLabel(node), escapeLabel(string(opType)), status.Counts[opType])
+	})
+
+	fmt.Fprintln(out, "# HELP flashback_op_errors_total Number of ops that failed.")
+	fmt.Fprintln(out, "# TYPE flashback_op_errors_total counter")
+	m.forEachNode(func(node string, status *ExecutionStatus) {
+		fmt.Fprintf(out, "flashback_op_errors_total{node=\"%s\"} %d\n", escapeLabel(node), status.OpsErrors)
+	})
+
+	fmt.Fprintln(out, "# HELP flashback_ops_per_second Ops executed per second during the last interval.")
+	fmt.Fprintln(out, "# TYPE flashback_ops_per_second gauge")
+	m.forEachNode(func(node string, status *ExecutionStatus) {
+		fmt.Fprintf(out, "flashback_ops_per_second{node=\"%s\"} %f\n", escapeLabel(node), status.IntervalOpsPerSec)
+	})
+
+	fmt.Fprintln(out, "# HELP flashback_op_latency_milliseconds Latency percentiles of the ops executed so far.")
+	fmt.Fprintln(out, "# TYPE flashback_op_latency_milliseconds summary")
+	m.forEachOpType(func(node string, opType OpType, status *ExecutionStatus) {
+		labels := fmt.Sprintf("node=\"%s\",op_type=\"%s\"", escapeLabel(node), escapeLabel(string(opType)))
+		percentiles := status.Percentiles
+		if percentiles == nil {
+			percentiles = latencyPercentiles
+		}
+		for i, latency := range status.Latencies[opType] {
+			fmt.Fprintf(out, "flashback_op_latency_milliseconds{%s,quantile=\"%s\"} %f\n",
+				labels, strconv.FormatFloat(percentiles[i], 'g', -1, 64), latency)
+		}
+		fmt.Fprintf(out, "flashback_op_latency_milliseconds{%s,quantile=\"1\"} %f\n",
+			labels, status.MaxLatency[opType])
+		fmt.Fprintf(out, "flashback_op_latency_milliseconds_sum{%s} %f\n", labels, status.LatencySums[opType])
+		fmt.Fprintf(out, "flashback_op_latency_milliseconds_count{%s} %d\n", labels, status.LatencyCounts[opType])
+	})
+
+	// the connection stats cover all the nodes, so any snapshot will do
+	var connections *ConnectionStats
+	m.forEachNode(func(node string, status *ExecutionStatus) {
+		if connections == nil {
+			connections = status.Connections
+		}
+	})
+	if connections != nil {
+		fmt.Fprintln(out, "# HELP flashback_sockets Sockets of the driver, open (alive) or reserved by a session (in_use).")
+		fmt.Fprintln(out, "# TYPE flashback_sockets gauge")
+		fmt.Fprintf(out, "flashback_sockets{state=\"alive\"} %d\n", connections.SocketsAlive)
+		fmt.Fprintf(out, "flashback_sockets{state=\"in_use\"} %d\n", connections.SocketsInUse)
+	}
+}
+
+func (m *MetricsExporter) forEachNode(f func(string, *ExecutionStatus)) {
+	for _, node := range m.nodes {
+		f(node, m.statuses[node])
+	}
+}
+
+func (m *MetricsExporter) forEachOpType(f func(string, OpType, *ExecutionStatus)) {
+	m.forEachNode(func(node string, status *ExecutionStatus) {
+		for _, opType := range AllOpTypes {
+			f(node, opType, status)
+		}
+	})
+}
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
@@ -0,0 +1,49 @@
+package flashback
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestMetricsExporter(t *testing.T) {
+	t.Parallel()
+
+	status := &ExecutionStatus{
+		OpsErrors:         3,
+		IntervalOpsPerSec: 12.5,
+		Latencies:         map[OpType][]float64{Query: []float64{1, 2, 3, 4, 5}},
+		MaxLatency:        map[OpType]float64{Query: 6},
+		Counts:            map[OpType]int64{Query: 42},
+		LatencySums:       map[OpType]float64{Query: 84.5},
+		LatencyCounts:     map[OpType]int64{Query: 40},
+		Connections:       &ConnectionStats{SocketsAlive: 12, SocketsInUse: 10},
+	}
+	exporter := NewMetricsExporter()
+	exporter.Update("default", status)
+
+	request, err := http.NewRequest("GET", "/metrics", nil)
+	ensure.Nil(t, err)
+	recorder := httptest.NewRecorder()
+	exporter.ServeHTTP(recorder, request)
+	body := recorder.Body.String()
+
+	for _, line := range []string{
+		`flashback_ops_total{node="default",op_type="query"} 42`,
+		`flashback_ops_total{node="default",op_type="insert"} 0`,
+		`flashback_op_errors_total{node="default"} 3`,
+		`flashback_ops_per_second{node="default"} 12.500000`,
+		`flashback_op_latency_milliseconds{node="default",op_type="query",quantile="0.5"} 1.000000`,
+		`flashback_op_latency_milliseconds{node="default",op_type="query",quantile="0.99"} 5.000000`,
+		`flashback_op_latency_milliseconds{node="default",op_type="query",quantile="1"} 6.000000`,
+		`flashback_op_latency_milliseconds_sum{node="default",op_type="query"} 84.500000`,
+		`flashback_op_latency_milliseconds_count{node="default",op_type="query"} 40`,
+		`flashback_sockets{state="alive"} 12`,
+		`flashback_sockets{state="in_use"} 10`,
+	} {
+		ensure.True(t, strings.Contains(body, line+"\n"), line)
+	}
+}
@@ -0,0 +1,64 @@
+package flashback
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// NsFilter decides which namespaces get replayed, based on lists of include
+// and exclude patterns. Patterns may contain "*" wildcards, e.g. "mydb.*".
+type NsFilter struct {
+	include []string
+	exclude []string
+}
+
+// NewNsFilter parses the comma-separated include and exclude patterns. Either
+// list may be empty; an empty include list includes every namespace.
+func NewNsFilter(include, exclude string) (*NsFilter, error) {
+	f := &NsFilter{}
+	var err error
+	if f.include, err = parseNsPatterns(include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = parseNsPatterns(exclude); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parseNsPatterns(list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+
+	patterns := strings.Split(list, ",")
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid namespace pattern %q: %s", pattern, err)
+		}
+	}
+	return patterns, nil
+}
+
+// Matches tells whether ops against the given namespace should be replayed.
+// Exclude patterns win over include patterns.
+func (f *NsFilter) Matches(ns string) bool {
+	if f == nil {
+		return true
+	}
+	if matchesAnyNs(ns, f.exclude) {
+		return false
+	}
+	return len(f.include) == 0 || matchesAnyNs(ns, f.include)
+}
+
+func matchesAnyNs(ns string, patterns []string) bool {
+	for _, pattern := range patterns {
+		// the patterns were validated when the filter got created
+		if matched, _ := path.Match(pattern, ns); matched {
+			return true
+		}
+	}
+	return false
+}
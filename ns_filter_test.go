@@ -0,0 +1,35 @@
+package flashback
+
+import (
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestNsFilter(t *testing.T) {
+	t.Parallel()
+
+	f, err := NewNsFilter("", "")
+	ensure.Nil(t, err)
+	ensure.True(t, f.Matches("db.coll"))
+
+	f, err = NewNsFilter("mydb.orders,logs.*", "")
+	ensure.Nil(t, err)
+	ensure.True(t, f.Matches("mydb.orders"))
+	ensure.True(t, f.Matches("logs.2015"))
+	ensure.False(t, f.Matches("mydb.users"))
+
+	// exclude wins on conflict
+	f, err = NewNsFilter("mydb.*", "mydb.users,*.system.*")
+	ensure.Nil(t, err)
+	ensure.True(t, f.Matches("mydb.orders"))
+	ensure.False(t, f.Matches("mydb.users"))
+	ensure.False(t, f.Matches("mydb.system.indexes"))
+	ensure.False(t, f.Matches("other.orders"))
+
+	f = nil
+	ensure.True(t, f.Matches("db.coll"))
+
+	_, err = NewNsFilter("mydb.[", "")
+	ensure.NotNil(t, err)
+}
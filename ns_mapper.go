@@ -0,0 +1,123 @@
+package flashback
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NsMapper rewrites the namespace of ops before they get executed, which
+// allows replaying ops recorded against one database (or collection) into
+// another one.
+type NsMapper struct {
+	// exact namespace (db.coll) matches, which take precedence over wildcards
+	exact map[string]string
+	// whole-database matches, keyed by the source database name
+	wildcard map[string]string
+	// appended to the target collections, see SetCollectionSuffix
+	collectionSuffix string
+	// the database every op goes to, see SetForcedDatabase
+	forcedDb string
+}
+
+// NewNsMapper parses a comma-separated list of from=to pairs, such as
+// "prod.users=staging.users,prod.*=staging.*". A "*" collection in the source
+// matches every collection of that database; a "*" collection in the target
+// keeps the original collection name.
+func NewNsMapper(spec string) (*NsMapper, error) {
+	m := &NsMapper{
+		exact:    make(map[string]string),
+		wildcard: make(map[string]string),
+	}
+	if spec == "" {
+		return m, nil
+	}
+
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid ns_map entry %q: expected from=to", pair)
+		}
+		fromDb, fromColl, err := splitNs(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid ns_map entry %q: %s", pair, err)
+		}
+		if _, _, err = splitNs(parts[1]); err != nil {
+			return nil, fmt.Errorf("invalid ns_map entry %q: %s", pair, err)
+		}
+
+		if fromColl == "*" {
+			m.wildcard[fromDb] = parts[1]
+		} else {
+			m.exact[parts[0]] = parts[1]
+		}
+	}
+	return m, nil
+}
+
+func splitNs(ns string) (string, string, error) {
+	parts := strings.SplitN(ns, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("namespace %q is not of the form <db>.<collection>", ns)
+	}
+	return parts[0], parts[1], nil
+}
+
+// SetCollectionSuffix makes the mapper append the suffix to the collections
+// it maps to, e.g. "users" becomes "users_alice" with "_alice", which keeps
+// the replays of several people against the same cluster apart. The suffix
+// applies after the rules, whether a rule matched or not. The system
+// collections, and the $cmd one of the database commands, keep their names.
+func (m *NsMapper) SetCollectionSuffix(suffix string) error {
+	if strings.ContainsAny(suffix, "$\x00") {
+		return fmt.Errorf("invalid collection suffix %q: collection names cannot contain '$' or null characters", suffix)
+	}
+	m.collectionSuffix = suffix
+	return nil
+}
+
+// SetForcedDatabase makes the mapper send the ops on every database to the
+// given one, keeping their collection names, e.g. to consolidate several
+// databases into one. It replaces the rules, so the mapper shouldn't have any.
+// An empty database leaves the ops on their own.
+func (m *NsMapper) SetForcedDatabase(database string) error {
+	if database == "" {
+		m.forcedDb = ""
+		return nil
+	}
+	if len(m.exact) > 0 || len(m.wildcard) > 0 {
+		return fmt.Errorf("the database can't be forced along with ns_map rules")
+	}
+	if strings.ContainsAny(database, "/\\. \"$\x00") {
+		return fmt.Errorf("invalid database name %q: database names cannot contain '/', '\\', '.', ' ', '\"', '$' or null characters", database)
+	}
+	m.forcedDb = database
+	return nil
+}
+
+// Map returns the database and collection an op recorded against the given
+// database and collection should be executed against. Namespaces that don't
+// match any rule are passed through unchanged, but for the collection suffix.
+func (m *NsMapper) Map(database, collection string) (string, string) {
+	if m == nil {
+		return database, collection
+	}
+
+	toDb, toColl := database, collection
+	target, ok := m.exact[database+"."+collection]
+	if !ok {
+		target, ok = m.wildcard[database]
+	}
+	if m.forcedDb != "" {
+		toDb = m.forcedDb
+	} else if ok {
+		// the target was validated when the mapper got created
+		toDb, toColl, _ = splitNs(target)
+		if toColl == "*" {
+			toColl = collection
+		}
+	}
+	if m.collectionSuffix != "" && !strings.HasPrefix(toColl, "system.") && toColl != "$cmd" {
+		toColl += m.collectionSuffix
+	}
+	return toDb, toColl
+}
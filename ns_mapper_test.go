@@ -0,0 +1,83 @@
+package flashback
+
+import (
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestNsMapper(t *testing.T) {
+	t.Parallel()
+
+	mapper, err := NewNsMapper("prod.users=staging.people,prod.*=staging.*,logs.*=archive.all")
+	ensure.Nil(t, err)
+
+	check := func(database, collection, expectedDb, expectedColl string) {
+		actualDb, actualColl := mapper.Map(database, collection)
+		ensure.DeepEqual(t, actualDb, expectedDb)
+		ensure.DeepEqual(t, actualColl, expectedColl)
+	}
+
+	// exact matches win over wildcards
+	check("prod", "users", "staging", "people")
+	check("prod", "orders", "staging", "orders")
+	check("logs", "2015", "archive", "all")
+	// unmatched namespaces pass through
+	check("other", "users", "other", "users")
+
+	// a nil mapper is a no-op
+	mapper = nil
+	check("prod", "users", "prod", "users")
+}
+
+func TestNsMapperInvalidSpec(t *testing.T) {
+	t.Parallel()
+
+	for _, spec := range []string{"prod", "prod.users", "prod.users=staging", "prod=staging.users", ".users=a.b"} {
+		_, err := NewNsMapper(spec)
+		ensure.NotNil(t, err)
+	}
+}
+
+func TestNsMapperCollectionSuffix(t *testing.T) {
+	t.Parallel()
+
+	mapper, err := NewNsMapper("prod.users=staging.people,prod.*=staging.*")
+	ensure.Nil(t, err)
+	ensure.NotNil(t, mapper.SetCollectionSuffix("_$bad"))
+	ensure.Nil(t, mapper.SetCollectionSuffix("_alice"))
+
+	check := func(database, collection, expectedDb, expectedColl string) {
+		actualDb, actualColl := mapper.Map(database, collection)
+		ensure.DeepEqual(t, actualDb, expectedDb)
+		ensure.DeepEqual(t, actualColl, expectedColl)
+	}
+	// the suffix applies to the targets of the rules, and to unmatched namespaces
+	check("prod", "users", "staging", "people_alice")
+	check("prod", "orders", "staging", "orders_alice")
+	check("other", "users", "other", "users_alice")
+	check("other", "system.indexes", "other", "system.indexes")
+}
+
+func TestNsMapperForcedDatabase(t *testing.T) {
+	t.Parallel()
+
+	mapper, err := NewNsMapper("prod.*=staging.*")
+	ensure.Nil(t, err)
+	ensure.NotNil(t, mapper.SetForcedDatabase("replay"))
+
+	mapper, err = NewNsMapper("")
+	ensure.Nil(t, err)
+	ensure.NotNil(t, mapper.SetForcedDatabase("bad.db"))
+	ensure.Nil(t, mapper.SetForcedDatabase("replay"))
+	ensure.Nil(t, mapper.SetCollectionSuffix("_alice"))
+
+	check := func(database, collection, expectedDb, expectedColl string) {
+		actualDb, actualColl := mapper.Map(database, collection)
+		ensure.DeepEqual(t, actualDb, expectedDb)
+		ensure.DeepEqual(t, actualColl, expectedColl)
+	}
+	check("prod", "users", "replay", "users_alice")
+	check("other", "users", "replay", "users_alice")
+	check("other", "$cmd", "replay", "$cmd")
+}
@@ -1,6 +1,9 @@
 package flashback
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/mgo.v2/bson"
@@ -21,10 +24,14 @@ const (
 	Command       OpType = "command"
 	Count         OpType = "command.count"
 	FindAndModify OpType = "command.findandmodify"
+	Aggregate     OpType = "command.aggregate"
+	Distinct      OpType = "command.distinct"
+	CreateIndexes OpType = "command.createindexes"
 	GetMore       OpType = "getmore"
 )
 
-// AllOpTypes specifies all supported op types
+// AllOpTypes specifies all supported op types. Command covers the commands
+// without an op type of their own, see OpsExecutor.SetGenericCommands.
 var AllOpTypes = []OpType{
 	Insert,
 	Update,
@@ -33,6 +40,132 @@ var AllOpTypes = []OpType{
 	Count,
 	FindAndModify,
 	GetMore,
+	Aggregate,
+	Distinct,
+	CreateIndexes,
+	Command,
+}
+
+// The phases of a two-phase replay, see PhaseOpTypes
+const (
+	WritesPhase = "writes"
+	ReadsPhase  = "reads"
+	AllPhase    = "all"
+)
+
+// WriteOpTypes are the op types replayed by the writes phase, which modify
+// the data (or, for the index builds, how the reads will run against it). The
+// generic commands may modify it as well, e.g. a mapReduce with an output
+// collection, so they go there too.
+var WriteOpTypes = []OpType{Insert, Update, Remove, FindAndModify, CreateIndexes, Command}
+
+// ReadOpTypes are the op types replayed by the reads phase
+var ReadOpTypes = []OpType{Query, Count, GetMore, Aggregate, Distinct}
+
+// PhaseOpTypes returns the op types to replay for the given phase: the writes
+// to first populate the target, then the reads against the populated data, or
+// all of them (nil, as for an empty op type list).
+func PhaseOpTypes(phase string) ([]OpType, error) {
+	switch phase {
+	case WritesPhase:
+		return WriteOpTypes, nil
+	case ReadsPhase:
+		return ReadOpTypes, nil
+	case AllPhase:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown phase %q, should be %s, %s or %s", phase, WritesPhase, ReadsPhase, AllPhase)
+}
+
+// ParseOpTypes parses a comma-separated list of op types, making sure each
+// of them is one of AllOpTypes.
+func ParseOpTypes(list string) ([]OpType, error) {
+	if list == "" {
+		return nil, nil
+	}
+
+	var opTypes []OpType
+	for _, name := range strings.Split(list, ",") {
+		opType := OpType(name)
+		valid := false
+		for _, supported := range AllOpTypes {
+			if opType == supported {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("unknown op type %q, should be one of %v", name, AllOpTypes)
+		}
+		opTypes = append(opTypes, opType)
+	}
+	return opTypes, nil
+}
+
+// DefaultOpTimeouts are the socket timeouts that differ from the default one
+// unless set otherwise: the index builds, which can take minutes, have none.
+const DefaultOpTimeouts = "command.createindexes=0"
+
+// ParseOpTimeouts parses a comma-separated list of op_type=duration pairs,
+// such as "command.createindexes=30m,command.aggregate=5m", each op type
+// being one of AllOpTypes. A zero duration means no timeout.
+func ParseOpTimeouts(list string) (map[OpType]time.Duration, error) {
+	timeouts := make(map[OpType]time.Duration)
+	err := parseOpTypeValues(list, "op timeout", "duration", func(opType OpType, value string) error {
+		timeout, err := time.ParseDuration(value)
+		if err == nil && timeout < 0 {
+			err = fmt.Errorf("negative timeout")
+		}
+		timeouts[opType] = timeout
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return timeouts, nil
+}
+
+// ParseOpRateLimits parses a comma-separated list of op_type=ops_per_sec
+// pairs, such as "command.aggregate=50,update=1000", each op type being one
+// of AllOpTypes.
+func ParseOpRateLimits(list string) (map[OpType]float64, error) {
+	limits := make(map[OpType]float64)
+	err := parseOpTypeValues(list, "op rate limit", "ops_per_sec", func(opType OpType, value string) error {
+		limit, err := strconv.ParseFloat(value, 64)
+		if err == nil && limit <= 0 {
+			err = fmt.Errorf("the rate must be positive")
+		}
+		limits[opType] = limit
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return limits, nil
+}
+
+// parseOpTypeValues parses a comma-separated list of op_type=value pairs,
+// each op type being one of AllOpTypes, and hands each pair to parse. what
+// names the pairs and valueName their values, in the errors.
+func parseOpTypeValues(list, what, valueName string, parse func(opType OpType, value string) error) error {
+	if list == "" {
+		return nil
+	}
+
+	for _, pair := range strings.Split(list, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid %s %q: expected op_type=%s", what, pair, valueName)
+		}
+		opTypes, err := ParseOpTypes(parts[0])
+		if err != nil {
+			return err
+		}
+		if err := parse(opTypes[0], parts[1]); err != nil {
+			return fmt.Errorf("invalid %s %q: %s", what, pair, err)
+		}
+	}
+	return nil
 }
 
 // Op represents an op generated by the record utility
@@ -49,6 +182,23 @@ type Op struct {
 	UpdateDoc  bson.D    `bson:"updateobj,omitempty"`
 	Database   string    `bson:",omitempty"`
 	Collection string    `bson:",omitempty"`
+	// the client session the op was sent in, if recorded. The ops sharing a
+	// session can be pinned to the same worker to keep their ordering.
+	SessionId string `bson:"session_id,omitempty"`
+	// the cursor the op opened (for queries) or read from (for getmores), if
+	// any, as recorded by the profiler
+	CursorId int64 `bson:"cursorid,omitempty"`
+	// where the op starts in the ops file(s), see ByLineOpsReader.SeekToOffset
+	Offset int64 `bson:"-"`
+	// the size of the op in the ops file(s), if read from them
+	Size int `bson:"-"`
+	// the flags of an update. Multi also applies to removes, which otherwise
+	// only delete the first match (i.e. justOne).
+	Upsert bool `bson:"upsert,omitempty"`
+	Multi  bool `bson:"multi,omitempty"`
+	// the documents a query returned when recorded, if known, see
+	// ReadValidator
+	Result []bson.D `bson:"result,omitempty"`
 }
 
 // GetElem is a helper to fetch a specific key from bson.D
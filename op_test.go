@@ -80,3 +80,57 @@ func TestGetElem(t *testing.T) {
 	ensure.False(t, exists)
 	ensure.Nil(t, value)
 }
+
+func TestParseOpTypes(t *testing.T) {
+	opTypes, err := ParseOpTypes("")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(opTypes), 0)
+	opTypes, err = ParseOpTypes("query,getmore,command.count")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, opTypes, []OpType{Query, GetMore, Count})
+	_, err = ParseOpTypes("query,foo")
+	ensure.NotNil(t, err)
+}
+
+func TestParseOpTimeouts(t *testing.T) {
+	timeouts, err := ParseOpTimeouts(DefaultOpTimeouts)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, timeouts, map[OpType]time.Duration{CreateIndexes: 0})
+	timeouts, err = ParseOpTimeouts("command.aggregate=5m,query=1s")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, timeouts, map[OpType]time.Duration{Aggregate: 5 * time.Minute, Query: time.Second})
+	for _, list := range []string{"query", "=1s", "foo=1s", "query=soon", "query=-1s"} {
+		_, err = ParseOpTimeouts(list)
+		ensure.NotNil(t, err)
+	}
+}
+
+func TestParseOpRateLimits(t *testing.T) {
+	limits, err := ParseOpRateLimits("")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(limits), 0)
+	limits, err = ParseOpRateLimits("command.aggregate=50,update=1000,query=0.5")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, limits, map[OpType]float64{Aggregate: 50, Update: 1000, Query: 0.5})
+	for _, list := range []string{"query", "=50", "aggregate=50", "query=fast", "query=0", "query=-1"} {
+		_, err = ParseOpRateLimits(list)
+		ensure.NotNil(t, err)
+	}
+}
+
+func TestPhaseOpTypes(t *testing.T) {
+	opTypes, err := PhaseOpTypes(AllPhase)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(opTypes), 0)
+	writes, err := PhaseOpTypes(WritesPhase)
+	ensure.Nil(t, err)
+	reads, err := PhaseOpTypes(ReadsPhase)
+	ensure.Nil(t, err)
+	// every op type belongs to exactly one phase
+	ensure.DeepEqual(t, len(writes)+len(reads), len(AllOpTypes))
+	for _, opType := range AllOpTypes {
+		ensure.True(t, shouldIncludeOp(&Op{Type: opType}, writes) != shouldIncludeOp(&Op{Type: opType}, reads))
+	}
+	_, err = PhaseOpTypes("foo")
+	ensure.NotNil(t, err)
+}
@@ -0,0 +1,244 @@
+package flashback
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/yaml.v2"
+)
+
+// The actions of the op transforms
+const (
+	// sets the To field to the value of the From field
+	CopyTransform = "copy"
+	// sets the To field to the first Length characters of the From field,
+	// which must be a string
+	PrefixTransform = "prefix"
+)
+
+// OpTransform is one of the rules of an OpTransformer
+type OpTransform struct {
+	// the namespaces the rule applies to, with "*" wildcards as for the
+	// namespace filters, e.g. "mydb.*". Empty for all of them.
+	Ns     string `yaml:"ns"`
+	Action string `yaml:"action"`
+	From   string `yaml:"from"`
+	To     string `yaml:"to"`
+	Length int    `yaml:"length"`
+}
+
+// OpTransformer rewrites the documents written by the ops before they get
+// executed, e.g. to replay the writes of a collection sharded on {a: 1} into
+// one sharded on {b: 1}, by deriving b from a. The rules apply, in order, to
+// the top-level fields of:
+//   - the inserted documents
+//   - the queries of the updates, removes and findAndModify commands, so that
+//     they target the documents by the new shard key too
+//   - the replacement documents of the updates, and the $set and $setOnInsert
+//     of the other updates
+//
+// The reads are left untouched. The given ops are never modified, since they
+// are shared by the executors of all the nodes.
+type OpTransformer struct {
+	transforms []OpTransform
+}
+
+// LoadOpTransformer loads the rules from a YAML (or JSON) file holding a list
+// of them, such as [{ns: mydb.users, action: copy, from: a, to: b}]. An empty
+// filename gives no transformer, which leaves the ops unchanged.
+func LoadOpTransformer(filename string) (*OpTransformer, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var transforms []OpTransform
+	if err = yaml.UnmarshalStrict(contents, &transforms); err != nil {
+		return nil, fmt.Errorf("could not parse the op transforms of %s: %s", filename, err)
+	}
+	return NewOpTransformer(transforms)
+}
+
+func NewOpTransformer(transforms []OpTransform) (*OpTransformer, error) {
+	for i, transform := range transforms {
+		if err := validateTransform(transform); err != nil {
+			return nil, fmt.Errorf("invalid op transform #%d: %s", i+1, err)
+		}
+	}
+	return &OpTransformer{transforms: transforms}, nil
+}
+
+func validateTransform(transform OpTransform) error {
+	if _, err := path.Match(transform.Ns, ""); err != nil {
+		return fmt.Errorf("invalid namespace pattern %q: %s", transform.Ns, err)
+	}
+	if transform.Action != CopyTransform && transform.Action != PrefixTransform {
+		return fmt.Errorf("unknown action %q, should be %s or %s", transform.Action, CopyTransform, PrefixTransform)
+	}
+	for _, field := range []string{transform.From, transform.To} {
+		if field == "" || strings.HasPrefix(field, "$") || strings.Contains(field, ".") {
+			return fmt.Errorf("invalid field %q, the transforms apply to top-level fields", field)
+		}
+	}
+	if transform.Action == PrefixTransform && transform.Length <= 0 {
+		return fmt.Errorf("the length of a prefix must be positive")
+	}
+	return nil
+}
+
+// Transform returns the op, or a copy of it whose documents got rewritten by
+// the rules that apply to its namespace
+func (t *OpTransformer) Transform(op *Op) *Op {
+	if t == nil {
+		return op
+	}
+	var transforms []OpTransform
+	ns := op.Database + "." + op.Collection
+	for _, transform := range t.transforms {
+		if matched, _ := path.Match(transform.Ns, ns); matched || transform.Ns == "" {
+			transforms = append(transforms, transform)
+		}
+	}
+	if len(transforms) == 0 {
+		return op
+	}
+
+	copied := *op
+	changed := false
+	rewrite := func(doc bson.D) bson.D {
+		if rewritten, ok := applyTransforms(doc, transforms); ok {
+			changed = true
+			return rewritten
+		}
+		return doc
+	}
+	switch op.Type {
+	case Insert:
+		copied.InsertDoc = rewrite(op.InsertDoc)
+		copied.CommandDoc = rewriteElem(op.CommandDoc, "documents", func(value interface{}) interface{} {
+			docs, ok := value.([]interface{})
+			if !ok {
+				return value
+			}
+			rewritten := make([]interface{}, len(docs))
+			for i, doc := range docs {
+				rewritten[i] = doc
+				if doc, ok := doc.(bson.D); ok {
+					rewritten[i] = rewrite(doc)
+				}
+			}
+			return rewritten
+		})
+	case Update:
+		copied.QueryDoc = rewrite(op.QueryDoc)
+		copied.UpdateDoc = rewriteUpdate(op.UpdateDoc, rewrite)
+	case Remove:
+		copied.QueryDoc = rewrite(op.QueryDoc)
+	case FindAndModify:
+		copied.CommandDoc = rewriteElem(op.CommandDoc, "query", func(value interface{}) interface{} {
+			if query, ok := value.(bson.D); ok {
+				return rewrite(query)
+			}
+			return value
+		})
+		copied.CommandDoc = rewriteElem(copied.CommandDoc, "update", func(value interface{}) interface{} {
+			if update, ok := value.(bson.D); ok {
+				return rewriteUpdate(update, rewrite)
+			}
+			return value
+		})
+	}
+	if !changed {
+		return op
+	}
+	return &copied
+}
+
+// rewriteUpdate rewrites the replacement document of an update, or else its
+// $set and $setOnInsert
+func rewriteUpdate(update bson.D, rewrite func(bson.D) bson.D) bson.D {
+	if len(update) == 0 || !strings.HasPrefix(update[0].Name, "$") {
+		return rewrite(update)
+	}
+	for _, operator := range []string{"$set", "$setOnInsert"} {
+		update = rewriteElem(update, operator, func(value interface{}) interface{} {
+			if fields, ok := value.(bson.D); ok {
+				return rewrite(fields)
+			}
+			return value
+		})
+	}
+	return update
+}
+
+// rewriteElem returns the document, or a copy of it whose given element got
+// rewritten, if it has one
+func rewriteElem(doc bson.D, name string, rewrite func(interface{}) interface{}) bson.D {
+	for i, elem := range doc {
+		if elem.Name != name {
+			continue
+		}
+		rewritten := make(bson.D, len(doc))
+		copy(rewritten, doc)
+		rewritten[i].Value = rewrite(elem.Value)
+		return rewritten
+	}
+	return doc
+}
+
+// applyTransforms returns a copy of the document with the transforms applied,
+// if any of them changed it. Only strings get a prefix, which in queries
+// leaves out the conditions (e.g. {$gt: "a"}), whose prefix means nothing.
+func applyTransforms(doc bson.D, transforms []OpTransform) (bson.D, bool) {
+	var rewritten bson.D
+	for _, transform := range transforms {
+		current := doc
+		if rewritten != nil {
+			current = rewritten
+		}
+		value, ok := GetElem(current, transform.From)
+		if !ok {
+			continue
+		}
+		if transform.Action == PrefixTransform {
+			s, ok := value.(string)
+			if !ok {
+				continue
+			}
+			value = stringPrefix(s, transform.Length)
+		}
+		if rewritten == nil {
+			rewritten = make(bson.D, len(doc))
+			copy(rewritten, doc)
+		}
+		rewritten = setElem(rewritten, transform.To, value)
+	}
+	return rewritten, rewritten != nil
+}
+
+// stringPrefix returns the first length characters of s
+func stringPrefix(s string, length int) string {
+	for i := range s {
+		if length == 0 {
+			return s[:i]
+		}
+		length--
+	}
+	return s
+}
+
+// setElem sets the value of the named element in place, or appends it
+func setElem(doc bson.D, name string, value interface{}) bson.D {
+	for i := range doc {
+		if doc[i].Name == name {
+			doc[i].Value = value
+			return doc
+		}
+	}
+	return append(doc, bson.DocElem{name, value})
+}
@@ -0,0 +1,96 @@
+package flashback
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestLoadOpTransformer(t *testing.T) {
+	transformer, err := LoadOpTransformer("")
+	ensure.Nil(t, err)
+	ensure.True(t, transformer == nil)
+
+	dir, err := ioutil.TempDir("", "flashback_transforms")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+	load := func(contents string) (*OpTransformer, error) {
+		filename := filepath.Join(dir, "transforms.yaml")
+		ensure.Nil(t, ioutil.WriteFile(filename, []byte(contents), 0666))
+		return LoadOpTransformer(filename)
+	}
+
+	transformer, err = load("- {ns: 'app.*', action: copy, from: a, to: b}\n" +
+		"- action: prefix\n  from: email\n  to: domain\n  length: 3\n")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, transformer.transforms, []OpTransform{
+		{Ns: "app.*", Action: CopyTransform, From: "a", To: "b"},
+		{Action: PrefixTransform, From: "email", To: "domain", Length: 3},
+	})
+	// JSON is YAML too
+	_, err = load(`[{"action": "copy", "from": "a", "to": "b"}]`)
+	ensure.Nil(t, err)
+
+	for _, contents := range []string{
+		"- {action: move, from: a, to: b}",
+		"- {action: copy, from: a}",
+		"- {action: copy, from: a.x, to: b}",
+		"- {action: copy, from: $a, to: b}",
+		"- {action: prefix, from: a, to: b}",
+		"- {action: copy, from: a, to: b, typo: 1}",
+		"- {ns: '[', action: copy, from: a, to: b}",
+	} {
+		_, err = load(contents)
+		ensure.NotNil(t, err)
+	}
+}
+
+func TestOpTransformer(t *testing.T) {
+	transformer, err := NewOpTransformer([]OpTransform{
+		{Ns: "app.users", Action: CopyTransform, From: "a", To: "b"},
+		{Ns: "app.*", Action: PrefixTransform, From: "name", To: "initials", Length: 2},
+	})
+	ensure.Nil(t, err)
+
+	insert := &Op{Database: "app", Collection: "users", Type: Insert,
+		InsertDoc: bson.D{{"_id", 1}, {"a", 5}, {"name", "éric"}}}
+	transformed := transformer.Transform(insert)
+	ensure.DeepEqual(t, transformed.InsertDoc, bson.D{{"_id", 1}, {"a", 5}, {"name", "éric"}, {"b", 5},
+		{"initials", "ér"}})
+	// the op is left untouched
+	ensure.DeepEqual(t, insert.InsertDoc, bson.D{{"_id", 1}, {"a", 5}, {"name", "éric"}})
+
+	bulk := &Op{Database: "app", Collection: "users", Type: Insert,
+		CommandDoc: bson.D{{"insert", "users"}, {"documents", []interface{}{bson.D{{"a", 1}}, bson.D{{"c", 2}}}}}}
+	documents, _ := GetElem(transformer.Transform(bulk).CommandDoc, "documents")
+	ensure.DeepEqual(t, documents, []interface{}{bson.D{{"a", 1}, {"b", 1}}, bson.D{{"c", 2}}})
+
+	update := &Op{Database: "app", Collection: "users", Type: Update,
+		QueryDoc:  bson.D{{"a", 5}, {"name", bson.D{{"$gt", "a"}}}},
+		UpdateDoc: bson.D{{"$set", bson.D{{"a", 6}}}, {"$inc", bson.D{{"a", 1}}}}}
+	transformed = transformer.Transform(update)
+	ensure.DeepEqual(t, transformed.QueryDoc, bson.D{{"a", 5}, {"name", bson.D{{"$gt", "a"}}}, {"b", 5}})
+	ensure.DeepEqual(t, transformed.UpdateDoc, bson.D{{"$set", bson.D{{"a", 6}, {"b", 6}}}, {"$inc", bson.D{{"a", 1}}}})
+	replacement := &Op{Database: "app", Collection: "users", Type: Update, UpdateDoc: bson.D{{"a", 7}, {"b", 0}}}
+	ensure.DeepEqual(t, transformer.Transform(replacement).UpdateDoc, bson.D{{"a", 7}, {"b", 7}})
+
+	findAndModify := &Op{Database: "app", Collection: "users", Type: FindAndModify, CommandDoc: bson.D{
+		{"findandmodify", "users"}, {"query", bson.D{{"a", 1}}}, {"update", bson.D{{"a", 2}}}}}
+	ensure.DeepEqual(t, transformer.Transform(findAndModify).CommandDoc, bson.D{
+		{"findandmodify", "users"}, {"query", bson.D{{"a", 1}, {"b", 1}}}, {"update", bson.D{{"a", 2}, {"b", 2}}}})
+
+	// the reads, the other namespaces and the docs without the field are left alone
+	query := &Op{Database: "app", Collection: "users", Type: Query, QueryDoc: bson.D{{"a", 1}}}
+	ensure.True(t, transformer.Transform(query) == query)
+	other := &Op{Database: "other", Collection: "users", Type: Insert, InsertDoc: bson.D{{"a", 1}}}
+	ensure.True(t, transformer.Transform(other) == other)
+	missing := &Op{Database: "app", Collection: "users", Type: Remove, QueryDoc: bson.D{{"c", 1}}}
+	ensure.True(t, transformer.Transform(missing) == missing)
+	var none *OpTransformer
+	ensure.True(t, none.Transform(insert) == insert)
+}
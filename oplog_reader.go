@@ -0,0 +1,241 @@
+package flashback
+
+import (
+	"io"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// how long a tailing Next waits for new entries before checking whether
+	// the reader got closed
+	oplogTailTimeout = time.Second
+	// how long to wait before tailing again after the cursor died
+	oplogRetryInterval = time.Second
+)
+
+// OplogOpsReader tails the oplog of a replica set member and translates its
+// entries into ops, which allows replaying the writes of a live source into
+// a target in near real time, e.g. for migration testing.
+//
+// Only inserts, updates and removes are translated: commands, no-ops and the
+// entries written by chunk migrations are skipped.
+type OplogOpsReader struct {
+	session *mgo.Session
+	iter    *mgo.Iter
+	// the timestamp of the latest entry read, where tailing resumes from
+	lastTs   bson.MongoTimestamp
+	opsRead  int
+	err      error
+	logger   *Logger
+	endTime  time.Time
+	opTypes  []OpType
+	nsFilter *NsFilter
+	closed   chan struct{}
+}
+
+type oplogEntry struct {
+	Ts          bson.MongoTimestamp `bson:"ts"`
+	Op          string              `bson:"op"`
+	Ns          string              `bson:"ns"`
+	O           bson.D              `bson:"o"`
+	O2          bson.D              `bson:"o2"`
+	FromMigrate bool                `bson:"fromMigrate"`
+}
+
+// NewOplogOpsReader creates a reader tailing the oplog (local.oplog.rs) of the
+// given session, starting after fromTimestamp. If fromTimestamp is 0, only the
+// entries written from now on are read.
+func NewOplogOpsReader(session *mgo.Session, fromTimestamp bson.MongoTimestamp,
+	logger *Logger) (error, *OplogOpsReader) {
+	r := &OplogOpsReader{
+		session: session,
+		lastTs:  fromTimestamp,
+		logger:  logger,
+		closed:  make(chan struct{}),
+	}
+	if fromTimestamp == 0 {
+		var latest oplogEntry
+		if err := r.oplog().Find(nil).Sort("-$natural").One(&latest); err != nil {
+			return err, nil
+		}
+		r.lastTs = latest.Ts
+	}
+	return nil, r
+}
+
+// MongoTimestampFromMillis converts a time in milliseconds since the epoch, as
+// used for start_time, into the timestamp of the first oplog entry at that time.
+func MongoTimestampFromMillis(millis int64) bson.MongoTimestamp {
+	return bson.MongoTimestamp((millis / 1000) << 32)
+}
+
+func timeFromMongoTimestamp(ts bson.MongoTimestamp) time.Time {
+	return time.Unix(int64(ts>>32), 0)
+}
+
+func (r *OplogOpsReader) oplog() *mgo.Collection {
+	return r.session.DB("local").C("oplog.rs")
+}
+
+// SetOpTypes makes the reader skip all the ops whose type isn't one of the
+// given op types. An empty list lets all the ops through.
+func (r *OplogOpsReader) SetOpTypes(opTypes []OpType) {
+	r.opTypes = opTypes
+}
+
+// SetNsFilter makes the reader skip all the ops against namespaces that
+// don't match the given filter.
+func (r *OplogOpsReader) SetNsFilter(nsFilter *NsFilter) {
+	r.nsFilter = nsFilter
+}
+
+// tail (re)starts tailing the oplog after the latest entry read
+func (r *OplogOpsReader) tail() {
+	var oldest oplogEntry
+	if err := r.oplog().Find(nil).Sort("$natural").One(&oldest); err == nil && oldest.Ts > r.lastTs {
+		// the entries we haven't read yet got overwritten: carry on, but loudly
+		r.logger.Errorf("The oplog rolled over, the ops between %v and %v are missed",
+			timeFromMongoTimestamp(r.lastTs), timeFromMongoTimestamp(oldest.Ts))
+	}
+
+	query := bson.M{"ts": bson.M{"$gt": r.lastTs}}
+	r.iter = r.oplog().Find(query).LogReplay().Tail(oplogTailTimeout)
+}
+
+func (r *OplogOpsReader) Next() *Op {
+	for {
+		select {
+		case <-r.closed:
+			if r.iter != nil {
+				r.iter.Close()
+				r.iter = nil
+			}
+			return nil
+		default:
+		}
+		if r.err == io.EOF {
+			return nil
+		}
+
+		if r.iter == nil {
+			r.tail()
+		}
+
+		var entry oplogEntry
+		if !r.iter.Next(&entry) {
+			if r.iter.Timeout() {
+				continue
+			}
+			// the cursor died, e.g. because the oplog rolled over or the
+			// connection got lost, so start over from where we are
+			if err := r.iter.Close(); err != nil {
+				r.logger.Errorf("Tailing the oplog failed, resuming after %v: %s",
+					timeFromMongoTimestamp(r.lastTs), err)
+				r.session.Refresh()
+			}
+			r.iter = nil
+			time.Sleep(oplogRetryInterval)
+			continue
+		}
+		r.lastTs = entry.Ts
+
+		op := opFromOplogEntry(&entry)
+		if op == nil {
+			continue
+		}
+		if !r.endTime.IsZero() && op.Timestamp.After(r.endTime) {
+			r.logger.Infof("Reached the end time after reading %d ops.", r.opsRead)
+			r.err = io.EOF
+			return nil
+		}
+		r.opsRead++
+
+		if !shouldIncludeOp(op, r.opTypes) || !r.nsFilter.Matches(canonicalNs(op)) {
+			continue
+		}
+		return op
+	}
+}
+
+// opFromOplogEntry translates the oplog entry into the op that made it, or
+// returns nil if the entry should be skipped.
+func opFromOplogEntry(entry *oplogEntry) *Op {
+	if entry.FromMigrate {
+		return nil
+	}
+
+	op := &Op{
+		Ns:        entry.Ns,
+		Timestamp: timeFromMongoTimestamp(entry.Ts),
+	}
+	switch entry.Op {
+	case "i":
+		op.Type = Insert
+		op.InsertDoc = entry.O
+	case "u":
+		op.Type = Update
+		op.QueryDoc = entry.O2
+		op.UpdateDoc = entry.O
+	case "d":
+		op.Type = Remove
+		op.QueryDoc = entry.O
+	default:
+		return nil
+	}
+
+	if _, _, err := splitNs(entry.Ns); err != nil {
+		return nil
+	}
+	normalizeOp(op)
+	return op
+}
+
+// SkipOps skips the next N ops
+func (r *OplogOpsReader) SkipOps(numSkipOps int) error {
+	for numSkipped := 0; numSkipped < numSkipOps; numSkipped++ {
+		if op := r.Next(); op == nil {
+			return r.Err()
+		}
+	}
+
+	r.logger.Infof("Done skipping %d ops.\n", numSkipOps)
+	return nil
+}
+
+// SetStartTime moves the reader to the first entry at the given time. Since
+// the oplog can be queried by time, no entries are actually skipped.
+func (r *OplogOpsReader) SetStartTime(startTime int64) (int64, error) {
+	if r.iter != nil {
+		r.iter.Close()
+		r.iter = nil
+	}
+	// tailing resumes *after* lastTs
+	r.lastTs = MongoTimestampFromMillis(startTime) - 1
+	return 0, nil
+}
+
+func (r *OplogOpsReader) SetEndTime(endTime int64) {
+	r.endTime = timeFromMillis(endTime)
+}
+
+func (r *OplogOpsReader) OpsRead() int {
+	return r.opsRead
+}
+
+func (r *OplogOpsReader) AllLoaded() bool {
+	return r.err == io.EOF
+}
+
+func (r *OplogOpsReader) Err() error {
+	return r.err
+}
+
+// Close stops the tailing, making Next return nil within oplogTailTimeout. It
+// may be called from another goroutine than the one reading the ops, but only
+// once.
+func (r *OplogOpsReader) Close() {
+	close(r.closed)
+}
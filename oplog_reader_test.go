@@ -0,0 +1,45 @@
+package flashback
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestOpFromOplogEntry(t *testing.T) {
+	ts := MongoTimestampFromMillis(1396456709420) + 3
+	ensure.DeepEqual(t, timeFromMongoTimestamp(ts), time.Unix(1396456709, 0))
+
+	op := opFromOplogEntry(&oplogEntry{Ts: ts, Op: "i", Ns: "db.coll", O: bson.D{{"_id", 1}}})
+	ensure.DeepEqual(t, *op, Op{
+		Ns:         "db.coll",
+		Timestamp:  time.Unix(1396456709, 0),
+		Type:       Insert,
+		InsertDoc:  bson.D{{"_id", 1}},
+		Database:   "db",
+		Collection: "coll",
+	})
+
+	op = opFromOplogEntry(&oplogEntry{Ts: ts, Op: "u", Ns: "db.coll",
+		O: bson.D{{"$set", bson.D{{"a", 1}}}}, O2: bson.D{{"_id", 1}}})
+	ensure.DeepEqual(t, op.Type, Update)
+	ensure.DeepEqual(t, op.QueryDoc, bson.D{{"_id", 1}})
+	ensure.DeepEqual(t, op.UpdateDoc, bson.D{{"$set", bson.D{{"a", 1}}}})
+
+	op = opFromOplogEntry(&oplogEntry{Ts: ts, Op: "d", Ns: "db.coll", O: bson.D{{"_id", 1}}})
+	ensure.DeepEqual(t, op.Type, Remove)
+	ensure.DeepEqual(t, op.QueryDoc, bson.D{{"_id", 1}})
+
+	// skipped entries
+	for _, entry := range []oplogEntry{
+		{Ts: ts, Op: "n", Ns: ""},
+		{Ts: ts, Op: "c", Ns: "db.$cmd", O: bson.D{{"drop", "coll"}}},
+		{Ts: ts, Op: "i", Ns: "db.coll", O: bson.D{{"_id", 1}}, FromMigrate: true},
+		{Ts: ts, Op: "i", Ns: "nocollection"},
+	} {
+		ensure.True(t, opFromOplogEntry(&entry) == nil)
+	}
+}
@@ -1,11 +1,24 @@
 package flashback
 
 import (
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"sync"
 	"time"
 )
 
-func NewBestEffortOpsDispatcher(reader OpsReader, opsSize int, logger *Logger) chan *Op {
+// NewBestEffortOpsDispatcher preloads up to opsSize ops, then dispatches them as
+// fast as they get consumed. If cyclic is set, the preloaded ops are
+// dispatched loops times over, or until the consumers stop if loops is 0.
+// Each pass then dispatches copies of the preloaded ops, so that an op still
+// being executed from one pass isn't handed out again by the next. The
+// dispatch is measured by the given meter, if not nil.
+func NewBestEffortOpsDispatcher(reader OpsReader, opsSize int, logger *Logger, cyclic bool,
+	loops int, meter *DispatchMeter) chan *Op {
 	queue := make([]*Op, opsSize, opsSize)
 	i := 0
 
@@ -30,12 +43,24 @@ func NewBestEffortOpsDispatcher(reader OpsReader, opsSize int, logger *Logger) c
 		}
 	}
 	opChannel := make(chan *Op, 10000)
+	meter.attach(opChannel)
 	// start a gorountine to dispatch these ops as fast as workers can handle.
 	go func() {
 		logger.Info("Started dispatching ops: as fast as possible")
+		if cyclic {
+			// without the nils padding the queue
+			queue = queue[:i]
+			for loop := 0; len(queue) > 0 && (loops == 0 || loop < loops); loop++ {
+				for _, op := range queue {
+					copied := *op
+					meter.send(opChannel, &copied)
+				}
+			}
+			queue = nil
+		}
 		for i, op := range queue {
 			queue[i] = nil
-			opChannel <- op
+			meter.send(opChannel, op)
 		}
 		close(opChannel)
 		logger.Info("Dispatching ended")
@@ -44,35 +69,642 @@ func NewBestEffortOpsDispatcher(reader OpsReader, opsSize int, logger *Logger) c
 	return opChannel
 }
 
-func NewByTimeOpsDispatcher(reader OpsReader, opsSize int, logger *Logger, speedup float64) chan *Op {
+// ErrOpsOutOfOrder is the error of a strict by time dispatch whose ops aren't
+// sorted by time
+var ErrOpsOutOfOrder = errors.New("the ops are not sorted by time")
+
+// DispatchStatus tells how a by time dispatch went. It is only safe to read
+// once the ops channel got closed.
+type DispatchStatus struct {
+	// how many ops were older than the op before them
+	Inversions int
+	// set if the dispatch stopped early
+	Err error
+	// how many ops were dispatched, the first one at FirstDispatch and the
+	// last one at LastDispatch
+	Dispatched    int
+	FirstDispatch time.Time
+	LastDispatch  time.Time
+}
+
+// Rate returns the average rate the ops were dispatched at, in ops per
+// second, from the first op to the last one, as RecordedRate measures it
+func (s *DispatchStatus) Rate() float64 {
+	span := s.LastDispatch.Sub(s.FirstDispatch)
+	if s.Dispatched < 2 || span <= 0 {
+		return 0
+	}
+	return float64(s.Dispatched-1) / span.Seconds()
+}
+
+// RecordedRate reads up to maxOps ops to tell the average rate they were
+// recorded at, in ops per second, from the first op to the last one. Replaying
+// them with a speedup of targetRate / RecordedRate with NewByTimeOpsDispatcher
+// thus keeps their bursts and lulls, while averaging targetRate.
+func RecordedRate(reader OpsReader, maxOps int) (float64, error) {
+	var first, last time.Time
+	ops := 0
+	for ; ops < maxOps; ops++ {
+		op := reader.Next()
+		if op == nil {
+			break
+		}
+		if ops == 0 {
+			first = op.Timestamp
+		}
+		if op.Timestamp.After(last) {
+			last = op.Timestamp
+		}
+	}
+	if err := reader.Err(); err != nil && err != io.EOF {
+		return 0, err
+	}
+	span := last.Sub(first)
+	if ops < 2 || span <= 0 {
+		return 0, fmt.Errorf("the %d ops read span no time, so they have no rate", ops)
+	}
+	return float64(ops-1) / span.Seconds(), nil
+}
+
+// NewByTimeOpsDispatcher replays the ops at the pace they were recorded at,
+// scaled by speedup. The time spent paused by the given pauser, if not nil,
+// doesn't count towards the schedule.
+//
+// The ops are expected to be sorted by time: an op older than the op before
+// it is dispatched right away, and counted as an inversion in the returned
+// status. If strictOrdering is set, the dispatch stops at the first inversion
+// instead, with ErrOpsOutOfOrder.
+//
+// If jitter isn't 0, each op is sent at a random offset within [-jitter,
+// +jitter] of its time, drawn from jitterSeed. The offset of an op doesn't
+// delay the ops after it, so the ops can go out of order within the jitter,
+// and the replay takes as long as without it.
+//
+// The dispatch is measured by the given meter, if not nil.
+func NewByTimeOpsDispatcher(reader OpsReader, opsSize int, logger *Logger, speedup float64,
+	pauser *Pauser, strictOrdering bool, jitter time.Duration, jitterSeed int64,
+	meter *DispatchMeter) (chan *Op, *DispatchStatus) {
 	opChannel := make(chan *Op, 5000)
+	meter.attach(opChannel)
+	status := &DispatchStatus{}
+	// with jitter, the ops are sent by timers as well as by the loop below
+	var sendMutex sync.Mutex
+	var pendingSends sync.WaitGroup
+	send := func(op *Op) {
+		sendMutex.Lock()
+		defer sendMutex.Unlock()
+		meter.send(opChannel, op)
+		status.LastDispatch = time.Now()
+		if status.Dispatched == 0 {
+			status.FirstDispatch = status.LastDispatch
+		}
+		status.Dispatched++
+	}
 	go func() {
 		logger.Info(fmt.Sprintf("Started replaying ops by time with speedup of %f", speedup))
+		rng := rand.New(rand.NewSource(jitterSeed))
 		now_epoch := time.Unix(0, 0)
 		epoch := time.Unix(0, 0)
+		pausedForAtEpoch := time.Duration(0)
+		var lastTimestamp time.Time
 		for i := 0; i < opsSize && !reader.AllLoaded(); i++ {
 			op := reader.Next()
 			if op == nil {
 				break
 			}
+			if op.Timestamp.Before(lastTimestamp) {
+				status.Inversions++
+				if strictOrdering {
+					logger.Errorf("Stopping the replay: op #%d is older than the op before it (%v < %v)",
+						reader.OpsRead(), op.Timestamp, lastTimestamp)
+					status.Err = ErrOpsOutOfOrder
+					break
+				}
+			} else {
+				lastTimestamp = op.Timestamp
+			}
+			if pauser != nil {
+				pauser.Wait()
+			}
 			if epoch.Unix() == 0 {
 				epoch = op.Timestamp
 				now_epoch = time.Now()
+				if pauser != nil {
+					pausedForAtEpoch = pauser.PausedFor()
+				}
 			}
 
 			elapsed := op.Timestamp.Sub(epoch)
 			currentElapsed := time.Now().Sub(now_epoch)
+			if pauser != nil {
+				currentElapsed -= pauser.PausedFor() - pausedForAtEpoch
+			}
 			currentElapsedScaled := time.Duration(float64(currentElapsed/time.Nanosecond) * speedup)
-			if elapsed > currentElapsedScaled {
-				time.Sleep(elapsed - currentElapsedScaled)
+			ahead := elapsed - currentElapsedScaled
+			if jitter > 0 {
+				// wake up early enough for the op to go out as much as jitter
+				// before its time, and leave the sending to a timer so that
+				// the ops after it are scheduled on time
+				if ahead > jitter {
+					time.Sleep(ahead - jitter)
+					ahead = jitter
+				}
+				if delay := ahead + jitterOffset(rng, jitter); delay > 0 {
+					pendingSends.Add(1)
+					time.AfterFunc(delay, func() {
+						send(op)
+						pendingSends.Done()
+					})
+				} else {
+					send(op)
+				}
+			} else {
+				// ops behind the schedule, including the out of order ones, go
+				// out right away
+				if ahead > 0 {
+					time.Sleep(ahead)
+				}
+				send(op)
 			}
-			opChannel <- op
 			if reader.OpsRead()%10000 == 0 {
 				logger.Info("Timestamp for latest op: ", op.Timestamp)
 			}
 		}
+		if status.Inversions > 0 {
+			logger.Errorf("%d ops were older than the op before them, and were replayed as soon as read",
+				status.Inversions)
+		}
+		pendingSends.Wait()
 		logger.Info("Dispatching ended")
 		close(opChannel)
 	}()
-	return opChannel
+	return opChannel, status
+}
+
+// jitterOffset returns a uniformly distributed offset within [-jitter, +jitter]
+func jitterOffset(rng *rand.Rand, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rng.Int63n(2*int64(jitter)+1)) - jitter
+}
+
+// NewRateLimitedOpsChan relays the ops from opsChan, at no more than
+// maxOpsPerSec ops per second. It works like a token bucket holding up to one
+// second worth of ops, so a lull in the ops doesn't turn into an unbounded
+// burst afterwards. Ops are never dropped: once the limit is hit, the relay
+// stops receiving, which in turn blocks the dispatcher feeding opsChan.
+func NewRateLimitedOpsChan(opsChan chan *Op, maxOpsPerSec float64, logger *Logger) chan *Op {
+	limitedChan := make(chan *Op)
+	go func() {
+		logger.Infof("Limiting the replay to %.2f ops/sec", maxOpsPerSec)
+		interval := time.Duration(float64(time.Second) / maxOpsPerSec)
+		next := time.Now()
+		for op := range opsChan {
+			now := time.Now()
+			if now.Sub(next) > time.Second {
+				next = now.Add(-time.Second)
+			} else if wait := next.Sub(now); wait > 0 {
+				time.Sleep(wait)
+			}
+			limitedChan <- op
+			next = next.Add(interval)
+		}
+		close(limitedChan)
+	}()
+	return limitedChan
+}
+
+// DispatchMeter measures the backpressure of the workers on the dispatch: how
+// many ops are queued in the channel of the dispatcher, and how long the
+// dispatcher is blocked sending to it. A channel that stays full means more
+// workers are needed, and one that stays empty (in stress mode) that the ops
+// can't be read fast enough.
+type DispatchMeter struct {
+	ops chan *Op
+
+	mutex sync.Mutex
+	// how long the dispatch was blocked on the workers in all, not counting
+	// the ongoing block, which started at blockedSince if any
+	blocked      time.Duration
+	blockedSince time.Time
+	// as of the previous sample
+	lastSample  time.Time
+	lastBlocked time.Duration
+}
+
+func NewDispatchMeter() *DispatchMeter {
+	return &DispatchMeter{lastSample: time.Now()}
+}
+
+// attach makes the meter measure the given channel, which the dispatcher
+// then sends its ops to with send
+func (m *DispatchMeter) attach(ops chan *Op) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	m.ops = ops
+	m.mutex.Unlock()
+}
+
+// send sends the op to the channel, timing how long it blocks because the
+// channel is full. A nil meter just sends it.
+func (m *DispatchMeter) send(ops chan *Op, op *Op) {
+	if m == nil {
+		ops <- op
+		return
+	}
+	select {
+	case ops <- op:
+		return
+	default:
+	}
+	m.mutex.Lock()
+	m.blockedSince = time.Now()
+	m.mutex.Unlock()
+	ops <- op
+	m.mutex.Lock()
+	m.blocked += time.Now().Sub(m.blockedSince)
+	m.blockedSince = time.Time{}
+	m.mutex.Unlock()
+}
+
+// Sample returns how many ops are queued for the workers, out of how many
+// fit, and the fraction of the time since the previous sample the dispatch
+// was blocked because the queue was full.
+func (m *DispatchMeter) Sample() (queued int, capacity int, blockedFraction float64) {
+	return m.sample(time.Now())
+}
+
+func (m *DispatchMeter) sample(now time.Time) (int, int, float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	blocked := m.blocked
+	if !m.blockedSince.IsZero() {
+		blocked += now.Sub(m.blockedSince)
+	}
+	fraction := 0.0
+	if elapsed := now.Sub(m.lastSample); elapsed > 0 {
+		fraction = math.Min(float64(blocked-m.lastBlocked)/float64(elapsed), 1)
+	}
+	m.lastSample, m.lastBlocked = now, blocked
+	return len(m.ops), cap(m.ops), fraction
+}
+
+// InflightLimiter caps how many ops are in flight at once, which probes the
+// target at a given concurrency rather than at a given rate. Unlike the
+// number of workers, it counts the ops actually outstanding, since a worker
+// may be idle. The workers call Acquire before executing each op, and Release
+// once it's done.
+type InflightLimiter struct {
+	tokens chan struct{}
+}
+
+func NewInflightLimiter(maxInflight int) *InflightLimiter {
+	return &InflightLimiter{tokens: make(chan struct{}, maxInflight)}
+}
+
+// Acquire blocks until fewer than maxInflight ops are in flight
+func (l *InflightLimiter) Acquire() {
+	l.tokens <- struct{}{}
+}
+
+// Release tells that an op acquired for is done
+func (l *InflightLimiter) Release() {
+	<-l.tokens
+}
+
+// Inflight returns how many ops are in flight
+func (l *InflightLimiter) Inflight() int {
+	return len(l.tokens)
+}
+
+// OpRateLimiter caps the rate of given op types, e.g. to hold the aggregates
+// to 50 ops/sec while the other ops run unbounded. Each op type has its own
+// token bucket, holding up to one second worth of ops like the one of
+// NewRateLimitedOpsChan. Unlike that one, it is applied by NewOpTypeOpsChans
+// to the queue of each limited op type, so that the ops held back don't hold
+// back the ops of the other types behind them, nor the workers.
+type OpRateLimiter struct {
+	mutex   sync.Mutex
+	start   time.Time
+	buckets map[OpType]*rateBucket
+}
+
+type rateBucket struct {
+	limit    float64
+	interval time.Duration
+	// when the next op may go
+	next time.Time
+	ops  int64
+}
+
+func NewOpRateLimiter(limits map[OpType]float64) *OpRateLimiter {
+	buckets := make(map[OpType]*rateBucket, len(limits))
+	for opType, limit := range limits {
+		buckets[opType] = &rateBucket{limit: limit, interval: time.Duration(float64(time.Second) / limit)}
+	}
+	return &OpRateLimiter{buckets: buckets}
+}
+
+// reserve counts an op of the given type, and returns how long it has to
+// wait. The op types without a limit always go right away.
+func (l *OpRateLimiter) reserve(opType OpType, now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.start.IsZero() {
+		l.start = now
+	}
+	bucket, ok := l.buckets[opType]
+	if !ok {
+		return 0
+	}
+	bucket.ops++
+	if now.Sub(bucket.next) > time.Second {
+		bucket.next = now.Add(-time.Second)
+	}
+	wait := bucket.next.Sub(now)
+	bucket.next = bucket.next.Add(bucket.interval)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// limited returns whether the ops of the given type are limited
+func (l *OpRateLimiter) limited(opType OpType) bool {
+	if l == nil {
+		return false
+	}
+	_, ok := l.buckets[opType]
+	return ok
+}
+
+// Limits returns the limits of the op types, in ops/sec
+func (l *OpRateLimiter) Limits() map[OpType]float64 {
+	limits := make(map[OpType]float64, len(l.buckets))
+	for opType, bucket := range l.buckets {
+		limits[opType] = bucket.limit
+	}
+	return limits
+}
+
+// Rates returns the rates the limited op types achieved since the first op,
+// in ops/sec
+func (l *OpRateLimiter) Rates() map[OpType]float64 {
+	return l.rates(time.Now())
+}
+
+func (l *OpRateLimiter) rates(now time.Time) map[OpType]float64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	rates := make(map[OpType]float64, len(l.buckets))
+	elapsed := now.Sub(l.start).Seconds()
+	for opType, bucket := range l.buckets {
+		if elapsed > 0 {
+			rates[opType] = float64(bucket.ops) / elapsed
+		} else {
+			rates[opType] = 0
+		}
+	}
+	return rates
+}
+
+// NewOpTypeOpsChans splits the ops from opsChan by op type: the ops of each of
+// the given op types go to a channel of their own, so that they can be served
+// by dedicated workers, and all the other ops go to the returned shared
+// channel. That way slow ops, such as aggregations, don't hold up the
+// workers serving fast ones.
+//
+// Each channel is fed through a queue of its own, see queueOps, so that a
+// channel that is full doesn't stop the others from receiving ops. The ops
+// of a type whose workers lag behind pile up in memory instead. The ops of
+// the types the given limiter (if any) limits are held in their queue until
+// they may go, the ones without dedicated workers going to the shared
+// channel through a queue of their own too. Closing stop stops the queues.
+func NewOpTypeOpsChans(opsChan chan *Op, opTypes []OpType, limiter *OpRateLimiter,
+	stop chan struct{}) (map[OpType]chan *Op, chan *Op) {
+	opTypeChans := make(map[OpType]chan *Op, len(opTypes))
+	opTypeQueues := make(map[OpType]chan *Op)
+	hold := func(opType OpType) func(now time.Time) time.Duration {
+		if !limiter.limited(opType) {
+			return nil
+		}
+		return func(now time.Time) time.Duration {
+			return limiter.reserve(opType, now)
+		}
+	}
+	for _, opType := range opTypes {
+		opTypeChan, opTypeQueue := make(chan *Op, 1000), make(chan *Op)
+		opTypeChans[opType], opTypeQueues[opType] = opTypeChan, opTypeQueue
+		go func(opType OpType) {
+			queueOps(opTypeQueue, opTypeChan, hold(opType), stop)
+			close(opTypeChan)
+		}(opType)
+	}
+
+	sharedChan := make(chan *Op, 1000)
+	var sharedQueues sync.WaitGroup
+	startSharedQueue := func(opType OpType) chan *Op {
+		sharedQueue := make(chan *Op)
+		sharedQueues.Add(1)
+		go func() {
+			defer sharedQueues.Done()
+			queueOps(sharedQueue, sharedChan, hold(opType), stop)
+		}()
+		return sharedQueue
+	}
+	if limiter != nil {
+		for opType := range limiter.buckets {
+			if _, ok := opTypeQueues[opType]; !ok {
+				opTypeQueues[opType] = startSharedQueue(opType)
+			}
+		}
+	}
+	// the op types not limited share the same queue
+	sharedQueue := startSharedQueue("")
+	go func() {
+		sharedQueues.Wait()
+		close(sharedChan)
+	}()
+
+	go func() {
+		defer func() {
+			for _, opTypeQueue := range opTypeQueues {
+				close(opTypeQueue)
+			}
+			close(sharedQueue)
+		}()
+		for op := range opsChan {
+			// the best effort dispatcher pads the ops with nils
+			if op == nil {
+				break
+			}
+			queue, ok := opTypeQueues[canonicalOpType(op)]
+			if !ok {
+				queue = sharedQueue
+			}
+			select {
+			case queue <- op:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return opTypeChans, sharedChan
+}
+
+// queueOps relays the ops from in to out, in order, queueing the ones out has
+// no room for, so that in is always ready to receive. If hold is given, each
+// op is held in the queue for as long as hold returns, once it's first in
+// line. queueOps returns once in is closed and all the ops are relayed, or
+// once stop is closed.
+func queueOps(in chan *Op, out chan *Op, hold func(now time.Time) time.Duration, stop chan struct{}) {
+	var queue []*Op
+	// whether the first op was held already, and until when
+	held := false
+	var release <-chan time.Time
+	for in != nil || len(queue) > 0 {
+		if len(queue) > 0 && hold != nil && !held {
+			held = true
+			if wait := hold(time.Now()); wait > 0 {
+				release = time.After(wait)
+			}
+		}
+		// a nil channel blocks, which leaves the send out while the queue is
+		// empty or its first op is held
+		var send chan *Op
+		var next *Op
+		if len(queue) > 0 && release == nil {
+			send = out
+			next = queue[0]
+		}
+		select {
+		case op, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			queue = append(queue, op)
+		case send <- next:
+			queue[0] = nil
+			queue = queue[1:]
+			held = false
+		case <-release:
+			release = nil
+		case <-stop:
+			return
+		}
+	}
+}
+
+// NewSessionPinnedOpsChans splits the ops from opsChan into one channel per
+// worker, such that all the ops sharing a session id go to the same worker.
+// That preserves the ordering within each session (e.g. reading one's own
+// writes) while still running different sessions in parallel. Ops without a
+// session id are spread round-robin.
+//
+// A worker lagging behind eventually blocks the others, since the ops have
+// to be handed out in order. The workers send their index to exited when they
+// stop, e.g. when they aren't authorized to run an op, after which the ops
+// pinned to them get dropped rather than blocking the others. exited needs
+// room for all the workers, or may be nil if they don't stop early.
+func NewSessionPinnedOpsChans(opsChan chan *Op, workers int, exited chan int) []chan *Op {
+	return newPinnedOpsChans(opsChan, workers, exited, func(op *Op) string {
+		return op.SessionId
+	})
+}
+
+// NewNsPinnedOpsChans works like NewSessionPinnedOpsChans, but pins the ops
+// to the workers by collection, so that the writes to each document are
+// replayed in order even as fast as possible. The commands (e.g. count or
+// findAndModify) are pinned by the collection they run against, along with
+// the other ops on it.
+func NewNsPinnedOpsChans(opsChan chan *Op, workers int, exited chan int) []chan *Op {
+	return newPinnedOpsChans(opsChan, workers, exited, pinnedNs)
+}
+
+// NewRoundRobinOpsChans splits the ops from opsChan into one channel per
+// worker, op i going to worker i mod workers, so that each worker gets the
+// same ops from one replay to the next rather than whichever ops the
+// scheduler hands it. Like for the pinned channels, a worker lagging behind
+// eventually blocks the others, so that costs some throughput.
+func NewRoundRobinOpsChans(opsChan chan *Op, workers int, exited chan int) []chan *Op {
+	return newPinnedOpsChans(opsChan, workers, exited, func(op *Op) string {
+		return ""
+	})
+}
+
+// pinnedNs returns the namespace the op is run against
+func pinnedNs(op *Op) string {
+	database, collection, err := splitNs(op.Ns)
+	if err != nil || collection != "$cmd" || len(op.CommandDoc) == 0 {
+		return op.Ns
+	}
+	if name, ok := op.CommandDoc[0].Value.(string); ok {
+		return database + "." + name
+	}
+	return op.Ns
+}
+
+// newPinnedOpsChans sends all the ops with the same key to the same worker,
+// and the ops without one round-robin. The ops pinned to a worker which
+// stopped, see exited, are dropped, while the others go to the workers left.
+func newPinnedOpsChans(opsChan chan *Op, workers int, exited chan int, key func(op *Op) string) []chan *Op {
+	workerChans := make([]chan *Op, workers)
+	for i := range workerChans {
+		workerChans[i] = make(chan *Op, 100)
+	}
+
+	go func() {
+		stopped := make([]bool, workers)
+		next := 0
+		// pick returns the worker the op with the given key goes to, or -1
+		// if the op has to be dropped
+		pick := func(opKey string) int {
+			if opKey != "" {
+				hash := fnv.New32a()
+				hash.Write([]byte(opKey))
+				if worker := int(hash.Sum32() % uint32(workers)); !stopped[worker] {
+					return worker
+				}
+				return -1
+			}
+			for i := 0; i < workers; i++ {
+				worker := next
+				next = (next + 1) % workers
+				if !stopped[worker] {
+					return worker
+				}
+			}
+			return -1
+		}
+
+		for op := range opsChan {
+			// the best effort dispatcher pads the ops with nils
+			if op == nil {
+				break
+			}
+
+			// a stopped worker no longer drains its channel, so it's only
+			// noticed once the channel is full
+			opKey := key(op)
+			for worker := pick(opKey); worker >= 0; {
+				select {
+				case workerChans[worker] <- op:
+					worker = -1
+				case id := <-exited:
+					stopped[id] = true
+					if id == worker {
+						worker = pick(opKey)
+					}
+				}
+			}
+		}
+		for _, workerChan := range workerChans {
+			close(workerChan)
+		}
+	}()
+	return workerChans
 }
@@ -0,0 +1,524 @@
+package flashback
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRateLimitedOpsChan(t *testing.T) {
+	logger, _ := NewLogger("", "")
+	opsChan := make(chan *Op, 20)
+	for i := 0; i < 20; i++ {
+		opsChan <- &Op{Type: Insert}
+	}
+	close(opsChan)
+
+	start := time.Now()
+	opsRead := 0
+	for range NewRateLimitedOpsChan(opsChan, 100, logger) {
+		opsRead++
+	}
+	elapsed := time.Now().Sub(start)
+
+	// the first op goes out right away, the other ones 10ms apart
+	ensure.DeepEqual(t, opsRead, 20)
+	ensure.True(t, elapsed >= 190*time.Millisecond, elapsed)
+	ensure.True(t, elapsed < time.Second, elapsed)
+}
+
+func TestInflightLimiter(t *testing.T) {
+	limiter := NewInflightLimiter(3)
+	var inflight, maxInflight int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limiter.Acquire()
+			defer limiter.Release()
+			current := atomic.AddInt32(&inflight, 1)
+			for {
+				seen := atomic.LoadInt32(&maxInflight)
+				if current <= seen || atomic.CompareAndSwapInt32(&maxInflight, seen, current) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&inflight, -1)
+		}()
+	}
+	wg.Wait()
+
+	ensure.DeepEqual(t, atomic.LoadInt32(&maxInflight), int32(3))
+	ensure.DeepEqual(t, limiter.Inflight(), 0)
+}
+
+func TestDispatchMeter(t *testing.T) {
+	meter := NewDispatchMeter()
+	metered := make(chan *Op, 2)
+	meter.attach(metered)
+	queued, capacity, blocked := meter.Sample()
+	ensure.DeepEqual(t, queued, 0)
+	ensure.DeepEqual(t, capacity, 2)
+	ensure.DeepEqual(t, blocked, float64(0))
+
+	// nobody reads the ops, so the third one blocks the dispatch
+	go func() {
+		for i := 0; i < 3; i++ {
+			meter.send(metered, &Op{})
+		}
+		close(metered)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	queued, _, blocked = meter.Sample()
+	ensure.DeepEqual(t, queued, 2)
+	ensure.True(t, blocked > 0.5)
+	// the ongoing block counts too
+	time.Sleep(10 * time.Millisecond)
+	_, _, blocked = meter.Sample()
+	ensure.DeepEqual(t, blocked, float64(1))
+
+	for i := 0; i < 3; i++ {
+		ensure.NotNil(t, <-metered)
+	}
+	_, ok := <-metered
+	ensure.False(t, ok)
+}
+
+func TestOpRateLimiter(t *testing.T) {
+	limiter := NewOpRateLimiter(map[OpType]float64{Aggregate: 10})
+	start := time.Now()
+	// the second worth of ops in the bucket, and the next one, go right away,
+	// then one every 100ms
+	for i := 0; i < 11; i++ {
+		ensure.DeepEqual(t, limiter.reserve(Aggregate, start), time.Duration(0))
+	}
+	ensure.DeepEqual(t, limiter.reserve(Aggregate, start), 100*time.Millisecond)
+	ensure.DeepEqual(t, limiter.reserve(Aggregate, start), 200*time.Millisecond)
+	// the other op types aren't limited
+	ensure.DeepEqual(t, limiter.reserve(Query, start), time.Duration(0))
+
+	// a lull doesn't turn into a burst
+	later := start.Add(time.Minute)
+	for i := 0; i < 11; i++ {
+		ensure.DeepEqual(t, limiter.reserve(Aggregate, later), time.Duration(0))
+	}
+	ensure.DeepEqual(t, limiter.reserve(Aggregate, later), 100*time.Millisecond)
+
+	ensure.DeepEqual(t, limiter.Limits(), map[OpType]float64{Aggregate: 10})
+	ensure.DeepEqual(t, limiter.rates(start.Add(25*time.Second)), map[OpType]float64{Aggregate: 1})
+}
+
+func TestCyclicBestEffortOpsDispatcher(t *testing.T) {
+	logger, _ := NewLogger("", "")
+	var ops []Op
+	for i := 0; i < 3; i++ {
+		ops = append(ops, Op{Ns: "db.c1", Type: Insert, NToSkip: int64(i), Timestamp: time.Unix(1396456709, 0)})
+	}
+	_, reader := NewByLineOpsReader(newMockOpsStreamReader(t, ops), logger, "")
+	opsChan := NewBestEffortOpsDispatcher(reader, 10, logger, true, 0, nil)
+
+	// the ops keep coming, without the nils padding the preloaded ones, as
+	// new copies on each pass
+	seen := make(map[*Op]bool)
+	for i := 0; i < 10; i++ {
+		op := <-opsChan
+		ensure.True(t, op != nil)
+		ensure.DeepEqual(t, op.NToSkip, int64(i%3))
+		ensure.False(t, seen[op])
+		seen[op] = true
+	}
+
+	_, reader = NewByLineOpsReader(newMockOpsStreamReader(t, ops), logger, "")
+	opsChan = NewBestEffortOpsDispatcher(reader, 10, logger, true, 2, nil)
+	dispatched := 0
+	for range opsChan {
+		dispatched++
+	}
+	ensure.DeepEqual(t, dispatched, 2*len(ops))
+}
+
+func TestByTimeOpsDispatcherOrdering(t *testing.T) {
+	logger, _ := NewLogger("", "")
+	start := time.Unix(1396456709, 0)
+	var ops []Op
+	for _, ms := range []int{0, 10, 5, 20, 15, 30} {
+		ops = append(ops, Op{Ns: "db.c1", Type: Insert, Timestamp: start.Add(time.Duration(ms) * time.Millisecond)})
+	}
+	dispatch := func(strictOrdering bool) (int, *DispatchStatus) {
+		_, reader := NewByLineOpsReader(newMockOpsStreamReader(t, ops), logger, "")
+		opsChan, status := NewByTimeOpsDispatcher(reader, len(ops), logger, 1, nil, strictOrdering, 0, 0, nil)
+		dispatched := 0
+		for range opsChan {
+			dispatched++
+		}
+		return dispatched, status
+	}
+
+	// the out of order ops still get replayed
+	dispatched, status := dispatch(false)
+	ensure.DeepEqual(t, dispatched, len(ops))
+	ensure.DeepEqual(t, status.Dispatched, len(ops))
+	ensure.False(t, status.LastDispatch.Before(status.FirstDispatch))
+	ensure.DeepEqual(t, status.Inversions, 2)
+	ensure.Nil(t, status.Err)
+
+	dispatched, status = dispatch(true)
+	ensure.DeepEqual(t, dispatched, 2)
+	ensure.DeepEqual(t, status.Inversions, 1)
+	ensure.DeepEqual(t, status.Err, ErrOpsOutOfOrder)
+}
+
+func TestByTimeOpsDispatcherJitter(t *testing.T) {
+	logger, _ := NewLogger("", "")
+	start := time.Unix(1396456709, 0)
+	var ops []Op
+	for i := 0; i < 200; i++ {
+		ops = append(ops, Op{Ns: "db.c1", Type: Insert, NToSkip: int64(i),
+			Timestamp: start.Add(time.Duration(i) * time.Millisecond)})
+	}
+	jitter := 20 * time.Millisecond
+	_, reader := NewByLineOpsReader(newMockOpsStreamReader(t, ops), logger, "")
+	opsChan, status := NewByTimeOpsDispatcher(reader, len(ops), logger, 1, nil, false, jitter, 1, nil)
+
+	// the ops are as early as they are late, rather than each being held up
+	// by the latest op before it
+	began := time.Now()
+	var lateness time.Duration
+	dispatched := 0
+	for op := range opsChan {
+		lateness += time.Since(began) - time.Duration(op.NToSkip)*time.Millisecond
+		dispatched++
+	}
+	ensure.DeepEqual(t, dispatched, len(ops))
+	ensure.DeepEqual(t, status.Dispatched, len(ops))
+	mean := lateness / time.Duration(len(ops))
+	ensure.True(t, mean > -jitter/4 && mean < jitter/4, mean)
+}
+
+func TestRecordedRate(t *testing.T) {
+	logger, _ := NewLogger("", "")
+	start := time.Unix(1396456709, 0)
+	var ops []Op
+	// 11 ops over 2 seconds, in bursts
+	for _, ms := range []int{0, 10, 20, 30, 40, 1000, 1010, 1020, 1990, 1995, 2000} {
+		ops = append(ops, Op{Ns: "db.c1", Type: Insert, Timestamp: start.Add(time.Duration(ms) * time.Millisecond)})
+	}
+	_, reader := NewByLineOpsReader(newMockOpsStreamReader(t, ops), logger, "")
+	rate, err := RecordedRate(reader, len(ops))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, rate, 5.0)
+
+	// only up to maxOps get read
+	_, reader = NewByLineOpsReader(newMockOpsStreamReader(t, ops), logger, "")
+	rate, err = RecordedRate(reader, 6)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, rate, 5.0)
+
+	_, reader = NewByLineOpsReader(newMockOpsStreamReader(t, ops[:1]), logger, "")
+	_, err = RecordedRate(reader, len(ops))
+	ensure.NotNil(t, err)
+
+	// the dispatch rate is measured likewise
+	status := &DispatchStatus{Dispatched: 11, FirstDispatch: start, LastDispatch: start.Add(2 * time.Second)}
+	ensure.DeepEqual(t, status.Rate(), 5.0)
+	ensure.DeepEqual(t, (&DispatchStatus{Dispatched: 1}).Rate(), 0.0)
+}
+
+func TestJitterOffset(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	ensure.DeepEqual(t, jitterOffset(rng, 0), time.Duration(0))
+
+	jitter := 10 * time.Millisecond
+	var sum time.Duration
+	for i := 0; i < 10000; i++ {
+		offset := jitterOffset(rng, jitter)
+		ensure.True(t, offset >= -jitter && offset <= jitter, offset)
+		sum += offset
+	}
+	// zero-mean, give or take
+	mean := sum / 10000
+	ensure.True(t, mean > -jitter/10 && mean < jitter/10, mean)
+}
+
+func TestSessionPinnedOpsChans(t *testing.T) {
+	opsChan := make(chan *Op, 100)
+	for i := 0; i < 90; i++ {
+		opsChan <- &Op{SessionId: fmt.Sprintf("session%d", i%3), NToSkip: int64(i)}
+	}
+	for i := 0; i < 10; i++ {
+		opsChan <- &Op{NToSkip: int64(i)}
+	}
+	close(opsChan)
+
+	workerChans := NewSessionPinnedOpsChans(opsChan, 4, nil)
+	ensure.DeepEqual(t, len(workerChans), 4)
+
+	sessionWorkers := make(map[string]int)
+	lastSeen := make(map[string]int64)
+	opsRead := 0
+	noSessionOps := make([]int, len(workerChans))
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	for i, workerChan := range workerChans {
+		wg.Add(1)
+		go func(worker int, workerChan chan *Op) {
+			defer wg.Done()
+			for op := range workerChan {
+				mutex.Lock()
+				opsRead++
+				if op.SessionId == "" {
+					noSessionOps[worker]++
+				} else {
+					if pinned, ok := sessionWorkers[op.SessionId]; ok {
+						ensure.DeepEqual(t, worker, pinned)
+						// in order within the session
+						ensure.True(t, op.NToSkip > lastSeen[op.SessionId])
+					}
+					sessionWorkers[op.SessionId] = worker
+					lastSeen[op.SessionId] = op.NToSkip
+				}
+				mutex.Unlock()
+			}
+		}(i, workerChan)
+	}
+	wg.Wait()
+
+	ensure.DeepEqual(t, opsRead, 100)
+	ensure.DeepEqual(t, len(sessionWorkers), 3)
+	// round-robin
+	ensure.DeepEqual(t, noSessionOps, []int{3, 3, 2, 2})
+}
+
+func TestSessionPinnedOpsChansStoppedWorker(t *testing.T) {
+	opsChan := make(chan *Op, 1100)
+	for i := 0; i < 1000; i++ {
+		opsChan <- &Op{SessionId: fmt.Sprintf("session%d", i%10), NToSkip: int64(i)}
+	}
+	for i := 0; i < 100; i++ {
+		opsChan <- &Op{NToSkip: int64(i)}
+	}
+	close(opsChan)
+
+	pinnedWorker := func(sessionId string) int {
+		hash := fnv.New32a()
+		hash.Write([]byte(sessionId))
+		return int(hash.Sum32() % 2)
+	}
+	pinnedOps := 0
+	for i := 0; i < 10; i++ {
+		if pinnedWorker(fmt.Sprintf("session%d", i)) == 0 {
+			pinnedOps += 100
+		}
+	}
+	ensure.True(t, pinnedOps > 0 && pinnedOps < 1000, pinnedOps)
+
+	// worker 1 stops before reading any op, e.g. as it isn't authorized to
+	// run one, which mustn't hold up worker 0 once its channel is full
+	exited := make(chan int, 2)
+	exited <- 1
+	workerChans := NewSessionPinnedOpsChans(opsChan, 2, exited)
+	sessionOps := 0
+	for op := range workerChans[0] {
+		if op.SessionId != "" {
+			ensure.DeepEqual(t, pinnedWorker(op.SessionId), 0)
+			sessionOps++
+		}
+	}
+	ensure.DeepEqual(t, sessionOps, pinnedOps)
+}
+
+func TestNsPinnedOpsChans(t *testing.T) {
+	opsChan := make(chan *Op, 100)
+	for i := 0; i < 30; i++ {
+		opsChan <- &Op{Ns: fmt.Sprintf("db.c%d", i%3), NToSkip: int64(i)}
+	}
+	// the commands go along with the ops on their collection
+	for i := 30; i < 40; i++ {
+		opsChan <- &Op{Ns: "db.$cmd", CommandDoc: bson.D{{"count", "c1"}}, NToSkip: int64(i)}
+	}
+	close(opsChan)
+
+	workerChans := NewNsPinnedOpsChans(opsChan, 4, nil)
+	ensure.DeepEqual(t, len(workerChans), 4)
+	nsWorkers := make(map[string]int)
+	lastSeen := make(map[string]int64)
+	opsRead := 0
+	for worker, workerChan := range workerChans {
+		// the channels are buffered, so they can be drained one after the other
+		for op := range workerChan {
+			opsRead++
+			ns := pinnedNs(op)
+			if pinned, ok := nsWorkers[ns]; ok {
+				ensure.DeepEqual(t, worker, pinned)
+				ensure.True(t, op.NToSkip > lastSeen[ns])
+			}
+			nsWorkers[ns] = worker
+			lastSeen[ns] = op.NToSkip
+		}
+	}
+	ensure.DeepEqual(t, opsRead, 40)
+	ensure.DeepEqual(t, len(nsWorkers), 3)
+	ensure.DeepEqual(t, lastSeen["db.c1"], int64(39))
+}
+
+func TestNsPinnedOpsChansStoppedWorker(t *testing.T) {
+	opsChan := make(chan *Op, 1000)
+	for i := 0; i < 1000; i++ {
+		opsChan <- &Op{Ns: fmt.Sprintf("db.c%d", i%10), NToSkip: int64(i)}
+	}
+	close(opsChan)
+
+	pinnedWorker := func(ns string) int {
+		hash := fnv.New32a()
+		hash.Write([]byte(ns))
+		return int(hash.Sum32() % 2)
+	}
+	pinnedOps := 0
+	for i := 0; i < 10; i++ {
+		if pinnedWorker(fmt.Sprintf("db.c%d", i)) == 0 {
+			pinnedOps += 100
+		}
+	}
+	ensure.True(t, pinnedOps > 0 && pinnedOps < 1000, pinnedOps)
+
+	// the collections of worker 0 still get all their ops, in order, once
+	// worker 1 stopped
+	exited := make(chan int, 2)
+	exited <- 1
+	workerChans := NewNsPinnedOpsChans(opsChan, 2, exited)
+	lastSeen := make(map[string]int64)
+	opsRead := 0
+	for op := range workerChans[0] {
+		ensure.DeepEqual(t, pinnedWorker(op.Ns), 0)
+		if last, ok := lastSeen[op.Ns]; ok {
+			ensure.True(t, op.NToSkip > last)
+		}
+		lastSeen[op.Ns] = op.NToSkip
+		opsRead++
+	}
+	ensure.DeepEqual(t, opsRead, pinnedOps)
+}
+
+func TestRoundRobinOpsChans(t *testing.T) {
+	opsChan := make(chan *Op, 100)
+	for i := 0; i < 30; i++ {
+		// the sessions don't matter
+		opsChan <- &Op{SessionId: "s1", NToSkip: int64(i)}
+	}
+	close(opsChan)
+
+	workerChans := NewRoundRobinOpsChans(opsChan, 4, nil)
+	ensure.DeepEqual(t, len(workerChans), 4)
+	opsRead := 0
+	for worker, workerChan := range workerChans {
+		expected := int64(worker)
+		for op := range workerChan {
+			opsRead++
+			ensure.DeepEqual(t, op.NToSkip, expected)
+			expected += 4
+		}
+	}
+	ensure.DeepEqual(t, opsRead, 30)
+}
+
+func TestOpTypeOpsChans(t *testing.T) {
+	opsChan := make(chan *Op, 100)
+	for i := 0; i < 10; i++ {
+		opsChan <- &Op{Type: Query}
+		opsChan <- &Op{Type: Command, CommandDoc: bson.D{{"aggregate", "c1"}}}
+		opsChan <- &Op{Type: Insert}
+	}
+	close(opsChan)
+
+	opTypeChans, sharedChan := NewOpTypeOpsChans(opsChan, []OpType{Query, Aggregate}, nil, nil)
+	ensure.DeepEqual(t, len(opTypeChans), 2)
+	opTypesRead := func(opsChan chan *Op) map[OpType]int {
+		read := make(map[OpType]int)
+		for op := range opsChan {
+			read[canonicalOpType(op)]++
+		}
+		return read
+	}
+	// the channels are buffered, so they can be drained one after the other
+	ensure.DeepEqual(t, opTypesRead(opTypeChans[Query]), map[OpType]int{Query: 10})
+	ensure.DeepEqual(t, opTypesRead(opTypeChans[Aggregate]), map[OpType]int{Aggregate: 10})
+	ensure.DeepEqual(t, opTypesRead(sharedChan), map[OpType]int{Insert: 10})
+}
+
+func TestOpTypeOpsChansSlowOpType(t *testing.T) {
+	opsChan := make(chan *Op)
+	opTypeChans, sharedChan := NewOpTypeOpsChans(opsChan, []OpType{Aggregate}, nil, nil)
+
+	// nobody reads the aggregates, yet the queries keep flowing
+	const ops = 5000
+	go func() {
+		for i := 0; i < ops; i++ {
+			opsChan <- &Op{Type: Command, CommandDoc: bson.D{{"aggregate", "c1"}}}
+			opsChan <- &Op{Type: Query}
+		}
+		close(opsChan)
+	}()
+	queries := 0
+	timeout := time.After(5 * time.Second)
+	for queries < ops {
+		select {
+		case op := <-sharedChan:
+			ensure.DeepEqual(t, op.Type, Query)
+			queries++
+		case <-timeout:
+			t.Fatalf("only %d of the %d queries went through", queries, ops)
+		}
+	}
+	_, ok := <-sharedChan
+	ensure.False(t, ok)
+
+	// the aggregates got queued in the meantime
+	aggregates := 0
+	for range opTypeChans[Aggregate] {
+		aggregates++
+	}
+	ensure.DeepEqual(t, aggregates, ops)
+}
+
+func TestOpTypeOpsChansRateLimited(t *testing.T) {
+	opsChan := make(chan *Op, 200)
+	for i := 0; i < 100; i++ {
+		opsChan <- &Op{Type: Command, CommandDoc: bson.D{{"aggregate", "c1"}}}
+		opsChan <- &Op{Type: Query}
+	}
+	stop := make(chan struct{})
+	start := time.Now()
+	_, sharedChan := NewOpTypeOpsChans(opsChan, nil, NewOpRateLimiter(map[OpType]float64{Aggregate: 10}), stop)
+
+	// the aggregates held back don't hold back the queries behind them
+	read := make(map[OpType]int)
+	timeout := time.After(500 * time.Millisecond)
+	for read[Query] < 100 {
+		select {
+		case op := <-sharedChan:
+			read[canonicalOpType(op)]++
+		case <-timeout:
+			t.Fatalf("only %d of the 100 queries went through", read[Query])
+		}
+	}
+	// while the aggregates trickle, the second worth of them in the bucket
+	// and one every 100ms
+	for read[Aggregate] < 13 {
+		read[canonicalOpType(<-sharedChan)]++
+	}
+	ensure.True(t, time.Now().Sub(start) >= 200*time.Millisecond)
+
+	// the queues stop holding the ops once stopped
+	close(stop)
+	for range sharedChan {
+	}
+}
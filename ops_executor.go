@@ -3,6 +3,12 @@ package flashback
 import (
 	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/mgo.v2"
@@ -11,8 +17,108 @@ import (
 
 var (
 	NotSupported = errors.New("op type not supported")
+	// the error of the ops that ran out of their time budget, see SetOpBudget
+	OpTimedOut = errors.New("op exceeded its time budget")
 )
 
+// ErrorCategory buckets op errors by their likely cause
+type ErrorCategory string
+
+const (
+	SocketError       ErrorCategory = "socket"
+	QueryError        ErrorCategory = "query"
+	DuplicateKeyError ErrorCategory = "duplicate_key"
+	NotFoundError     ErrorCategory = "not_found"
+	TimeoutError      ErrorCategory = "timeout"
+	OtherError        ErrorCategory = "other"
+)
+
+// AllErrorCategories specifies all the error categories, in reporting order
+var AllErrorCategories = []ErrorCategory{
+	SocketError,
+	QueryError,
+	DuplicateKeyError,
+	NotFoundError,
+	TimeoutError,
+	OtherError,
+}
+
+// ParseErrorCategories parses a comma-separated list of error categories,
+// such as "duplicate_key,not_found", making sure each of them is one of
+// AllErrorCategories.
+func ParseErrorCategories(list string) ([]ErrorCategory, error) {
+	if list == "" {
+		return nil, nil
+	}
+
+	var categories []ErrorCategory
+	for _, name := range strings.Split(list, ",") {
+		category := ErrorCategory(name)
+		valid := false
+		for _, supported := range AllErrorCategories {
+			if category == supported {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("unknown error category %q, should be one of %v", name, AllErrorCategories)
+		}
+		categories = append(categories, category)
+	}
+	return categories, nil
+}
+
+// mongo's error code for an op that exceeded its time limit
+const maxTimeMSExpiredCode = 50
+
+// CategorizeError tells which category an error returned by Execute falls
+// into. It returns an empty category for a nil error.
+func CategorizeError(err error) ErrorCategory {
+	if err == nil {
+		return ""
+	}
+	if mgo.IsDup(err) {
+		return DuplicateKeyError
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return TimeoutError
+	}
+
+	switch err := err.(type) {
+	case *mgo.QueryError:
+		if err.Code == maxTimeMSExpiredCode {
+			return TimeoutError
+		}
+		return QueryError
+	case *mgo.LastError:
+		if err.WTimeout {
+			return TimeoutError
+		}
+		return QueryError
+	case net.Error:
+		return SocketError
+	}
+
+	switch err {
+	case mgo.ErrNotFound:
+		return NotFoundError
+	case io.EOF, io.ErrUnexpectedEOF:
+		return SocketError
+	case NotSupported:
+		return OtherError
+	case OpTimedOut:
+		return TimeoutError
+	}
+
+	// mgo doesn't export the errors it returns when it can't get a socket
+	message := err.Error()
+	if message == "no reachable servers" || strings.HasPrefix(message, "Closed explicitly") {
+		return SocketError
+	}
+	return OtherError
+}
+
 type execute func(op *Op, collection *mgo.Collection) error
 
 type OpsExecutor struct {
@@ -25,13 +131,54 @@ type OpsExecutor struct {
 	lastResult  interface{}
 	lastLatency time.Duration
 	subExecutes map[OpType]execute
+
+	nsMapper   *NsMapper
+	maxRetries int
+	// rewrites the documents of the ops, see SetOpTransformer
+	opTransformer *OpTransformer
+	// the mode read ops are run with, unless they recorded their own
+	readMode mgo.Mode
+	// see withRecordedTimestamps
+	preserveTimestamps bool
+	// whether the queries fetch all their results, or only the first batch
+	drainCursors bool
+	// whether inserting docs that already exist counts as a success
+	ignoreDupKey bool
+	// the cursors the getmores read from
+	cursors *Cursors
+	// if set, warns about the ops lacking the indexes they need
+	indexChecker *IndexChecker
+	// if set, compares the results of the queries to the recorded ones
+	readValidator *ReadValidator
+	// if set, logs the ops slower than its threshold
+	slowOpLog *SlowOpLog
+	// the socket timeouts of the op types that don't use socketTimeout, see
+	// SetOpTimeouts
+	socketTimeout time.Duration
+	opTimeouts    map[OpType]time.Duration
+	// the time each op may take, retries included, see SetOpBudget
+	opBudget time.Duration
+	// only go through the motions, without sending anything to the database
+	dryRun bool
+	// the stats that didn't fit in the statsChan, updated atomically
+	droppedStats int64
+	// if set, counts the ops whose stats didn't fit in the statsChan
+	statsAnalyzer *StatsAnalyzer
+	// whether the commands without an op type of their own get replayed
+	genericCommands bool
 }
 
 func NewOpsExecutor(session *mgo.Session, statsChan chan OpStat, logger *Logger) *OpsExecutor {
 	e := &OpsExecutor{
-		session:   session,
-		statsChan: statsChan,
-		logger:    logger,
+		session:      session,
+		statsChan:    statsChan,
+		logger:       logger,
+		maxRetries:   DefaultMaxRetries,
+		cursors:      NewCursors(),
+		drainCursors: true,
+	}
+	if session != nil {
+		e.readMode = session.Mode()
 	}
 
 	e.subExecutes = map[OpType]execute{
@@ -41,18 +188,118 @@ func NewOpsExecutor(session *mgo.Session, statsChan chan OpStat, logger *Logger)
 		Remove:        e.execRemove,
 		Count:         e.execCount,
 		FindAndModify: e.execFindAndModify,
-		GetMore:       e.skipGetMore,
+		Aggregate:     e.execAggregate,
+		Distinct:      e.execDistinct,
+		CreateIndexes: e.execCreateIndexes,
+		Command:       e.execCommand,
+		GetMore:       e.execGetMore,
 	}
 	return e
 }
 
+// NewDryRunOpsExecutor creates an executor that reports the ops it is handed
+// to the statsChan without actually executing them, e.g. to validate an ops
+// file.
+func NewDryRunOpsExecutor(statsChan chan OpStat, logger *Logger) *OpsExecutor {
+	e := NewOpsExecutor(nil, statsChan, logger)
+	e.dryRun = true
+	return e
+}
+
+// SetNsMapper makes the executor run each op against the namespace the given
+// mapper maps it to, rather than against the recorded namespace.
+func (e *OpsExecutor) SetNsMapper(mapper *NsMapper) {
+	e.nsMapper = mapper
+}
+
+// SetOpTransformer makes the executor rewrite the documents of the ops with
+// the given transformer before executing them. It is safe to share between
+// executors.
+func (e *OpsExecutor) SetOpTransformer(transformer *OpTransformer) {
+	e.opTransformer = transformer
+}
+
+// SetMaxRetries sets how many times an op gets retried after a socket failure
+func (e *OpsExecutor) SetMaxRetries(maxRetries int) {
+	e.maxRetries = maxRetries
+}
+
+// SetReadPreference sets the mode the read ops (queries, counts, distincts
+// and aggregations) are run with. Ops that recorded their own read
+// preference, e.g. when they went through a mongos, use that instead.
+func (e *OpsExecutor) SetReadPreference(mode mgo.Mode) {
+	e.readMode = mode
+}
+
+// SetPreserveTimestamps makes the writes use the time they were recorded at
+// for the timestamps the server would otherwise fill in, see
+// withRecordedTimestamps.
+func (e *OpsExecutor) SetPreserveTimestamps(preserveTimestamps bool) {
+	e.preserveTimestamps = preserveTimestamps
+}
+
+// SetDrainCursors sets whether the queries that didn't leave a cursor open
+// when recorded fetch all their results, which is the default, or only their
+// first batch, e.g. for tests focused on throughput rather than on faithful
+// latencies. Either way, the latency recorded covers what was fetched.
+func (e *OpsExecutor) SetDrainCursors(drainCursors bool) {
+	e.drainCursors = drainCursors
+}
+
+// SetIgnoreDupKey makes the inserts that fail with duplicate key errors only
+// (e.g. when re-running the replay of inserts against the same target) count
+// as successes. The insert commands then run unordered, so that the documents
+// after a duplicate still get inserted.
+func (e *OpsExecutor) SetIgnoreDupKey(ignoreDupKey bool) {
+	e.ignoreDupKey = ignoreDupKey
+}
+
+// SetSession makes the executor run the next ops with the given session, e.g.
+// after re-dialing a server that restarted. The caller remains responsible
+// for closing the previous session.
+func (e *OpsExecutor) SetSession(session *mgo.Session) {
+	e.session = session
+}
+
+// SetCursors makes the executor share the cursors of its queries with other
+// executors, see Cursors.
+func (e *OpsExecutor) SetCursors(cursors *Cursors) {
+	e.cursors = cursors
+}
+
+// isReadOp tells whether the read preference applies to the op type.
+// Getmores always go to the server their cursor is on.
+func isReadOp(opType OpType) bool {
+	switch opType {
+	case Query, Count, Aggregate, Distinct:
+		return true
+	}
+	return false
+}
+
 func (e *OpsExecutor) execQuery(op *Op, coll *mgo.Collection) error {
-	query := coll.Find(op.QueryDoc)
-	if op.NToSkip != 0 {
-		query.Skip(int(op.NToSkip))
+	find := parseRecordedFind(op)
+	query := coll.Find(find.filter)
+	if find.projection != nil {
+		query.Select(find.projection)
 	}
-	if op.NToReturn != 0 {
-		query.Limit(int(op.NToReturn))
+	if len(find.sort) > 0 {
+		query.Sort(find.sort...)
+	}
+	if len(find.hint) > 0 {
+		query.Hint(find.hint...)
+	}
+	if find.skip != 0 {
+		query.Skip(find.skip)
+	}
+	if op.CursorId != 0 {
+		return e.execCursorQuery(op, query)
+	}
+	if find.limit != 0 {
+		query.Limit(find.limit)
+	}
+	if !e.drainCursors {
+		return e.execFirstBatch(query)
 	}
 	result := []Document{}
 	err := query.All(&result)
@@ -60,134 +307,903 @@ func (e *OpsExecutor) execQuery(op *Op, coll *mgo.Collection) error {
 	return err
 }
 
+// recordedFind is the filter of a recorded query, along with the modifiers
+// that change what it costs the server, e.g. a sort without an index
+type recordedFind struct {
+	filter     interface{}
+	projection interface{}
+	// as expected by mgo's Sort and Hint, e.g. "-age"
+	sort  []string
+	hint  []string
+	skip  int
+	limit int
+}
+
+// parseRecordedFind pulls the filter and the modifiers out of the recorded
+// query, which is either a find command (as the profiler of MongoDB 3.2 and
+// later records it), the filter wrapped in $query next to modifiers such as
+// $orderby (as sent by the legacy drivers and mongos), or the bare filter.
+// The ntoskip and ntoreturn of the op, if any, take precedence.
+func parseRecordedFind(op *Op) recordedFind {
+	find := recordedFind{filter: op.QueryDoc}
+	doc := op.QueryDoc
+	if len(doc) > 0 && strings.ToLower(doc[0].Name) == "find" {
+		find.filter, _ = GetElem(doc, "filter")
+		find.projection, _ = GetElem(doc, "projection")
+		sort, _ := GetElem(doc, "sort")
+		find.sort = keyPatternFields(sort)
+		hint, _ := GetElem(doc, "hint")
+		find.hint = keyPatternFields(hint)
+		if skip, ok := GetElem(doc, "skip"); ok {
+			find.skip, _ = safeGetInt(skip)
+		}
+		if limit, ok := GetElem(doc, "limit"); ok {
+			find.limit, _ = safeGetInt(limit)
+		}
+	} else {
+		// the server accepts the wrapper fields with or without the $
+		for _, prefix := range []string{"$", ""} {
+			filter, ok := GetElem(doc, prefix+"query")
+			if _, isDoc := filter.(bson.D); !ok || !isDoc {
+				continue
+			}
+			find.filter = filter
+			orderBy, _ := GetElem(doc, prefix+"orderby")
+			find.sort = keyPatternFields(orderBy)
+			hint, _ := GetElem(doc, "$hint")
+			find.hint = keyPatternFields(hint)
+			break
+		}
+	}
+
+	if op.NToSkip != 0 {
+		find.skip = int(op.NToSkip)
+	}
+	if op.NToReturn != 0 {
+		find.limit = int(op.NToReturn)
+	}
+	return find
+}
+
+// keyPatternFields turns a sort or index key pattern, such as {age: -1}, into
+// the fields mgo expects, such as "-age". Anything but a document gives none,
+// e.g. a hint by index name, which mgo doesn't support.
+func keyPatternFields(pattern interface{}) []string {
+	doc, ok := pattern.(bson.D)
+	if !ok {
+		return nil
+	}
+	var fields []string
+	for _, elem := range doc {
+		if elem.Name == "" {
+			continue
+		}
+		if meta, ok := elem.Value.(bson.D); ok {
+			if kind, _ := GetElem(meta, "$meta"); kind == "textScore" {
+				fields = append(fields, "$textScore:"+elem.Name)
+			}
+			continue
+		}
+		if direction, err := safeGetInt(elem.Value); err == nil && direction < 0 {
+			fields = append(fields, "-"+elem.Name)
+		} else {
+			fields = append(fields, elem.Name)
+		}
+	}
+	return fields
+}
+
+// execFirstBatch only fetches the first batch of the query's results, then
+// closes its cursor
+func (e *OpsExecutor) execFirstBatch(query *mgo.Query) error {
+	iter := query.Batch(defaultFirstBatchSize).Prefetch(0).Iter()
+	result, _ := fetchBatch(iter, defaultFirstBatchSize)
+	e.lastResult = &result
+	return iter.Close()
+}
+
 func (e *OpsExecutor) execInsert(op *Op, coll *mgo.Collection) error {
-	return coll.Insert(op.InsertDoc)
+	if op.InsertDoc == nil && len(op.CommandDoc) > 0 {
+		return e.execBulkInsert(op, coll)
+	}
+	err := coll.Insert(op.InsertDoc)
+	if e.ignoreDupKey && mgo.IsDup(err) {
+		return nil
+	}
+	return err
+}
+
+// execBulkInsert runs an insert command, which may insert many documents at
+// once, as a single bulk op so that its latency covers the whole batch.
+func (e *OpsExecutor) execBulkInsert(op *Op, coll *mgo.Collection) error {
+	value, _ := GetElem(op.CommandDoc, "documents")
+	docs, ok := value.([]interface{})
+	if !ok || len(docs) == 0 {
+		return NotSupported
+	}
+
+	bulk := coll.Bulk()
+	if ordered, _ := GetElem(op.CommandDoc, "ordered"); ordered == false || e.ignoreDupKey {
+		bulk.Unordered()
+	}
+	bulk.Insert(docs...)
+	_, err := bulk.Run()
+	if e.ignoreDupKey {
+		return withoutDupKeyErrors(err)
+	}
+	return err
+}
+
+// withoutDupKeyErrors returns the first error of a bulk op that isn't a
+// duplicate key error, if any
+func withoutDupKeyErrors(err error) error {
+	bulkErr, ok := err.(*mgo.BulkError)
+	if !ok {
+		if mgo.IsDup(err) {
+			return nil
+		}
+		return err
+	}
+	for _, errCase := range bulkErr.Cases() {
+		if !mgo.IsDup(errCase.Err) {
+			return errCase.Err
+		}
+	}
+	return nil
 }
 
 func (e *OpsExecutor) execUpdate(op *Op, coll *mgo.Collection) error {
-	return coll.Update(op.QueryDoc, op.UpdateDoc)
+	var err error
+	switch {
+	case op.Upsert && op.Multi:
+		// mgo has no helper for that combination
+		var reply writeCommandReply
+		err = coll.Database.Run(bson.D{
+			{"update", coll.Name},
+			{"updates", []bson.D{{
+				{"q", op.QueryDoc},
+				{"u", op.UpdateDoc},
+				{"upsert", true},
+				{"multi", true},
+			}}},
+		}, &reply)
+		if err == nil {
+			err = reply.err()
+		}
+	case op.Upsert:
+		_, err = coll.Upsert(op.QueryDoc, op.UpdateDoc)
+	case op.Multi:
+		_, err = coll.UpdateAll(op.QueryDoc, op.UpdateDoc)
+	default:
+		err = coll.Update(op.QueryDoc, op.UpdateDoc)
+	}
+	return err
+}
+
+// writeCommandReply is the part of the reply of a write command telling
+// whether the writes failed, which the server reports with ok: 1
+type writeCommandReply struct {
+	WriteErrors []struct {
+		Code   int    `bson:"code"`
+		ErrMsg string `bson:"errmsg"`
+	} `bson:"writeErrors"`
+	WriteConcernError *struct {
+		Code   int    `bson:"code"`
+		ErrMsg string `bson:"errmsg"`
+	} `bson:"writeConcernError"`
+}
+
+// mongo's error code for a write concern that timed out
+const writeConcernTimeoutCode = 64
+
+// err returns the first failure the reply reports, if any, as a LastError, as
+// mgo does for its own write helpers, so that e.g. mgo.IsDup recognizes it
+func (r *writeCommandReply) err() error {
+	if len(r.WriteErrors) > 0 {
+		return &mgo.LastError{Code: r.WriteErrors[0].Code, Err: r.WriteErrors[0].ErrMsg}
+	}
+	if wcErr := r.WriteConcernError; wcErr != nil {
+		return &mgo.LastError{Code: wcErr.Code, Err: wcErr.ErrMsg, WTimeout: wcErr.Code == writeConcernTimeoutCode}
+	}
+	return nil
 }
 
+// execRemove deletes all the matching docs if the remove was recorded as a
+// multi one, and only the first match otherwise (which was the only kind
+// recorded before).
 func (e *OpsExecutor) execRemove(op *Op, coll *mgo.Collection) error {
+	if op.Multi {
+		_, err := coll.RemoveAll(op.QueryDoc)
+		return err
+	}
 	return coll.Remove(op.QueryDoc)
 }
 
 func (e *OpsExecutor) execCount(op *Op, coll *mgo.Collection) error {
-	_, err := coll.Count()
+	var query interface{}
+	if value, ok := GetElem(op.CommandDoc, "query"); ok && value != nil {
+		if query, ok = value.(bson.D); !ok {
+			return fmt.Errorf("bad query document in count operation")
+		}
+	}
+
+	q := coll.Find(query)
+	if value, ok := GetElem(op.CommandDoc, "skip"); ok {
+		skip, err := safeGetInt(value)
+		if err != nil {
+			return fmt.Errorf("bad skip in count operation: %s", err)
+		}
+		q.Skip(skip)
+	}
+	if value, ok := GetElem(op.CommandDoc, "limit"); ok {
+		limit, err := safeGetInt(value)
+		if err != nil {
+			return fmt.Errorf("bad limit in count operation: %s", err)
+		}
+		q.Limit(limit)
+	}
+
+	count, err := q.Count()
+	e.lastResult = count
 	return err
 }
 
 func (e *OpsExecutor) execFindAndModify(op *Op, coll *mgo.Collection) error {
-	result := Document{}
-	var query, update bson.D
+	// Replay the recorded command as is, so that all of its options (sort,
+	// upsert, remove, new, fields) are honored. Only the collection name gets
+	// replaced, since the namespace may have been remapped.
+	cmd := make(bson.D, len(op.CommandDoc))
+	copy(cmd, op.CommandDoc)
+	cmd[0].Value = coll.Name
 
-	// Maybe clean this up later using a struct
-	if value, ok := GetElem(op.CommandDoc, "query"); ok {
-		if query, ok = value.(bson.D); !ok {
+	if value, ok := GetElem(cmd, "query"); ok {
+		if _, ok = value.(bson.D); !ok {
 			return fmt.Errorf("bad query document in findAndModify operation")
 		}
-	} else {
-		return fmt.Errorf("missing query document in findAndModify operation")
 	}
-	if value, ok := GetElem(op.CommandDoc, "update"); ok {
-		if update, ok = value.(bson.D); !ok {
+	if value, ok := GetElem(cmd, "update"); ok {
+		if _, ok = value.(bson.D); !ok {
 			return fmt.Errorf("bad update document in findAndModify operation")
 		}
-	} else {
+	} else if remove, _ := GetElem(cmd, "remove"); remove != true {
 		return fmt.Errorf("missing update document in findAndModify operation")
 	}
 
-	change := mgo.Change{Update: update}
-	_, err := coll.Find(query).Apply(change, result)
+	result := Document{}
+	err := coll.Database.Run(cmd, &result)
+	e.lastResult = result
 	return err
 }
 
-// currently not supported
-func (e *OpsExecutor) skipGetMore(op *Op, coll *mgo.Collection) error {
+func (e *OpsExecutor) execAggregate(op *Op, coll *mgo.Collection) error {
+	value, ok := GetElem(op.CommandDoc, "pipeline")
+	if !ok {
+		return fmt.Errorf("missing pipeline in aggregate operation")
+	}
+	pipeline, ok := value.([]interface{})
+	if !ok {
+		return fmt.Errorf("bad pipeline in aggregate operation")
+	}
+
+	pipe := coll.Pipe(pipeline)
+	if allowDiskUse, _ := GetElem(op.CommandDoc, "allowDiskUse"); allowDiskUse == true {
+		pipe.AllowDiskUse()
+	}
+	if value, ok := GetElem(op.CommandDoc, "cursor"); ok {
+		if cursor, ok := value.(bson.D); ok {
+			if batchSize, ok := GetElem(cursor, "batchSize"); ok {
+				size, err := safeGetInt(batchSize)
+				if err != nil {
+					return fmt.Errorf("bad batchSize in aggregate operation: %s", err)
+				}
+				pipe.Batch(size)
+			}
+		}
+	}
+
+	// drain the cursor, so that we time the whole aggregation
+	result := []Document{}
+	err := pipe.All(&result)
+	e.lastResult = &result
+	return err
+}
+
+func (e *OpsExecutor) execDistinct(op *Op, coll *mgo.Collection) error {
+	value, ok := GetElem(op.CommandDoc, "key")
+	if !ok {
+		return fmt.Errorf("missing key in distinct operation")
+	}
+	key, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("bad key in distinct operation")
+	}
+	var query bson.D
+	if value, ok := GetElem(op.CommandDoc, "query"); ok && value != nil {
+		if query, ok = value.(bson.D); !ok {
+			return fmt.Errorf("bad query document in distinct operation")
+		}
+	}
+
+	result := []interface{}{}
+	err := coll.Find(query).Distinct(key, &result)
+	e.lastResult = &result
+	return err
+}
+
+// execCommand runs a command that has no op type of its own verbatim, but
+// for the collection name of the collectionCommands
+func (e *OpsExecutor) execCommand(op *Op, coll *mgo.Collection) error {
+	cmd := make(bson.D, len(op.CommandDoc))
+	copy(cmd, op.CommandDoc)
+	if collectionCommand(cmd) {
+		cmd[0].Value = coll.Name
+	}
+
+	result := Document{}
+	err := coll.Database.Run(cmd, &result)
+	e.lastResult = result
+	return err
+}
+
+func (e *OpsExecutor) execCreateIndexes(op *Op, coll *mgo.Collection) error {
+	// Like for findAndModify, the recorded command is replayed as is, rather
+	// than through Collection.EnsureIndex: the latter skips the indexes the
+	// session already ensured, and doesn't support all the index options.
+	cmd := make(bson.D, len(op.CommandDoc))
+	copy(cmd, op.CommandDoc)
+	cmd[0].Value = coll.Name
+
+	value, ok := GetElem(cmd, "indexes")
+	if !ok {
+		return fmt.Errorf("missing indexes in createIndexes operation")
+	}
+	if indexes, ok := value.([]interface{}); !ok || len(indexes) == 0 {
+		return fmt.Errorf("bad indexes in createIndexes operation")
+	}
+
+	result := Document{}
+	err := coll.Database.Run(cmd, &result)
+	e.lastResult = result
+	return err
+}
+
+// execCursorQuery runs a query that left a cursor open when recorded: only
+// its first batch is fetched, and the cursor is kept for the getmores to
+// fetch the next ones. ntoreturn is the batch size for such queries.
+func (e *OpsExecutor) execCursorQuery(op *Op, query *mgo.Query) error {
+	batchSize := recordedBatchSize(op.NToReturn, defaultFirstBatchSize)
+	// no prefetching, so that the next batch gets timed by its getmore
+	iter := query.Batch(batchSize).Prefetch(0).Iter()
+	result, done := fetchBatch(iter, batchSize)
+	e.lastResult = &result
+	if done {
+		return iter.Close()
+	}
+	e.cursors.add(op.CursorId, iter, batchSize)
+	return nil
+}
+
+// execGetMore fetches the next batch from the cursor of the query the getmore
+// was recorded for. Getmores whose cursor isn't open (e.g. because their query
+// wasn't replayed) are skipped.
+func (e *OpsExecutor) execGetMore(op *Op, coll *mgo.Collection) error {
+	if op.CursorId == 0 {
+		return nil
+	}
+	cursor := e.cursors.get(op.CursorId)
+	if cursor == nil {
+		return nil
+	}
+
+	cursor.mutex.Lock()
+	defer cursor.mutex.Unlock()
+	batchSize := recordedBatchSize(op.NToReturn, cursor.batchSize)
+	result, done := fetchBatch(cursor.iter, batchSize)
+	e.lastResult = &result
+	if done {
+		e.cursors.remove(op.CursorId)
+		return cursor.iter.Close()
+	}
 	return nil
 }
 
+// recordedBatchSize returns the batch size a recorded ntoreturn asks for, or
+// the given default if it doesn't ask for any. A negative ntoreturn asks for
+// a single batch of its absolute value.
+func recordedBatchSize(ntoreturn int64, defaultSize int) int {
+	if ntoreturn < 0 {
+		ntoreturn = -ntoreturn
+	}
+	if ntoreturn == 0 {
+		return defaultSize
+	}
+	return int(ntoreturn)
+}
+
 // We only support handful op types. This function helps us to process supported
-// ops in a universal way.
+// ops in a universal way. The other commands keep the Command type, see
+// OpsExecutor.SetGenericCommands, but for the authentication ones, which
+// can't be replayed out of their context.
 //
 // We do not canonicalize the ops in OpsReader because we hope ops reader to do
 // its job honestly and the consumer of these ops decide how to further process
 // the original ops.
+//
+// The op is shared by the executors of all the nodes, which canonicalize it
+// again, so it is left untouched: the canonicalized op is a copy of it, if it
+// needs any change.
 func CanonicalizeOp(op *Op) *Op {
 	if op.Type != Command {
 		return op
 	}
+	if len(op.CommandDoc) == 0 || authCommands[strings.ToLower(op.CommandDoc[0].Name)] {
+		return nil
+	}
 
-	// the command to be run is the first element in the command document
-	// TODO: these unprotected type assertions aren't great, but one problem at at time
-	cmd := op.CommandDoc[0]
+	// the commands run against a collection name it first, the others (e.g.
+	// {ping: 1} or {eval: "..."}) stay on the $cmd collection. canonicalOpType
+	// only gives the commands naming a collection a type of their own.
+	opType := canonicalOpType(op)
+	collection, ok := op.CommandDoc[0].Value.(string)
+	if !ok || opType == Command && (!collectionCommand(op.CommandDoc) || op.Collection == collection) {
+		return op
+	}
+	copied := *op
+	copied.Type = opType
+	copied.Collection = collection
+	return &copied
+}
 
-	if cmd.Name == "count" || cmd.Name == "findandmodify" {
-		collName := cmd.Value.(string)
+// the commands whose first element names the collection they run against,
+// which the replay may map to another one. The value of the others is left
+// alone, be it a full namespace (renameCollection), javascript (eval) or
+// else.
+var collectionCommands = map[string]bool{
+	"aggregate":                true,
+	"clonecollectionascapped":  true,
+	"collmod":                  true,
+	"collstats":                true,
+	"compact":                  true,
+	"converttocapped":          true,
+	"count":                    true,
+	"create":                   true,
+	"createindexes":            true,
+	"delete":                   true,
+	"deleteindexes":            true,
+	"distinct":                 true,
+	"drop":                     true,
+	"dropindexes":              true,
+	"find":                     true,
+	"findandmodify":            true,
+	"geonear":                  true,
+	"geosearch":                true,
+	"insert":                   true,
+	"killcursors":              true,
+	"listindexes":              true,
+	"mapreduce":                true,
+	"parallelcollectionscan":   true,
+	"plancacheclear":           true,
+	"plancacheclearfilters":    true,
+	"plancachelistfilters":     true,
+	"plancachelistplans":       true,
+	"plancachelistqueryshapes": true,
+	"plancachesetfilter":       true,
+	"reindex":                  true,
+	"touch":                    true,
+	"update":                   true,
+	"validate":                 true,
+}
 
-		op.Type = OpType("command." + cmd.Name)
-		op.Collection = collName
-		return op
+// collectionCommand returns whether the given command is one of the
+// collectionCommands, with the name of a collection
+func collectionCommand(cmd bson.D) bool {
+	if len(cmd) == 0 || !collectionCommands[strings.ToLower(cmd[0].Name)] {
+		return false
 	}
+	_, ok := cmd[0].Value.(string)
+	return ok
+}
 
-	return nil
+// the commands CanonicalizeOp drops, see it
+var authCommands = map[string]bool{
+	"authenticate": true,
+	"getnonce":     true,
+	"logout":       true,
+	"saslcontinue": true,
+	"saslstart":    true,
+}
+
+// canonicalOpType returns the type CanonicalizeOp gives the op, without
+// modifying it. Unsupported commands keep the Command type.
+func canonicalOpType(op *Op) OpType {
+	if op.Type != Command || len(op.CommandDoc) == 0 {
+		return op.Type
+	}
+
+	// the command to be run is the first element in the command document.
+	// Drivers aren't consistent about its case, e.g. findAndModify vs
+	// findandmodify, but the server doesn't care.
+	name := strings.ToLower(op.CommandDoc[0].Name)
+	if _, ok := op.CommandDoc[0].Value.(string); !ok {
+		// the command doesn't name a collection, e.g. {aggregate: 1} runs a
+		// $currentOp pipeline against the database, so it has to be run as
+		// recorded
+		return Command
+	}
+	if name == "insert" {
+		return Insert
+	}
+	if name == "count" || name == "findandmodify" || name == "aggregate" || name == "distinct" ||
+		name == "createindexes" {
+		return OpType("command." + name)
+	}
+	return Command
 }
 
-func retryOnSocketFailure(block func() error, session *mgo.Session, logger *Logger) error {
+// DefaultMaxRetries is how many times an op is retried after a socket failure
+// by default
+const DefaultMaxRetries = 3
+
+var (
+	// the backoff before the first retry, which doubles for each further one
+	retryBaseBackoff = 100 * time.Millisecond
+	retryMaxBackoff  = 10 * time.Second
+)
+
+func retryOnSocketFailure(block func() error, session *mgo.Session, logger *Logger, maxRetries int) error {
 	err := block()
+	for attempt := 1; attempt <= maxRetries && isRetriable(err); attempt++ {
+		// It's probably a socket error (e.g. the replica set is electing a new
+		// primary) so we refresh the connection, back off, and try again
+		session.Refresh()
+		backoff := retryBackoff(attempt)
+		logger.Errorf("retrying mongo query in %v (attempt %d of %d) after error: %s",
+			backoff, attempt, maxRetries, err)
+		time.Sleep(backoff)
+		err = block()
+	}
+	return err
+}
+
+// isRetriable tells whether the error may be transient
+func isRetriable(err error) bool {
 	if err == nil {
-		return nil
+		return false
 	}
 
 	switch err.(type) {
 	case *mgo.QueryError, *mgo.LastError:
-		return err
+		return false
 	}
 
 	switch err {
-	case mgo.ErrNotFound, NotSupported:
-		return err
+	case mgo.ErrNotFound, NotSupported, OpTimedOut:
+		return false
 	}
+	return true
+}
+
+// SetIndexChecker makes the executor check that the collections have the
+// indexes the ops need, see IndexChecker.
+func (e *OpsExecutor) SetIndexChecker(checker *IndexChecker) {
+	e.indexChecker = checker
+}
+
+// SetReadValidator makes the executor compare the results of the queries
+// that were recorded with theirs, see ReadValidator. Only the queries that
+// fetch all their results are compared, i.e. not those with a cursor or when
+// the cursors aren't drained. The comparison doesn't count towards the
+// latency.
+func (e *OpsExecutor) SetReadValidator(validator *ReadValidator) {
+	e.readValidator = validator
+}
+
+// SetOpTimeouts makes the executor run the ops of the given types with their
+// own socket timeout (0 meaning none), e.g. for the index builds, which would
+// otherwise fail after socketTimeout, the timeout of the other ops.
+func (e *OpsExecutor) SetOpTimeouts(socketTimeout time.Duration, timeouts map[OpType]time.Duration) {
+	e.socketTimeout = socketTimeout
+	e.opTimeouts = timeouts
+}
+
+// SetOpBudget bounds the time each op may take, retries included (0 meaning
+// no bound), so that a pathological op doesn't hold up its worker for
+// minutes. mgo can't cancel an op in flight, so while the op runs, its socket
+// timeout is kept capped at what's left of the budget, and no attempt starts
+// once it is spent. The ops that exceed it fail with OpTimedOut, even those
+// that completed late. An op given up on keeps running on the server though.
+func (e *OpsExecutor) SetOpBudget(budget time.Duration) {
+	e.opBudget = budget
+}
+
+// SetGenericCommands makes the executor replay the commands that don't have
+// an op type of their own (e.g. mapReduce or collStats) as recorded, under
+// the Command op type, rather than refusing them with NotSupported. Their
+// stats tell the command run, see OpStat.Command.
+func (e *OpsExecutor) SetGenericCommands(genericCommands bool) {
+	e.genericCommands = genericCommands
+}
 
-	// Otherwise it's probably a socket error so we refresh the connection,
-	// and try again
-	session.Refresh()
-	logger.Error("retrying mongo query after error: ", err)
-	return block()
+// SetSlowOpLog makes the executor log the ops that take longer than the
+// threshold of the given SlowOpLog, failed or not.
+func (e *OpsExecutor) SetSlowOpLog(slowOpLog *SlowOpLog) {
+	e.slowOpLog = slowOpLog
+}
+
+// IsConnectionError tells whether the op failed because of the connection to
+// the server, as opposed to the op itself being refused, e.g. because of a
+// duplicate key.
+func IsConnectionError(err error) bool {
+	return isRetriable(err)
+}
+
+// retryBackoff returns an exponential backoff for the given attempt, with
+// jitter so that the workers don't all retry in lockstep.
+func retryBackoff(attempt int) time.Duration {
+	backoff := retryBaseBackoff << uint(attempt-1)
+	if backoff <= 0 || backoff > retryMaxBackoff {
+		backoff = retryMaxBackoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff)/2+1))
 }
 
 func (e *OpsExecutor) Execute(op *Op) error {
 	startOp := time.Now()
 
 	op = CanonicalizeOp(op)
+	if op == nil || op.Type == Command && !e.genericCommands {
+		return NotSupported
+	}
+	if e.preserveTimestamps {
+		op = withRecordedTimestamps(op)
+	}
+	op = e.opTransformer.Transform(op)
 
+	// the op is shared with the executors of other nodes, so leave it untouched
+	database, collection := e.nsMapper.Map(op.Database, op.Collection)
+	if e.indexChecker != nil && !e.dryRun {
+		// that doesn't count towards the latency of the op
+		checkStart := time.Now()
+		e.indexChecker.Check(e.session, op, database, collection)
+		startOp = startOp.Add(time.Now().Sub(checkStart))
+	}
 	block := func() error {
-		coll := e.session.DB(op.Database).C(op.Collection)
+		if isReadOp(op.Type) {
+			mode, ok := recordedReadPreference(op)
+			if !ok {
+				mode = e.readMode
+			}
+			// writes always go to the primary, whatever the mode, so the mode
+			// only gets changed when needed, which spares refreshing the session
+			if e.session.Mode() != mode {
+				e.session.SetMode(mode, true)
+			}
+		}
+		coll := e.session.DB(database).C(collection)
 		return e.subExecutes[op.Type](op, coll)
 	}
-	err := retryOnSocketFailure(block, e.session, e.logger)
+	var err error
+	if !e.dryRun {
+		timeout, customTimeout := e.opTimeouts[op.Type]
+		if e.opBudget > 0 {
+			if !customTimeout {
+				timeout = e.socketTimeout
+			}
+			err = e.executeWithinBudget(block, timeout)
+		} else {
+			if customTimeout {
+				e.session.SetSocketTimeout(timeout)
+			}
+			err = retryOnSocketFailure(block, e.session, e.logger, e.maxRetries)
+			if customTimeout {
+				e.session.SetSocketTimeout(e.socketTimeout)
+			}
+		}
+	}
 
 	latencyOp := time.Now().Sub(startOp)
 	e.lastLatency = latencyOp
+	if e.readValidator != nil && err == nil && !e.dryRun && op.Type == Query && op.Result != nil &&
+		op.CursorId == 0 && e.drainCursors {
+		e.readValidator.Validate(op, *e.lastResult.(*[]Document))
+	}
+	if e.slowOpLog != nil && !e.dryRun {
+		e.slowOpLog.Log(e.logger, op, database+"."+collection, latencyOp)
+	}
 
 	if e.statsChan != nil {
-		if err == nil {
-			e.statsChan <- OpStat{op.Type, latencyOp, false}
-		} else {
-			// error condition
-			e.statsChan <- OpStat{op.Type, latencyOp, true}
+		opStat := OpStat{
+			OpType:        op.Type,
+			Latency:       latencyOp,
+			OpError:       err != nil,
+			ErrorCategory: CategorizeError(err),
+			Ns:            database + "." + collection,
+			StartTime:     startOp,
+			Command:       commandName(op),
+		}
+		// if the analyzer falls behind, the latency gets dropped rather than
+		// holding up the replay, but the op still gets counted
+		select {
+		case e.statsChan <- opStat:
+		default:
+			atomic.AddInt64(&e.droppedStats, 1)
+			if e.statsAnalyzer != nil {
+				e.statsAnalyzer.CountWithoutLatency(opStat)
+			}
 		}
 	}
 
 	return err
 }
 
+// executeWithinBudget runs the attempts of an op with the socket timeout of
+// its type (0 meaning none), capped at what's left of the op budget.
+//
+// mgo sets the socket deadline anew on each round trip, e.g. for each batch
+// of a query, so a timeout set once would bound each batch rather than the
+// whole op. Instead, a watchdog keeps lowering the socket timeout as the
+// budget runs out, which leaves a round trip at most budgetWatchInterval past
+// the deadline.
+func (e *OpsExecutor) executeWithinBudget(block func() error, timeout time.Duration) error {
+	deadline := time.Now().Add(e.opBudget)
+	stopWatch := make(chan struct{})
+	watchStopped := make(chan struct{})
+	go func() {
+		defer close(watchStopped)
+		ticker := time.NewTicker(budgetWatchInterval(e.opBudget))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopWatch:
+				return
+			case now := <-ticker.C:
+				e.session.SetSocketTimeout(budgetTimeout(deadline.Sub(now), timeout))
+			}
+		}
+	}()
+
+	attempt := func() error {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return OpTimedOut
+		}
+		e.session.SetSocketTimeout(budgetTimeout(remaining, timeout))
+		err := block()
+		if time.Now().After(deadline) {
+			return OpTimedOut
+		}
+		return err
+	}
+	err := retryOnSocketFailure(attempt, e.session, e.logger, e.maxRetries)
+	close(stopWatch)
+	<-watchStopped
+	e.session.SetSocketTimeout(e.socketTimeout)
+	if err == OpTimedOut {
+		// the socket may have timed out in the middle of a reply
+		e.session.Refresh()
+	}
+	return err
+}
+
+// budgetWatchInterval is how often the socket timeout of an op gets lowered
+// to what's left of the given budget, see executeWithinBudget
+func budgetWatchInterval(budget time.Duration) time.Duration {
+	interval := budget / 20
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	return interval
+}
+
+// budgetTimeout returns the socket timeout for the round trips of an op with
+// the given time left of its budget, given the timeout of its type (0 meaning
+// none). Once the budget is spent, the next round trip times out right away.
+func budgetTimeout(remaining time.Duration, timeout time.Duration) time.Duration {
+	if remaining <= 0 {
+		// 0 would mean no timeout
+		return time.Nanosecond
+	}
+	if timeout == 0 || remaining < timeout {
+		return remaining
+	}
+	return timeout
+}
+
 func (e *OpsExecutor) LastLatency() time.Duration {
 	return e.lastLatency
 }
 
+// commandName returns the name of the command run by Command ops, "" for the
+// other op types
+func commandName(op *Op) string {
+	if op.Type != Command {
+		return ""
+	}
+	return strings.ToLower(op.CommandDoc[0].Name)
+}
+
+// SetStatsAnalyzer makes the executor count the ops whose stats don't fit in
+// the statsChan with the given analyzer, the one reading the statsChan, so
+// that only their latency is lost. Otherwise, they aren't counted at all.
+func (e *OpsExecutor) SetStatsAnalyzer(analyzer *StatsAnalyzer) {
+	e.statsAnalyzer = analyzer
+}
+
+// DroppedStats returns how many ops didn't fit in the statsChan, see
+// SetStatsAnalyzer
+func (e *OpsExecutor) DroppedStats() int64 {
+	return atomic.LoadInt64(&e.droppedStats)
+}
+
+// ParseWriteConcern converts a write concern such as "0", "1" or "majority"
+// into the mgo.Safe to be passed to Session.SetSafe. Note that "0" (fire and
+// forget) is represented by a nil mgo.Safe.
+func ParseWriteConcern(writeConcern string) (*mgo.Safe, error) {
+	w, err := strconv.Atoi(writeConcern)
+	if err != nil {
+		if writeConcern == "" {
+			return nil, fmt.Errorf("empty write concern")
+		}
+		// "majority" or a custom tag set
+		return &mgo.Safe{WMode: writeConcern}, nil
+	}
+
+	switch {
+	case w < 0:
+		return nil, fmt.Errorf("invalid write concern %d", w)
+	case w == 0:
+		return nil, nil
+	default:
+		return &mgo.Safe{W: w}, nil
+	}
+}
+
+var readPreferenceModes = map[string]mgo.Mode{
+	"primary":            mgo.Primary,
+	"primarypreferred":   mgo.PrimaryPreferred,
+	"secondary":          mgo.Secondary,
+	"secondarypreferred": mgo.SecondaryPreferred,
+	"nearest":            mgo.Nearest,
+}
+
+// ParseReadPreference converts a read preference mode such as "primary" or
+// "secondaryPreferred" into the mgo.Mode to be passed to Session.SetMode.
+func ParseReadPreference(readPreference string) (mgo.Mode, error) {
+	mode, ok := readPreferenceModes[strings.ToLower(readPreference)]
+	if !ok {
+		return 0, fmt.Errorf("unknown read preference %q, should be one of primary, primaryPreferred, "+
+			"secondary, secondaryPreferred or nearest", readPreference)
+	}
+	return mode, nil
+}
+
+// recordedReadPreference returns the mode of the $readPreference the op was
+// recorded with, if any. Queries sent through a mongos carry it next to
+// $query, and commands carry it in the command document.
+func recordedReadPreference(op *Op) (mgo.Mode, bool) {
+	value, ok := GetElem(op.QueryDoc, "$readPreference")
+	if !ok {
+		if value, ok = GetElem(op.CommandDoc, "$readPreference"); !ok {
+			return 0, false
+		}
+	}
+
+	var name interface{} = value
+	if doc, ok := value.(bson.D); ok {
+		name, _ = GetElem(doc, "mode")
+	}
+	if name, ok := name.(string); ok {
+		if mode, err := ParseReadPreference(name); err == nil {
+			return mode, true
+		}
+	}
+	return 0, false
+}
+
 func safeGetInt(i interface{}) (int, error) {
 	switch i.(type) {
+	case int:
+		return i.(int), nil
 	case int32:
 		return int(i.(int32)), nil
 	case int64:
@@ -1,7 +1,11 @@
 package flashback
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -138,8 +142,946 @@ func TestExecution(t *testing.T) {
 	ensure.DeepEqual(t, len(*findResult), 0)
 }
 
+func TestFindAndModifyExecution(t *testing.T) {
+	test_db := "test_db_for_executor_fam"
+	test_collection := "c1"
+
+	session, err := mgo.Dial("localhost")
+	ensure.Nil(t, err)
+	defer session.Close()
+	err = session.DB(test_db).DropDatabase()
+	ensure.Nil(t, err)
+	coll := session.DB(test_db).C(test_collection)
+	ensure.Nil(t, coll.Insert(bson.M{"_id": 1, "kind": "a"}, bson.M{"_id": 2, "kind": "a"}))
+
+	logger, err := NewLogger("", "")
+	ensure.Nil(t, err)
+	exec := NewOpsExecutor(session, nil, logger)
+	execute := func(cmd bson.D) {
+		op := &Op{
+			Ns:         fmt.Sprintf("%s.$cmd", test_db),
+			Timestamp:  time.Unix(1396456709, int64(472*time.Millisecond)),
+			CommandDoc: cmd,
+			Type:       Command,
+		}
+		normalizeOp(op)
+		ensure.Nil(t, exec.Execute(op))
+		ensure.DeepEqual(t, CanonicalizeOp(op).Type, FindAndModify)
+	}
+	count := func(query bson.M) int {
+		n, err := coll.Find(query).Count()
+		ensure.Nil(t, err)
+		return n
+	}
+
+	// sort picks which of the matching docs gets modified
+	execute(bson.D{
+		{"findAndModify", test_collection},
+		{"query", bson.D{{"kind", "a"}}},
+		{"sort", bson.D{{"_id", -1}}},
+		{"update", bson.D{{"$set", bson.D{{"kind", "b"}}}}},
+	})
+	ensure.DeepEqual(t, count(bson.M{"_id": 2, "kind": "b"}), 1)
+	ensure.DeepEqual(t, count(bson.M{"_id": 1, "kind": "a"}), 1)
+
+	// upsert creates the missing doc
+	execute(bson.D{
+		{"findandmodify", test_collection},
+		{"query", bson.D{{"_id", 3}}},
+		{"update", bson.D{{"$set", bson.D{{"kind", "c"}}}}},
+		{"upsert", true},
+	})
+	ensure.DeepEqual(t, count(bson.M{"_id": 3, "kind": "c"}), 1)
+
+	// remove deletes the doc, no update needed
+	execute(bson.D{
+		{"findandmodify", test_collection},
+		{"query", bson.D{{"_id", 1}}},
+		{"remove", true},
+	})
+	ensure.DeepEqual(t, count(bson.M{"_id": 1}), 0)
+	ensure.DeepEqual(t, count(nil), 2)
+}
+
+func TestAggregateExecution(t *testing.T) {
+	test_db := "test_db_for_executor_aggregate"
+	test_collection := "c1"
+
+	session, err := mgo.Dial("localhost")
+	ensure.Nil(t, err)
+	defer session.Close()
+	err = session.DB(test_db).DropDatabase()
+	ensure.Nil(t, err)
+	coll := session.DB(test_db).C(test_collection)
+	for i := 0; i < 10; i++ {
+		ensure.Nil(t, coll.Insert(bson.M{"_id": i, "even": i%2 == 0}))
+	}
+
+	logger, err := NewLogger("", "")
+	ensure.Nil(t, err)
+	exec := NewOpsExecutor(session, nil, logger)
+	op := &Op{
+		Ns:        fmt.Sprintf("%s.$cmd", test_db),
+		Timestamp: time.Unix(1396456709, int64(472*time.Millisecond)),
+		CommandDoc: bson.D{
+			{"aggregate", test_collection},
+			{"pipeline", []interface{}{
+				bson.D{{"$match", bson.D{{"even", true}}}},
+				bson.D{{"$sort", bson.D{{"_id", 1}}}},
+			}},
+			{"allowDiskUse", true},
+			{"cursor", bson.D{{"batchSize", 2}}},
+		},
+		Type: Command,
+	}
+	normalizeOp(op)
+	err = exec.Execute(op)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, CanonicalizeOp(op).Type, Aggregate)
+
+	// all the batches got drained
+	result := exec.lastResult.(*[]Document)
+	ensure.DeepEqual(t, len(*result), 5)
+}
+
+func TestDistinctExecution(t *testing.T) {
+	test_db := "test_db_for_executor_distinct"
+	test_collection := "c1"
+
+	session, err := mgo.Dial("localhost")
+	ensure.Nil(t, err)
+	defer session.Close()
+	err = session.DB(test_db).DropDatabase()
+	ensure.Nil(t, err)
+	coll := session.DB(test_db).C(test_collection)
+	for i := 0; i < 10; i++ {
+		ensure.Nil(t, coll.Insert(bson.M{"_id": i, "mod": i % 3, "even": i%2 == 0}))
+	}
+
+	logger, err := NewLogger("", "")
+	ensure.Nil(t, err)
+	exec := NewOpsExecutor(session, nil, logger)
+	distinct := func(commandDoc bson.D) []interface{} {
+		op := &Op{
+			Ns:         fmt.Sprintf("%s.$cmd", test_db),
+			Timestamp:  time.Unix(1396456709, int64(472*time.Millisecond)),
+			CommandDoc: commandDoc,
+			Type:       Command,
+		}
+		normalizeOp(op)
+		ensure.Nil(t, exec.Execute(op))
+		ensure.DeepEqual(t, CanonicalizeOp(op).Type, Distinct)
+		return *exec.lastResult.(*[]interface{})
+	}
+
+	ensure.DeepEqual(t, len(distinct(bson.D{{"distinct", test_collection}, {"key", "mod"}})), 3)
+	ensure.DeepEqual(t, len(distinct(bson.D{
+		{"distinct", test_collection},
+		{"key", "even"},
+		{"query", bson.D{{"_id", bson.D{{"$lt", 1}}}}},
+	})), 1)
+}
+
+func TestCountExecution(t *testing.T) {
+	test_db := "test_db_for_executor_count"
+	test_collection := "c1"
+
+	session, err := mgo.Dial("localhost")
+	ensure.Nil(t, err)
+	defer session.Close()
+	err = session.DB(test_db).DropDatabase()
+	ensure.Nil(t, err)
+	coll := session.DB(test_db).C(test_collection)
+	for i := 0; i < 10; i++ {
+		ensure.Nil(t, coll.Insert(bson.M{"_id": i, "even": i%2 == 0}))
+	}
+
+	logger, err := NewLogger("", "")
+	ensure.Nil(t, err)
+	statsChan := make(chan OpStat, 10)
+	exec := NewOpsExecutor(session, statsChan, logger)
+	count := func(commandDoc bson.D) int {
+		op := &Op{
+			Ns:         fmt.Sprintf("%s.$cmd", test_db),
+			Timestamp:  time.Unix(1396456709, int64(472*time.Millisecond)),
+			CommandDoc: commandDoc,
+			Type:       Command,
+		}
+		normalizeOp(op)
+		ensure.Nil(t, exec.Execute(op))
+		ensure.DeepEqual(t, CanonicalizeOp(op).Type, Count)
+
+		// the latency gets recorded under the count op type
+		opStat := <-statsChan
+		ensure.DeepEqual(t, opStat.OpType, Count)
+		ensure.False(t, opStat.OpError)
+		return exec.lastResult.(int)
+	}
+
+	ensure.DeepEqual(t, count(bson.D{{"count", test_collection}}), 10)
+	ensure.DeepEqual(t, count(bson.D{{"count", test_collection}, {"query", bson.D{{"even", true}}}}), 5)
+	ensure.DeepEqual(t, count(bson.D{
+		{"count", test_collection},
+		{"query", bson.D{{"even", true}}},
+		{"skip", 1},
+		{"limit", 3},
+	}), 3)
+}
+
+func TestGetMoreExecution(t *testing.T) {
+	test_db := "test_db_for_executor_getmore"
+	test_collection := "c1"
+
+	session, err := mgo.Dial("localhost")
+	ensure.Nil(t, err)
+	defer session.Close()
+	err = session.DB(test_db).DropDatabase()
+	ensure.Nil(t, err)
+	coll := session.DB(test_db).C(test_collection)
+	for i := 0; i < 25; i++ {
+		ensure.Nil(t, coll.Insert(bson.M{"_id": i}))
+	}
+
+	logger, err := NewLogger("", "")
+	ensure.Nil(t, err)
+	statsChan := make(chan OpStat, 10)
+	exec := NewOpsExecutor(session, statsChan, logger)
+	const recordedCursorId = 12345
+	execute := func(opType OpType) int {
+		op := &Op{
+			Ns:        fmt.Sprintf("%s.%s", test_db, test_collection),
+			Timestamp: time.Unix(1396456709, int64(472*time.Millisecond)),
+			Type:      opType,
+			NToReturn: 10,
+			CursorId:  recordedCursorId,
+		}
+		normalizeOp(op)
+		ensure.Nil(t, exec.Execute(op))
+		opStat := <-statsChan
+		ensure.DeepEqual(t, opStat.OpType, opType)
+		ensure.False(t, opStat.OpError)
+		return len(*exec.lastResult.(*[]Document))
+	}
+
+	// the query only fetches the first batch, and the getmores the next ones
+	ensure.DeepEqual(t, execute(Query), 10)
+	ensure.DeepEqual(t, exec.cursors.Len(), 1)
+	ensure.DeepEqual(t, execute(GetMore), 10)
+	ensure.DeepEqual(t, execute(GetMore), 5)
+	// the cursor got exhausted
+	ensure.DeepEqual(t, exec.cursors.Len(), 0)
+}
+
+func TestGetMoreDefaultBatchExecution(t *testing.T) {
+	test_db := "test_db_for_executor_getmore_default"
+	test_collection := "c1"
+
+	session, err := mgo.Dial("localhost")
+	ensure.Nil(t, err)
+	defer session.Close()
+	err = session.DB(test_db).DropDatabase()
+	ensure.Nil(t, err)
+	coll := session.DB(test_db).C(test_collection)
+	for i := 0; i < 250; i++ {
+		ensure.Nil(t, coll.Insert(bson.M{"_id": i}))
+	}
+
+	logger, err := NewLogger("", "")
+	ensure.Nil(t, err)
+	exec := NewOpsExecutor(session, nil, logger)
+	const recordedCursorId = 12345
+	execute := func(opType OpType, ntoreturn int64) int {
+		op := &Op{
+			Ns:        fmt.Sprintf("%s.%s", test_db, test_collection),
+			Timestamp: time.Unix(1396456709, int64(472*time.Millisecond)),
+			Type:      opType,
+			NToReturn: ntoreturn,
+			CursorId:  recordedCursorId,
+		}
+		normalizeOp(op)
+		ensure.Nil(t, exec.Execute(op))
+		return len(*exec.lastResult.(*[]Document))
+	}
+
+	// without an ntoreturn, each getmore fetches a default batch rather than
+	// draining the cursor
+	ensure.DeepEqual(t, execute(Query, 0), defaultFirstBatchSize)
+	ensure.DeepEqual(t, execute(GetMore, 0), defaultFirstBatchSize)
+	ensure.DeepEqual(t, exec.cursors.Len(), 1)
+	// a negative ntoreturn asks for its absolute value
+	ensure.DeepEqual(t, execute(GetMore, -20), 20)
+	ensure.DeepEqual(t, execute(GetMore, 0), 250-2*defaultFirstBatchSize-20)
+	ensure.DeepEqual(t, exec.cursors.Len(), 0)
+}
+
+func TestUndrainedQueryExecution(t *testing.T) {
+	test_db := "test_db_for_executor_undrained"
+	test_collection := "c1"
+
+	session, err := mgo.Dial("localhost")
+	ensure.Nil(t, err)
+	defer session.Close()
+	err = session.DB(test_db).DropDatabase()
+	ensure.Nil(t, err)
+	coll := session.DB(test_db).C(test_collection)
+	for i := 0; i < 150; i++ {
+		ensure.Nil(t, coll.Insert(bson.M{"_id": i}))
+	}
+
+	logger, err := NewLogger("", "")
+	ensure.Nil(t, err)
+	exec := NewOpsExecutor(session, nil, logger)
+	query := func(ntoreturn int64) int {
+		op := &Op{
+			Ns:        fmt.Sprintf("%s.%s", test_db, test_collection),
+			Timestamp: time.Unix(1396456709, int64(472*time.Millisecond)),
+			Type:      Query,
+			QueryDoc:  bson.D{},
+			NToReturn: ntoreturn,
+		}
+		ensure.Nil(t, exec.Execute(op))
+		return len(*exec.lastResult.(*[]Document))
+	}
+
+	// by default, all the results are fetched
+	ensure.DeepEqual(t, query(0), 150)
+	exec.SetDrainCursors(false)
+	ensure.DeepEqual(t, query(0), defaultFirstBatchSize)
+	ensure.DeepEqual(t, query(20), 20)
+	// no cursor is left open
+	ensure.DeepEqual(t, exec.cursors.Len(), 0)
+}
+
+func TestQueryModifiersExecution(t *testing.T) {
+	test_db := "test_db_for_executor_query_modifiers"
+	test_collection := "c1"
+
+	session, err := mgo.Dial("localhost")
+	ensure.Nil(t, err)
+	defer session.Close()
+	err = session.DB(test_db).DropDatabase()
+	ensure.Nil(t, err)
+	coll := session.DB(test_db).C(test_collection)
+	for i := 0; i < 10; i++ {
+		ensure.Nil(t, coll.Insert(bson.M{"_id": i, "a": i % 3, "b": i}))
+	}
+
+	logger, err := NewLogger("", "")
+	ensure.Nil(t, err)
+	exec := NewOpsExecutor(session, nil, logger)
+	query := func(queryDoc bson.D) []Document {
+		op := &Op{
+			Ns:        fmt.Sprintf("%s.%s", test_db, test_collection),
+			Timestamp: time.Unix(1396456709, int64(472*time.Millisecond)),
+			Type:      Query,
+			QueryDoc:  queryDoc,
+		}
+		ensure.Nil(t, exec.Execute(op))
+		return *exec.lastResult.(*[]Document)
+	}
+
+	result := query(bson.D{
+		{"find", test_collection},
+		{"filter", bson.D{{"a", bson.D{{"$gt", 0}}}}},
+		{"sort", bson.D{{"b", -1}}},
+		{"projection", bson.D{{"_id", 0}, {"b", 1}}},
+		{"skip", 1},
+		{"limit", 3},
+	})
+	ensure.DeepEqual(t, len(result), 3)
+	ensure.DeepEqual(t, result[0], Document{"b": 7})
+	ensure.DeepEqual(t, result[1], Document{"b": 5})
+	ensure.DeepEqual(t, result[2], Document{"b": 4})
+
+	result = query(bson.D{{"$query", bson.D{{"a", 0}}}, {"$orderby", bson.D{{"b", -1}}}})
+	ensure.DeepEqual(t, len(result), 4)
+	ensure.DeepEqual(t, result[0]["b"], 9)
+	ensure.DeepEqual(t, result[3]["b"], 0)
+}
+
+func TestUpdateExecution(t *testing.T) {
+	test_db := "test_db_for_executor_update"
+	test_collection := "c1"
+
+	session, err := mgo.Dial("localhost")
+	ensure.Nil(t, err)
+	defer session.Close()
+	err = session.DB(test_db).DropDatabase()
+	ensure.Nil(t, err)
+	coll := session.DB(test_db).C(test_collection)
+	for i := 0; i < 10; i++ {
+		ensure.Nil(t, coll.Insert(bson.M{"_id": i, "even": i%2 == 0}))
+	}
+
+	logger, err := NewLogger("", "")
+	ensure.Nil(t, err)
+	exec := NewOpsExecutor(session, nil, logger)
+	update := func(query bson.D, value string, upsert bool, multi bool) int {
+		op := &Op{
+			Ns:        fmt.Sprintf("%s.%s", test_db, test_collection),
+			Timestamp: time.Unix(1396456709, int64(472*time.Millisecond)),
+			Type:      Update,
+			QueryDoc:  query,
+			UpdateDoc: bson.D{{"$set", bson.D{{"value", value}}}},
+			Upsert:    upsert,
+			Multi:     multi,
+		}
+		normalizeOp(op)
+		ensure.Nil(t, exec.Execute(op))
+		count, err := coll.Find(bson.M{"value": value}).Count()
+		ensure.Nil(t, err)
+		return count
+	}
+
+	// a plain update only changes the first match
+	ensure.DeepEqual(t, update(bson.D{{"even", true}}, "single", false, false), 1)
+	// a multi update changes all of them
+	ensure.DeepEqual(t, update(bson.D{{"even", true}}, "multi", false, true), 5)
+	// an upsert inserts the missing doc
+	ensure.DeepEqual(t, update(bson.D{{"_id", 42}}, "upsert", true, false), 1)
+	ensure.DeepEqual(t, update(bson.D{{"_id", 43}}, "upsert multi", true, true), 1)
+	count, err := coll.Count()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, count, 12)
+}
+
+func TestRemoveExecution(t *testing.T) {
+	test_db := "test_db_for_executor_remove"
+	test_collection := "c1"
+
+	session, err := mgo.Dial("localhost")
+	ensure.Nil(t, err)
+	defer session.Close()
+	err = session.DB(test_db).DropDatabase()
+	ensure.Nil(t, err)
+	coll := session.DB(test_db).C(test_collection)
+	for i := 0; i < 10; i++ {
+		ensure.Nil(t, coll.Insert(bson.M{"_id": i, "mod": i % 3}))
+	}
+
+	logger, err := NewLogger("", "")
+	ensure.Nil(t, err)
+	exec := NewOpsExecutor(session, nil, logger)
+	remove := func(query bson.D, multi bool) int {
+		op := &Op{
+			Ns:        fmt.Sprintf("%s.%s", test_db, test_collection),
+			Timestamp: time.Unix(1396456709, int64(472*time.Millisecond)),
+			Type:      Remove,
+			QueryDoc:  query,
+			Multi:     multi,
+		}
+		normalizeOp(op)
+		ensure.Nil(t, exec.Execute(op))
+		count, err := coll.Count()
+		ensure.Nil(t, err)
+		return count
+	}
+
+	// a plain remove only deletes the first match
+	ensure.DeepEqual(t, remove(bson.D{{"mod", 0}}, false), 9)
+	// a multi remove deletes all of them
+	ensure.DeepEqual(t, remove(bson.D{{"mod", 1}}, true), 6)
+	// and succeeds when nothing matches
+	ensure.DeepEqual(t, remove(bson.D{{"mod", 1}}, true), 6)
+}
+
+func TestCreateIndexesExecution(t *testing.T) {
+	test_db := "test_db_for_executor_create_indexes"
+	test_collection := "c1"
+
+	session, err := mgo.Dial("localhost")
+	ensure.Nil(t, err)
+	defer session.Close()
+	err = session.DB(test_db).DropDatabase()
+	ensure.Nil(t, err)
+
+	logger, err := NewLogger("", "")
+	ensure.Nil(t, err)
+	statsChan := make(chan OpStat, 10)
+	exec := NewOpsExecutor(session, statsChan, logger)
+	exec.SetOpTimeouts(time.Minute, map[OpType]time.Duration{CreateIndexes: 0})
+	op := &Op{
+		Ns:        fmt.Sprintf("%s.$cmd", test_db),
+		Timestamp: time.Unix(1396456709, int64(472*time.Millisecond)),
+		Type:      Command,
+		CommandDoc: bson.D{
+			{"createIndexes", test_collection},
+			{"indexes", []interface{}{
+				bson.D{{"key", bson.D{{"a", 1}, {"b", -1}}}, {"name", "a_1_b_-1"}, {"unique", true}},
+			}},
+		},
+	}
+	normalizeOp(op)
+	ensure.Nil(t, exec.Execute(op))
+	opStat := <-statsChan
+	ensure.DeepEqual(t, opStat.OpType, CreateIndexes)
+	ensure.False(t, opStat.OpError)
+
+	indexes, err := session.DB(test_db).C(test_collection).Indexes()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(indexes), 2)
+	ensure.DeepEqual(t, indexes[0].Key, []string{"a", "-b"})
+	ensure.True(t, indexes[0].Unique)
+}
+
+func TestCreateIndexesTimeout(t *testing.T) {
+	test_db := "test_db_for_executor_create_indexes_timeout"
+	test_collection := "c1"
+
+	session, err := mgo.Dial("localhost")
+	ensure.Nil(t, err)
+	defer session.Close()
+	err = session.DB(test_db).DropDatabase()
+	ensure.Nil(t, err)
+	ensure.Nil(t, session.DB(test_db).C(test_collection).Insert(bson.M{"_id": 1}))
+
+	logger, err := NewLogger("", "")
+	ensure.Nil(t, err)
+	exec := NewOpsExecutor(session, nil, logger)
+	exec.SetMaxRetries(0)
+	opTimeouts, err := ParseOpTimeouts(DefaultOpTimeouts)
+	ensure.Nil(t, err)
+	socketTimeout := 100 * time.Millisecond
+	session.SetSocketTimeout(socketTimeout)
+	exec.SetOpTimeouts(socketTimeout, opTimeouts)
+
+	// stands for an index build that takes longer than the socket timeout
+	slow := func(op *Op, coll *mgo.Collection) error {
+		return coll.Find(bson.M{"$where": "sleep(300) || true"}).One(&bson.M{})
+	}
+	exec.subExecutes[CreateIndexes] = slow
+	exec.subExecutes[Query] = slow
+
+	op := &Op{
+		Ns:         fmt.Sprintf("%s.$cmd", test_db),
+		Timestamp:  time.Unix(1396456709, int64(472*time.Millisecond)),
+		Type:       Command,
+		CommandDoc: bson.D{{"createIndexes", test_collection}, {"indexes", []interface{}{}}},
+	}
+	normalizeOp(op)
+	ensure.Nil(t, exec.Execute(op))
+
+	// the other ops get the socket timeout back, which aborts them
+	op = &Op{
+		Ns:        fmt.Sprintf("%s.%s", test_db, test_collection),
+		Timestamp: time.Unix(1396456709, int64(472*time.Millisecond)),
+		Type:      Query,
+		QueryDoc:  bson.D{},
+	}
+	normalizeOp(op)
+	ensure.NotNil(t, exec.Execute(op))
+}
+
+func TestBulkInsertExecution(t *testing.T) {
+	test_db := "test_db_for_executor_bulk_insert"
+	test_collection := "c1"
+
+	session, err := mgo.Dial("localhost")
+	ensure.Nil(t, err)
+	defer session.Close()
+	err = session.DB(test_db).DropDatabase()
+	ensure.Nil(t, err)
+
+	docs := make([]interface{}, 1000)
+	for i := range docs {
+		docs[i] = bson.D{{"_id", i}}
+	}
+	// go through bson like a recorded op would
+	encoded, err := bson.Marshal(&Op{
+		Ns:         fmt.Sprintf("%s.$cmd", test_db),
+		Timestamp:  time.Unix(1396456709, int64(472*time.Millisecond)),
+		Type:       Command,
+		CommandDoc: bson.D{{"insert", test_collection}, {"documents", docs}, {"ordered", false}},
+	})
+	ensure.Nil(t, err)
+	var op Op
+	ensure.Nil(t, bson.Unmarshal(encoded, &op))
+	normalizeOp(&op)
+
+	logger, err := NewLogger("", "")
+	ensure.Nil(t, err)
+	statsChan := make(chan OpStat, 10)
+	exec := NewOpsExecutor(session, statsChan, logger)
+	ensure.Nil(t, exec.Execute(&op))
+
+	// the whole batch is a single op
+	ensure.DeepEqual(t, len(statsChan), 1)
+	opStat := <-statsChan
+	ensure.DeepEqual(t, opStat.OpType, Insert)
+	ensure.False(t, opStat.OpError)
+	count, err := session.DB(test_db).C(test_collection).Count()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, count, 1000)
+
+	// replaying the batch again fails, unless the duplicates are ignored
+	ensure.True(t, mgo.IsDup(exec.Execute(&op)))
+	opStat = <-statsChan
+	ensure.DeepEqual(t, opStat.ErrorCategory, DuplicateKeyError)
+	exec.SetIgnoreDupKey(true)
+	ensure.Nil(t, exec.Execute(&op))
+	opStat = <-statsChan
+	ensure.False(t, opStat.OpError)
+
+	// even in an ordered batch, the documents after a duplicate get inserted
+	ordered := op
+	ordered.CommandDoc = bson.D{{"insert", test_collection},
+		{"documents", []interface{}{bson.D{{"_id", 0}}, bson.D{{"_id", 1000}}}}, {"ordered", true}}
+	ensure.Nil(t, exec.Execute(&ordered))
+	<-statsChan
+	count, err = session.DB(test_db).C(test_collection).Count()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, count, 1001)
+}
+
+func TestWithoutDupKeyErrors(t *testing.T) {
+	ensure.Nil(t, withoutDupKeyErrors(nil))
+	ensure.Nil(t, withoutDupKeyErrors(&mgo.LastError{Code: 11000, Err: "E11000 duplicate key error"}))
+	err := &mgo.LastError{Code: 121, Err: "Document failed validation"}
+	ensure.DeepEqual(t, withoutDupKeyErrors(err), err)
+}
+
+func TestCanonicalizeOp(t *testing.T) {
+	op := CanonicalizeOp(&Op{Type: Command, CommandDoc: bson.D{{"findAndModify", "c1"}}})
+	ensure.DeepEqual(t, op.Type, FindAndModify)
+	ensure.DeepEqual(t, op.Collection, "c1")
+	op = CanonicalizeOp(&Op{Type: Command, CommandDoc: bson.D{{"count", "c2"}}})
+	ensure.DeepEqual(t, op.Type, Count)
+	ensure.DeepEqual(t, op.Collection, "c2")
+	op = CanonicalizeOp(&Op{Type: Command, CommandDoc: bson.D{{"aggregate", "c4"}}})
+	ensure.DeepEqual(t, op.Type, Aggregate)
+	op = CanonicalizeOp(&Op{Type: Command, CommandDoc: bson.D{{"distinct", "c6"}}})
+	ensure.DeepEqual(t, op.Type, Distinct)
+	ensure.DeepEqual(t, op.Collection, "c6")
+	op = CanonicalizeOp(&Op{Type: Command, CommandDoc: bson.D{{"createIndexes", "c7"}}})
+	ensure.DeepEqual(t, op.Type, CreateIndexes)
+	ensure.DeepEqual(t, op.Collection, "c7")
+	op = CanonicalizeOp(&Op{Type: Command, CommandDoc: bson.D{{"insert", "c5"}}})
+	ensure.DeepEqual(t, op.Type, Insert)
+	ensure.DeepEqual(t, op.Collection, "c5")
+	// the other commands are left to the generic execution, but for the
+	// authentication ones
+	op = CanonicalizeOp(&Op{Type: Command, Collection: "$cmd", CommandDoc: bson.D{{"dropDatabase", 1}}})
+	ensure.DeepEqual(t, op.Type, Command)
+	ensure.DeepEqual(t, op.Collection, "$cmd")
+	op = CanonicalizeOp(&Op{Type: Command, CommandDoc: bson.D{{"collStats", "c8"}}})
+	ensure.DeepEqual(t, op.Type, Command)
+	ensure.DeepEqual(t, op.Collection, "c8")
+	// the value of the commands that don't run against a collection isn't
+	// one, even if it's a string
+	op = CanonicalizeOp(&Op{Type: Command, Collection: "$cmd", CommandDoc: bson.D{{"eval", "db.c10.count()"}}})
+	ensure.DeepEqual(t, op.Type, Command)
+	ensure.DeepEqual(t, op.Collection, "$cmd")
+	op = CanonicalizeOp(&Op{Type: Command, Collection: "$cmd", CommandDoc: bson.D{{"renameCollection", "db.c11"}}})
+	ensure.DeepEqual(t, op.Collection, "$cmd")
+	// the commands run against the database rather than a collection keep
+	// the Command type, e.g. {aggregate: 1} for a $currentOp pipeline
+	for _, name := range []string{"aggregate", "count", "createIndexes", "distinct", "findAndModify", "insert"} {
+		op = CanonicalizeOp(&Op{Type: Command, Collection: "$cmd", CommandDoc: bson.D{{name, 1}}})
+		ensure.DeepEqual(t, op.Type, Command)
+		ensure.DeepEqual(t, op.Collection, "$cmd")
+	}
+	op = CanonicalizeOp(&Op{Type: Command, CommandDoc: bson.D{{"saslStart", 1}}})
+	ensure.True(t, op == nil)
+	op = CanonicalizeOp(&Op{Type: Query, Collection: "c3"})
+	ensure.DeepEqual(t, op.Type, Query)
+
+	// the executors of all the nodes canonicalize the op they share again,
+	// concurrently, which must leave it untouched
+	for _, shared := range []*Op{
+		{Type: Command, Collection: "$cmd", CommandDoc: bson.D{{"collStats", "c9"}}},
+		{Type: Command, Collection: "$cmd", CommandDoc: bson.D{{"findAndModify", "c9"}}},
+	} {
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				op := CanonicalizeOp(shared)
+				ensure.DeepEqual(t, op.Collection, "c9")
+				ensure.True(t, CanonicalizeOp(op) == op)
+			}()
+		}
+		wg.Wait()
+		ensure.DeepEqual(t, shared.Type, Command)
+		ensure.DeepEqual(t, shared.Collection, "$cmd")
+	}
+}
+
+func TestDryRunExecution(t *testing.T) {
+	logger, err := NewLogger("", "")
+	ensure.Nil(t, err)
+	statsChan := make(chan OpStat, 1)
+	exec := NewDryRunOpsExecutor(statsChan, logger)
+
+	op := &Op{
+		Ns:        "db.coll",
+		Type:      Insert,
+		InsertDoc: bson.D{{"a", 1}},
+	}
+	normalizeOp(op)
+	err = exec.Execute(op)
+	ensure.Nil(t, err)
+
+	stat := <-statsChan
+	ensure.DeepEqual(t, stat.OpType, Insert)
+	ensure.DeepEqual(t, stat.Ns, "db.coll")
+	ensure.False(t, stat.OpError)
+
+	// the stats that don't fit in the channel get dropped, without blocking
+	ensure.Nil(t, exec.Execute(op))
+	ensure.Nil(t, exec.Execute(op))
+	ensure.DeepEqual(t, len(statsChan), 1)
+	ensure.DeepEqual(t, exec.DroppedStats(), int64(1))
+
+	// but for their latency, if the analyzer counts them
+	analyzer := NewStatsAnalyzer(make(chan OpStat))
+	exec.SetStatsAnalyzer(analyzer)
+	ensure.Nil(t, exec.Execute(op))
+	ensure.DeepEqual(t, exec.DroppedStats(), int64(2))
+	status := analyzer.GetStatus()
+	ensure.DeepEqual(t, status.OpsExecuted, int64(1))
+	ensure.DeepEqual(t, status.Counts[Insert], int64(1))
+	ensure.DeepEqual(t, status.MaxLatency[Insert], float64(0))
+	// which the latency count of the metrics leaves out too
+	ensure.DeepEqual(t, status.LatencyCounts[Insert], int64(0))
+}
+
+func TestGenericCommandExecution(t *testing.T) {
+	test_db := "test_db_for_executor_generic_command"
+
+	session, err := mgo.Dial("localhost")
+	ensure.Nil(t, err)
+	defer session.Close()
+	err = session.DB(test_db).DropDatabase()
+	ensure.Nil(t, err)
+	ensure.Nil(t, session.DB(test_db).C("c1").Insert(bson.M{"_id": 1}))
+
+	logger, err := NewLogger("", "")
+	ensure.Nil(t, err)
+	statsChan := make(chan OpStat, 10)
+	exec := NewOpsExecutor(session, statsChan, logger)
+	exec.SetGenericCommands(true)
+	execute := func(ns string, cmd bson.D) {
+		op := &Op{Ns: ns, Type: Command, CommandDoc: cmd}
+		normalizeOp(op)
+		ensure.Nil(t, exec.Execute(op))
+		ensure.False(t, (<-statsChan).OpError)
+	}
+
+	// the collection of collStats is the one it names
+	execute(test_db+".$cmd", bson.D{{"collStats", "c1"}})
+	ensure.DeepEqual(t, exec.lastResult.(Document)["count"], 1)
+
+	// while the namespaces of renameCollection are kept as they are
+	execute("admin.$cmd", bson.D{{"renameCollection", test_db + ".c1"}, {"to", test_db + ".c2"}})
+	names, err := session.DB(test_db).CollectionNames()
+	ensure.Nil(t, err)
+	ensure.StringContains(t, strings.Join(names, ","), "c2")
+
+	// and so are the commands that don't name a collection
+	execute(test_db+".$cmd", bson.D{{"listCollections", 1}, {"filter", bson.D{{"name", "c2"}}}})
+	execute(test_db+".$cmd", bson.D{{"dbHash", 1}})
+}
+
+func TestGenericCommandDryRun(t *testing.T) {
+	logger, err := NewLogger("", "")
+	ensure.Nil(t, err)
+	statsChan := make(chan OpStat, 1)
+	exec := NewDryRunOpsExecutor(statsChan, logger)
+
+	op := &Op{Ns: "db.$cmd", Type: Command, CommandDoc: bson.D{{"collStats", "coll"}}}
+	normalizeOp(op)
+	ensure.DeepEqual(t, exec.Execute(op), NotSupported)
+	ensure.DeepEqual(t, len(statsChan), 0)
+
+	exec.SetGenericCommands(true)
+	ensure.Nil(t, exec.Execute(op))
+	stat := <-statsChan
+	ensure.DeepEqual(t, stat.OpType, Command)
+	ensure.DeepEqual(t, stat.Command, "collstats")
+	ensure.DeepEqual(t, stat.Ns, "db.coll")
+}
+
+func TestWriteCommandReply(t *testing.T) {
+	decode := func(doc bson.M) *writeCommandReply {
+		encoded, err := bson.Marshal(doc)
+		ensure.Nil(t, err)
+		var reply writeCommandReply
+		ensure.Nil(t, bson.Unmarshal(encoded, &reply))
+		return &reply
+	}
+
+	ensure.Nil(t, decode(bson.M{"ok": 1, "n": 2, "nModified": 2}).err())
+	err := decode(bson.M{"ok": 1, "n": 0, "writeErrors": []bson.M{
+		{"index": 0, "code": 11000, "errmsg": "E11000 duplicate key error"}}}).err()
+	ensure.True(t, mgo.IsDup(err))
+	ensure.DeepEqual(t, CategorizeError(err), DuplicateKeyError)
+	err = decode(bson.M{"ok": 1, "n": 1, "writeConcernError": bson.M{"code": 64, "errmsg": "waiting for replication timed out"}}).err()
+	ensure.DeepEqual(t, CategorizeError(err), TimeoutError)
+}
+
+func TestRetryOnSocketFailure(t *testing.T) {
+	logger, err := NewLogger("", "")
+	ensure.Nil(t, err)
+	session := &mgo.Session{}
+	retryBaseBackoff = time.Millisecond
+	defer func() { retryBaseBackoff = 100 * time.Millisecond }()
+
+	failures := func(n int, failure error) func() error {
+		return func() error {
+			if n > 0 {
+				n--
+				return failure
+			}
+			return nil
+		}
+	}
+
+	// transient errors are retried up to maxRetries times
+	ensure.Nil(t, retryOnSocketFailure(failures(3, io.EOF), session, logger, 3))
+	ensure.DeepEqual(t, retryOnSocketFailure(failures(4, io.EOF), session, logger, 3), io.EOF)
+	ensure.DeepEqual(t, retryOnSocketFailure(failures(1, io.EOF), session, logger, 0), io.EOF)
+
+	// the other ones aren't
+	ensure.DeepEqual(t, retryOnSocketFailure(failures(1, mgo.ErrNotFound), session, logger, 3), mgo.ErrNotFound)
+	queryErr := &mgo.QueryError{Message: "bad query"}
+	ensure.DeepEqual(t, retryOnSocketFailure(failures(1, queryErr), session, logger, 3), error(queryErr))
+}
+
+func TestExecuteWithinBudget(t *testing.T) {
+	logger, err := NewLogger("", "")
+	ensure.Nil(t, err)
+	exec := NewOpsExecutor(&mgo.Session{}, nil, logger)
+	exec.SetOpBudget(50 * time.Millisecond)
+	retryBaseBackoff = time.Millisecond
+	defer func() { retryBaseBackoff = 100 * time.Millisecond }()
+
+	ensure.Nil(t, exec.executeWithinBudget(func() error { return nil }, time.Minute))
+	slow := func() error {
+		time.Sleep(60 * time.Millisecond)
+		return nil
+	}
+	ensure.DeepEqual(t, exec.executeWithinBudget(slow, 0), OpTimedOut)
+
+	// the retries stop once the budget is spent
+	attempts := 0
+	failing := func() error {
+		attempts++
+		time.Sleep(20 * time.Millisecond)
+		return io.EOF
+	}
+	exec.SetMaxRetries(10)
+	ensure.DeepEqual(t, exec.executeWithinBudget(failing, time.Minute), OpTimedOut)
+	ensure.True(t, attempts < 10, attempts)
+
+	// the socket timeout of the round trips shrinks with the budget
+	ensure.DeepEqual(t, budgetTimeout(time.Second, 0), time.Second)
+	ensure.DeepEqual(t, budgetTimeout(time.Second, time.Minute), time.Second)
+	ensure.DeepEqual(t, budgetTimeout(time.Minute, time.Second), time.Second)
+	ensure.DeepEqual(t, budgetTimeout(0, time.Second), time.Nanosecond)
+	ensure.DeepEqual(t, budgetWatchInterval(time.Second), 50*time.Millisecond)
+	ensure.DeepEqual(t, budgetWatchInterval(time.Millisecond), time.Millisecond)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	for attempt := 1; attempt < 20; attempt++ {
+		backoff := retryBackoff(attempt)
+		ensure.True(t, backoff <= retryMaxBackoff, backoff)
+		if attempt <= 5 {
+			expected := retryBaseBackoff << uint(attempt-1)
+			ensure.True(t, backoff >= expected/2 && backoff <= expected, backoff)
+		}
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	ensure.False(t, IsConnectionError(nil))
+	ensure.True(t, IsConnectionError(io.EOF))
+	ensure.False(t, IsConnectionError(&mgo.LastError{Code: 11000}))
+	ensure.False(t, IsConnectionError(mgo.ErrNotFound))
+	ensure.False(t, IsConnectionError(OpTimedOut))
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestCategorizeError(t *testing.T) {
+	ensure.DeepEqual(t, CategorizeError(nil), ErrorCategory(""))
+	ensure.DeepEqual(t, CategorizeError(&mgo.LastError{Code: 11000, Err: "E11000 duplicate key error"}), DuplicateKeyError)
+	ensure.DeepEqual(t, CategorizeError(&mgo.LastError{Err: "bad update"}), QueryError)
+	ensure.DeepEqual(t, CategorizeError(&mgo.LastError{WTimeout: true}), TimeoutError)
+	ensure.DeepEqual(t, CategorizeError(&mgo.QueryError{Code: 2, Message: "bad query"}), QueryError)
+	ensure.DeepEqual(t, CategorizeError(&mgo.QueryError{Code: 50, Message: "exceeded time limit"}), TimeoutError)
+	ensure.DeepEqual(t, CategorizeError(mgo.ErrNotFound), NotFoundError)
+	ensure.DeepEqual(t, CategorizeError(timeoutError{}), TimeoutError)
+	ensure.DeepEqual(t, CategorizeError(OpTimedOut), TimeoutError)
+	ensure.DeepEqual(t, CategorizeError(io.EOF), SocketError)
+	ensure.DeepEqual(t, CategorizeError(errors.New("no reachable servers")), SocketError)
+	ensure.DeepEqual(t, CategorizeError(errors.New("something else")), OtherError)
+}
+
+func TestParseErrorCategories(t *testing.T) {
+	categories, err := ParseErrorCategories("")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(categories), 0)
+	categories, err = ParseErrorCategories("duplicate_key,not_found")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, categories, []ErrorCategory{DuplicateKeyError, NotFoundError})
+	_, err = ParseErrorCategories("dupkey")
+	ensure.NotNil(t, err)
+}
+
+func TestParseRecordedFind(t *testing.T) {
+	filter := bson.D{{"a", bson.D{{"$gt", 1}}}}
+
+	// a bare filter
+	find := parseRecordedFind(&Op{QueryDoc: filter, NToSkip: 5, NToReturn: 10})
+	ensure.DeepEqual(t, find, recordedFind{filter: filter, skip: 5, limit: 10})
+
+	// a find command
+	find = parseRecordedFind(&Op{QueryDoc: bson.D{
+		{"find", "c1"},
+		{"filter", filter},
+		{"projection", bson.D{{"b", 1}}},
+		{"sort", bson.D{{"b", -1}, {"c", 1.0}, {"score", bson.D{{"$meta", "textScore"}}}}},
+		{"hint", bson.D{{"b", -1}}},
+		{"skip", int64(2)},
+		{"limit", 3},
+	}})
+	ensure.DeepEqual(t, find, recordedFind{
+		filter:     filter,
+		projection: bson.D{{"b", 1}},
+		sort:       []string{"-b", "c", "$textScore:score"},
+		hint:       []string{"-b"},
+		skip:       2,
+		limit:      3,
+	})
+
+	// a wrapped filter, with or without the $
+	find = parseRecordedFind(&Op{QueryDoc: bson.D{
+		{"$query", filter},
+		{"$orderby", bson.D{{"b", 1}}},
+		{"$hint", "b_1"},
+		{"$readPreference", bson.D{{"mode", "secondary"}}},
+	}})
+	ensure.DeepEqual(t, find, recordedFind{filter: filter, sort: []string{"b"}})
+	find = parseRecordedFind(&Op{QueryDoc: bson.D{{"query", filter}, {"orderby", bson.D{{"b", -1}}}}})
+	ensure.DeepEqual(t, find, recordedFind{filter: filter, sort: []string{"-b"}})
+
+	// a filter on a field named query
+	odd := bson.D{{"query", "text"}}
+	ensure.DeepEqual(t, parseRecordedFind(&Op{QueryDoc: odd}), recordedFind{filter: odd})
+}
+
 func TestSafeGetInt(t *testing.T) {
-	val, err := safeGetInt(int32(11))
+	// what the bson package decodes the int32s into
+	val, err := safeGetInt(11)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, val, int(11))
+	val, err = safeGetInt(int32(11))
 	ensure.Nil(t, err)
 	ensure.DeepEqual(t, val, int(11))
 	val, err = safeGetInt(int64(11))
@@ -154,3 +1096,107 @@ func TestSafeGetInt(t *testing.T) {
 	val, err = safeGetInt("a")
 	ensure.NotNil(t, err)
 }
+
+func TestParseWriteConcern(t *testing.T) {
+	safe, err := ParseWriteConcern("0")
+	ensure.Nil(t, err)
+	ensure.True(t, safe == nil)
+	safe, err = ParseWriteConcern("2")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, *safe, mgo.Safe{W: 2})
+	safe, err = ParseWriteConcern("majority")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, *safe, mgo.Safe{WMode: "majority"})
+	_, err = ParseWriteConcern("-1")
+	ensure.NotNil(t, err)
+	_, err = ParseWriteConcern("")
+	ensure.NotNil(t, err)
+}
+
+func TestParseReadPreference(t *testing.T) {
+	mode, err := ParseReadPreference("primary")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, mode, mgo.Primary)
+	mode, err = ParseReadPreference("secondaryPreferred")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, mode, mgo.SecondaryPreferred)
+	mode, err = ParseReadPreference("nearest")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, mode, mgo.Nearest)
+	_, err = ParseReadPreference("tertiary")
+	ensure.NotNil(t, err)
+}
+
+func TestRecordedReadPreference(t *testing.T) {
+	_, ok := recordedReadPreference(&Op{QueryDoc: bson.D{{"a", 1}}})
+	ensure.False(t, ok)
+
+	mode, ok := recordedReadPreference(&Op{QueryDoc: bson.D{
+		{"$query", bson.D{{"a", 1}}},
+		{"$readPreference", bson.D{{"mode", "secondary"}}},
+	}})
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, mode, mgo.Secondary)
+
+	mode, ok = recordedReadPreference(&Op{CommandDoc: bson.D{
+		{"count", "coll"},
+		{"$readPreference", bson.D{{"mode", "nearest"}}},
+	}})
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, mode, mgo.Nearest)
+
+	// unknown modes are ignored
+	_, ok = recordedReadPreference(&Op{QueryDoc: bson.D{{"$readPreference", bson.D{{"mode", "bogus"}}}}})
+	ensure.False(t, ok)
+}
+
+// The workers of a replay with -pool_size share the pool of a session, each
+// op taking a socket from it. These compare the throughput of 16 workers per
+// CPU sharing a single socket with the one of them sharing 16.
+func BenchmarkSharedPool1(b *testing.B) {
+	benchmarkSharedPool(b, 1)
+}
+
+func BenchmarkSharedPool16(b *testing.B) {
+	benchmarkSharedPool(b, 16)
+}
+
+func benchmarkSharedPool(b *testing.B, poolSize int) {
+	test_db := "test_db_for_executor_shared_pool"
+	test_collection := "c1"
+
+	pool, err := mgo.Dial("localhost")
+	ensure.Nil(b, err)
+	defer pool.Close()
+	err = pool.DB(test_db).DropDatabase()
+	ensure.Nil(b, err)
+	for i := 0; i < 100; i++ {
+		ensure.Nil(b, pool.DB(test_db).C(test_collection).Insert(bson.M{"_id": i}))
+	}
+	pool.SetPoolLimit(poolSize)
+
+	logger, err := NewLogger("", "")
+	ensure.Nil(b, err)
+	op := &Op{
+		Ns:        fmt.Sprintf("%s.%s", test_db, test_collection),
+		Type:      Query,
+		QueryDoc:  bson.D{{"_id", bson.D{{"$gte", 0}}}},
+		NToReturn: 100,
+	}
+	normalizeOp(op)
+
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		session := pool.Copy()
+		defer session.Close()
+		// the stats are dropped once the channel is full, which is fine here
+		exec := NewOpsExecutor(session, make(chan OpStat), logger)
+		for pb.Next() {
+			if err := exec.Execute(op); err != nil {
+				b.Fatal(err)
+			}
+			session.Refresh()
+		}
+	})
+}
@@ -0,0 +1,398 @@
+package flashback
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// StdinFilename can be passed as the ops filename to read ops from stdin
+const StdinFilename = "-"
+
+// openOpsFiles opens the ops stream named by filename, which may be:
+//   - StdinFilename, to read the ops from stdin
+//   - a directory, to read all the files in it in lexical order
+//   - a glob such as "ops-*.bson", to read all the matching files in lexical order
+//   - a tar archive (ending in .tar, .tar.gz or .tgz), to read all the files in it
+//     in the order of the archive
+//   - an http(s):// or s3:// url, to download the file while reading it
+//   - a regular file
+//
+// Multiple files are read one after the other, as if they were concatenated.
+func openOpsFiles(filename string, logger *Logger) (io.ReadCloser, error) {
+	if filename == StdinFilename {
+		return openOpsStream(filename, os.Stdin, nil)
+	}
+	if isOpsURL(filename) {
+		return openURLOps(filename, logger)
+	}
+	if isTarFilename(filename) {
+		return openTarOps(filename, logger)
+	}
+
+	filenames, err := opsFilenames(filename)
+	if err != nil {
+		return nil, err
+	}
+	multi := &multiFileReader{filenames: filenames, logger: logger}
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return nil, err
+		}
+		multi.totalBytes += info.Size()
+	}
+	// open the first file right away, so that we fail early if it's missing
+	if err = multi.openNext(); err != nil {
+		return nil, err
+	}
+	return multi, nil
+}
+
+func opsFilenames(filename string) ([]string, error) {
+	if strings.ContainsAny(filename, "*?[") {
+		// Glob returns the matches in lexical order
+		filenames, err := filepath.Glob(filename)
+		if err != nil {
+			return nil, err
+		}
+		if len(filenames) == 0 {
+			return nil, fmt.Errorf("no ops files match %s", filename)
+		}
+		return filenames, nil
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{filename}, nil
+	}
+
+	// ReadDir returns the entries sorted by name
+	entries, err := ioutil.ReadDir(filename)
+	if err != nil {
+		return nil, err
+	}
+	var filenames []string
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			filenames = append(filenames, filepath.Join(filename, entry.Name()))
+		}
+	}
+	if len(filenames) == 0 {
+		return nil, fmt.Errorf("no ops files found in %s", filename)
+	}
+	return filenames, nil
+}
+
+// opsStream reads an ops file, decompressing it if needed
+type opsStream struct {
+	io.Reader
+	file *os.File
+}
+
+// openOpsStream wraps the file, adding the number of (compressed) bytes read
+// from it to bytesRead unless that is nil.
+func openOpsStream(filename string, file *os.File, bytesRead *int64) (*opsStream, error) {
+	var raw io.Reader = file
+	if bytesRead != nil {
+		raw = &countingReader{file, bytesRead}
+	}
+	src, err := maybeGunzip(filename, raw)
+	if err != nil {
+		closeOpsFile(file)
+		return nil, err
+	}
+	return &opsStream{src, file}, nil
+}
+
+func (s *opsStream) Close() error {
+	if closer, ok := s.Reader.(io.Closer); ok {
+		closer.Close()
+	}
+	return closeOpsFile(s.file)
+}
+
+// closeOpsFile closes the file, unless it's stdin, which isn't ours to close
+func closeOpsFile(file *os.File) error {
+	if file == os.Stdin {
+		return nil
+	}
+	return file.Close()
+}
+
+// countingReader atomically adds the number of bytes read to count, so that
+// it can be polled from another goroutine
+type countingReader struct {
+	io.Reader
+	count *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	atomic.AddInt64(c.count, int64(n))
+	return n, err
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// maybeGunzip wraps the given file in a gzip reader if it looks compressed.
+// The returned reader is buffered either way, since we need to peek at the
+// first bytes to sniff the format.
+func maybeGunzip(filename string, file io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(file)
+	magic, err := buffered.Peek(len(gzipMagic))
+	if strings.HasSuffix(filename, ".gz") || (err == nil && bytes.Equal(magic, gzipMagic)) {
+		return gzip.NewReader(buffered)
+	}
+	return buffered, nil
+}
+
+// multiFileReader reads a list of ops files one after the other
+type multiFileReader struct {
+	filenames  []string
+	current    *opsStream
+	logger     *Logger
+	totalBytes int64
+	bytesRead  int64
+}
+
+func (m *multiFileReader) openNext() error {
+	filename := m.filenames[0]
+	m.filenames = m.filenames[1:]
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	if m.current, err = openOpsStream(filename, file, &m.bytesRead); err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+	return nil
+}
+
+func (m *multiFileReader) Read(p []byte) (int, error) {
+	for {
+		if m.current == nil {
+			if len(m.filenames) == 0 {
+				return 0, io.EOF
+			}
+			if err := m.openNext(); err != nil {
+				return 0, err
+			}
+			m.logger.Infof("Started reading ops from %s", m.current.file.Name())
+		}
+
+		n, err := m.current.Read(p)
+		if err == io.EOF {
+			m.current.Close()
+			m.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (m *multiFileReader) Close() error {
+	if m.current == nil {
+		return nil
+	}
+	err := m.current.Close()
+	m.current = nil
+	return err
+}
+
+// seek moves to the given offset in the concatenated files, skipping the
+// whole files before it. Since the offsets are in the decompressed stream,
+// that only works if none of the files to go through is gzipped. It must be
+// called before anything is read.
+func (m *multiFileReader) seek(offset int64) error {
+	// the size of the files skipped as a whole
+	skipped := int64(0)
+	for {
+		filename := m.current.file.Name()
+		if _, ok := m.current.Reader.(*gzip.Reader); ok {
+			return fmt.Errorf("cannot seek in the gzipped ops file %s", filename)
+		}
+		info, err := m.current.file.Stat()
+		if err != nil {
+			return err
+		}
+
+		if offset < info.Size() || len(m.filenames) == 0 {
+			// start over from the offset, dropping what got buffered
+			if _, err := m.current.file.Seek(offset, io.SeekStart); err != nil {
+				return err
+			}
+			atomic.StoreInt64(&m.bytesRead, skipped+offset)
+			m.current.Reader = bufio.NewReader(&countingReader{m.current.file, &m.bytesRead})
+			return nil
+		}
+
+		offset -= info.Size()
+		skipped += info.Size()
+		m.current.Close()
+		if err := m.openNext(); err != nil {
+			return err
+		}
+	}
+}
+
+// CheckOpsSeekable makes sure the ops named by filename, see openOpsFiles, can
+// be resumed from an offset later on, i.e. that they are files or urls none of
+// which is gzipped.
+func CheckOpsSeekable(filename string) error {
+	if filename == StdinFilename || isTarFilename(filename) {
+		return fmt.Errorf("cannot seek in %s, only in ops files or urls", filename)
+	}
+	if isOpsURL(filename) {
+		r, err := newURLReader(filename)
+		if err != nil {
+			return err
+		}
+		_, gzipped := r.reader.(*gzip.Reader)
+		r.Close()
+		if gzipped {
+			return fmt.Errorf("cannot seek in the gzipped ops file %s", filename)
+		}
+		return nil
+	}
+	filenames, err := opsFilenames(filename)
+	if err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		file, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		stream, err := openOpsStream(filename, file, nil)
+		if err != nil {
+			return fmt.Errorf("%s: %s", filename, err)
+		}
+		_, gzipped := stream.Reader.(*gzip.Reader)
+		stream.Close()
+		if gzipped {
+			return fmt.Errorf("cannot seek in the gzipped ops file %s", filename)
+		}
+	}
+	return nil
+}
+
+// BytesRead returns how many bytes have been read from the files so far. For
+// gzipped files, that is the compressed size.
+func (m *multiFileReader) BytesRead() int64 {
+	return atomic.LoadInt64(&m.bytesRead)
+}
+
+// TotalBytes returns the combined size of all the files
+func (m *multiFileReader) TotalBytes() int64 {
+	return m.totalBytes
+}
+
+func isTarFilename(filename string) bool {
+	for _, suffix := range []string{".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(filename, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// tarReader reads the ops files packed in a tar archive one after the other
+type tarReader struct {
+	file       *os.File
+	archive    *tar.Reader
+	logger     *Logger
+	current    io.Reader
+	totalBytes int64
+	bytesRead  int64
+}
+
+func openTarOps(filename string, logger *Logger) (*tarReader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	t := &tarReader{file: file, logger: logger, totalBytes: info.Size()}
+	// .tgz archives get sniffed as gzipped
+	src, err := maybeGunzip(filename, &countingReader{file, &t.bytesRead})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	t.archive = tar.NewReader(src)
+	return t, nil
+}
+
+// nextEntry moves to the next ops file of the archive, skipping the
+// directories and the hidden files
+func (t *tarReader) nextEntry() error {
+	for {
+		header, err := t.archive.Next()
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(header.Name)
+		if header.Typeflag != tar.TypeReg || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if t.current, err = maybeGunzip(header.Name, t.archive); err != nil {
+			return fmt.Errorf("%s: %s", header.Name, err)
+		}
+		t.logger.Infof("Started reading ops from %s", header.Name)
+		return nil
+	}
+}
+
+func (t *tarReader) Read(p []byte) (int, error) {
+	for {
+		if t.current == nil {
+			if err := t.nextEntry(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := t.current.Read(p)
+		if err == io.EOF {
+			t.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (t *tarReader) Close() error {
+	return t.file.Close()
+}
+
+// BytesRead returns how many bytes of the archive have been read so far
+func (t *tarReader) BytesRead() int64 {
+	return atomic.LoadInt64(&t.bytesRead)
+}
+
+// TotalBytes returns the size of the archive
+func (t *tarReader) TotalBytes() int64 {
+	return t.totalBytes
+}
@@ -0,0 +1,205 @@
+package flashback
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// the keys of the extended JSON objects that stand for a single BSON value,
+// such as {"$oid": "..."}, as opposed to a document or a query operator
+var extendedJSONTypes = map[string]bool{
+	"$oid":        true,
+	"$date":       true,
+	"$numberLong": true,
+	"$binary":     true,
+	"$timestamp":  true,
+	"$regex":      true,
+	"$minKey":     true,
+	"$maxKey":     true,
+	"$undefined":  true,
+}
+
+// the number types of the canonical extended JSON of the newer tools, which
+// the bson package doesn't know, along with their decoding. Their value is
+// always a string, e.g. {"$numberDouble": "Infinity"}.
+var extendedJSONNumbers = map[string]func(value string) (interface{}, error){
+	"$numberInt": func(value string) (interface{}, error) {
+		n, err := strconv.ParseInt(value, 10, 32)
+		return int(n), err
+	},
+	"$numberDouble": func(value string) (interface{}, error) {
+		// that takes Infinity, -Infinity and NaN as well
+		return strconv.ParseFloat(value, 64)
+	},
+	"$numberDecimal": func(value string) (interface{}, error) {
+		return bson.ParseDecimal128(value)
+	},
+}
+
+// jsonOpsSource reads ops written one per line as MongoDB extended JSON, as
+// mongoexport writes documents, instead of BSON. Like the BSON documents, the
+// lines it loads keep their length, so that the ops offsets stay offsets into
+// the ops file.
+type jsonOpsSource struct {
+	reader *bufio.Reader
+	err    error
+}
+
+// isJSONOps tells whether the ops start like a JSON document rather than a
+// BSON one. The length prefix of a BSON document always holds a null byte,
+// since a document is at most 16MB.
+func isJSONOps(start []byte) bool {
+	if len(start) < 4 || bytes.IndexByte(start[:4], 0) >= 0 {
+		return false
+	}
+	return bytes.IndexByte([]byte("{ \t\r\n"), start[0]) >= 0
+}
+
+// LoadNext returns the next op line, along with the blank lines before it, or
+// nil once all the lines are read
+func (s *jsonOpsSource) LoadNext() []byte {
+	var line []byte
+	for {
+		more, err := s.reader.ReadBytes('\n')
+		line = append(line, more...)
+		if err != nil {
+			if err != io.EOF {
+				s.err = err
+			}
+			if len(bytes.TrimSpace(line)) == 0 {
+				return nil
+			}
+			return line
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			return line
+		}
+	}
+}
+
+func (s *jsonOpsSource) Err() error {
+	return s.err
+}
+
+// unmarshalJSONOp decodes an op written as extended JSON into op. The $oid,
+// $date, $numberLong, $numberDecimal etc. values are decoded into their BSON types, and the
+// documents keep the order of their fields, which matters for the commands.
+func unmarshalJSONOp(line []byte, op *Op) error {
+	doc, err := parseExtendedJSON(line)
+	if err != nil {
+		return err
+	}
+	encoded, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(encoded, op)
+}
+
+// parseExtendedJSON decodes an extended JSON document into a bson.D
+func parseExtendedJSON(data []byte) (bson.D, error) {
+	var raw json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	value, err := extendedJSONValue(raw)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := value.(bson.D)
+	if !ok {
+		return nil, errors.New("the op is not a JSON object")
+	}
+	return doc, nil
+}
+
+// extendedJSONValue decodes a (valid) JSON value, turning the objects into
+// bson.D, unless they stand for a BSON value, whose decoding is left to the
+// extended JSON support of the bson package. The integers are decoded as such
+// rather than as floats.
+func extendedJSONValue(raw json.RawMessage) (interface{}, error) {
+	raw = bytes.TrimSpace(raw)
+	switch raw[0] {
+	case '{':
+		return extendedJSONObject(raw)
+	case '[':
+		var elems []json.RawMessage
+		if err := json.Unmarshal(raw, &elems); err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, len(elems))
+		for i, elem := range elems {
+			var err error
+			if values[i], err = extendedJSONValue(elem); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return value, nil
+	}
+	if n, err := strconv.ParseInt(string(number), 10, 64); err == nil {
+		if int64(int32(n)) == n {
+			return int(n), nil
+		}
+		return n, nil
+	}
+	return number.Float64()
+}
+
+func extendedJSONObject(raw json.RawMessage) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	// the opening brace
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	doc := bson.D{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		name := token.(string)
+		if decode, ok := extendedJSONNumbers[name]; ok && len(doc) == 0 {
+			var value string
+			if err = decoder.Decode(&value); err != nil {
+				return nil, err
+			}
+			if decoder.More() {
+				return nil, fmt.Errorf("unexpected field after %s", name)
+			}
+			return decode(value)
+		}
+		if len(doc) == 0 && extendedJSONTypes[name] {
+			var value interface{}
+			err = bson.UnmarshalJSON(raw, &value)
+			return value, err
+		}
+		var rawValue json.RawMessage
+		if err = decoder.Decode(&rawValue); err != nil {
+			return nil, err
+		}
+		value, err := extendedJSONValue(rawValue)
+		if err != nil {
+			return nil, err
+		}
+		doc = append(doc, bson.DocElem{name, value})
+	}
+	return doc, nil
+}
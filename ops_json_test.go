@@ -0,0 +1,155 @@
+package flashback
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestParseExtendedJSON(t *testing.T) {
+	t.Parallel()
+
+	doc, err := parseExtendedJSON([]byte(`{"_id": {"$oid": "5099803df3f4948bd2f98391"}, ` +
+		`"at": {"$date": "2014-04-02T16:38:29.42Z"}, "epoch": {"$date": {"$numberLong": "1396456709420"}}, ` +
+		`"big": {"$numberLong": "9007199254740993"}, "small": 3, "huge": 5000000000, "ratio": 0.5, ` +
+		`"data": {"$binary": "AQID", "$type": "00"}, "oplog": {"$timestamp": {"t": 1396456709, "i": 2}}, ` +
+		`"pattern": {"$regex": "^a", "$options": "i"}, "low": {"$minKey": 1}, "high": {"$maxKey": 1}, ` +
+		`"gone": {"$undefined": true}, "tags": ["a", {"$numberLong": "1"}], "range": {"$gt": 1, "$lt": 5}}`))
+	ensure.Nil(t, err)
+
+	at := time.Date(2014, 4, 2, 16, 38, 29, 420*int(time.Millisecond), time.UTC)
+	expected := bson.D{
+		{"_id", bson.ObjectIdHex("5099803df3f4948bd2f98391")},
+		{"at", at},
+		{"epoch", at},
+		{"big", int64(9007199254740993)},
+		{"small", 3},
+		{"huge", int64(5000000000)},
+		{"ratio", 0.5},
+		{"data", []byte{1, 2, 3}},
+		{"oplog", bson.MongoTimestamp(1396456709<<32 | 2)},
+		{"pattern", bson.RegEx{Pattern: "^a", Options: "i"}},
+		{"low", bson.MinKey},
+		{"high", bson.MaxKey},
+		{"gone", bson.Undefined},
+		{"tags", []interface{}{"a", int64(1)}},
+		// the query operators are documents like the others
+		{"range", bson.D{{"$gt", 1}, {"$lt", 5}}},
+	}
+	ensure.DeepEqual(t, len(doc), len(expected))
+	for i := range expected {
+		ensure.DeepEqual(t, doc[i].Name, expected[i].Name)
+		if at, ok := doc[i].Value.(time.Time); ok {
+			ensure.True(t, at.Equal(expected[i].Value.(time.Time)))
+		} else {
+			ensure.DeepEqual(t, doc[i].Value, expected[i].Value)
+		}
+	}
+
+	_, err = parseExtendedJSON([]byte(`["not", "an", "op"]`))
+	ensure.NotNil(t, err)
+	_, err = parseExtendedJSON([]byte(`{"truncated": `))
+	ensure.NotNil(t, err)
+}
+
+func TestExtendedJSONRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	decimal, err := bson.ParseDecimal128("1.10")
+	ensure.Nil(t, err)
+	at := time.Date(2014, 4, 2, 16, 38, 29, 420*int(time.Millisecond), time.UTC)
+	// each type is decoded to its BSON type, which it keeps once encoded
+	types := []struct {
+		json     string
+		expected interface{}
+	}{
+		{`{"$oid": "5099803df3f4948bd2f98391"}`, bson.ObjectIdHex("5099803df3f4948bd2f98391")},
+		{`{"$date": "2014-04-02T16:38:29.42Z"}`, at},
+		{`{"$date": {"$numberLong": "1396456709420"}}`, at},
+		{`{"$numberLong": "9007199254740993"}`, int64(9007199254740993)},
+		{`{"$numberInt": "-42"}`, -42},
+		{`{"$numberDouble": "0.5"}`, 0.5},
+		{`{"$numberDouble": "-Infinity"}`, math.Inf(-1)},
+		{`{"$numberDecimal": "1.10"}`, decimal},
+		{`{"$binary": "AQID", "$type": "00"}`, []byte{1, 2, 3}},
+		{`{"$timestamp": {"t": 1396456709, "i": 2}}`, bson.MongoTimestamp(1396456709<<32 | 2)},
+		{`{"$regex": "^a", "$options": "i"}`, bson.RegEx{Pattern: "^a", Options: "i"}},
+		{`{"$minKey": 1}`, bson.MinKey},
+		{`{"$maxKey": 1}`, bson.MaxKey},
+		{`{"$undefined": true}`, bson.Undefined},
+	}
+	for _, tc := range types {
+		doc, err := parseExtendedJSON([]byte(`{"v": ` + tc.json + `}`))
+		ensure.Nil(t, err, tc.json)
+		encoded, err := bson.Marshal(doc)
+		ensure.Nil(t, err, tc.json)
+		var decoded bson.D
+		ensure.Nil(t, bson.Unmarshal(encoded, &decoded), tc.json)
+		for _, value := range []interface{}{doc[0].Value, decoded[0].Value} {
+			if at, ok := value.(time.Time); ok {
+				ensure.True(t, at.Equal(tc.expected.(time.Time)), tc.json)
+			} else {
+				ensure.DeepEqual(t, value, tc.expected, tc.json)
+			}
+		}
+	}
+
+	doc, err := parseExtendedJSON([]byte(`{"v": {"$numberDouble": "NaN"}}`))
+	ensure.Nil(t, err)
+	ensure.True(t, math.IsNaN(doc[0].Value.(float64)))
+	for _, bad := range []string{`{"$numberInt": "5000000000"}`, `{"$numberInt": 5}`,
+		`{"$numberDouble": "fast"}`, `{"$numberDecimal": "1.1", "$scale": 2}`} {
+		_, err = parseExtendedJSON([]byte(`{"v": ` + bad + `}`))
+		ensure.NotNil(t, err, bad)
+	}
+}
+
+func TestJSONOpsReader(t *testing.T) {
+	logger, _ = NewLogger("", "")
+	lines := []string{
+		`{"ns": "db.coll", "ts": {"$date": "2014-04-02T16:38:29.42Z"}, "op": "insert", ` +
+			`"o": {"_id": {"$oid": "5099803df3f4948bd2f98391"}, "n": {"$numberLong": "42"}}}`,
+		``,
+		`not json`,
+		`{"ns": "db.$cmd", "ts": {"$date": {"$numberLong": "1396456709421"}}, "op": "command", ` +
+			`"command": {"count": "coll", "query": {"at": {"$lt": {"$date": "2014-04-02T00:00:00Z"}}}}}`,
+	}
+	stream := strings.Join(lines, "\n")
+	ensure.True(t, isJSONOps([]byte(stream)))
+
+	_, reader := NewByLineOpsReader(mockBytesReader{bytes.NewReader([]byte(stream))}, logger, "")
+	op := reader.Next()
+	ensure.NotNil(t, op)
+	ensure.DeepEqual(t, op.Type, Insert)
+	ensure.DeepEqual(t, op.Offset, int64(0))
+	ensure.DeepEqual(t, op.InsertDoc, bson.D{
+		{"_id", bson.ObjectIdHex("5099803df3f4948bd2f98391")},
+		{"n", int64(42)},
+	})
+
+	op = reader.Next()
+	ensure.NotNil(t, op)
+	ensure.DeepEqual(t, op.Type, Command)
+	// the offsets are the ones of the lines
+	ensure.DeepEqual(t, op.Offset, int64(len(lines[0])+len(lines[1])+len(lines[2])+3))
+	ensure.DeepEqual(t, op.CommandDoc[0].Name, "count")
+	query, _ := GetElem(op.CommandDoc, "query")
+	at, _ := GetElem(query.(bson.D), "at")
+	lt, _ := GetElem(at.(bson.D), "$lt")
+	ensure.True(t, lt.(time.Time).Equal(time.Date(2014, 4, 2, 0, 0, 0, 0, time.UTC)))
+
+	ensure.True(t, reader.Next() == nil)
+	ensure.DeepEqual(t, reader.MalformedOps(), 1)
+	ensure.Nil(t, reader.Err())
+
+	// BSON documents always have a null byte in their length
+	encoded, err := bson.Marshal(bson.M{"ns": "db.coll"})
+	ensure.Nil(t, err)
+	ensure.False(t, isJSONOps(encoded))
+}
@@ -0,0 +1,107 @@
+package flashback
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// OpsProfile tallies the ops of a trace by op type and by namespace, e.g. to
+// check that the recorded workload is the one intended before replaying it
+type OpsProfile struct {
+	// the ops counted, skipped ones included
+	Ops     int64
+	OpTypes map[OpType]int64
+	// by database.collection
+	Namespaces map[string]int64
+	// the ops that wouldn't be replayed, such as the authentication commands
+	Skipped int64
+}
+
+// NsCount is the number of ops of a namespace
+type NsCount struct {
+	Ns  string
+	Ops int64
+}
+
+func NewOpsProfile() *OpsProfile {
+	return &OpsProfile{
+		OpTypes:    make(map[OpType]int64),
+		Namespaces: make(map[string]int64),
+	}
+}
+
+// Add counts the op under the type and namespace it would be replayed with,
+// see CanonicalizeOp
+func (p *OpsProfile) Add(op *Op) {
+	p.Ops++
+	op = CanonicalizeOp(op)
+	if op == nil {
+		p.Skipped++
+		return
+	}
+	p.OpTypes[op.Type]++
+	p.Namespaces[op.Database+"."+op.Collection]++
+}
+
+// Distribution returns the share of each op type, most frequent first, such
+// as "60% query, 25% insert, 15% update"
+func (p *OpsProfile) Distribution() string {
+	var counts []opTypeCount
+	for _, opType := range AllOpTypes {
+		if p.OpTypes[opType] > 0 {
+			counts = append(counts, opTypeCount{opType, p.OpTypes[opType]})
+		}
+	}
+	// stable, so that the ties stay in the order of AllOpTypes
+	sort.Stable(byOpTypeCount(counts))
+
+	total := p.Ops - p.Skipped
+	shares := make([]string, len(counts))
+	for i, count := range counts {
+		share := 100 * float64(count.ops) / float64(total)
+		if share < 1 {
+			shares[i] = fmt.Sprintf("<1%% %s", count.opType)
+		} else {
+			shares[i] = fmt.Sprintf("%.0f%% %s", share, count.opType)
+		}
+	}
+	return strings.Join(shares, ", ")
+}
+
+// TopNamespaces returns the n namespaces with the most ops, most frequent
+// first, or all of them if n is 0
+func (p *OpsProfile) TopNamespaces(n int) []NsCount {
+	names := make([]string, 0, len(p.Namespaces))
+	for ns := range p.Namespaces {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+	counts := make([]NsCount, len(names))
+	for i, ns := range names {
+		counts[i] = NsCount{Ns: ns, Ops: p.Namespaces[ns]}
+	}
+	// the ties stay sorted by name
+	sort.Stable(byNsCount(counts))
+	if n > 0 && len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+type opTypeCount struct {
+	opType OpType
+	ops    int64
+}
+
+type byOpTypeCount []opTypeCount
+
+func (c byOpTypeCount) Len() int           { return len(c) }
+func (c byOpTypeCount) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byOpTypeCount) Less(i, j int) bool { return c[i].ops > c[j].ops }
+
+type byNsCount []NsCount
+
+func (c byNsCount) Len() int           { return len(c) }
+func (c byNsCount) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byNsCount) Less(i, j int) bool { return c[i].Ops > c[j].Ops }
@@ -0,0 +1,39 @@
+package flashback
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestOpsProfile(t *testing.T) {
+	t.Parallel()
+
+	profile := NewOpsProfile()
+	for i := 0; i < 6; i++ {
+		profile.Add(&Op{Database: "db", Collection: "users", Type: Query})
+	}
+	profile.Add(&Op{Database: "db", Collection: "users", Type: Insert})
+	profile.Add(&Op{Database: "db", Collection: "events", Type: Insert})
+	profile.Add(&Op{Database: "db", Collection: "events", Type: Update})
+	// commands are counted under the op type they get replayed with
+	profile.Add(&Op{Database: "db", Collection: "$cmd", Type: Command,
+		CommandDoc: bson.D{{"count", "events"}}})
+	profile.Add(&Op{Database: "admin", Collection: "$cmd", Type: Command,
+		CommandDoc: bson.D{{"saslStart", 1}}})
+
+	ensure.DeepEqual(t, profile.Ops, int64(11))
+	ensure.DeepEqual(t, profile.Skipped, int64(1))
+	ensure.DeepEqual(t, profile.OpTypes[Count], int64(1))
+	// the ties keep the order of AllOpTypes
+	ensure.DeepEqual(t, profile.Distribution(), "60% query, 20% insert, 10% update, 10% command.count")
+	ensure.DeepEqual(t, profile.TopNamespaces(0), []NsCount{{"db.users", 7}, {"db.events", 3}})
+	ensure.DeepEqual(t, profile.TopNamespaces(1), []NsCount{{"db.users", 7}})
+
+	for i := 0; i < 200; i++ {
+		profile.Add(&Op{Database: "db", Collection: "users", Type: Query})
+	}
+	ensure.DeepEqual(t, profile.Distribution(), "98% query, <1% insert, <1% update, <1% command.count")
+}
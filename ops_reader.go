@@ -1,10 +1,15 @@
 package flashback
 
 import (
+	"bufio"
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"io"
-	"os"
+	"io/ioutil"
+	"math"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/mgo.v2/bson"
@@ -28,6 +33,10 @@ type OpsReader interface {
 	// Can be used with SkipOps, but you should call SkipOps after SetStartTime
 	SetStartTime(int64) (int64, error)
 
+	// Stop at a specific time in the set of ops: once an op past that time is
+	// read, the reader behaves as if it reached EOF
+	SetEndTime(int64)
+
 	// How many ops are read so far
 	OpsRead() int
 
@@ -40,19 +49,41 @@ type OpsReader interface {
 	Close()
 }
 
-// ByLineOpsReader reads ops from a json file that is exported from python's
-// json_util module, where each line is a json-represented op.
+// ByLineOpsReader reads ops from a stream of BSON documents, one per op, as
+// written by the Record tool (or pcap_converter). Despite the name, there are
+// no lines: each document is prefixed by its length, as per the BSON spec.
+// Streams of extended JSON documents, one per line, are read too, see
+// jsonOpsSource.
 //
-// Note: After parse each json-represented op, we need perform post-process to
-// convert some "metadata" into MongoDB specific data structures, like "Object
-// Id" and datetime.
+// Note: After decoding each op, we need to post-process it, e.g. to populate
+// its database and collection from its namespace.
 type ByLineOpsReader struct {
 	err       error
 	opsRead   int
 	closeFunc func()
 	logger    *Logger
 	opFilters []OpType
-	src       *db.DecodedBSONSource
+	opTypes   []OpType
+	nsFilter  *NsFilter
+	endTime   time.Time
+	// the source is only set up once the first op is read, since it depends
+	// on the format of the ops, see openSource
+	reader    io.Reader
+	src       opsDocSource
+	unmarshal func([]byte, *Op) error
+	position  bytesCounter
+	seeker    offsetSeeker
+	// where the next document starts in the ops file(s)
+	offset int64
+
+	lastTimestamp time.Time
+	warnedOrder   bool
+
+	// how many documents were loaded from the source, including the
+	// malformed ones, which are skipped unless strict
+	docsLoaded int
+	malformed  int
+	strict     bool
 }
 
 func NewByLineOpsReader(reader io.ReadCloser, logger *Logger, opFilter string) (error, *ByLineOpsReader) {
@@ -64,7 +95,7 @@ func NewByLineOpsReader(reader io.ReadCloser, logger *Logger, opFilter string) (
 		}
 	}
 	return nil, &ByLineOpsReader{
-		src:       db.NewDecodedBSONSource(db.NewBSONSource(reader)),
+		reader:    reader,
 		err:       nil,
 		opsRead:   0,
 		logger:    logger,
@@ -72,26 +103,207 @@ func NewByLineOpsReader(reader io.ReadCloser, logger *Logger, opFilter string) (
 	}
 }
 
+// NewFileByLineOpsReader opens the ops file and returns a reader for it. The
+// filename may also be StdinFilename, a directory or a glob, see
+// openOpsFiles. Files that are gzipped (either by a ".gz" extension or by
+// their magic bytes) are decompressed transparently.
 func NewFileByLineOpsReader(filename string, logger *Logger, opFilter string) (error, *ByLineOpsReader) {
-	file, err := os.Open(filename)
+	src, err := openOpsFiles(filename, logger)
+	if err != nil {
+		return err, nil
+	}
+	return newSourceByLineOpsReader(src, logger, opFilter)
+}
+
+// NewTarOpsReader reads the ops files packed in the given tar archive, which
+// may be gzipped (e.g. ops.tar.gz), one after the other in the order of the
+// archive, as one continuous stream of ops. The archive is streamed rather
+// than extracted. NewFileByLineOpsReader does the same for the filenames
+// ending in .tar, .tar.gz or .tgz.
+func NewTarOpsReader(filename string, logger *Logger, opFilter string) (error, *ByLineOpsReader) {
+	src, err := openTarOps(filename, logger)
 	if err != nil {
 		return err, nil
 	}
-	err, reader := NewByLineOpsReader(file, logger, opFilter)
+	return newSourceByLineOpsReader(src, logger, opFilter)
+}
+
+func newSourceByLineOpsReader(src io.ReadCloser, logger *Logger, opFilter string) (error, *ByLineOpsReader) {
+	err, reader := NewByLineOpsReader(src, logger, opFilter)
 	if err != nil {
+		src.Close()
 		return err, reader
 	}
 	reader.closeFunc = func() {
-		file.Close()
+		src.Close()
+	}
+	if position, ok := src.(bytesCounter); ok {
+		reader.position = position
+	}
+	if seeker, ok := src.(offsetSeeker); ok {
+		reader.seeker = seeker
 	}
 	return nil, reader
 }
 
+// opsDocSource loads the ops one at a time, undecoded
+type opsDocSource interface {
+	LoadNext() []byte
+	Err() error
+}
+
+// openSource sets up the source according to the format of the ops, BSON or
+// extended JSON, and how to decode them
+func (r *ByLineOpsReader) openSource() {
+	buffered := bufio.NewReader(r.reader)
+	if start, _ := buffered.Peek(4); isJSONOps(start) {
+		r.src = &jsonOpsSource{reader: buffered}
+		r.unmarshal = unmarshalJSONOp
+		return
+	}
+	r.src = db.NewDecodedBSONSource(db.NewBSONSource(ioutil.NopCloser(buffered)))
+	r.unmarshal = func(doc []byte, op *Op) error {
+		return bson.Unmarshal(doc, op)
+	}
+}
+
+// offsetSeeker is implemented by the sources that can move to an offset
+// without reading up to it
+type offsetSeeker interface {
+	seek(offset int64) error
+}
+
+// SeekToOffset moves the reader to the op starting at the given offset, as
+// found in Op.Offset, e.g. to resume a replay that crashed. It must be called
+// before any op is read, and only works with uncompressed ops files.
+func (r *ByLineOpsReader) SeekToOffset(offset int64) error {
+	if r.docsLoaded > 0 {
+		return errors.New("cannot seek once ops have been read")
+	}
+	if r.seeker == nil {
+		return errors.New("the ops source does not support seeking")
+	}
+	if err := r.seeker.seek(offset); err != nil {
+		return err
+	}
+	r.offset = offset
+	r.logger.Infof("Resuming from offset %d.", offset)
+	return nil
+}
+
+// bytesCounter is implemented by the sources that know how far in the ops
+// file(s) they are
+type bytesCounter interface {
+	BytesRead() int64
+	TotalBytes() int64
+}
+
+// BytesRead returns how many bytes of the ops file(s) have been read so far,
+// including the ones read ahead by buffering. It is safe to call from another
+// goroutine than the one reading the ops.
+func (r *ByLineOpsReader) BytesRead() int64 {
+	if r.position == nil {
+		return 0
+	}
+	return r.position.BytesRead()
+}
+
+// TotalBytes returns the size of the ops file(s), or 0 if it is unknown (e.g.
+// when reading from stdin).
+func (r *ByLineOpsReader) TotalBytes() int64 {
+	if r.position == nil {
+		return 0
+	}
+	return r.position.TotalBytes()
+}
+
+// SetOpTypes makes the reader skip all the ops whose (canonical) type isn't
+// one of the given op types. An empty list lets all the ops through.
+func (r *ByLineOpsReader) SetOpTypes(opTypes []OpType) {
+	r.opTypes = opTypes
+}
+
+// SetNsFilter makes the reader skip all the ops against namespaces that
+// don't match the given filter.
+func (r *ByLineOpsReader) SetNsFilter(nsFilter *NsFilter) {
+	r.nsFilter = nsFilter
+}
+
+// SetStrict makes the reader stop at the first malformed op, with an error,
+// rather than skip it.
+func (r *ByLineOpsReader) SetStrict(strict bool) {
+	r.strict = strict
+}
+
+// MalformedOps returns how many malformed ops got skipped so far
+func (r *ByLineOpsReader) MalformedOps() int {
+	return r.malformed
+}
+
+// validOpTypes are the op types found in the ops files, before
+// canonicalization
+var validOpTypes = []OpType{Insert, Update, Remove, Query, Command, GetMore}
+
+// validateOp makes sure the op can be handled by the rest of the pipeline
+func validateOp(op *Op) error {
+	if _, _, err := splitNs(op.Ns); err != nil {
+		return err
+	}
+	if op.Timestamp.IsZero() {
+		return errors.New("missing timestamp")
+	}
+	for _, opType := range validOpTypes {
+		if op.Type == opType {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown op type %q", op.Type)
+}
+
+// nextOp decodes the next valid op from the source into op. Malformed ops
+// are logged and skipped, unless the reader is strict. It returns false at
+// the end of the source, or on error.
+func (r *ByLineOpsReader) nextOp(op *Op) bool {
+	if r.src == nil {
+		r.openSource()
+	}
+	for {
+		doc := r.src.LoadNext()
+		if doc == nil {
+			if err := r.src.Err(); err != nil {
+				r.err = err
+			}
+			return false
+		}
+		r.docsLoaded++
+
+		*op = Op{}
+		err := r.unmarshal(doc, op)
+		op.Offset = r.offset
+		op.Size = len(doc)
+		r.offset += int64(len(doc))
+		if err == nil {
+			err = validateOp(op)
+		}
+		if err == nil {
+			return true
+		}
+
+		if r.strict {
+			r.err = fmt.Errorf("malformed op #%d: %s", r.docsLoaded, err)
+			r.logger.Error(r.err)
+			return false
+		}
+		r.malformed++
+		r.logger.Errorf("skipping malformed op #%d: %s", r.docsLoaded, err)
+	}
+}
+
 func (r *ByLineOpsReader) SkipOps(numSkipOps int) error {
 	var op Op
 	for numSkipped := 0; numSkipped < numSkipOps; numSkipped++ {
-		if ok := r.src.Next(&op); !ok {
-			return r.src.Err()
+		if ok := r.nextOp(&op); !ok {
+			return r.err
 		}
 	}
 
@@ -101,13 +313,13 @@ func (r *ByLineOpsReader) SkipOps(numSkipOps int) error {
 
 func (r *ByLineOpsReader) SetStartTime(startTime int64) (int64, error) {
 	var numSkipped int64
-	searchTime := time.Unix(startTime/1000, startTime%1000*1000000)
+	searchTime := timeFromMillis(startTime)
 
 	var op Op
 	for {
 		// The nature of this function is that it will discard the first op
-		if ok := r.src.Next(&op); !ok {
-			return numSkipped, r.src.Err()
+		if ok := r.nextOp(&op); !ok {
+			return numSkipped, r.err
 		}
 		numSkipped++
 
@@ -121,28 +333,57 @@ func (r *ByLineOpsReader) SetStartTime(startTime int64) (int64, error) {
 	return numSkipped, errors.New("no ops found after specified start_time")
 }
 
+func (r *ByLineOpsReader) SetEndTime(endTime int64) {
+	r.endTime = timeFromMillis(endTime)
+}
+
+func timeFromMillis(millis int64) time.Time {
+	return time.Unix(millis/1000, millis%1000*1000000)
+}
+
 func (r *ByLineOpsReader) Next() *Op {
+	if r.err == io.EOF {
+		return nil
+	}
+
 	// we may need to skip certain type of ops
 	var op Op
 	for {
-		if ok := r.src.Next(&op); !ok {
+		if ok := r.nextOp(&op); !ok {
+			return nil
+		}
+
+		if !r.endTime.IsZero() && op.Timestamp.After(r.endTime) {
+			r.logger.Infof("Reached the end time after reading %d ops.", r.opsRead)
+			r.err = io.EOF
 			return nil
 		}
 
 		r.opsRead++
 
+		if op.Timestamp.Before(r.lastTimestamp) && !r.warnedOrder {
+			r.logger.Errorf("Op #%d is older than the op before it (%v < %v). Ops are expected to be "+
+				"sorted by time, which matters for the \"real\" style", r.opsRead, op.Timestamp, r.lastTimestamp)
+			r.warnedOrder = true
+		}
+		r.lastTimestamp = op.Timestamp
+
 		// filter out unwanted ops
-		if shouldFilterOp(&op, r.opFilters) {
+		if shouldFilterOp(&op, r.opFilters) || !shouldIncludeOp(&op, r.opTypes) {
 			continue
 		}
 
 		normalizeOp(&op)
 
+		if !r.nsFilter.Matches(canonicalNs(&op)) {
+			continue
+		}
+
 		// Clean up empty keys on specific ops
 		emptyKeysToPrune := []string{"$set", "$unset"}
 		switch op.Type {
 		case Command:
-			if op.CommandDoc[0].Name == "findandmodify" {
+			if canonicalOpType(&op) == FindAndModify {
 				for i := range op.CommandDoc {
 					if op.CommandDoc[i].Name == "update" {
 						if updateDoc, ok := op.CommandDoc[i].Value.(bson.D); ok {
@@ -187,6 +428,32 @@ func shouldFilterOp(op *Op, filters []OpType) bool {
 	return false
 }
 
+func shouldIncludeOp(op *Op, opTypes []OpType) bool {
+	if len(opTypes) == 0 {
+		return true
+	}
+
+	opType := canonicalOpType(op)
+	for _, included := range opTypes {
+		if opType == included {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalNs returns the namespace the (normalized) op will be run against.
+// For commands, that is the collection the command is run on, rather than
+// the "$cmd" collection found in the recorded namespace.
+func canonicalNs(op *Op) string {
+	if op.Type == Command && len(op.CommandDoc) > 0 {
+		if collection, ok := op.CommandDoc[0].Value.(string); ok {
+			return op.Database + "." + collection
+		}
+	}
+	return op.Database + "." + op.Collection
+}
+
 func normalizeOp(op *Op) {
 	// populate db and collection name
 	parts := strings.SplitN(op.Ns, ".", 2)
@@ -201,6 +468,15 @@ type CyclicOpsReader struct {
 	previousRead int
 	err          error
 	logger       *Logger
+	endTime      int64
+	// how many times to go through the ops, 0 meaning infinitely
+	loops int
+	cycle int
+	done  bool
+	// the malformed ops skipped by the previous readers
+	previousMalformed int
+	// the bytes read by the previous readers
+	previousBytes int64
 }
 
 func NewCyclicOpsReader(maker func() OpsReader, logger *Logger) *CyclicOpsReader {
@@ -215,16 +491,80 @@ func NewCyclicOpsReader(maker func() OpsReader, logger *Logger) *CyclicOpsReader
 		0,
 		nil,
 		logger,
+		0,
+		0,
+		1,
+		false,
+		0,
+		0,
+	}
+}
+
+// NewFileCyclicOpsReader cycles through the given ops file(s), re-opening
+// them for every cycle, so that the ops are streamed from disk rather than
+// held in memory however large the files are. setup, if not nil, is called
+// on the reader of each cycle, e.g. to set its filters.
+func NewFileCyclicOpsReader(filename string, logger *Logger, opFilter string,
+	setup func(*ByLineOpsReader)) (error, *CyclicOpsReader) {
+	var openErr error
+	maker := func() OpsReader {
+		err, reader := NewFileByLineOpsReader(filename, logger, opFilter)
+		if err != nil {
+			openErr = err
+			return nil
+		}
+		if setup != nil {
+			setup(reader)
+		}
+		return reader
 	}
+	if reader := NewCyclicOpsReader(maker, logger); reader != nil {
+		return nil, reader
+	}
+	return openErr, nil
+}
+
+// SetLoops bounds how many times the ops get read, after which the reader
+// behaves as if it reached EOF. 0 (the default) means infinitely.
+func (c *CyclicOpsReader) SetLoops(loops int) {
+	c.loops = loops
 }
 
 func (c *CyclicOpsReader) Next() *Op {
+	if c.done {
+		return nil
+	}
+
 	var op *Op = nil
 	if op = c.reader.Next(); op == nil {
-		c.logger.Info("Recycle starts")
+		if err := c.reader.Err(); err != nil && err != io.EOF {
+			// e.g. a malformed op in strict mode: starting over would hit it again
+			c.err = err
+			c.done = true
+			return nil
+		}
+		if c.loops > 0 && c.cycle >= c.loops {
+			c.logger.Infof("Done after %d loops", c.cycle)
+			c.done = true
+			return nil
+		}
+		c.cycle++
+		c.logger.Infof("Recycle starts (loop #%d)", c.cycle)
 		c.previousRead += c.reader.OpsRead()
+		c.previousMalformed += malformedOps(c.reader)
+		c.previousBytes += bytesRead(c.reader)
 		c.reader.Close()
-		c.reader = c.maker()
+		reader := c.maker()
+		if reader == nil {
+			// e.g. the file got deleted in the meantime
+			c.err = errors.New("could not reopen the ops for the next loop")
+			c.done = true
+			return nil
+		}
+		c.reader = reader
+		if c.endTime > 0 {
+			c.reader.SetEndTime(c.endTime)
+		}
 		op = c.reader.Next()
 	}
 	if op == nil {
@@ -238,8 +578,39 @@ func (c *CyclicOpsReader) OpsRead() int {
 	return c.reader.OpsRead() + c.previousRead
 }
 
+// MalformedOps returns how many malformed ops got skipped so far, over all
+// the cycles
+func (c *CyclicOpsReader) MalformedOps() int {
+	return malformedOps(c.reader) + c.previousMalformed
+}
+
+// BytesRead returns how many bytes of the ops file(s) have been read so far,
+// over all the cycles
+func (c *CyclicOpsReader) BytesRead() int64 {
+	return bytesRead(c.reader) + c.previousBytes
+}
+
+// bytesRead returns how many bytes the reader read, if it knows
+func bytesRead(reader OpsReader) int64 {
+	if counter, ok := reader.(interface {
+		BytesRead() int64
+	}); ok {
+		return counter.BytesRead()
+	}
+	return 0
+}
+
+func malformedOps(reader OpsReader) int {
+	if counter, ok := reader.(interface {
+		MalformedOps() int
+	}); ok {
+		return counter.MalformedOps()
+	}
+	return 0
+}
+
 func (c *CyclicOpsReader) AllLoaded() bool {
-	return false
+	return c.done
 }
 
 func (c *CyclicOpsReader) SkipOps(numSkipOps int) error {
@@ -250,6 +621,12 @@ func (c *CyclicOpsReader) SetStartTime(startTime int64) (int64, error) {
 	return c.reader.SetStartTime(startTime)
 }
 
+// SetEndTime applies to every cycle, so each of them stops at the end time
+func (c *CyclicOpsReader) SetEndTime(endTime int64) {
+	c.endTime = endTime
+	c.reader.SetEndTime(endTime)
+}
+
 func (c *CyclicOpsReader) Err() error {
 	if c.err != nil {
 		return c.err
@@ -261,6 +638,203 @@ func (c *CyclicOpsReader) Close() {
 	c.reader.Close()
 }
 
+// FractionOpsReader only lets through a fraction of the ops of the underlying
+// reader, e.g. to replay 10% of the production load. Whether an op is kept
+// depends on a hash of the op rather than on chance, so the same ops are
+// replayed on every run.
+type FractionOpsReader struct {
+	OpsReader
+	// the ops are kept if their hash is below it
+	threshold uint64
+	opsSeen   int64
+	opsKept   int64
+}
+
+// NewFractionOpsReader keeps the given fraction, between 0 and 1, of the ops
+func NewFractionOpsReader(reader OpsReader, fraction float64) *FractionOpsReader {
+	threshold := uint64(math.MaxUint64)
+	if fraction < 1 {
+		threshold = uint64(fraction * math.MaxUint64)
+	}
+	return &FractionOpsReader{OpsReader: reader, threshold: threshold}
+}
+
+func (r *FractionOpsReader) Next() *Op {
+	for {
+		op := r.OpsReader.Next()
+		if op == nil {
+			return nil
+		}
+		r.opsSeen++
+		if hashOp(op) <= r.threshold {
+			r.opsKept++
+			return op
+		}
+	}
+}
+
+// OpsSeen returns how many ops the underlying reader returned so far
+func (r *FractionOpsReader) OpsSeen() int64 {
+	return r.opsSeen
+}
+
+// OpsKept returns how many of them were let through
+func (r *FractionOpsReader) OpsKept() int64 {
+	return r.opsKept
+}
+
+// SizeLimitedOpsReader keeps the ops larger than a given size out of the
+// replay, e.g. so that a few huge documents held by many workers at once
+// don't exhaust the memory of the replay host. The size is the one of the op
+// in the ops file(s), or of its BSON for the ops read from elsewhere. Each of
+// them gets logged with its namespace and size. Once SetKeepOversized is
+// called, they are replayed after all, but still counted apart.
+type SizeLimitedOpsReader struct {
+	OpsReader
+	maxSize       int
+	keepOversized bool
+	logger        *Logger
+	oversizedOps  int64
+}
+
+func NewSizeLimitedOpsReader(reader OpsReader, maxSize int, logger *Logger) *SizeLimitedOpsReader {
+	return &SizeLimitedOpsReader{OpsReader: reader, maxSize: maxSize, logger: logger}
+}
+
+// SetKeepOversized makes the reader return the oversized ops too
+func (r *SizeLimitedOpsReader) SetKeepOversized(keepOversized bool) {
+	r.keepOversized = keepOversized
+}
+
+func (r *SizeLimitedOpsReader) Next() *Op {
+	for {
+		op := r.OpsReader.Next()
+		if op == nil {
+			return nil
+		}
+		size := op.Size
+		if size == 0 {
+			encoded, err := bson.Marshal(op)
+			if err != nil {
+				return op
+			}
+			size = len(encoded)
+		}
+		if size <= r.maxSize {
+			return op
+		}
+
+		r.oversizedOps++
+		if r.keepOversized {
+			return op
+		}
+		r.logger.Errorf("skipping the %s op on %s of %d bytes, larger than %d bytes", op.Type, op.Ns,
+			size, r.maxSize)
+	}
+}
+
+// OversizedOps returns how many ops were larger than the limit so far, whether
+// they were skipped or not
+func (r *SizeLimitedOpsReader) OversizedOps() int64 {
+	return r.oversizedOps
+}
+
+// StaleOpsReader skips the ops recorded longer than maxAge ago, e.g. the
+// backlog of an oplog tailed from far behind, or of a recording resumed
+// after a long pause. The age is relative to the clock of the trace, i.e. to
+// the newest op read so far, unless SetWallClock is called. The ops without a
+// timestamp are kept.
+type StaleOpsReader struct {
+	OpsReader
+	maxAge time.Duration
+	// the newest timestamp read so far
+	newest time.Time
+	// if not nil, the clock to use instead of the trace's
+	now      func() time.Time
+	staleOps int64
+}
+
+func NewStaleOpsReader(reader OpsReader, maxAge time.Duration) *StaleOpsReader {
+	return &StaleOpsReader{OpsReader: reader, maxAge: maxAge}
+}
+
+// SetWallClock makes the age relative to the current time instead, e.g. for
+// an oplog tailed live, whose newest entries may already be stale.
+func (r *StaleOpsReader) SetWallClock(wallClock bool) {
+	if wallClock {
+		r.now = time.Now
+	} else {
+		r.now = nil
+	}
+}
+
+func (r *StaleOpsReader) Next() *Op {
+	for {
+		op := r.OpsReader.Next()
+		if op == nil || op.Timestamp.IsZero() {
+			return op
+		}
+		now := r.newest
+		if r.now != nil {
+			now = r.now()
+		} else if op.Timestamp.After(now) {
+			r.newest = op.Timestamp
+			now = op.Timestamp
+		}
+		if !op.Timestamp.Before(now.Add(-r.maxAge)) {
+			return op
+		}
+		r.staleOps++
+	}
+}
+
+// StaleOps returns how many ops were skipped as stale so far
+func (r *StaleOpsReader) StaleOps() int64 {
+	return r.staleOps
+}
+
+// TimedOpsReader measures how long the underlying reader takes to read (and
+// parse) the ops, to tell whether a replay is held up by the ops file(s)
+// rather than by the database.
+type TimedOpsReader struct {
+	OpsReader
+	// in nanoseconds, updated atomically
+	readTime int64
+}
+
+func NewTimedOpsReader(reader OpsReader) *TimedOpsReader {
+	return &TimedOpsReader{OpsReader: reader}
+}
+
+func (r *TimedOpsReader) Next() *Op {
+	start := time.Now()
+	op := r.OpsReader.Next()
+	atomic.AddInt64(&r.readTime, int64(time.Now().Sub(start)))
+	return op
+}
+
+// ReadTime returns the time spent reading the ops so far
+func (r *TimedOpsReader) ReadTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&r.readTime))
+}
+
+// BytesRead returns how many bytes of the ops file(s) have been read so far,
+// or 0 if the underlying reader doesn't know (e.g. when tailing the oplog)
+func (r *TimedOpsReader) BytesRead() int64 {
+	return bytesRead(r.OpsReader)
+}
+
+func hashOp(op *Op) uint64 {
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%s %s %d", op.Type, op.Ns, op.Timestamp.UnixNano())
+	for _, doc := range []bson.D{op.QueryDoc, op.InsertDoc, op.UpdateDoc, op.CommandDoc} {
+		if encoded, err := bson.Marshal(doc); err == nil {
+			hash.Write(encoded)
+		}
+	}
+	return hash.Sum64()
+}
+
 // Some operations are recorded with empty values for $set, $unset
 // When these are replayed against a mongo instance, they generate an error and do not execute
 // This method will detect and remove these empty blocks before the query is executed
@@ -1,9 +1,15 @@
 package flashback
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -108,6 +114,130 @@ func CheckSetStartTime(t *testing.T, loader OpsReader) {
 	ensure.DeepEqual(t, expectedOpsRead, 1)
 }
 
+func CheckSetEndTime(t *testing.T, loader OpsReader) {
+	expectedOpsRead := 0
+	loader.SetEndTime(1396456709423)
+
+	for op := loader.Next(); op != nil; op = loader.Next() {
+		expectedOpsRead += 1
+		ensure.NotNil(t, op)
+		ensure.DeepEqual(t, loader.OpsRead(), expectedOpsRead)
+	}
+
+	// Verify that only the first 3 ops are read, and that the reader stays done
+	ensure.DeepEqual(t, expectedOpsRead, 3)
+	ensure.True(t, loader.AllLoaded())
+	ensure.True(t, loader.Next() == nil)
+}
+
+func TestCyclicOpsReaderLoops(t *testing.T) {
+	logger, _ = NewLogger("", "")
+	testOps := makeTestInsertOps()
+	maker := func() OpsReader {
+		_, reader := NewByLineOpsReader(newMockOpsStreamReader(t, testOps), logger, "")
+		return reader
+	}
+
+	reader := NewCyclicOpsReader(maker, logger)
+	reader.SetLoops(3)
+	opsRead := 0
+	for op := reader.Next(); op != nil; op = reader.Next() {
+		opsRead++
+	}
+	ensure.DeepEqual(t, opsRead, 3*len(testOps))
+	ensure.DeepEqual(t, reader.OpsRead(), 3*len(testOps))
+	ensure.True(t, reader.AllLoaded())
+	ensure.Nil(t, reader.Err())
+	ensure.True(t, reader.Next() == nil)
+
+	// infinitely by default
+	reader = NewCyclicOpsReader(maker, logger)
+	for i := 0; i < 10*len(testOps); i++ {
+		ensure.NotNil(t, reader.Next())
+	}
+	ensure.False(t, reader.AllLoaded())
+}
+
+// Implements ReadCloser over raw bytes
+type mockBytesReader struct {
+	*bytes.Reader
+}
+
+func (m mockBytesReader) Close() error {
+	return nil
+}
+
+func TestFileCyclicOpsReader(t *testing.T) {
+	logger, _ = NewLogger("", "")
+	dir, err := ioutil.TempDir("", "flashback_ops")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "ops.bson")
+	testOps := makeTestInsertOps()
+	writeOpsFile(t, filename, testOps, false)
+
+	setups := 0
+	err, reader := NewFileCyclicOpsReader(filename, logger, "", func(*ByLineOpsReader) {
+		setups++
+	})
+	ensure.Nil(t, err)
+	reader.SetLoops(3)
+	for i := 0; i < len(testOps); i++ {
+		ensure.NotNil(t, reader.Next())
+	}
+
+	// every loop reads the file from disk again, rather than from memory
+	writeOpsFile(t, filename, testOps[:2], false)
+	for i := 0; i < 2; i++ {
+		ensure.NotNil(t, reader.Next())
+	}
+	ensure.DeepEqual(t, setups, 2)
+
+	// the file is gone by the next loop
+	ensure.Nil(t, os.Remove(filename))
+	ensure.True(t, reader.Next() == nil)
+	ensure.True(t, reader.AllLoaded())
+	ensure.NotNil(t, reader.Err())
+
+	err, _ = NewFileCyclicOpsReader(filename, logger, "", nil)
+	ensure.NotNil(t, err)
+}
+
+func TestMalformedOps(t *testing.T) {
+	logger, _ = NewLogger("", "")
+	testOps := makeTestInsertOps()
+
+	var stream []byte
+	appendDoc := func(doc interface{}) {
+		encoded, err := bson.Marshal(doc)
+		ensure.Nil(t, err)
+		stream = append(stream, encoded...)
+	}
+	appendDoc(testOps[0])
+	appendDoc(bson.M{"ns": "nocollection", "ts": testOps[0].Timestamp, "op": "insert"})
+	appendDoc(bson.M{"ns": "db.coll", "ts": testOps[0].Timestamp, "op": "killcursors"})
+	appendDoc(bson.M{"ns": "db.coll", "op": "insert"})
+	// a document whose length is right, but not its content
+	stream = append(stream, 8, 0, 0, 0, 0x42, 'a', 0, 0)
+	appendDoc(testOps[1])
+
+	_, reader := NewByLineOpsReader(mockBytesReader{bytes.NewReader(stream)}, logger, "")
+	opsRead := 0
+	for op := reader.Next(); op != nil; op = reader.Next() {
+		opsRead++
+	}
+	ensure.DeepEqual(t, opsRead, 2)
+	ensure.DeepEqual(t, reader.MalformedOps(), 4)
+	ensure.Nil(t, reader.Err())
+
+	_, reader = NewByLineOpsReader(mockBytesReader{bytes.NewReader(stream)}, logger, "")
+	reader.SetStrict(true)
+	ensure.NotNil(t, reader.Next())
+	ensure.True(t, reader.Next() == nil)
+	ensure.StringContains(t, reader.Err().Error(), "malformed op #2")
+	ensure.DeepEqual(t, reader.MalformedOps(), 0)
+}
+
 func TestPruneEmptyKeys(t *testing.T) {
 	t.Parallel()
 	// Check findAndModify and update structures to ensure nil $unsets are removed
@@ -147,11 +277,9 @@ func TestPruneEmptyKeys(t *testing.T) {
 	}
 }
 
-func TestFileByLineOpsReader(t *testing.T) {
-	t.Parallel()
-	logger, _ = NewLogger("", "")
-
-	testOps := []Op{
+// The five insert ops that CheckOpsReader and friends expect to read
+func makeTestInsertOps() []Op {
+	return []Op{
 		Op{
 			Ns:        "db.coll",
 			Timestamp: time.Unix(1396456709, int64(421*time.Millisecond)),
@@ -183,6 +311,13 @@ func TestFileByLineOpsReader(t *testing.T) {
 			InsertDoc: bson.D{{"logType5", "warning"}, {"message", "m5"}},
 		},
 	}
+}
+
+func TestFileByLineOpsReader(t *testing.T) {
+	t.Parallel()
+	logger, _ = NewLogger("", "")
+
+	testOps := makeTestInsertOps()
 
 	reader := newMockOpsStreamReader(t, testOps)
 	err, loader := NewByLineOpsReader(reader, logger, "")
@@ -200,6 +335,243 @@ func TestFileByLineOpsReader(t *testing.T) {
 	err, loader = NewByLineOpsReader(reader, logger, "")
 	ensure.Nil(t, err)
 	CheckSetStartTime(t, loader)
+
+	// Reset the reader so that we can test SetEndTime
+	reader = newMockOpsStreamReader(t, testOps)
+	err, loader = NewByLineOpsReader(reader, logger, "")
+	ensure.Nil(t, err)
+	CheckSetEndTime(t, loader)
+}
+
+func TestGzippedFileByLineOpsReader(t *testing.T) {
+	t.Parallel()
+	logger, _ = NewLogger("", "")
+
+	file, err := ioutil.TempFile("", "flashback_ops")
+	ensure.Nil(t, err)
+	defer os.Remove(file.Name())
+
+	writer := gzip.NewWriter(file)
+	for _, op := range makeTestInsertOps() {
+		opBytes, err := bson.Marshal(op)
+		ensure.Nil(t, err)
+		_, err = writer.Write(opBytes)
+		ensure.Nil(t, err)
+	}
+	ensure.Nil(t, writer.Close())
+	ensure.Nil(t, file.Close())
+
+	// The file has no ".gz" extension, so this relies on sniffing the magic bytes
+	err, loader := NewFileByLineOpsReader(file.Name(), logger, "")
+	ensure.Nil(t, err)
+	CheckOpsReader(t, loader)
+	loader.Close()
+
+	err, loader = NewFileByLineOpsReader(file.Name(), logger, "")
+	ensure.Nil(t, err)
+	CheckSetStartTime(t, loader)
+	loader.Close()
+}
+
+func writeOpsFile(t *testing.T, filename string, ops []Op, gzipped bool) {
+	file, err := os.Create(filename)
+	ensure.Nil(t, err)
+	defer file.Close()
+	var writer io.Writer = file
+	if gzipped {
+		gzipWriter := gzip.NewWriter(file)
+		defer gzipWriter.Close()
+		writer = gzipWriter
+	}
+	for _, op := range ops {
+		opBytes, err := bson.Marshal(op)
+		ensure.Nil(t, err)
+		_, err = writer.Write(opBytes)
+		ensure.Nil(t, err)
+	}
+}
+
+func TestMultiFileByLineOpsReader(t *testing.T) {
+	t.Parallel()
+	logger, _ = NewLogger("", "")
+
+	dir, err := ioutil.TempDir("", "flashback_ops")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// the files get read in lexical order, and may be compressed or not
+	testOps := makeTestInsertOps()
+	writeOpsFile(t, filepath.Join(dir, "ops-02.bson.gz"), testOps[3:], true)
+	writeOpsFile(t, filepath.Join(dir, "ops-01.bson"), testOps[1:3], false)
+	writeOpsFile(t, filepath.Join(dir, "ops-00.bson"), testOps[:1], false)
+
+	err, loader := NewFileByLineOpsReader(dir, logger, "")
+	ensure.Nil(t, err)
+	ensure.True(t, loader.TotalBytes() > 0)
+	ensure.True(t, loader.BytesRead() < loader.TotalBytes())
+	CheckOpsReader(t, loader)
+	ensure.DeepEqual(t, loader.BytesRead(), loader.TotalBytes())
+	loader.Close()
+
+	err, loader = NewFileByLineOpsReader(filepath.Join(dir, "ops-*"), logger, "")
+	ensure.Nil(t, err)
+	CheckOpsReader(t, loader)
+	loader.Close()
+
+	// skipping spans the files
+	err, loader = NewFileByLineOpsReader(dir, logger, "")
+	ensure.Nil(t, err)
+	CheckSetStartTime(t, loader)
+	loader.Close()
+
+	err, _ = NewFileByLineOpsReader(filepath.Join(dir, "nothing-*"), logger, "")
+	ensure.NotNil(t, err)
+}
+
+func TestTarOpsReader(t *testing.T) {
+	t.Parallel()
+	logger, _ = NewLogger("", "")
+
+	dir, err := ioutil.TempDir("", "flashback_ops")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	opsBytes := func(ops []Op, gzipped bool) []byte {
+		var buffer bytes.Buffer
+		var writer io.Writer = &buffer
+		gzipWriter := gzip.NewWriter(&buffer)
+		if gzipped {
+			writer = gzipWriter
+		}
+		for _, op := range ops {
+			encoded, err := bson.Marshal(op)
+			ensure.Nil(t, err)
+			writer.Write(encoded)
+		}
+		if gzipped {
+			ensure.Nil(t, gzipWriter.Close())
+		}
+		return buffer.Bytes()
+	}
+
+	// the entries are read in the order of the archive, and may be
+	// compressed or not
+	testOps := makeTestInsertOps()
+	filename := filepath.Join(dir, "ops.tar.gz")
+	file, err := os.Create(filename)
+	ensure.Nil(t, err)
+	gzipWriter := gzip.NewWriter(file)
+	archive := tar.NewWriter(gzipWriter)
+	ensure.Nil(t, archive.WriteHeader(&tar.Header{Name: "shards/", Typeflag: tar.TypeDir, Mode: 0755}))
+	for _, entry := range []struct {
+		name     string
+		contents []byte
+	}{
+		{"shards/shard-02.bson", opsBytes(testOps[:1], false)},
+		{"shards/shard-00.bson.gz", opsBytes(testOps[1:3], true)},
+		{"shards/shard-01.bson", opsBytes(testOps[3:], false)},
+	} {
+		ensure.Nil(t, archive.WriteHeader(&tar.Header{Name: entry.name, Typeflag: tar.TypeReg, Mode: 0644,
+			Size: int64(len(entry.contents))}))
+		_, err = archive.Write(entry.contents)
+		ensure.Nil(t, err)
+	}
+	ensure.Nil(t, archive.Close())
+	ensure.Nil(t, gzipWriter.Close())
+	ensure.Nil(t, file.Close())
+
+	err, loader := NewTarOpsReader(filename, logger, "")
+	ensure.Nil(t, err)
+	CheckOpsReader(t, loader)
+	ensure.DeepEqual(t, loader.BytesRead(), loader.TotalBytes())
+	loader.Close()
+
+	// skipping spans the entries
+	err, loader = NewFileByLineOpsReader(filename, logger, "")
+	ensure.Nil(t, err)
+	CheckSetStartTime(t, loader)
+	loader.Close()
+}
+
+func TestSeekToOffset(t *testing.T) {
+	t.Parallel()
+	logger, _ = NewLogger("", "")
+
+	dir, err := ioutil.TempDir("", "flashback_ops")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	testOps := makeTestInsertOps()
+	writeOpsFile(t, filepath.Join(dir, "ops-00.bson"), testOps[:2], false)
+	writeOpsFile(t, filepath.Join(dir, "ops-01.bson"), testOps[2:], false)
+
+	// remember where each op starts
+	err, loader := NewFileByLineOpsReader(dir, logger, "")
+	ensure.Nil(t, err)
+	var offsets []int64
+	for op := loader.Next(); op != nil; op = loader.Next() {
+		offsets = append(offsets, op.Offset)
+	}
+	loader.Close()
+	ensure.DeepEqual(t, len(offsets), len(testOps))
+	ensure.DeepEqual(t, offsets[0], int64(0))
+
+	// resuming from within the first file, then from within the second one
+	for _, i := range []int{1, 3} {
+		err, loader = NewFileByLineOpsReader(dir, logger, "")
+		ensure.Nil(t, err)
+		ensure.Nil(t, loader.SeekToOffset(offsets[i]))
+		op := loader.Next()
+		ensure.NotNil(t, op)
+		ensure.DeepEqual(t, op.Offset, offsets[i])
+		message, _ := GetElem(op.InsertDoc, "message")
+		ensure.DeepEqual(t, message, fmt.Sprintf("m%d", i+1))
+		// too late once ops got read
+		ensure.NotNil(t, loader.SeekToOffset(0))
+		loader.Close()
+	}
+
+	// the offsets are in the decompressed stream, so gzipped files can't seek
+	writeOpsFile(t, filepath.Join(dir, "ops-00.bson"), testOps[:2], true)
+	err, loader = NewFileByLineOpsReader(dir, logger, "")
+	ensure.Nil(t, err)
+	ensure.NotNil(t, loader.SeekToOffset(offsets[3]))
+	loader.Close()
+
+	// which can be told before reading them
+	ensure.NotNil(t, CheckOpsSeekable(dir))
+	ensure.Nil(t, CheckOpsSeekable(filepath.Join(dir, "ops-01.bson")))
+	ensure.NotNil(t, CheckOpsSeekable(StdinFilename))
+}
+
+func TestStdinByLineOpsReader(t *testing.T) {
+	logger, _ = NewLogger("", "")
+
+	file, err := ioutil.TempFile("", "flashback_ops")
+	ensure.Nil(t, err)
+	defer os.Remove(file.Name())
+	for _, op := range makeTestInsertOps() {
+		opBytes, err := bson.Marshal(op)
+		ensure.Nil(t, err)
+		_, err = file.Write(opBytes)
+		ensure.Nil(t, err)
+	}
+	_, err = file.Seek(0, 0)
+	ensure.Nil(t, err)
+
+	stdin := os.Stdin
+	os.Stdin = file
+	defer func() { os.Stdin = stdin }()
+
+	err, loader := NewFileByLineOpsReader(StdinFilename, logger, "")
+	ensure.Nil(t, err)
+	CheckOpsReader(t, loader)
+	loader.Close()
+
+	// stdin is left open
+	_, err = file.Seek(0, 0)
+	ensure.Nil(t, err)
+	ensure.Nil(t, file.Close())
 }
 
 func TestOpFilter(t *testing.T) {
@@ -248,6 +620,106 @@ func TestOpFilter(t *testing.T) {
 	test("update,insert,command", 0)
 }
 
+func TestOpTypes(t *testing.T) {
+	logger, _ = NewLogger("", "")
+
+	testOps := []Op{
+		Op{
+			Ns:        "db.coll",
+			Timestamp: time.Unix(1396456709, int64(421*time.Millisecond)),
+			Type:      Insert,
+			InsertDoc: bson.D{{"logType1", "warning"}, {"message", "m1"}},
+		},
+		Op{
+			Ns:        "db.coll",
+			Timestamp: time.Unix(1396456709, int64(422*time.Millisecond)),
+			Type:      Query,
+			QueryDoc:  bson.D{{"_id", "foo"}},
+		},
+		Op{
+			Ns:         "db.$cmd",
+			Timestamp:  time.Unix(1396456709, int64(423*time.Millisecond)),
+			Type:       Command,
+			CommandDoc: bson.D{{"count", "coll"}},
+		},
+		Op{
+			Ns:        "db.coll",
+			Timestamp: time.Unix(1396456709, int64(424*time.Millisecond)),
+			Type:      Query,
+			QueryDoc:  bson.D{{"_id", "bar"}},
+		},
+	}
+
+	test := func(opTypes []OpType, opFilter string, expectedOps int) {
+		reader := newMockOpsStreamReader(t, testOps)
+		err, loader := NewByLineOpsReader(reader, logger, opFilter)
+		ensure.Nil(t, err)
+		loader.SetOpTypes(opTypes)
+		opsRead := 0
+		for op := loader.Next(); op != nil; op = loader.Next() {
+			opsRead += 1
+		}
+		ensure.DeepEqual(t, opsRead, expectedOps)
+	}
+
+	test(nil, "", 4)
+	test([]OpType{Query}, "", 2)
+	test([]OpType{Query, Count}, "", 3)
+	test([]OpType{Count, Insert}, "insert", 1)
+	test([]OpType{FindAndModify}, "", 0)
+}
+
+func TestNsFilterReader(t *testing.T) {
+	logger, _ = NewLogger("", "")
+
+	testOps := []Op{
+		Op{
+			Ns:        "mydb.orders",
+			Timestamp: time.Unix(1396456709, int64(421*time.Millisecond)),
+			Type:      Insert,
+			InsertDoc: bson.D{{"_id", "foo"}},
+		},
+		Op{
+			Ns:        "mydb.users",
+			Timestamp: time.Unix(1396456709, int64(422*time.Millisecond)),
+			Type:      Query,
+			QueryDoc:  bson.D{{"_id", "foo"}},
+		},
+		Op{
+			Ns:         "mydb.$cmd",
+			Timestamp:  time.Unix(1396456709, int64(423*time.Millisecond)),
+			Type:       Command,
+			CommandDoc: bson.D{{"count", "orders"}},
+		},
+		Op{
+			Ns:        "other.orders",
+			Timestamp: time.Unix(1396456709, int64(424*time.Millisecond)),
+			Type:      Query,
+			QueryDoc:  bson.D{{"_id", "bar"}},
+		},
+	}
+
+	test := func(include, exclude string, expectedOps int) {
+		reader := newMockOpsStreamReader(t, testOps)
+		err, loader := NewByLineOpsReader(reader, logger, "")
+		ensure.Nil(t, err)
+		nsFilter, err := NewNsFilter(include, exclude)
+		ensure.Nil(t, err)
+		loader.SetNsFilter(nsFilter)
+		opsRead := 0
+		for op := loader.Next(); op != nil; op = loader.Next() {
+			opsRead += 1
+		}
+		ensure.DeepEqual(t, opsRead, expectedOps)
+	}
+
+	test("", "", 4)
+	test("mydb.orders", "", 2)
+	test("mydb.*", "", 3)
+	test("mydb.*", "mydb.orders", 1)
+	test("", "*.orders", 1)
+}
+
 func TestShouldFilterOp(t *testing.T) {
 	t.Parallel()
 
@@ -271,3 +743,153 @@ func CheckTime(t *testing.T, pythonTime float64, goTime time.Time) {
 	ensure.DeepEqual(t, goTime.Unix(), int64(pythonTime)/1e3)
 	ensure.DeepEqual(t, goTime.UnixNano(), int64(pythonTime)*1e6)
 }
+
+func TestTimedOpsReader(t *testing.T) {
+	logger, _ = NewLogger("", "")
+	dir, err := ioutil.TempDir("", "flashback_ops")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "ops.bson")
+	testOps := makeTestInsertOps()
+	writeOpsFile(t, filename, testOps, false)
+	info, err := os.Stat(filename)
+	ensure.Nil(t, err)
+
+	err, cyclicReader := NewFileCyclicOpsReader(filename, logger, "", nil)
+	ensure.Nil(t, err)
+	cyclicReader.SetLoops(2)
+	reader := NewTimedOpsReader(cyclicReader)
+	opsRead := 0
+	for op := reader.Next(); op != nil; op = reader.Next() {
+		opsRead++
+	}
+	ensure.DeepEqual(t, opsRead, 2*len(testOps))
+	// the bytes of both loops count
+	ensure.DeepEqual(t, reader.BytesRead(), 2*info.Size())
+	ensure.True(t, reader.ReadTime() > 0)
+}
+
+func TestFractionOpsReader(t *testing.T) {
+	t.Parallel()
+
+	var ops []Op
+	start := time.Unix(1396456709, 0)
+	for i := 0; i < 1000; i++ {
+		ops = append(ops, Op{
+			Type:      Query,
+			Ns:        "db.coll",
+			Timestamp: start.Add(time.Duration(i) * time.Millisecond),
+			QueryDoc:  bson.D{{"_id", i}},
+		})
+	}
+	readKept := func(fraction float64) []*Op {
+		_, byLineReader := NewByLineOpsReader(newMockOpsStreamReader(t, ops), logger, "")
+		reader := NewFractionOpsReader(byLineReader, fraction)
+		var kept []*Op
+		for op := reader.Next(); op != nil; op = reader.Next() {
+			kept = append(kept, op)
+		}
+		ensure.DeepEqual(t, reader.OpsSeen(), int64(len(ops)))
+		ensure.DeepEqual(t, reader.OpsKept(), int64(len(kept)))
+		return kept
+	}
+
+	kept := readKept(0.1)
+	ensure.True(t, len(kept) > 50 && len(kept) < 150, len(kept))
+	// the same ops are picked every time
+	ensure.DeepEqual(t, readKept(0.1), kept)
+	ensure.DeepEqual(t, len(readKept(1)), len(ops))
+}
+
+func TestSizeLimitedOpsReader(t *testing.T) {
+	t.Parallel()
+	logger, _ = NewLogger("", "")
+
+	var ops []Op
+	start := time.Unix(1396456709, 0)
+	for i := 0; i < 10; i++ {
+		payload := "small"
+		if i%5 == 0 {
+			payload = strings.Repeat("x", 10000)
+		}
+		ops = append(ops, Op{
+			Type:      Insert,
+			Ns:        "db.coll",
+			Timestamp: start.Add(time.Duration(i) * time.Millisecond),
+			InsertDoc: bson.D{{"_id", i}, {"payload", payload}},
+		})
+	}
+	read := func(keepOversized bool) (int, int64) {
+		_, byLineReader := NewByLineOpsReader(newMockOpsStreamReader(t, ops), logger, "")
+		reader := NewSizeLimitedOpsReader(byLineReader, 1000, logger)
+		reader.SetKeepOversized(keepOversized)
+		opsRead := 0
+		for op := reader.Next(); op != nil; op = reader.Next() {
+			opsRead++
+		}
+		return opsRead, reader.OversizedOps()
+	}
+
+	opsRead, oversized := read(false)
+	ensure.DeepEqual(t, opsRead, 8)
+	// the reader measures the ops as read
+	_, byLineReader := NewByLineOpsReader(newMockOpsStreamReader(t, ops), logger, "")
+	encoded, err := bson.Marshal(ops[0])
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, byLineReader.Next().Size, len(encoded))
+	ensure.DeepEqual(t, oversized, int64(2))
+	// the oversized ops are still counted when kept
+	opsRead, oversized = read(true)
+	ensure.DeepEqual(t, opsRead, 10)
+	ensure.DeepEqual(t, oversized, int64(2))
+}
+
+func TestStaleOpsReader(t *testing.T) {
+	t.Parallel()
+	testLogger, _ := NewLogger("", "")
+
+	var ops []Op
+	start := time.Unix(1396456709, 0)
+	for i := 0; i < 10; i++ {
+		ops = append(ops, Op{
+			Type:      Insert,
+			Ns:        "db.coll",
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+			InsertDoc: bson.D{{"_id", i}},
+		})
+	}
+	read := func(ops []Op, wallClock bool) ([]interface{}, int64) {
+		_, byLineReader := NewByLineOpsReader(newMockOpsStreamReader(t, ops), testLogger, "")
+		reader := NewStaleOpsReader(byLineReader, 5*time.Minute)
+		reader.SetWallClock(wallClock)
+		if wallClock {
+			reader.now = func() time.Time {
+				return start.Add(10 * time.Minute)
+			}
+		}
+		var ids []interface{}
+		for op := reader.Next(); op != nil; op = reader.Next() {
+			ids = append(ids, op.InsertDoc[0].Value)
+		}
+		return ids, reader.StaleOps()
+	}
+
+	// against the wall clock, the ops of the first 5 minutes are stale
+	ids, staleOps := read(ops, true)
+	ensure.DeepEqual(t, ids, []interface{}{5, 6, 7, 8, 9})
+	ensure.DeepEqual(t, staleOps, int64(5))
+
+	// against the trace clock, the ops in order are all fresh, and only the
+	// ops recorded over 5 minutes before an op read earlier are stale
+	ids, staleOps = read(ops, false)
+	ensure.DeepEqual(t, len(ids), len(ops))
+	ensure.DeepEqual(t, staleOps, int64(0))
+	var resumed []Op
+	for i, minutes := range []int{0, 1, 20, 5, 21, 14, 17} {
+		resumed = append(resumed, Op{Type: Insert, Ns: "db.coll",
+			Timestamp: start.Add(time.Duration(minutes) * time.Minute), InsertDoc: bson.D{{"_id", i}}})
+	}
+	ids, staleOps = read(resumed, false)
+	ensure.DeepEqual(t, ids, []interface{}{0, 1, 2, 4, 6})
+	ensure.DeepEqual(t, staleOps, int64(2))
+}
@@ -0,0 +1,554 @@
+package flashback
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// isOpsURL tells whether the ops filename is an http(s):// or s3:// url
+func isOpsURL(filename string) bool {
+	for _, scheme := range []string{"http://", "https://", "s3://"} {
+		if strings.HasPrefix(filename, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// urlReader streams an ops file from an http(s) server or from S3, without
+// staging it locally. Like for local files, it is decompressed if gzipped.
+type urlReader struct {
+	url    string
+	signer *s3Signer
+	// set for the S3 objects fetched without credentials
+	anonymous bool
+	body      io.ReadCloser
+	// the (possibly gunzipped) body
+	reader     io.Reader
+	totalBytes int64
+	bytesRead  int64
+}
+
+// openURLOps starts downloading the ops file at the given url. s3://bucket/key
+// urls are fetched from the S3 endpoint of AWS_REGION (or AWS_DEFAULT_REGION,
+// us-east-1 by default), with the credentials findAWSCredentials finds, or
+// anonymously if there are none, which only works for public objects.
+func openURLOps(rawurl string, logger *Logger) (io.ReadCloser, error) {
+	r, err := newURLReader(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if r.anonymous {
+		logger.Warnf("No AWS credentials found, fetching %s anonymously", rawurl)
+	}
+	logger.Infof("Started reading ops from %s", rawurl)
+	return r, nil
+}
+
+// newURLReader starts downloading the ops file at the given url, see
+// openURLOps
+func newURLReader(rawurl string) (*urlReader, error) {
+	r := &urlReader{url: rawurl}
+	if strings.HasPrefix(rawurl, "s3://") {
+		bucketAndKey := strings.SplitN(strings.TrimPrefix(rawurl, "s3://"), "/", 2)
+		if len(bucketAndKey) != 2 || bucketAndKey[0] == "" || bucketAndKey[1] == "" {
+			return nil, fmt.Errorf("invalid s3 url %s, expected s3://<bucket>/<key>", rawurl)
+		}
+		region := os.Getenv("AWS_REGION")
+		if region == "" {
+			region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+		if region == "" {
+			region = "us-east-1"
+		}
+		r.url = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucketAndKey[0], region, bucketAndKey[1])
+
+		credentials, err := findAWSCredentials()
+		if err != nil {
+			return nil, err
+		}
+		if credentials != nil {
+			r.signer = &s3Signer{credentials: credentials, region: region}
+		} else {
+			r.anonymous = true
+		}
+	}
+
+	resp, err := r.get(0)
+	if err != nil {
+		return nil, err
+	}
+	r.totalBytes = resp.ContentLength
+	if r.totalBytes < 0 {
+		r.totalBytes = 0
+	}
+	r.body = resp.Body
+	if r.reader, err = maybeGunzip(rawurl, &countingReader{r.body, &r.bytesRead}); err != nil {
+		r.body.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// get requests the file from the given offset onwards
+func (r *urlReader) get(offset int64) (*http.Response, error) {
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// otherwise the transport may gunzip the body behind our back
+	req.Header.Set("Accept-Encoding", "identity")
+	expectedStatus := http.StatusOK
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		expectedStatus = http.StatusPartialContent
+	}
+	if r.signer != nil {
+		r.signer.sign(req, time.Now())
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != expectedStatus {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if r.anonymous && resp.StatusCode == http.StatusForbidden {
+			return nil, fmt.Errorf("fetching %s anonymously was denied, since no AWS credentials were found "+
+				"(looked for %s)", r.url, awsCredentialsSources)
+		}
+		return nil, fmt.Errorf("fetching %s failed with %s: %s", r.url, resp.Status,
+			strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+func (r *urlReader) Read(p []byte) (int, error) {
+	return r.reader.Read(p)
+}
+
+func (r *urlReader) Close() error {
+	if closer, ok := r.reader.(io.Closer); ok {
+		closer.Close()
+	}
+	return r.body.Close()
+}
+
+// seek starts the download over from the given offset, with a range request.
+// Like for local files, that only works if the file isn't gzipped. It must be
+// called before anything is read.
+func (r *urlReader) seek(offset int64) error {
+	if _, ok := r.reader.(*gzip.Reader); ok {
+		return fmt.Errorf("cannot seek in the gzipped ops file %s", r.url)
+	}
+	resp, err := r.get(offset)
+	if err != nil {
+		return err
+	}
+	r.body.Close()
+	r.body = resp.Body
+	atomic.StoreInt64(&r.bytesRead, offset)
+	r.reader = bufio.NewReader(&countingReader{r.body, &r.bytesRead})
+	return nil
+}
+
+// BytesRead returns how many bytes have been downloaded so far, counting
+// those skipped by seek. For gzipped files, that is the compressed size.
+func (r *urlReader) BytesRead() int64 {
+	return atomic.LoadInt64(&r.bytesRead)
+}
+
+// TotalBytes returns the size of the file, or 0 if the server didn't tell
+func (r *urlReader) TotalBytes() int64 {
+	return r.totalBytes
+}
+
+type awsCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+}
+
+var (
+	// the instance metadata service, where the instance profile credentials
+	// are found
+	instanceMetadataURL = "http://169.254.169.254/latest"
+	// the ECS agent, where the container credentials are found, see
+	// AWS_CONTAINER_CREDENTIALS_RELATIVE_URI
+	containerCredentialsURL = "http://169.254.170.2"
+	// where the web identity tokens are traded for credentials
+	stsURL = "https://sts.amazonaws.com/"
+)
+
+// where findAWSCredentials looks, for the error messages
+const awsCredentialsSources = "the AWS_ACCESS_KEY_ID variable, the shared credentials file, " +
+	"AWS_WEB_IDENTITY_TOKEN_FILE, the container credentials or the instance profile"
+
+// findAWSCredentials looks up the credentials in the same order as the AWS
+// SDKs: in the environment, then in the profile of the shared credentials
+// file, then through the web identity token, then in the container
+// credentials (on ECS) or else in the instance profile (on EC2). It returns
+// nil if there are none.
+func findAWSCredentials() (*awsCredentials, error) {
+	if accessKeyId := os.Getenv("AWS_ACCESS_KEY_ID"); accessKeyId != "" {
+		return &awsCredentials{
+			AccessKeyId:     accessKeyId,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	if credentials, err := sharedFileCredentials(); credentials != nil || err != nil {
+		return credentials, err
+	}
+	if tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); tokenFile != "" {
+		return webIdentityCredentials(tokenFile)
+	}
+	if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" ||
+		os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" {
+		return containerCredentials()
+	}
+	return instanceProfileCredentials()
+}
+
+// sharedFileCredentials reads the credentials of the AWS_PROFILE profile
+// ("default" if not set) from the shared credentials file, which is
+// AWS_SHARED_CREDENTIALS_FILE or else ~/.aws/credentials. It returns nil if
+// there is no such file, or no such profile unless AWS_PROFILE names it.
+func sharedFileCredentials() (*awsCredentials, error) {
+	filename := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if filename == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		filename = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	explicitProfile := profile != ""
+	if !explicitProfile {
+		profile = "default"
+	}
+
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		if explicitProfile {
+			return nil, fmt.Errorf("no AWS profile %s, since there is no shared credentials file %s", profile,
+				filename)
+		}
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// an ini file, with a section per profile
+	found := false
+	credentials := &awsCredentials{}
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			found = found || section == profile
+			continue
+		}
+		keyAndValue := strings.SplitN(line, "=", 2)
+		if section != profile || len(keyAndValue) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(keyAndValue[1])
+		switch strings.ToLower(strings.TrimSpace(keyAndValue[0])) {
+		case "aws_access_key_id":
+			credentials.AccessKeyId = value
+		case "aws_secret_access_key":
+			credentials.SecretAccessKey = value
+		case "aws_session_token":
+			credentials.Token = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read the shared credentials file %s: %s", filename, err)
+	}
+
+	switch {
+	case !found && explicitProfile:
+		return nil, fmt.Errorf("no AWS profile %s in the shared credentials file %s", profile, filename)
+	case !found:
+		return nil, nil
+	case credentials.AccessKeyId == "" || credentials.SecretAccessKey == "":
+		return nil, fmt.Errorf("the AWS profile %s of %s has no aws_access_key_id and aws_secret_access_key, "+
+			"which are the only credentials supported there", profile, filename)
+	}
+	return credentials, nil
+}
+
+// webIdentityCredentials trades the web identity token in the given file
+// (e.g. the one of an EKS service account) for the credentials of the
+// AWS_ROLE_ARN role
+func webIdentityCredentials(tokenFile string) (*awsCredentials, error) {
+	roleArn := os.Getenv("AWS_ROLE_ARN")
+	if roleArn == "" {
+		return nil, fmt.Errorf("AWS_WEB_IDENTITY_TOKEN_FILE is set, but not AWS_ROLE_ARN")
+	}
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the web identity token: %s", err)
+	}
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("flashback-%d", time.Now().UnixNano())
+	}
+
+	params := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleArn},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.PostForm(stsURL, params)
+	if err != nil {
+		return nil, fmt.Errorf("could not assume the role %s: %s", roleArn, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not assume the role %s: %s", roleArn, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not assume the role %s: %s: %s", roleArn, resp.Status,
+			strings.TrimSpace(string(body)))
+	}
+	var reply struct {
+		Credentials struct {
+			AccessKeyId     string
+			SecretAccessKey string
+			SessionToken    string
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err = xml.Unmarshal(body, &reply); err != nil || reply.Credentials.AccessKeyId == "" {
+		return nil, fmt.Errorf("could not parse the credentials of the role %s: %s", roleArn, body)
+	}
+	return &awsCredentials{
+		AccessKeyId:     reply.Credentials.AccessKeyId,
+		SecretAccessKey: reply.Credentials.SecretAccessKey,
+		Token:           reply.Credentials.SessionToken,
+	}, nil
+}
+
+// containerCredentials fetches the credentials of the ECS task role, from the
+// AWS_CONTAINER_CREDENTIALS_RELATIVE_URI path of the ECS agent, or else from
+// AWS_CONTAINER_CREDENTIALS_FULL_URI
+func containerCredentials() (*awsCredentials, error) {
+	credentialsURL := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relativeURI := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relativeURI != "" {
+		credentialsURL = containerCredentialsURL + relativeURI
+	}
+	req, err := http.NewRequest("GET", credentialsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	authorization := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if tokenFile := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); tokenFile != "" {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the container authorization token: %s", err)
+		}
+		authorization = strings.TrimSpace(string(token))
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not get the container credentials: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not get the container credentials: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not get the container credentials: %s", resp.Status)
+	}
+	var credentials awsCredentials
+	if err = json.Unmarshal(body, &credentials); err != nil || credentials.AccessKeyId == "" {
+		return nil, fmt.Errorf("could not parse the container credentials: %s", body)
+	}
+	return &credentials, nil
+}
+
+// instanceProfileCredentials fetches the credentials of the instance profile
+// from the instance metadata service (IMDSv2). It returns nil outside of EC2,
+// where the service is unreachable, or if the instance has no profile.
+func instanceProfileCredentials() (*awsCredentials, error) {
+	client := &http.Client{Timeout: time.Second}
+	metadata := func(method string, path string, token string) (int, string, error) {
+		req, err := http.NewRequest(method, instanceMetadataURL+path, nil)
+		if err != nil {
+			return 0, "", err
+		}
+		if token == "" {
+			req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+		} else {
+			req.Header.Set("X-aws-ec2-metadata-token", token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return 0, "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, "", fmt.Errorf("the instance metadata service returned %s", resp.Status)
+		}
+		return resp.StatusCode, strings.TrimSpace(string(body)), nil
+	}
+
+	status, token, err := metadata("PUT", "/api/token", "")
+	if status == 0 && err != nil {
+		// not on EC2
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not get a token from the instance metadata service: %s", err)
+	}
+	status, role, err := metadata("GET", "/meta-data/iam/security-credentials/", token)
+	if status == http.StatusNotFound || err == nil && role == "" {
+		// no instance profile
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not get the instance profile: %s", err)
+	}
+	role = strings.SplitN(role, "\n", 2)[0]
+	_, encoded, err := metadata("GET", "/meta-data/iam/security-credentials/"+role, token)
+	if err != nil {
+		return nil, fmt.Errorf("could not get the credentials of the instance profile %s: %s", role, err)
+	}
+	var credentials awsCredentials
+	if err = json.Unmarshal([]byte(encoded), &credentials); err != nil {
+		return nil, fmt.Errorf("could not parse the credentials of the instance profile %s: %s", role, err)
+	}
+	return &credentials, nil
+}
+
+// s3Signer signs the requests to S3, with AWS Signature Version 4
+type s3Signer struct {
+	credentials *awsCredentials
+	region      string
+}
+
+// the hash of an empty payload
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *s3Signer) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if s.credentials.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.credentials.Token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncodePath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex(canonicalRequest)
+
+	key := hmacSHA256([]byte("AWS4"+s.credentials.SecretAccessKey), date)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.credentials.AccessKeyId, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// uriEncodePath escapes everything but the unreserved characters and the
+// slashes, as signature V4 expects
+func uriEncodePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	var encoded bytes.Buffer
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return encoded.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, strings.Replace(url.QueryEscape(name), "+", "%20", -1)+"="+
+				strings.Replace(url.QueryEscape(value), "+", "%20", -1))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
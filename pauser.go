@@ -0,0 +1,81 @@
+package flashback
+
+import (
+	"sync"
+	"time"
+)
+
+// Pauser lets the replay be paused and resumed, e.g. while taking a backup of
+// the target. The workers call Wait before fetching each op, and the by time
+// dispatcher leaves the paused time out of its schedule, so the ops keep their
+// relative timing once resumed.
+type Pauser struct {
+	mutex   sync.Mutex
+	resumed *sync.Cond
+	paused  bool
+	// when the current pause started
+	pausedAt time.Time
+	// the duration of the pauses that are over
+	pausedFor time.Duration
+}
+
+func NewPauser() *Pauser {
+	p := &Pauser{}
+	p.resumed = sync.NewCond(&p.mutex)
+	return p
+}
+
+// Toggle pauses the replay if it's running and resumes it otherwise. It
+// returns whether the replay is now paused.
+func (p *Pauser) Toggle() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.paused {
+		p.resume()
+	} else {
+		p.paused = true
+		p.pausedAt = time.Now()
+	}
+	return p.paused
+}
+
+// Resume resumes the replay if it's paused.
+func (p *Pauser) Resume() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.paused {
+		p.resume()
+	}
+}
+
+func (p *Pauser) resume() {
+	p.paused = false
+	p.pausedFor += time.Now().Sub(p.pausedAt)
+	p.resumed.Broadcast()
+}
+
+// Wait blocks for as long as the replay is paused.
+func (p *Pauser) Wait() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for p.paused {
+		p.resumed.Wait()
+	}
+}
+
+func (p *Pauser) Paused() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.paused
+}
+
+// PausedFor returns how long the replay has been paused overall, including
+// the current pause if any.
+func (p *Pauser) PausedFor() time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.paused {
+		return p.pausedFor + time.Now().Sub(p.pausedAt)
+	}
+	return p.pausedFor
+}
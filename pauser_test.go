@@ -0,0 +1,38 @@
+package flashback
+
+import (
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestPauser(t *testing.T) {
+	pauser := NewPauser()
+	ensure.False(t, pauser.Paused())
+	pauser.Wait()
+
+	ensure.True(t, pauser.Toggle())
+	ensure.True(t, pauser.Paused())
+	resumed := make(chan struct{})
+	go func() {
+		pauser.Wait()
+		close(resumed)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-resumed:
+		t.Fatal("Wait returned while paused")
+	default:
+	}
+
+	ensure.False(t, pauser.Toggle())
+	<-resumed
+	pausedFor := pauser.PausedFor()
+	ensure.True(t, pausedFor >= 50*time.Millisecond, pausedFor)
+
+	// resuming a running replay does nothing
+	pauser.Resume()
+	ensure.False(t, pauser.Paused())
+	ensure.DeepEqual(t, pauser.PausedFor(), pausedFor)
+}
@@ -0,0 +1,177 @@
+package flashback
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ReadValidator compares the results of the replayed queries to the ones
+// recorded along with them (in the result field of the ops), e.g. to check
+// that the target system returns the same data as the recorded one. The
+// field order of the documents doesn't matter, and neither does their order
+// unless the query sorts them.
+//
+// The mismatches are counted, and optionally dumped as JSON lines for later
+// inspection. The executors of a node should all share the same
+// ReadValidator.
+type ReadValidator struct {
+	node       string
+	validated  int64
+	mismatches int64
+
+	mutex      sync.Mutex
+	out        io.Writer
+	maxEntries int
+	entries    int
+}
+
+type readMismatchEntry struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Node      string          `json:"node"`
+	Reason    string          `json:"reason"`
+	Op        json.RawMessage `json:"op"`
+	Recorded  interface{}     `json:"recorded"`
+	Replayed  interface{}     `json:"replayed"`
+}
+
+func NewReadValidator(node string) *ReadValidator {
+	return &ReadValidator{node: node}
+}
+
+// SetDump makes the validator append the mismatches to out, along with both
+// results, up to maxEntries of them.
+func (v *ReadValidator) SetDump(out io.Writer, maxEntries int) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.out = out
+	v.maxEntries = maxEntries
+}
+
+// Validate compares the replayed result of the query to its recorded one. It
+// returns whether they match.
+func (v *ReadValidator) Validate(op *Op, replayed []Document) bool {
+	atomic.AddInt64(&v.validated, 1)
+	reason := compareResults(op, op.Result, replayed)
+	if reason == "" {
+		return true
+	}
+	atomic.AddInt64(&v.mismatches, 1)
+	v.dump(op, replayed, reason)
+	return false
+}
+
+func (v *ReadValidator) dump(op *Op, replayed []Document, reason string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.out == nil || v.entries >= v.maxEntries {
+		return
+	}
+	v.entries++
+
+	encodedOp, err := OpJSON(op)
+	if err != nil {
+		return
+	}
+	recorded := make([]interface{}, len(op.Result))
+	for i, doc := range op.Result {
+		recorded[i] = jsonDoc(doc)
+	}
+	encoded, err := json.Marshal(readMismatchEntry{time.Now(), v.node, reason, encodedOp, recorded, replayed})
+	if err != nil {
+		return
+	}
+	v.out.Write(append(encoded, '\n'))
+}
+
+// Validated returns how many queries were validated so far
+func (v *ReadValidator) Validated() int64 {
+	return atomic.LoadInt64(&v.validated)
+}
+
+// Mismatches returns how many of them didn't return the recorded result
+func (v *ReadValidator) Mismatches() int64 {
+	return atomic.LoadInt64(&v.mismatches)
+}
+
+// compareResults returns why the results differ, or "" if they match
+func compareResults(op *Op, recorded []bson.D, replayed []Document) string {
+	if len(recorded) != len(replayed) {
+		return fmt.Sprintf("recorded %d documents, got %d", len(recorded), len(replayed))
+	}
+	recordedKeys := make([]string, len(recorded))
+	replayedKeys := make([]string, len(replayed))
+	for i := range recorded {
+		var err error
+		if recordedKeys[i], err = canonicalDoc(recorded[i]); err != nil {
+			return err.Error()
+		}
+		if replayedKeys[i], err = canonicalDoc(replayed[i]); err != nil {
+			return err.Error()
+		}
+	}
+	if !isSortedQuery(op) {
+		sort.Strings(recordedKeys)
+		sort.Strings(replayedKeys)
+	}
+	for i := range recordedKeys {
+		if recordedKeys[i] != replayedKeys[i] {
+			return fmt.Sprintf("document #%d differs", i)
+		}
+	}
+	return ""
+}
+
+// canonicalDoc renders the document such that documents with the same fields
+// and values render the same, whatever the order of their fields
+func canonicalDoc(doc interface{}) (string, error) {
+	encoded, err := bson.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	var decoded bson.M
+	if err = bson.Unmarshal(encoded, &decoded); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%#v", canonicalValue(decoded)), nil
+}
+
+// the fields of a document, sorted by name
+type canonicalFields []interface{}
+
+// canonicalValue turns the maps into sorted lists of their fields, since the
+// order of the map keys isn't deterministic
+func canonicalValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case bson.M:
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fields := make(canonicalFields, 0, 2*len(names))
+		for _, name := range names {
+			fields = append(fields, name, canonicalValue(value[name]))
+		}
+		return fields
+	case []interface{}:
+		values := make([]interface{}, len(value))
+		for i, elem := range value {
+			values[i] = canonicalValue(elem)
+		}
+		return values
+	}
+	return value
+}
+
+// isSortedQuery tells whether the query sorts its results, in which case
+// their order matters
+func isSortedQuery(op *Op) bool {
+	return len(parseRecordedFind(op).sort) > 0
+}
@@ -0,0 +1,57 @@
+package flashback
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestReadValidator(t *testing.T) {
+	var out bytes.Buffer
+	validator := NewReadValidator("default")
+	validator.SetDump(&out, 1)
+	op := &Op{
+		Ns:       "db.c1",
+		Type:     Query,
+		QueryDoc: bson.D{{"a", bson.D{{"$gt", 0}}}},
+		Result: []bson.D{
+			{{"_id", 1}, {"a", 1}, {"sub", bson.D{{"x", 1}, {"y", []interface{}{1, 2}}}}},
+			{{"_id", 2}, {"a", 2}},
+		},
+	}
+
+	// neither the order of the fields nor the one of the documents matter
+	ensure.True(t, validator.Validate(op, []Document{
+		{"a": 2, "_id": 2},
+		{"sub": bson.M{"y": []interface{}{1, 2}, "x": 1}, "a": 1, "_id": 1},
+	}))
+	// but the values do
+	ensure.False(t, validator.Validate(op, []Document{
+		{"a": 2, "_id": 2},
+		{"sub": bson.M{"y": []interface{}{2, 1}, "x": 1}, "a": 1, "_id": 1},
+	}))
+	ensure.False(t, validator.Validate(op, []Document{{"a": 2, "_id": 2}}))
+	ensure.DeepEqual(t, validator.Validated(), int64(3))
+	ensure.DeepEqual(t, validator.Mismatches(), int64(2))
+
+	// only the first mismatch got dumped
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	ensure.DeepEqual(t, len(lines), 1)
+	var entry map[string]interface{}
+	ensure.Nil(t, json.Unmarshal([]byte(lines[0]), &entry))
+	ensure.DeepEqual(t, entry["node"], "default")
+	ensure.DeepEqual(t, entry["reason"], "document #0 differs")
+	ensure.DeepEqual(t, len(entry["recorded"].([]interface{})), 2)
+	ensure.DeepEqual(t, len(entry["replayed"].([]interface{})), 2)
+
+	// the order matters for the sorted queries
+	sorted := *op
+	sorted.QueryDoc = bson.D{{"$query", op.QueryDoc}, {"$orderby", bson.D{{"a", 1}}}}
+	sorted.Result = []bson.D{{{"_id", 1}, {"a", 1}}, {{"_id", 2}, {"a", 2}}}
+	ensure.True(t, validator.Validate(&sorted, []Document{{"a": 1, "_id": 1}, {"a": 2, "_id": 2}}))
+	ensure.False(t, validator.Validate(&sorted, []Document{{"a": 2, "_id": 2}, {"a": 1, "_id": 1}}))
+}
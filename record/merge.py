@@ -14,16 +14,29 @@ def dump_op(output, op):
 
     # handpick some essential fields to execute.
     if op_type == "query":
-        copier.copy_fields("query", "ntoskip", "ntoreturn")
+        copier.copy_fields("query", "ntoskip", "ntoreturn", "cursorid")
+    elif op_type == "getmore":
+        # the cursor id ties the getmore to the query it reads from
+        copier.copy_fields("ntoreturn", "cursorid")
     elif op_type == "insert":
         copier.copy_fields("o")
     elif op_type == "update":
-        copier.copy_fields("updateobj", "query")
+        copier.copy_fields("updateobj", "query", "upsert", "multi")
     elif op_type == "remove":
         copier.copy_fields("query")
+        # the removes that could delete several documents are replayed as
+        # multi ones, the others only delete the first match
+        if op.get("command", {}).get("limit") == 0 or op.get("ndeleted", 0) > 1:
+            copier.dest["multi"] = True
     elif op_type == "command":
         copier.copy_fields("command")
 
+    # keep track of the (logical) session the op was sent in, if any, so that
+    # the replay can preserve the ordering within each session
+    lsid = op.get("lsid") or op.get("command", {}).get("lsid")
+    if lsid and "id" in lsid:
+        copier.dest["session_id"] = str(lsid["id"])
+
     output.write(BSON.encode(copier.dest))
 
 def merge_to_final_output(oplog_output_file, profiler_output_files, output_file):
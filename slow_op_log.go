@@ -0,0 +1,64 @@
+package flashback
+
+import (
+	"sync"
+	"time"
+)
+
+// how much of the slow ops SlowOpLog logs
+const slowOpMaxLen = 300
+
+// SlowOpLog logs the ops that took longer than a threshold, which catches the
+// outliers that the latency percentiles smooth over. To avoid a flood of logs
+// during a slowdown, it logs at most maxPerSecond ops a second, and tells how
+// many it left out with the next op it logs.
+//
+// The executors should all share the same SlowOpLog, so that the cap applies
+// to the whole replay.
+type SlowOpLog struct {
+	threshold    time.Duration
+	maxPerSecond int
+
+	mutex sync.Mutex
+	// the second the ops logged and suppressed are counted over
+	windowStart time.Time
+	logged      int
+	suppressed  int
+}
+
+func NewSlowOpLog(threshold time.Duration, maxPerSecond int) *SlowOpLog {
+	return &SlowOpLog{threshold: threshold, maxPerSecond: maxPerSecond}
+}
+
+// Log logs the op run against the given namespace to logger, if its latency
+// exceeds the threshold and the cap allows. It returns whether it did.
+func (s *SlowOpLog) Log(logger *Logger, op *Op, ns string, latency time.Duration) bool {
+	return s.log(logger, op, ns, latency, time.Now())
+}
+
+func (s *SlowOpLog) log(logger *Logger, op *Op, ns string, latency time.Duration, now time.Time) bool {
+	if latency <= s.threshold {
+		return false
+	}
+
+	s.mutex.Lock()
+	suppressed := 0
+	if now.Sub(s.windowStart) >= time.Second {
+		suppressed = s.suppressed
+		s.windowStart, s.logged, s.suppressed = now, 0, 0
+	}
+	if s.logged >= s.maxPerSecond {
+		s.suppressed++
+		s.mutex.Unlock()
+		return false
+	}
+	s.logged++
+	s.mutex.Unlock()
+
+	if suppressed > 0 {
+		logger.Warnf("%d more slow ops were left out of the log, to cap its rate", suppressed)
+	}
+	logger.WithFields(Fields{"op_type": op.Type}).Warnf("Slow op - type:%s,ns:%s,latency:%v,op:%s",
+		op.Type, ns, latency, FormatOp(op, slowOpMaxLen))
+	return true
+}
@@ -0,0 +1,40 @@
+package flashback
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestSlowOpLog(t *testing.T) {
+	file, err := ioutil.TempFile("", "flashback_log")
+	ensure.Nil(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+	logger, err := NewLogger(file.Name(), file.Name())
+	ensure.Nil(t, err)
+	defer logger.Close()
+
+	slowOpLog := NewSlowOpLog(500*time.Millisecond, 2)
+	op := &Op{Type: Query, Database: "db", Collection: "coll"}
+	now := time.Now()
+	ensure.False(t, slowOpLog.log(logger, op, "db.coll", 500*time.Millisecond, now))
+	ensure.True(t, slowOpLog.log(logger, op, "db.coll", time.Second, now))
+	ensure.True(t, slowOpLog.log(logger, op, "db.mapped", 2*time.Second, now))
+	// capped until the next second
+	ensure.False(t, slowOpLog.log(logger, op, "db.coll", time.Second, now.Add(500*time.Millisecond)))
+	ensure.False(t, slowOpLog.log(logger, op, "db.coll", time.Second, now.Add(900*time.Millisecond)))
+	ensure.True(t, slowOpLog.log(logger, op, "db.coll", 3*time.Second, now.Add(time.Second)))
+
+	lines := readLogLines(t, file.Name())
+	ensure.DeepEqual(t, len(lines), 4)
+	ensure.True(t, strings.HasPrefix(lines[0], "WARN "))
+	ensure.StringContains(t, lines[0], "type:query,ns:db.coll,latency:1s")
+	ensure.StringContains(t, lines[1], "ns:db.mapped,latency:2s")
+	ensure.StringContains(t, lines[2], "2 more slow ops were left out")
+	ensure.StringContains(t, lines[3], "latency:3s")
+}
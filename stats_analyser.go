@@ -1,7 +1,13 @@
 package flashback
 
 import (
+	"fmt"
+	"github.com/HdrHistogram/hdrhistogram-go"
 	"github.com/bmizerany/perks/quantile"
+	"gopkg.in/mgo.v2"
+	"math"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -10,13 +16,41 @@ type OpStat struct {
 	OpType  OpType
 	Latency time.Duration
 	OpError bool
+	// the category of the error, if any
+	ErrorCategory ErrorCategory
+	// the namespace the op was executed against
+	Ns string
+	// when the op started executing
+	StartTime time.Time
+	// the name of the command run, for the Command ops
+	Command string
 }
 
 var (
 	latencyPercentiles = []float64{0.5, 0.7, 0.9, 0.95, 0.99}
 )
 
-// Percentiles
+// ParsePercentiles parses a comma-separated list of percentiles, such as
+// "50,90,99,99.9", into the fractions (0.5, 0.9...) SetPercentiles expects.
+func ParsePercentiles(list string) ([]float64, error) {
+	var percentiles []float64
+	for _, value := range strings.Split(list, ",") {
+		// parsed as is divided by 100, so that 99.9 gives exactly 0.999
+		percentile, err := strconv.ParseFloat(strings.TrimSpace(value)+"e-2", 64)
+		if err != nil || percentile <= 0 || percentile >= 1 {
+			return nil, fmt.Errorf("invalid percentile %q, should be between 0 and 100 (exclusive)", value)
+		}
+		percentiles = append(percentiles, percentile)
+	}
+	return percentiles, nil
+}
+
+// DefaultOpsPerSecSmoothing is the weight of the latest interval in the
+// smoothed ops/sec, see SetOpsPerSecSmoothing
+const DefaultOpsPerSecSmoothing = 0.3
+
+// Percentiles, as indices into the latencies of an ExecutionStatus. They are
+// always computed, see SetPercentiles for the other ones.
 const (
 	P50 = iota
 	P70 = iota
@@ -27,6 +61,8 @@ const (
 
 type StatsAnalyzer struct {
 	statsChan chan OpStat
+	// the percentiles computed, starting with latencyPercentiles
+	percentiles []float64
 
 	startTime   time.Time
 	stream      map[OpType]*quantile.Stream
@@ -34,6 +70,11 @@ type StatsAnalyzer struct {
 	opsExecuted int64
 	opsErrors   int64
 	counts      map[OpType]int64
+	errorCounts map[ErrorCategory]int64
+	// the sum and number of the latencies recorded, which leave out the ops
+	// counted without one
+	latencySums   map[OpType]float64
+	latencyCounts map[OpType]int64
 
 	intervalStartTime   time.Time
 	intervalStream      map[OpType]*quantile.Stream
@@ -41,6 +82,58 @@ type StatsAnalyzer struct {
 	intervalOpsExecuted int64
 	intervalOpsErrors   int64
 	intervalCounts      map[OpType]int64
+	intervalErrorCounts map[ErrorCategory]int64
+
+	// the exponentially-weighted moving average of the interval ops/sec, see
+	// SetOpsPerSecSmoothing
+	smoothing         float64
+	smoothedOpsPerSec float64
+	smoothedOnce      bool
+
+	// per-namespace stats, only tracked once TrackNamespaces has been called
+	nsStream             map[string]*quantile.Stream
+	nsMaxLatency         map[string]float64
+	nsCounts             map[string]int64
+	nsIntervalStream     map[string]*quantile.Stream
+	nsIntervalMaxLatency map[string]float64
+	nsIntervalCounts     map[string]int64
+
+	// whether the statuses include the ConnectionStats, see TrackConnections
+	trackConnections bool
+
+	// the breakdown of the Command ops by command name
+	commandCounts     map[string]int64
+	commandMaxLatency map[string]float64
+
+	// how far the replay is, see SetExpectedOps and SetProgressFunc
+	expectedOps  int64
+	progressFunc func() float64
+
+	// during the warmup, the ops are counted in warmupOpsSeen only, see
+	// SetWarmupOps and SetWarmupDuration
+	warmupOps     int64
+	warmupEnd     time.Time
+	warmupOpsSeen int64
+	warmingUp     bool
+
+	// full-fidelity latencies (in nanoseconds), only recorded once
+	// RecordHistograms has been called
+	histograms map[OpType]*hdrhistogram.Histogram
+
+	// where to write the latency of every op, see SetLatencyCSV
+	latencyCSV *LatencyCSVWriter
+	node       string
+
+	// the latencies over a sliding window, only tracked once SetWindow has
+	// been called
+	windowDuration time.Duration
+	window         map[OpType]*latencyWindow
+
+	// the ops analyzed since the previous sample, only tracked once
+	// TrackTimeSeries has been called
+	sampleStream      *quantile.Stream
+	sampleStartTime   time.Time
+	sampleOpsExecuted int64
 
 	mutex *sync.Mutex
 }
@@ -49,6 +142,42 @@ func (s *StatsAnalyzer) process(opStat OpStat) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	if s.skipWarmupOp() {
+		return
+	}
+	s.count(opStat)
+	s.recordLatency(opStat)
+}
+
+// CountWithoutLatency counts the op and its error, if any, without its
+// latency, e.g. for the ops whose stats don't fit in the statsChan. It is
+// safe to call from another goroutine than the one analyzing the statsChan.
+func (s *StatsAnalyzer) CountWithoutLatency(opStat OpStat) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.skipWarmupOp() {
+		return
+	}
+	s.count(opStat)
+}
+
+// skipWarmupOp tells whether the op about to be analyzed is part of the
+// warmup, counting it as such
+func (s *StatsAnalyzer) skipWarmupOp() bool {
+	if !s.warmingUp {
+		return false
+	}
+	if s.warmupOpsSeen < s.warmupOps || time.Now().Before(s.warmupEnd) {
+		s.warmupOpsSeen++
+		return true
+	}
+	s.endWarmup()
+	return false
+}
+
+// count counts the op and its error, if any
+func (s *StatsAnalyzer) count(opStat OpStat) {
 	s.counts[opStat.OpType]++
 	s.intervalCounts[opStat.OpType]++
 	s.opsExecuted++
@@ -56,11 +185,25 @@ func (s *StatsAnalyzer) process(opStat OpStat) {
 	if opStat.OpError == true {
 		s.opsErrors++
 		s.intervalOpsErrors++
+		category := opStat.ErrorCategory
+		if category == "" {
+			category = OtherError
+		}
+		s.errorCounts[category]++
+		s.intervalErrorCounts[category]++
+	}
+	if opStat.Command != "" {
+		s.commandCounts[opStat.Command]++
 	}
+}
 
+// recordLatency adds the latency of the op to the percentiles
+func (s *StatsAnalyzer) recordLatency(opStat OpStat) {
 	latencyMs := float64(opStat.Latency) / float64(time.Millisecond)
 	s.stream[opStat.OpType].Insert(latencyMs)
 	s.intervalStream[opStat.OpType].Insert(latencyMs)
+	s.latencySums[opStat.OpType] += latencyMs
+	s.latencyCounts[opStat.OpType]++
 
 	if s.maxLatency[opStat.OpType] < latencyMs {
 		s.maxLatency[opStat.OpType] = latencyMs
@@ -68,29 +211,325 @@ func (s *StatsAnalyzer) process(opStat OpStat) {
 	if s.intervalMaxLatency[opStat.OpType] < latencyMs {
 		s.intervalMaxLatency[opStat.OpType] = latencyMs
 	}
+
+	if opStat.Command != "" {
+		if s.commandMaxLatency[opStat.Command] < latencyMs {
+			s.commandMaxLatency[opStat.Command] = latencyMs
+		}
+	}
+	if s.nsStream != nil {
+		s.processNs(opStat.Ns, latencyMs)
+	}
+	if s.histograms != nil {
+		// latencies past the highest trackable one get clamped to it
+		latency := opStat.Latency
+		if latency > histogramMaxLatency {
+			latency = histogramMaxLatency
+		}
+		s.histograms[opStat.OpType].RecordValue(int64(latency))
+	}
+	if s.latencyCSV != nil {
+		s.latencyCSV.write(s.node, opStat)
+	}
+	if s.window != nil {
+		s.window[opStat.OpType].insert(time.Now(), latencyMs)
+	}
+	if s.sampleStream != nil {
+		s.sampleStream.Insert(latencyMs)
+		s.sampleOpsExecuted++
+	}
+}
+
+func (s *StatsAnalyzer) processNs(ns string, latencyMs float64) {
+	if _, ok := s.nsStream[ns]; !ok {
+		s.nsStream[ns] = quantile.NewTargeted(s.percentiles...)
+		s.nsIntervalStream[ns] = quantile.NewTargeted(s.percentiles...)
+	}
+
+	s.nsCounts[ns]++
+	s.nsIntervalCounts[ns]++
+	s.nsStream[ns].Insert(latencyMs)
+	s.nsIntervalStream[ns].Insert(latencyMs)
+
+	if s.nsMaxLatency[ns] < latencyMs {
+		s.nsMaxLatency[ns] = latencyMs
+	}
+	if s.nsIntervalMaxLatency[ns] < latencyMs {
+		s.nsIntervalMaxLatency[ns] = latencyMs
+	}
+}
+
+// SetPercentiles makes the analyzer also compute the given percentiles (as
+// fractions, e.g. 0.999), on top of the P50 to P99 ones. They come after them
+// in the latencies of the ExecutionStatus, see its Percentiles. It should be
+// called before any op is analyzed.
+func (s *StatsAnalyzer) SetPercentiles(percentiles []float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.percentiles = append([]float64{}, latencyPercentiles...)
+	for _, percentile := range percentiles {
+		if percentileIndex(s.percentiles, percentile) < 0 {
+			s.percentiles = append(s.percentiles, percentile)
+		}
+	}
+	for _, opType := range AllOpTypes {
+		s.stream[opType] = quantile.NewTargeted(s.percentiles...)
+		s.intervalStream[opType] = quantile.NewTargeted(s.percentiles...)
+	}
+}
+
+func percentileIndex(percentiles []float64, percentile float64) int {
+	for i, p := range percentiles {
+		if p == percentile {
+			return i
+		}
+	}
+	return -1
+}
+
+// TrackNamespaces makes the analyzer also break down the latencies by
+// namespace. This is opt-in since traces that touch many collections would
+// otherwise use a lot of memory.
+func (s *StatsAnalyzer) TrackNamespaces() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.nsStream = make(map[string]*quantile.Stream)
+	s.nsMaxLatency = make(map[string]float64)
+	s.nsCounts = make(map[string]int64)
+	s.nsIntervalStream = make(map[string]*quantile.Stream)
+	s.nsIntervalMaxLatency = make(map[string]float64)
+	s.nsIntervalCounts = make(map[string]int64)
+}
+
+// SetWindow makes the analyzer also compute the latency percentiles over the
+// given sliding window, e.g. the last minute, see WindowLatencies. The window
+// is rounded up to the second.
+func (s *StatsAnalyzer) SetWindow(window time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.windowDuration = window
+	s.window = make(map[OpType]*latencyWindow)
+	for _, opType := range AllOpTypes {
+		s.window[opType] = newLatencyWindow(window)
+	}
+}
+
+// SetOpsPerSecSmoothing sets how much the latest interval weighs in the
+// smoothed ops/sec, between 0 (exclusive) and 1, where 1 means no smoothing.
+// The lower the factor, the steadier the rate but the slower it follows the
+// actual changes.
+func (s *StatsAnalyzer) SetOpsPerSecSmoothing(factor float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.smoothing = factor
+}
+
+// TrackTimeSeries makes the analyzer also track the ops analyzed since the
+// previous call to SampleTimeSeries. Those samples are kept apart from the
+// intervals of GetStatus, so that they can be taken at a faster pace than the
+// reports.
+func (s *StatsAnalyzer) TrackTimeSeries() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sampleStream = quantile.NewTargeted(latencyPercentiles...)
+	s.sampleStartTime = time.Now()
+	s.sampleOpsExecuted = 0
+}
+
+// TimeSeriesSample sums up the ops analyzed between two samples, all op types
+// included
+type TimeSeriesSample struct {
+	// since the start of the replay, as in ExecutionStatus
+	OpsExecuted int64
+	// since the previous sample
+	OpsPerSec float64
+	P50       float64
+	P99       float64
+}
+
+// SampleTimeSeries returns the stats of the ops analyzed since the previous
+// sample, and starts the next one. TrackTimeSeries must have been called.
+func (s *StatsAnalyzer) SampleTimeSeries() TimeSeriesSample {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	sample := TimeSeriesSample{OpsExecuted: s.opsExecuted}
+	if durationSec := float64(now.Sub(s.sampleStartTime)) / float64(time.Second); durationSec > 0 {
+		sample.OpsPerSec = float64(s.sampleOpsExecuted) / durationSec
+	}
+	if s.sampleOpsExecuted > 0 {
+		sample.P50 = s.sampleStream.Query(0.5)
+		sample.P99 = s.sampleStream.Query(0.99)
+	}
+
+	s.sampleStream.Reset()
+	s.sampleStartTime = now
+	s.sampleOpsExecuted = 0
+	return sample
+}
+
+const (
+	// the range and precision of the latencies recorded in the histograms
+	histogramMinLatency = time.Microsecond
+	histogramMaxLatency = time.Hour
+	histogramSigFigs    = 3
+)
+
+// ConnectionStats are the socket counters of the mgo driver, which tell
+// whether the workers are starved of connections. They cover all the
+// sessions of the process, i.e. those to every node.
+type ConnectionStats struct {
+	// the sockets open to the servers, and those reserved by sessions
+	SocketsAlive int
+	SocketsInUse int
+	// how many sessions hold the sockets in use, which may be shared
+	SocketRefs int
+	// the connections to primaries and to secondaries made so far
+	MasterConns int
+	SlaveConns  int
+	// the ops sent and the replies received so far
+	SentOps     int
+	ReceivedOps int
+}
+
+// TrackConnections makes the statuses include the ConnectionStats. It enables
+// the stats of mgo, which should happen before any session is dialed for the
+// socket counts to be right.
+func (s *StatsAnalyzer) TrackConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	mgo.SetStats(true)
+	s.trackConnections = true
+}
+
+// RecordHistograms makes the analyzer also record all the latencies in an
+// HdrHistogram per op type, as opposed to only tracking a few percentiles.
+// See WriteHistograms.
+func (s *StatsAnalyzer) RecordHistograms() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.histograms = make(map[OpType]*hdrhistogram.Histogram)
+	for _, opType := range AllOpTypes {
+		s.histograms[opType] = hdrhistogram.New(int64(histogramMinLatency), int64(histogramMaxLatency),
+			histogramSigFigs)
+	}
+}
+
+// WriteHistograms writes the histogram of each op type to the log, in the
+// HdrHistogram log format, so that the histograms of several replays can be
+// merged into accurate aggregate percentiles. Each histogram is tagged with
+// the given prefix followed by its op type. The latencies are in nanoseconds.
+func (s *StatsAnalyzer) WriteHistograms(log *hdrhistogram.HistogramLogWriter, tagPrefix string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.histograms == nil {
+		return nil
+	}
+	for _, opType := range AllOpTypes {
+		histogram := s.histograms[opType]
+		histogram.SetTag(tagPrefix + string(opType))
+		histogram.SetStartTimeMs(s.startTime.UnixNano() / int64(time.Millisecond))
+		histogram.SetEndTimeMs(time.Now().UnixNano() / int64(time.Millisecond))
+		if err := log.OutputIntervalHistogram(histogram); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetLatencyCSV makes the analyzer also write the latency of every op (but
+// the ones of the warmup) to the given writer, as the given node.
+func (s *StatsAnalyzer) SetLatencyCSV(latencyCSV *LatencyCSVWriter, node string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.latencyCSV = latencyCSV
+	s.node = node
+}
+
+// SetExpectedOps lets the analyzer report the progress of the replay as the
+// fraction of the given number of ops that got executed.
+func (s *StatsAnalyzer) SetExpectedOps(expectedOps int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expectedOps = expectedOps
+}
+
+// SetProgressFunc lets the analyzer report the progress of the replay when
+// the number of ops to execute isn't known in advance. The function returns
+// the progress between 0 and 1, e.g. from the position in the ops file. It is
+// only used if no expected number of ops was set.
+func (s *StatsAnalyzer) SetProgressFunc(progressFunc func() float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.progressFunc = progressFunc
+}
+
+// SetWarmupOps makes the analyzer ignore the stats of the first warmupOps ops,
+// which are skewed by cold caches and connection setup. The measurement (and
+// the ops/sec) starts over once they are done.
+func (s *StatsAnalyzer) SetWarmupOps(warmupOps int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.warmupOps = warmupOps
+	s.warmingUp = warmupOps > 0
+}
+
+// SetWarmupDuration works like SetWarmupOps, but ignores the stats of the ops
+// executed during the given duration, from now on.
+func (s *StatsAnalyzer) SetWarmupDuration(warmup time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.warmupEnd = time.Now().Add(warmup)
+	s.warmingUp = warmup > 0
+}
+
+func (s *StatsAnalyzer) endWarmup() {
+	s.warmingUp = false
+	s.startTime = time.Now()
+	s.intervalStartTime = s.startTime
 }
 
 func NewStatsAnalyzer(statsChan chan OpStat) *StatsAnalyzer {
 	stream := make(map[OpType]*quantile.Stream)
 	intervalStream := make(map[OpType]*quantile.Stream)
 	for _, opType := range AllOpTypes {
-		stream[opType] = quantile.NewTargeted(0.5, 0.7, 0.9, 0.95, 0.99)
-		intervalStream[opType] = quantile.NewTargeted(0.5, 0.7, 0.9, 0.95, 0.99)
+		stream[opType] = quantile.NewTargeted(latencyPercentiles...)
+		intervalStream[opType] = quantile.NewTargeted(latencyPercentiles...)
 	}
 	statsAnalyzer := &StatsAnalyzer{
 		statsChan:           statsChan,
+		percentiles:         latencyPercentiles,
 		startTime:           time.Now(),
 		stream:              stream,
 		maxLatency:          make(map[OpType]float64),
+		latencySums:         make(map[OpType]float64),
+		latencyCounts:       make(map[OpType]int64),
 		opsExecuted:         0,
 		opsErrors:           0,
 		counts:              make(map[OpType]int64),
+		errorCounts:         make(map[ErrorCategory]int64),
 		intervalStartTime:   time.Now(),
 		intervalStream:      intervalStream,
 		intervalMaxLatency:  make(map[OpType]float64),
 		intervalOpsExecuted: 0,
 		intervalOpsErrors:   0,
 		intervalCounts:      make(map[OpType]int64),
+		intervalErrorCounts: make(map[ErrorCategory]int64),
+		smoothing:           DefaultOpsPerSecSmoothing,
+		commandCounts:       make(map[string]int64),
+		commandMaxLatency:   make(map[string]float64),
 		mutex:               &sync.Mutex{},
 	}
 
@@ -115,7 +554,10 @@ type ExecutionStatus struct {
 	IntervalOpsErrors   int64
 	OpsPerSec           float64
 	IntervalOpsPerSec   float64
+	SmoothedOpsPerSec   float64
 	IntervalDuration    time.Duration
+	// the percentiles of the latencies, see P50 and SetPercentiles
+	Percentiles         []float64
 	Latencies           map[OpType][]float64
 	IntervalLatencies   map[OpType][]float64
 	MaxLatency          map[OpType]float64
@@ -124,12 +566,50 @@ type ExecutionStatus struct {
 	IntervalCounts      map[OpType]int64
 	TypeOpsSec          map[OpType]float64
 	IntervalTypeOpsSec  map[OpType]float64
+	ErrorCounts         map[ErrorCategory]int64
+	IntervalErrorCounts map[ErrorCategory]int64
+
+	// per-namespace breakdown, nil unless the analyzer tracks namespaces
+	NsLatencies          map[string][]float64
+	NsIntervalLatencies  map[string][]float64
+	NsMaxLatency         map[string]float64
+	NsIntervalMaxLatency map[string]float64
+	NsCounts             map[string]int64
+	NsIntervalCounts     map[string]int64
+
+	// the socket counters of the driver, nil unless the analyzer tracks them
+	Connections *ConnectionStats
+
+	// the sum of the latencies of each op type, and how many there are
+	LatencySums   map[OpType]float64
+	LatencyCounts map[OpType]int64
+
+	// the Command ops run so far and their max latency, by command name
+	CommandCounts     map[string]int64
+	CommandMaxLatency map[string]float64
+
+	// the latencies over the last Window, nil unless the analyzer has one
+	Window           time.Duration
+	WindowLatencies  map[OpType][]float64
+	WindowMaxLatency map[OpType]float64
+
+	// fraction of the replay that is done, between 0 and 1, or -1 if unknown
+	Progress float64
+	// estimated time until the replay is done, only meaningful if Progress is
+	// known and positive
+	ETA time.Duration
+	// whether the stats are still being ignored, see SetWarmupOps
+	WarmingUp bool
 }
 
 func (s *StatsAnalyzer) GetStatus() *ExecutionStatus {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	if s.warmingUp && s.warmupOpsSeen >= s.warmupOps && !time.Now().Before(s.warmupEnd) {
+		s.endWarmup()
+	}
+
 	opsExecuted := s.opsExecuted
 	intervalOpsExecuted := s.intervalOpsExecuted
 	opsErrors := s.opsErrors
@@ -141,6 +621,14 @@ func (s *StatsAnalyzer) GetStatus() *ExecutionStatus {
 	intervalDuration := now.Sub(s.intervalStartTime)
 	intervalDurationSec := float64(intervalDuration) / float64(time.Second)
 	intervalOpsPerSec := float64(intervalOpsExecuted) / intervalDurationSec
+	if intervalDurationSec > 0 {
+		if s.smoothedOnce {
+			s.smoothedOpsPerSec += s.smoothing * (intervalOpsPerSec - s.smoothedOpsPerSec)
+		} else {
+			s.smoothedOpsPerSec = intervalOpsPerSec
+			s.smoothedOnce = true
+		}
+	}
 
 	latencies := make(map[OpType][]float64)
 	intervalLatencies := make(map[OpType][]float64)
@@ -150,11 +638,15 @@ func (s *StatsAnalyzer) GetStatus() *ExecutionStatus {
 	intervalTypeOpsSec := make(map[OpType]float64)
 	maxLatency := make(map[OpType]float64)
 	intervalMaxLatency := make(map[OpType]float64)
+	latencySums := make(map[OpType]float64)
+	latencyCounts := make(map[OpType]int64)
 
 	for _, opType := range AllOpTypes {
 		maxLatency[opType] = s.maxLatency[opType]
+		latencySums[opType] = s.latencySums[opType]
+		latencyCounts[opType] = s.latencyCounts[opType]
 		intervalMaxLatency[opType] = s.intervalMaxLatency[opType]
-		for _, percentile := range latencyPercentiles {
+		for _, percentile := range s.percentiles {
 			latencies[opType] = append(latencies[opType], s.stream[opType].Query(percentile))
 			intervalLatencies[opType] = append(intervalLatencies[opType],
 				s.intervalStream[opType].Query(percentile))
@@ -166,6 +658,13 @@ func (s *StatsAnalyzer) GetStatus() *ExecutionStatus {
 		intervalTypeOpsSec[opType] = float64(s.intervalCounts[opType]) / intervalDurationSec
 	}
 
+	errorCounts := make(map[ErrorCategory]int64)
+	intervalErrorCounts := make(map[ErrorCategory]int64)
+	for _, category := range AllErrorCategories {
+		errorCounts[category] = s.errorCounts[category]
+		intervalErrorCounts[category] = s.intervalErrorCounts[category]
+	}
+
 	status := ExecutionStatus{
 		OpsExecuted:         opsExecuted,
 		IntervalOpsExecuted: intervalOpsExecuted,
@@ -173,15 +672,89 @@ func (s *StatsAnalyzer) GetStatus() *ExecutionStatus {
 		IntervalOpsErrors:   intervalOpsErrors,
 		OpsPerSec:           opsPerSec,
 		IntervalOpsPerSec:   intervalOpsPerSec,
+		SmoothedOpsPerSec:   s.smoothedOpsPerSec,
 		IntervalDuration:    intervalDuration,
+		Percentiles:         s.percentiles,
 		Latencies:           latencies,
 		IntervalLatencies:   intervalLatencies,
 		MaxLatency:          maxLatency,
 		IntervalMaxLatency:  intervalMaxLatency,
+		LatencySums:         latencySums,
+		LatencyCounts:       latencyCounts,
 		Counts:              counts,
 		IntervalCounts:      intervalCounts,
 		TypeOpsSec:          typeOpsSec,
 		IntervalTypeOpsSec:  intervalTypeOpsSec,
+		ErrorCounts:         errorCounts,
+		IntervalErrorCounts: intervalErrorCounts,
+		Progress:            -1,
+		WarmingUp:           s.warmingUp,
+	}
+
+	elapsed := now.Sub(s.startTime)
+	if s.expectedOps > 0 {
+		// the warmup ops are part of the replay too
+		done := opsExecuted + s.warmupOpsSeen
+		status.Progress = math.Min(float64(done)/float64(s.expectedOps), 1)
+		if opsPerSec > 0 {
+			remaining := float64(s.expectedOps-done) / opsPerSec
+			status.ETA = time.Duration(math.Max(remaining, 0) * float64(time.Second))
+		}
+	} else if s.progressFunc != nil {
+		status.Progress = math.Min(math.Max(s.progressFunc(), 0), 1)
+		if status.Progress > 0 {
+			status.ETA = time.Duration(float64(elapsed) * (1 - status.Progress) / status.Progress)
+		}
+	}
+
+	if s.nsStream != nil {
+		status.NsLatencies = make(map[string][]float64)
+		status.NsIntervalLatencies = make(map[string][]float64)
+		status.NsMaxLatency = make(map[string]float64)
+		status.NsIntervalMaxLatency = make(map[string]float64)
+		status.NsCounts = make(map[string]int64)
+		status.NsIntervalCounts = make(map[string]int64)
+		for ns, stream := range s.nsStream {
+			for _, percentile := range s.percentiles {
+				status.NsLatencies[ns] = append(status.NsLatencies[ns], stream.Query(percentile))
+				status.NsIntervalLatencies[ns] = append(status.NsIntervalLatencies[ns],
+					s.nsIntervalStream[ns].Query(percentile))
+			}
+			status.NsMaxLatency[ns] = s.nsMaxLatency[ns]
+			status.NsIntervalMaxLatency[ns] = s.nsIntervalMaxLatency[ns]
+			status.NsCounts[ns] = s.nsCounts[ns]
+			status.NsIntervalCounts[ns] = s.nsIntervalCounts[ns]
+		}
+	}
+
+	if s.trackConnections {
+		stats := mgo.GetStats()
+		status.Connections = &ConnectionStats{
+			SocketsAlive: stats.SocketsAlive,
+			SocketsInUse: stats.SocketsInUse,
+			SocketRefs:   stats.SocketRefs,
+			MasterConns:  stats.MasterConns,
+			SlaveConns:   stats.SlaveConns,
+			SentOps:      stats.SentOps,
+			ReceivedOps:  stats.ReceivedOps,
+		}
+	}
+
+	status.CommandCounts = make(map[string]int64, len(s.commandCounts))
+	status.CommandMaxLatency = make(map[string]float64, len(s.commandCounts))
+	for name, count := range s.commandCounts {
+		status.CommandCounts[name] = count
+		status.CommandMaxLatency[name] = s.commandMaxLatency[name]
+	}
+
+	if s.window != nil {
+		status.Window = s.windowDuration
+		status.WindowLatencies = make(map[OpType][]float64)
+		status.WindowMaxLatency = make(map[OpType]float64)
+		for _, opType := range AllOpTypes {
+			status.WindowLatencies[opType], status.WindowMaxLatency[opType] =
+				s.window[opType].percentiles(now, s.percentiles)
+		}
 	}
 
 	// reset interval
@@ -191,8 +764,90 @@ func (s *StatsAnalyzer) GetStatus() *ExecutionStatus {
 		s.intervalCounts[opType] = 0
 		s.intervalMaxLatency[opType] = 0
 	}
+	for ns := range s.nsStream {
+		s.nsIntervalStream[ns].Reset()
+		s.nsIntervalCounts[ns] = 0
+		s.nsIntervalMaxLatency[ns] = 0
+	}
+	for _, category := range AllErrorCategories {
+		s.intervalErrorCounts[category] = 0
+	}
 	s.intervalOpsExecuted = 0
 	s.intervalOpsErrors = 0
 
 	return &status
 }
+
+// ErrorRate returns the percentage of the ops executed so far that failed
+func (status *ExecutionStatus) ErrorRate() float64 {
+	if status.OpsExecuted == 0 {
+		return 0
+	}
+	return float64(status.OpsErrors) / float64(status.OpsExecuted) * 100
+}
+
+// StatsSummary is the machine readable form of the stats, e.g. for comparing
+// the results of different runs. The json field names are part of its
+// interface, so please don't change them.
+type StatsSummary struct {
+	OpsExecuted int64                    `json:"ops_executed"`
+	OpsErrors   int64                    `json:"ops_errors"`
+	OpsPerSec   float64                  `json:"ops_per_sec"`
+	OpTypes     map[OpType]OpTypeSummary `json:"op_types"`
+	Errors      map[ErrorCategory]int64  `json:"errors"`
+}
+
+// OpTypeSummary holds the stats of a single op type in a StatsSummary
+type OpTypeSummary struct {
+	Count     int64          `json:"count"`
+	OpsPerSec float64        `json:"ops_per_sec"`
+	Latencies LatencySummary `json:"latencies_ms"`
+}
+
+// LatencySummary holds the latency percentiles, in milliseconds
+type LatencySummary struct {
+	P50 float64 `json:"p50"`
+	P70 float64 `json:"p70"`
+	P90 float64 `json:"p90"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+	// the max latency
+	P100 float64 `json:"p100"`
+}
+
+// PercentileIndex returns the index of the given percentile in the latencies,
+// or -1 if it isn't computed
+func (status *ExecutionStatus) PercentileIndex(percentile float64) int {
+	percentiles := status.Percentiles
+	if percentiles == nil {
+		percentiles = latencyPercentiles
+	}
+	return percentileIndex(percentiles, percentile)
+}
+
+// Summary returns the totals (as opposed to the interval stats) of the status
+func (status *ExecutionStatus) Summary() *StatsSummary {
+	summary := &StatsSummary{
+		OpsExecuted: status.OpsExecuted,
+		OpsErrors:   status.OpsErrors,
+		OpsPerSec:   status.OpsPerSec,
+		OpTypes:     make(map[OpType]OpTypeSummary),
+		Errors:      status.ErrorCounts,
+	}
+	for _, opType := range AllOpTypes {
+		latencies := status.Latencies[opType]
+		summary.OpTypes[opType] = OpTypeSummary{
+			Count:     status.Counts[opType],
+			OpsPerSec: status.TypeOpsSec[opType],
+			Latencies: LatencySummary{
+				P50:  latencies[P50],
+				P70:  latencies[P70],
+				P90:  latencies[P90],
+				P95:  latencies[P95],
+				P99:  latencies[P99],
+				P100: status.MaxLatency[opType],
+			},
+		}
+	}
+	return summary
+}
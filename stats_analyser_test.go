@@ -1,11 +1,14 @@
 package flashback
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"math"
 	"testing"
 	"time"
 
+	"github.com/HdrHistogram/hdrhistogram-go"
 	"github.com/facebookgo/ensure"
 )
 
@@ -22,7 +25,7 @@ func TestBasics(t *testing.T) {
 
 	for i := 0; i < 10; i += 1 {
 		for _, opType := range AllOpTypes {
-			statsChan <- OpStat{opType, time.Duration(i) * time.Millisecond, false}
+			statsChan <- OpStat{OpType: opType, Latency: time.Duration(i) * time.Millisecond}
 		}
 	}
 	time.Sleep(100 * time.Millisecond)
@@ -31,8 +34,10 @@ func TestBasics(t *testing.T) {
 	ensure.DeepEqual(t, status.IntervalOpsExecuted, int64(10*len(AllOpTypes)))
 	ensure.DeepEqual(t, status.OpsErrors, int64(0))
 	ensure.DeepEqual(t, status.IntervalOpsErrors, int64(0))
-	floatEquals(status.OpsPerSec, 689.0, t)
-	floatEquals(status.IntervalOpsPerSec, 689.0, t)
+	// 10 ops of each type over about 100ms
+	opTypes := float64(len(AllOpTypes))
+	floatEquals(status.OpsPerSec, 10*opTypes/0.1, t)
+	floatEquals(status.IntervalOpsPerSec, 10*opTypes/0.1, t)
 
 	for _, opType := range AllOpTypes {
 		ensure.DeepEqual(t, status.Latencies[opType][P50], float64(4))
@@ -56,10 +61,10 @@ func TestBasics(t *testing.T) {
 	// second interval
 	for i := 0; i < 10; i += 1 {
 		for _, opType := range AllOpTypes {
-			statsChan <- OpStat{opType, time.Duration(i) * time.Millisecond, false}
+			statsChan <- OpStat{OpType: opType, Latency: time.Duration(i) * time.Millisecond}
 		}
 	}
-	statsChan <- OpStat{Insert, 0, true}
+	statsChan <- OpStat{OpType: Insert, Latency: 0, OpError: true}
 	time.Sleep(200 * time.Millisecond)
 
 	status = analyser.GetStatus()
@@ -67,8 +72,9 @@ func TestBasics(t *testing.T) {
 	ensure.DeepEqual(t, status.IntervalOpsExecuted, int64(10*len(AllOpTypes))+1)
 	ensure.DeepEqual(t, status.OpsErrors, int64(1))
 	ensure.DeepEqual(t, status.IntervalOpsErrors, int64(1))
-	floatEquals(status.OpsPerSec, 458.0, t)
-	floatEquals(status.IntervalOpsPerSec, 352.0, t)
+	// 10 more ops of each type and an error over about 200ms more
+	floatEquals(status.OpsPerSec, (20*opTypes+1)/0.3, t)
+	floatEquals(status.IntervalOpsPerSec, (10*opTypes+1)/0.2, t)
 
 	for _, opType := range AllOpTypes {
 		if opType == Insert {
@@ -90,7 +96,7 @@ func TestLatencies(t *testing.T) {
 	start := 1000
 	for _, opType := range AllOpTypes {
 		for i := 100; i >= 0; i-- {
-			statsChan <- OpStat{opType, time.Duration(start+i) * time.Millisecond, false}
+			statsChan <- OpStat{OpType: opType, Latency: time.Duration(start+i) * time.Millisecond}
 		}
 		start += 2000
 	}
@@ -114,7 +120,7 @@ func TestLatencies(t *testing.T) {
 	start = 2000
 	for _, opType := range AllOpTypes {
 		for i := 100; i >= 0; i-- {
-			statsChan <- OpStat{opType, time.Duration(start+i) * time.Millisecond, false}
+			statsChan <- OpStat{OpType: opType, Latency: time.Duration(start+i) * time.Millisecond}
 		}
 		start += 2000
 	}
@@ -133,3 +139,352 @@ func TestLatencies(t *testing.T) {
 		start += 2000
 	}
 }
+
+func TestNsStats(t *testing.T) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+
+	// namespaces aren't tracked by default
+	statsChan <- OpStat{OpType: Query, Latency: time.Millisecond, Ns: "db.c1"}
+	time.Sleep(10 * time.Millisecond)
+	status := analyser.GetStatus()
+	ensure.True(t, status.NsCounts == nil)
+
+	analyser.TrackNamespaces()
+	for i := 1; i <= 10; i++ {
+		statsChan <- OpStat{OpType: Query, Latency: time.Duration(i) * time.Millisecond, Ns: "db.c1"}
+		statsChan <- OpStat{OpType: Insert, Latency: time.Duration(10*i) * time.Millisecond, Ns: "db.c2"}
+	}
+	time.Sleep(10 * time.Millisecond)
+	status = analyser.GetStatus()
+	ensure.DeepEqual(t, status.NsCounts, map[string]int64{"db.c1": 10, "db.c2": 10})
+	ensure.DeepEqual(t, status.NsIntervalCounts, map[string]int64{"db.c1": 10, "db.c2": 10})
+	ensure.DeepEqual(t, status.NsMaxLatency, map[string]float64{"db.c1": 10, "db.c2": 100})
+	ensure.DeepEqual(t, len(status.NsLatencies["db.c1"]), len(latencyPercentiles))
+
+	// the interval stats get reset, the totals don't
+	statsChan <- OpStat{OpType: Query, Latency: time.Millisecond, Ns: "db.c1"}
+	time.Sleep(10 * time.Millisecond)
+	status = analyser.GetStatus()
+	ensure.DeepEqual(t, status.NsCounts, map[string]int64{"db.c1": 11, "db.c2": 10})
+	ensure.DeepEqual(t, status.NsIntervalCounts, map[string]int64{"db.c1": 1, "db.c2": 0})
+	ensure.DeepEqual(t, status.NsIntervalMaxLatency["db.c1"], float64(1))
+}
+
+func TestPercentiles(t *testing.T) {
+	percentiles, err := ParsePercentiles("50, 99.9")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, percentiles, []float64{0.5, 0.999})
+	for _, invalid := range []string{"", "0", "100", "a,50"} {
+		_, err = ParsePercentiles(invalid)
+		ensure.NotNil(t, err)
+	}
+
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+	analyser.SetPercentiles(percentiles)
+	for i := 1; i <= 1000; i++ {
+		statsChan <- OpStat{OpType: Query, Latency: time.Duration(i) * time.Millisecond}
+	}
+	time.Sleep(10 * time.Millisecond)
+	status := analyser.GetStatus()
+	// the extra percentiles come after the default ones
+	ensure.DeepEqual(t, status.Percentiles, []float64{0.5, 0.7, 0.9, 0.95, 0.99, 0.999})
+	ensure.DeepEqual(t, status.PercentileIndex(0.5), P50)
+	ensure.DeepEqual(t, status.PercentileIndex(0.999), 5)
+	ensure.DeepEqual(t, status.PercentileIndex(0.8), -1)
+	ensure.DeepEqual(t, len(status.Latencies[Query]), 6)
+	floatEquals(status.Latencies[Query][5], 999, t)
+}
+
+func TestCommandStats(t *testing.T) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+	statsChan <- OpStat{OpType: Command, Command: "collstats", Latency: 2 * time.Millisecond}
+	statsChan <- OpStat{OpType: Command, Command: "collstats", Latency: 5 * time.Millisecond}
+	statsChan <- OpStat{OpType: Command, Command: "mapreduce", Latency: 300 * time.Millisecond}
+	statsChan <- OpStat{OpType: Query, Latency: time.Millisecond}
+	time.Sleep(10 * time.Millisecond)
+
+	status := analyser.GetStatus()
+	ensure.DeepEqual(t, status.Counts[Command], int64(3))
+	ensure.DeepEqual(t, status.CommandCounts, map[string]int64{"collstats": 2, "mapreduce": 1})
+	floatEquals(status.CommandMaxLatency["collstats"], 5, t)
+	floatEquals(status.CommandMaxLatency["mapreduce"], 300, t)
+}
+
+func TestSmoothedOpsPerSec(t *testing.T) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+	analyser.SetOpsPerSecSmoothing(0.5)
+	for i := 0; i < 10; i++ {
+		statsChan <- OpStat{OpType: Query, Latency: time.Millisecond}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// the first interval is taken as is, the next ones are averaged in
+	status := analyser.GetStatus()
+	ensure.True(t, status.IntervalOpsPerSec > 0)
+	ensure.DeepEqual(t, status.SmoothedOpsPerSec, status.IntervalOpsPerSec)
+	first := status.SmoothedOpsPerSec
+
+	time.Sleep(10 * time.Millisecond)
+	status = analyser.GetStatus()
+	ensure.DeepEqual(t, status.IntervalOpsPerSec, float64(0))
+	ensure.DeepEqual(t, status.SmoothedOpsPerSec, first/2)
+}
+
+func TestConnectionStats(t *testing.T) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+	ensure.True(t, analyser.GetStatus().Connections == nil)
+	analyser.TrackConnections()
+	connections := analyser.GetStatus().Connections
+	ensure.NotNil(t, connections)
+	ensure.True(t, connections.SocketsInUse <= connections.SocketsAlive)
+}
+
+func TestStatusSummary(t *testing.T) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+
+	for i := 1; i <= 10; i++ {
+		statsChan <- OpStat{OpType: Query, Latency: time.Duration(i) * time.Millisecond}
+	}
+	statsChan <- OpStat{OpType: Insert, Latency: time.Millisecond, OpError: true}
+	time.Sleep(10 * time.Millisecond)
+	summary := analyser.GetStatus().Summary()
+
+	ensure.DeepEqual(t, summary.OpsExecuted, int64(11))
+	ensure.DeepEqual(t, summary.OpsErrors, int64(1))
+	ensure.DeepEqual(t, len(summary.OpTypes), len(AllOpTypes))
+	ensure.DeepEqual(t, summary.OpTypes[Query].Count, int64(10))
+	ensure.DeepEqual(t, summary.OpTypes[Query].Latencies.P100, float64(10))
+	ensure.DeepEqual(t, summary.OpTypes[Insert].Count, int64(1))
+	ensure.DeepEqual(t, summary.OpTypes[Remove].Count, int64(0))
+
+	encoded, err := json.Marshal(summary)
+	ensure.Nil(t, err)
+	ensure.StringContains(t, string(encoded), `"query":{"count":10,`)
+	ensure.StringContains(t, string(encoded), `"p100":10}`)
+}
+
+func TestErrorCounts(t *testing.T) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+
+	statsChan <- OpStat{OpType: Insert, OpError: true, ErrorCategory: DuplicateKeyError}
+	statsChan <- OpStat{OpType: Insert, OpError: true, ErrorCategory: DuplicateKeyError}
+	statsChan <- OpStat{OpType: Query, OpError: true, ErrorCategory: SocketError}
+	statsChan <- OpStat{OpType: Query}
+	time.Sleep(10 * time.Millisecond)
+	status := analyser.GetStatus()
+	ensure.DeepEqual(t, status.ErrorCounts[DuplicateKeyError], int64(2))
+	ensure.DeepEqual(t, status.ErrorCounts[SocketError], int64(1))
+	ensure.DeepEqual(t, status.ErrorCounts[TimeoutError], int64(0))
+	ensure.DeepEqual(t, status.IntervalErrorCounts[DuplicateKeyError], int64(2))
+	ensure.DeepEqual(t, status.ErrorRate(), float64(75))
+
+	// errors without a category count as "other"
+	statsChan <- OpStat{OpType: Query, OpError: true}
+	time.Sleep(10 * time.Millisecond)
+	status = analyser.GetStatus()
+	ensure.DeepEqual(t, status.ErrorCounts[DuplicateKeyError], int64(2))
+	ensure.DeepEqual(t, status.IntervalErrorCounts[DuplicateKeyError], int64(0))
+	ensure.DeepEqual(t, status.IntervalErrorCounts[OtherError], int64(1))
+}
+
+func TestProgress(t *testing.T) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+
+	// unknown by default
+	ensure.DeepEqual(t, analyser.GetStatus().Progress, float64(-1))
+
+	progress := 0.25
+	analyser.SetProgressFunc(func() float64 { return progress })
+	time.Sleep(10 * time.Millisecond)
+	status := analyser.GetStatus()
+	ensure.DeepEqual(t, status.Progress, 0.25)
+	// three times what it took to get a quarter of the way
+	ensure.True(t, status.ETA >= 30*time.Millisecond)
+
+	// the expected number of ops takes precedence
+	analyser.SetExpectedOps(4)
+	statsChan <- OpStat{OpType: Query}
+	statsChan <- OpStat{OpType: Query}
+	time.Sleep(10 * time.Millisecond)
+	status = analyser.GetStatus()
+	ensure.DeepEqual(t, status.Progress, 0.5)
+	ensure.True(t, status.ETA > 0)
+
+	statsChan <- OpStat{OpType: Query}
+	statsChan <- OpStat{OpType: Query}
+	time.Sleep(10 * time.Millisecond)
+	status = analyser.GetStatus()
+	ensure.DeepEqual(t, status.Progress, float64(1))
+	ensure.DeepEqual(t, status.ETA, time.Duration(0))
+}
+
+func TestWarmup(t *testing.T) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+	analyser.SetWarmupOps(2)
+	analyser.SetExpectedOps(4)
+
+	statsChan <- OpStat{OpType: Query, Latency: 100 * time.Millisecond, OpError: true}
+	time.Sleep(10 * time.Millisecond)
+	status := analyser.GetStatus()
+	ensure.True(t, status.WarmingUp)
+	ensure.DeepEqual(t, status.OpsExecuted, int64(0))
+
+	statsChan <- OpStat{OpType: Query, Latency: 100 * time.Millisecond}
+	statsChan <- OpStat{OpType: Query, Latency: time.Millisecond}
+	time.Sleep(10 * time.Millisecond)
+	status = analyser.GetStatus()
+	ensure.False(t, status.WarmingUp)
+	ensure.DeepEqual(t, status.OpsExecuted, int64(1))
+	ensure.DeepEqual(t, status.OpsErrors, int64(0))
+	ensure.DeepEqual(t, status.MaxLatency[Query], float64(1))
+	// the warmup ops still count towards the progress
+	ensure.DeepEqual(t, status.Progress, 0.75)
+
+	statsChan = make(chan OpStat)
+	analyser = NewStatsAnalyzer(statsChan)
+	analyser.SetWarmupDuration(time.Hour)
+	statsChan <- OpStat{OpType: Query}
+	time.Sleep(10 * time.Millisecond)
+	status = analyser.GetStatus()
+	ensure.True(t, status.WarmingUp)
+	ensure.DeepEqual(t, status.OpsExecuted, int64(0))
+}
+
+func TestWriteHistograms(t *testing.T) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+	analyser.RecordHistograms()
+
+	for i := 1; i <= 100; i++ {
+		statsChan <- OpStat{OpType: Query, Latency: time.Duration(i) * time.Millisecond}
+	}
+	statsChan <- OpStat{OpType: Insert, Latency: 2 * time.Hour}
+	time.Sleep(10 * time.Millisecond)
+
+	var buffer bytes.Buffer
+	ensure.Nil(t, analyser.WriteHistograms(hdrhistogram.NewHistogramLogWriter(&buffer), "default:"))
+
+	reader := hdrhistogram.NewHistogramLogReader(&buffer)
+	histograms := make(map[string]*hdrhistogram.Histogram)
+	for {
+		histogram, err := reader.NextIntervalHistogram()
+		ensure.Nil(t, err)
+		if histogram == nil {
+			break
+		}
+		histograms[histogram.Tag()] = histogram
+	}
+	ensure.DeepEqual(t, len(histograms), len(AllOpTypes))
+	query := histograms["default:query"]
+	ensure.DeepEqual(t, query.TotalCount(), int64(100))
+	floatEquals(float64(query.ValueAtQuantile(99)), float64(99*time.Millisecond), t)
+	// clamped
+	ensure.DeepEqual(t, histograms["default:insert"].TotalCount(), int64(1))
+	ensure.DeepEqual(t, histograms["default:remove"].TotalCount(), int64(0))
+}
+
+func TestLatencyCSV(t *testing.T) {
+	var out bytes.Buffer
+	latencyCSV, err := NewLatencyCSVWriter(&out)
+	ensure.Nil(t, err)
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+	analyser.SetLatencyCSV(latencyCSV, "default")
+
+	startTime := time.Date(2014, 4, 2, 16, 38, 29, 0, time.UTC)
+	statsChan <- OpStat{OpType: Query, Latency: 1500 * time.Microsecond, Ns: "db.c1", StartTime: startTime}
+	statsChan <- OpStat{OpType: Insert, Latency: 2 * time.Millisecond, Ns: "db.c2", StartTime: startTime,
+		OpError: true, ErrorCategory: DuplicateKeyError}
+	close(statsChan)
+	time.Sleep(10 * time.Millisecond)
+	ensure.Nil(t, latencyCSV.Flush())
+
+	ensure.DeepEqual(t, out.String(), "timestamp,node,op_type,ns,latency_ms,success,error\n"+
+		"2014-04-02T16:38:29Z,default,query,db.c1,1.500,true,\n"+
+		"2014-04-02T16:38:29Z,default,insert,db.c2,2.000,false,duplicate_key\n")
+}
+
+func TestTimeSeries(t *testing.T) {
+	var out bytes.Buffer
+	timeSeries, err := NewTimeSeriesWriter(&out)
+	ensure.Nil(t, err)
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+	analyser.TrackTimeSeries()
+
+	for i := 1; i <= 100; i++ {
+		statsChan <- OpStat{OpType: Query, Latency: time.Duration(i) * time.Millisecond}
+	}
+	time.Sleep(10 * time.Millisecond)
+	sample := analyser.SampleTimeSeries()
+	ensure.DeepEqual(t, sample.OpsExecuted, int64(100))
+	ensure.True(t, sample.OpsPerSec > 0)
+	floatEquals(sample.P50, 50, t)
+	floatEquals(sample.P99, 99, t)
+
+	// the samples don't affect the intervals of the reports
+	ensure.DeepEqual(t, analyser.GetStatus().IntervalOpsExecuted, int64(100))
+
+	// each sample only covers the ops since the previous one
+	statsChan <- OpStat{OpType: Insert, Latency: 2 * time.Millisecond}
+	time.Sleep(10 * time.Millisecond)
+	sample = analyser.SampleTimeSeries()
+	ensure.DeepEqual(t, sample.OpsExecuted, int64(101))
+	floatEquals(sample.P99, 2, t)
+	sample = analyser.SampleTimeSeries()
+	ensure.DeepEqual(t, sample, TimeSeriesSample{OpsExecuted: 101})
+
+	timeSeries.Write(1.5, "default", TimeSeriesSample{OpsExecuted: 10, OpsPerSec: 20, P50: 1.5, P99: 3})
+	ensure.Nil(t, timeSeries.Flush())
+	ensure.DeepEqual(t, out.String(), "elapsed_sec,node,ops_executed,ops_per_sec,p50_ms,p99_ms\n"+
+		"1.5,default,10,20.00,1.500,3.000\n")
+}
+
+func TestLatencyWindow(t *testing.T) {
+	window := newLatencyWindow(3 * time.Second)
+	start := time.Unix(1396456709, 0)
+	// a spike in the first second, then back to normal
+	for i := 0; i < 5000; i++ {
+		window.insert(start, 100)
+	}
+	for second := 1; second <= 2; second++ {
+		for i := 1; i <= 5000; i++ {
+			window.insert(start.Add(time.Duration(second)*time.Second), float64(i%10))
+		}
+	}
+
+	// the samples of each second weigh as much as all its latencies
+	latencies, max := window.percentiles(start.Add(2*time.Second), []float64{0.5, 0.9})
+	floatEquals(latencies[0], 7, t)
+	floatEquals(latencies[1], 100, t)
+	floatEquals(max, 100, t)
+	// the spike eventually leaves the window
+	latencies, max = window.percentiles(start.Add(3*time.Second), []float64{0.5, 0.9})
+	ensure.True(t, latencies[1] < 10, latencies)
+	floatEquals(max, 9, t)
+	latencies, max = window.percentiles(start.Add(10*time.Second), []float64{0.5})
+	ensure.DeepEqual(t, latencies, []float64{0})
+	ensure.DeepEqual(t, max, 0.0)
+
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+	analyser.SetWindow(time.Minute)
+	ensure.True(t, analyser.GetStatus().WindowLatencies[Query] != nil)
+	for i := 1; i <= 100; i++ {
+		statsChan <- OpStat{OpType: Query, Latency: time.Duration(i) * time.Millisecond}
+	}
+	time.Sleep(10 * time.Millisecond)
+	status := analyser.GetStatus()
+	ensure.DeepEqual(t, status.Window, time.Minute)
+	floatEquals(status.WindowMaxLatency[Query], 100, t)
+	ensure.True(t, status.WindowLatencies[Query][P99] >= 98, status.WindowLatencies[Query])
+}
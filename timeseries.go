@@ -0,0 +1,53 @@
+package flashback
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// TimeSeriesWriter writes the samples of the analyzers as CSV rows, e.g. to
+// plot how the servers responded over the replay. It may be shared by the
+// analyzers of several nodes.
+type TimeSeriesWriter struct {
+	mutex sync.Mutex
+	out   *csv.Writer
+}
+
+var timeSeriesHeader = []string{"elapsed_sec", "node", "ops_executed", "ops_per_sec", "p50_ms", "p99_ms"}
+
+// NewTimeSeriesWriter writes the CSV header to out, followed by the rows
+// written by Write.
+func NewTimeSeriesWriter(out io.Writer) (*TimeSeriesWriter, error) {
+	w := &TimeSeriesWriter{out: csv.NewWriter(out)}
+	if err := w.out.Write(timeSeriesHeader); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write writes the sample taken from the analyzer of the node, elapsedSec
+// seconds into the replay, see StatsAnalyzer.SampleTimeSeries.
+func (w *TimeSeriesWriter) Write(elapsedSec float64, node string, sample TimeSeriesSample) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.out.Write([]string{
+		strconv.FormatFloat(elapsedSec, 'f', 1, 64),
+		node,
+		strconv.FormatInt(sample.OpsExecuted, 10),
+		strconv.FormatFloat(sample.OpsPerSec, 'f', 2, 64),
+		strconv.FormatFloat(sample.P50, 'f', 3, 64),
+		strconv.FormatFloat(sample.P99, 'f', 3, 64),
+	})
+}
+
+// Flush writes the buffered rows, returning the first error the writes hit
+func (w *TimeSeriesWriter) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.out.Flush()
+	return w.out.Error()
+}
@@ -0,0 +1,113 @@
+package flashback
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// withRecordedTimestamps returns the op, or a copy of it, such that the
+// timestamps the server would otherwise fill in at execution time get the
+// time the op was recorded at instead. That covers:
+//   - inserts: the top-level empty timestamps (i.e. Timestamp(0, 0)) of the
+//     inserted document
+//   - updates and findAndModify updates: the fields set by $currentDate,
+//     which become part of $set
+//
+// The other op types, as well as dates computed by the application, are
+// left untouched. The given op is never modified, since it is shared by the
+// executors of all the nodes.
+func withRecordedTimestamps(op *Op) *Op {
+	switch op.Type {
+	case Insert:
+		if insertDoc, ok := fillEmptyTimestamps(op.InsertDoc, op.Timestamp); ok {
+			copied := *op
+			copied.InsertDoc = insertDoc
+			return &copied
+		}
+	case Update:
+		if updateDoc, ok := replaceCurrentDate(op.UpdateDoc, op.Timestamp); ok {
+			copied := *op
+			copied.UpdateDoc = updateDoc
+			return &copied
+		}
+	case FindAndModify:
+		for i, elem := range op.CommandDoc {
+			if elem.Name != "update" {
+				continue
+			}
+			updateDoc, ok := elem.Value.(bson.D)
+			if !ok {
+				break
+			}
+			if updateDoc, ok = replaceCurrentDate(updateDoc, op.Timestamp); ok {
+				copied := *op
+				copied.CommandDoc = make(bson.D, len(op.CommandDoc))
+				copy(copied.CommandDoc, op.CommandDoc)
+				copied.CommandDoc[i].Value = updateDoc
+				return &copied
+			}
+		}
+	}
+	return op
+}
+
+func mongoTimestampFromTime(t time.Time) bson.MongoTimestamp {
+	// the ordinal starts at 1 within each second
+	return bson.MongoTimestamp(t.Unix()<<32 | 1)
+}
+
+func fillEmptyTimestamps(doc bson.D, recorded time.Time) (bson.D, bool) {
+	var filled bson.D
+	for i, elem := range doc {
+		if ts, ok := elem.Value.(bson.MongoTimestamp); ok && ts == 0 {
+			if filled == nil {
+				filled = make(bson.D, len(doc))
+				copy(filled, doc)
+			}
+			filled[i].Value = mongoTimestampFromTime(recorded)
+		}
+	}
+	return filled, filled != nil
+}
+
+// replaceCurrentDate turns {$currentDate: {a: true}} into {$set: {a: <recorded>}}
+func replaceCurrentDate(updateDoc bson.D, recorded time.Time) (bson.D, bool) {
+	value, ok := GetElem(updateDoc, "$currentDate")
+	if !ok {
+		return nil, false
+	}
+	fields, ok := value.(bson.D)
+	if !ok {
+		return nil, false
+	}
+
+	var set bson.D
+	if value, ok := GetElem(updateDoc, "$set"); ok {
+		if set, ok = value.(bson.D); !ok {
+			return nil, false
+		}
+	}
+	set = append(bson.D{}, set...)
+	for _, field := range fields {
+		var fieldValue interface{} = recorded
+		if spec, ok := field.Value.(bson.D); ok {
+			if fieldType, _ := GetElem(spec, "$type"); fieldType == "timestamp" {
+				fieldValue = mongoTimestampFromTime(recorded)
+			}
+		}
+		set = append(set, bson.DocElem{Name: field.Name, Value: fieldValue})
+	}
+
+	replaced := bson.D{}
+	for _, elem := range updateDoc {
+		switch elem.Name {
+		case "$currentDate":
+		case "$set":
+		default:
+			replaced = append(replaced, elem)
+		}
+	}
+	replaced = append(replaced, bson.DocElem{Name: "$set", Value: set})
+	return replaced, true
+}
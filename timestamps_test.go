@@ -0,0 +1,60 @@
+package flashback
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestWithRecordedTimestamps(t *testing.T) {
+	recorded := time.Unix(1396456709, 0)
+	recordedTs := bson.MongoTimestamp(1396456709<<32 | 1)
+
+	insertOp := &Op{
+		Type:      Insert,
+		Timestamp: recorded,
+		InsertDoc: bson.D{{"_id", 1}, {"created", bson.MongoTimestamp(0)}, {"other", bson.MongoTimestamp(5)}},
+	}
+	op := withRecordedTimestamps(insertOp)
+	ensure.DeepEqual(t, op.InsertDoc, bson.D{{"_id", 1}, {"created", recordedTs}, {"other", bson.MongoTimestamp(5)}})
+	// the original op is left untouched
+	ensure.DeepEqual(t, insertOp.InsertDoc[1].Value, bson.MongoTimestamp(0))
+
+	updateOp := &Op{
+		Type:      Update,
+		Timestamp: recorded,
+		UpdateDoc: bson.D{
+			{"$set", bson.D{{"a", 1}}},
+			{"$currentDate", bson.D{{"modified", true}, {"ts", bson.D{{"$type", "timestamp"}}}}},
+			{"$inc", bson.D{{"n", 1}}},
+		},
+	}
+	op = withRecordedTimestamps(updateOp)
+	ensure.DeepEqual(t, op.UpdateDoc, bson.D{
+		{"$inc", bson.D{{"n", 1}}},
+		{"$set", bson.D{{"a", 1}, {"modified", recorded}, {"ts", recordedTs}}},
+	})
+	ensure.DeepEqual(t, len(updateOp.UpdateDoc), 3)
+
+	famOp := &Op{
+		Type:      FindAndModify,
+		Timestamp: recorded,
+		CommandDoc: bson.D{
+			{"findandmodify", "c1"},
+			{"update", bson.D{{"$currentDate", bson.D{{"modified", bson.D{{"$type", "date"}}}}}}},
+		},
+	}
+	op = withRecordedTimestamps(famOp)
+	ensure.DeepEqual(t, op.CommandDoc[1].Value, bson.D{{"$set", bson.D{{"modified", recorded}}}})
+	_, ok := GetElem(famOp.CommandDoc[1].Value.(bson.D), "$currentDate")
+	ensure.True(t, ok)
+
+	// nothing to do
+	queryOp := &Op{Type: Query, Timestamp: recorded}
+	ensure.True(t, withRecordedTimestamps(queryOp) == queryOp)
+	plainUpdateOp := &Op{Type: Update, UpdateDoc: bson.D{{"$set", bson.D{{"a", 1}}}}}
+	ensure.True(t, withRecordedTimestamps(plainUpdateOp) == plainUpdateOp)
+}